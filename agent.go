@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often an agent sends its results to the controller
+	reportInterval = time.Second
+
+	// results an agent holds on to while the controller can't be reached,
+	// newer ones are dropped after that
+	reportQueue = 100000
+)
+
+// agentReporter is a Stage sending results to a controller, a serve -http
+// running somewhere else, so it can compare the targets from every agent
+type agentReporter struct {
+	url    string // the controller's /report
+	name   string // agent name the controller knows results by
+	token  string // API token allowing reporting, if the controller has tokens
+	client *http.Client
+
+	mu      sync.Mutex
+	queue   []Result
+	dropped int // results dropped since the last warning
+
+	droppedTotal atomic.Int64
+}
+
+// Initialize and return an agentReporter sending to the controller at url,
+// over TLS with config if it's https
+func newAgentReporter(url, name, token string, config *tls.Config) *agentReporter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &agentReporter{
+		url:    strings.TrimSuffix(url, "/") + "/report",
+		name:   name,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+func (ar *agentReporter) Process(r *Result) bool {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if len(ar.queue) >= reportQueue {
+		ar.dropped++
+		ar.droppedTotal.Add(1)
+		return true
+	}
+	ar.queue = append(ar.queue, *r)
+	return true
+}
+
+// run sends results every reportInterval until ctx is done, and then the
+// last of them
+func (ar *agentReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ar.flush(final)
+			return
+		case <-ticker.C:
+			ar.flush(ctx)
+		}
+	}
+}
+
+// send the queued results, keeping them for next time if that fails
+func (ar *agentReporter) flush(ctx context.Context) {
+	ar.mu.Lock()
+	batch := ar.queue
+	ar.queue = nil
+	if ar.dropped > 0 {
+		logger.Warn("controller not keeping up, dropped results", "url", ar.url, "dropped", ar.dropped)
+		ar.dropped = 0
+	}
+	ar.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	err := ar.send(ctx, batch)
+	if err == nil {
+		return
+	}
+	logger.Error("reporting to controller", "url", ar.url, "results", len(batch), "err", err)
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	keep := min(len(batch), reportQueue-len(ar.queue))
+	ar.dropped += len(batch) - keep
+	ar.droppedTotal.Add(int64(len(batch) - keep))
+	ar.queue = append(batch[:keep], ar.queue...)
+}
+
+// POST results to the controller as JSON lines
+func (ar *agentReporter) send(ctx context.Context, batch []Result) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range batch {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ar.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set(agentHeader, ar.name)
+	if ar.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ar.token)
+	}
+	resp, err := ar.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("controller answered %s", resp.Status)
+	}
+	return nil
+}
+
+// header agents name themselves in
+const agentHeader = "X-Ping-Agent"
+
+// vantagePoints are the agents reporting to a controller, with the stats of
+// every target they probe
+type vantagePoints struct {
+	mu     sync.Mutex
+	agents map[string]*agentInfo
+	order  []string // agents in the order first heard from
+}
+
+type agentInfo struct {
+	lastSeen time.Time
+	stats    *TargetStats
+}
+
+// an agent and the targets it probes
+type agentJSON struct {
+	Agent    string       `json:"agent"`
+	LastSeen time.Time    `json:"last_seen"`
+	Targets  []targetJSON `json:"targets"`
+}
+
+// get returns the agent called name, adding it if it's new
+func (vp *vantagePoints) get(name string) *agentInfo {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+	if vp.agents == nil {
+		vp.agents = make(map[string]*agentInfo)
+	}
+	a, ok := vp.agents[name]
+	if !ok {
+		a = &agentInfo{stats: NewTargetStats(0)}
+		vp.agents[name] = a
+		vp.order = append(vp.order, name)
+	}
+	a.lastSeen = time.Now()
+	return a
+}
+
+// list every agent and its stats, of target only if it isn't empty
+func (vp *vantagePoints) list(target string) []agentJSON {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+
+	list := []agentJSON{}
+	for _, name := range vp.order {
+		a := vp.agents[name]
+		aj := agentJSON{Agent: name, LastSeen: a.lastSeen, Targets: []targetJSON{}}
+		for _, t := range a.stats.Targets() {
+			if target == "" || t == target {
+				aj.Targets = append(aj.Targets, targetJSON{Target: t, Stats: a.stats.Get(t).Snapshot()})
+			}
+		}
+		list = append(list, aj)
+	}
+	return list
+}
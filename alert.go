@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// loss and rtt are judged over this many of a target's latest probes
+const alertWindow = 10
+
+// Thresholds are the limits a target alerts on, zero for none
+type Thresholds struct {
+	MaxLoss float64       // percent of probes lost
+	MaxRTT  time.Duration // average rtt of the replies
+}
+
+// alerter is a Stage warning when a target goes over its thresholds, and
+// saying so again when it's back under them
+type alerter struct {
+	what    string // what's alerted on, "target" or "group", for the log
+	mu      sync.Mutex
+	targets map[string]*alertState
+}
+
+// a target's thresholds and latest probes
+type alertState struct {
+	th       Thresholds
+	lost     [alertWindow]bool
+	rtt      [alertWindow]time.Duration
+	n        int // probes seen, up to alertWindow
+	pos      int // where the next probe goes
+	alerting bool
+}
+
+// Initialize and return an alerter without thresholds, on what
+func newAlerter(what string) *alerter {
+	return &alerter{what: what, targets: make(map[string]*alertState)}
+}
+
+// Set the thresholds of target, zero thresholds stop its alerts
+func (a *alerter) Set(target string, th Thresholds) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if th == (Thresholds{}) {
+		delete(a.targets, target)
+		return
+	}
+	a.targets[target] = &alertState{th: th}
+}
+
+func (a *alerter) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.targets[r.Target]
+	if !ok {
+		return true
+	}
+
+	st.lost[st.pos] = r.Kind != KindReply
+	st.rtt[st.pos] = r.RTT
+	st.pos = (st.pos + 1) % alertWindow
+	st.n = min(st.n+1, alertWindow)
+
+	lost, replies := 0, 0
+	var total time.Duration
+	for i := range st.n {
+		if st.lost[i] {
+			lost++
+		} else {
+			replies++
+			total += st.rtt[i]
+		}
+	}
+	loss := float64(lost) / float64(st.n) * 100
+	var avg time.Duration
+	if replies > 0 {
+		avg = total / time.Duration(replies)
+	}
+
+	over := (st.th.MaxLoss > 0 && loss > st.th.MaxLoss) ||
+		(st.th.MaxRTT > 0 && avg > st.th.MaxRTT)
+	switch {
+	case over && !st.alerting:
+		logger.Warn(a.what+" over its thresholds", a.what, r.Target,
+			"loss", loss, "avg_rtt", avg, "max_loss", st.th.MaxLoss, "max_rtt", st.th.MaxRTT)
+	case !over && st.alerting:
+		logger.Info(a.what+" back under its thresholds", a.what, r.Target,
+			"loss", loss, "avg_rtt", avg)
+	}
+	st.alerting = over
+	return true
+}
+
+// the latest probes of a target with thresholds, in a serve -state file
+type savedAlert struct {
+	Lost     [alertWindow]bool          `json:"lost"`
+	RTT      [alertWindow]time.Duration `json:"rtt"`
+	N        int                        `json:"n"`
+	Pos      int                        `json:"pos"`
+	Alerting bool                       `json:"alerting,omitempty"`
+}
+
+func (a *alerter) stateName() string { return "alerts" }
+
+func (a *alerter) saveState() any {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	saved := make(map[string]savedAlert, len(a.targets))
+	for target, st := range a.targets {
+		saved[target] = savedAlert{st.lost, st.rtt, st.n, st.pos, st.alerting}
+	}
+	return saved
+}
+
+// loadState restores the probes of targets that have thresholds, so Set
+// them first
+func (a *alerter) loadState(b json.RawMessage) error {
+	var saved map[string]savedAlert
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for target, s := range saved {
+		st, ok := a.targets[target]
+		if !ok {
+			continue
+		}
+		st.lost, st.rtt, st.alerting = s.Lost, s.RTT, s.Alerting
+		st.n, st.pos = min(s.N, alertWindow), max(s.Pos, 0)%alertWindow
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of every new reply in a target's baseline, about the last 20
+	// to 40 replies count
+	baselineAlpha = 0.05
+
+	// replies a baseline needs before anything is judged against it
+	baselineWarmup = 20
+
+	// smallest standard deviation replies are judged by, in ms
+	minDeviation = 0.1
+)
+
+// AnomalyDetector is a Stage keeping a rolling baseline of every target's
+// RTT and setting Result.Anomaly on replies more than Sigma standard
+// deviations from it. The deviation is taken to be at least 5% of the
+// baseline and 0.1ms, so targets with very steady RTTs aren't flagged for
+// scheduling noise.
+type AnomalyDetector struct {
+	Sigma float64
+
+	mu        sync.Mutex
+	baselines map[string]*baseline
+}
+
+// exponentially weighted mean and variance of a target's RTT, in ms
+type baseline struct {
+	n          int
+	mean, vari float64
+}
+
+// Initialize and return an AnomalyDetector flagging replies sigma standard
+// deviations off
+func NewAnomalyDetector(sigma float64) *AnomalyDetector {
+	return &AnomalyDetector{Sigma: sigma, baselines: make(map[string]*baseline)}
+}
+
+func (ad *AnomalyDetector) Process(r *Result) bool {
+	if r.Kind != KindReply {
+		return true
+	}
+	x := r.RTT.Seconds() * 1e3
+
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	b, ok := ad.baselines[r.Target]
+	if !ok {
+		b = &baseline{mean: x}
+		ad.baselines[r.Target] = b
+	}
+
+	if b.n >= baselineWarmup {
+		dev := max(math.Sqrt(b.vari), b.mean/20, minDeviation)
+		if d := (x - b.mean) / dev; math.Abs(d) > ad.Sigma {
+			r.Anomaly = d
+			logger.Debug("latency anomaly", "target", r.Target, "seq", r.Seq, "rtt", r.RTT,
+				"baseline", time.Duration(b.mean*float64(time.Millisecond)), "sigma", d)
+		}
+	}
+
+	// anomalies are part of the baseline too, so it follows lasting changes
+	diff := x - b.mean
+	incr := baselineAlpha * diff
+	b.mean += incr
+	b.vari = (1 - baselineAlpha) * (b.vari + diff*incr)
+	b.n++
+	return true
+}
+
+// a target's baseline in a serve -state file
+type savedBaseline struct {
+	N    int     `json:"n"`
+	Mean float64 `json:"mean_ms"`
+	Var  float64 `json:"var"`
+}
+
+func (ad *AnomalyDetector) stateName() string { return "baselines" }
+
+func (ad *AnomalyDetector) saveState() any {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+
+	saved := make(map[string]savedBaseline, len(ad.baselines))
+	for target, b := range ad.baselines {
+		saved[target] = savedBaseline{b.n, b.mean, b.vari}
+	}
+	return saved
+}
+
+func (ad *AnomalyDetector) loadState(b json.RawMessage) error {
+	var saved map[string]savedBaseline
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	for target, s := range saved {
+		ad.baselines[target] = &baseline{n: s.N, mean: s.Mean, vari: s.Var}
+	}
+	return nil
+}
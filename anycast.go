@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// replies in a row a new TTL, or RTT level, has to hold for before it
+	// counts, so one odd reply isn't taken for a switch
+	anycastConfirm = 5
+
+	// replies the settled RTT level is the median of
+	anycastWindow = 20
+
+	// how far the RTT has to move to be on another level, at least this
+	// much and anycastShiftFraction of the old level
+	anycastShiftMin      = 5 * time.Millisecond
+	anycastShiftFraction = 0.3
+)
+
+// AnycastWatcher is a Stage flagging replies that look like they come from
+// another instance of an anycast target than the ones before: the reply TTL
+// settling on another value, the instance being another number of hops
+// away, or the RTT settling on another level. Path changes found by Trace
+// are flagged too. Any of these can also be a route change on the way, so
+// they're hints rather than proof. Result.Anycast says what changed.
+type AnycastWatcher struct {
+	mu      sync.Mutex
+	targets map[string]*anycastState
+	pending map[string]string // path changes for the next reply of a target
+}
+
+// what a target's replies have settled on
+type anycastState struct {
+	ttl       int       // reply ttl, -1 until known
+	candidate int       // another ttl replies came back with
+	seen      int       // replies in a row with candidate
+	level     []float64 // rtts in ms of the current level, the latest anycastWindow
+	recent    []float64 // rtts of the latest anycastConfirm replies
+}
+
+// Initialize and return an AnycastWatcher
+func NewAnycastWatcher() *AnycastWatcher {
+	return &AnycastWatcher{targets: make(map[string]*anycastState), pending: make(map[string]string)}
+}
+
+func (aw *AnycastWatcher) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	var changes []string
+	if r.Kind == KindReply {
+		if change, ok := aw.pending[r.Target]; ok {
+			changes = append(changes, change)
+			delete(aw.pending, r.Target)
+		}
+		st, ok := aw.targets[r.Target]
+		if !ok {
+			st = &anycastState{ttl: -1}
+			aw.targets[r.Target] = st
+		}
+		if change := st.ttlChange(r.TTL); change != "" {
+			changes = append(changes, change)
+		}
+		if change := st.levelChange(r.RTT.Seconds() * 1e3); change != "" {
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) > 0 {
+		r.Anycast = strings.Join(changes, ", ")
+		logger.Info("anycast instance may have changed", "target", r.Target, "seq", r.Seq, "change", r.Anycast)
+	}
+	return true
+}
+
+// ttlChange takes the ttl of a reply and describes the change if replies
+// settled on another one
+func (st *anycastState) ttlChange(ttl int) string {
+	switch {
+	case ttl < 0:
+		return ""
+	case st.ttl < 0 || ttl == st.ttl:
+		st.ttl, st.seen = ttl, 0
+		return ""
+	case ttl == st.candidate:
+		st.seen++
+	default:
+		st.candidate, st.seen = ttl, 1
+	}
+	if st.seen < anycastConfirm {
+		return ""
+	}
+	change := fmt.Sprintf("reply ttl %d→%d", st.ttl, ttl)
+	st.ttl, st.seen = ttl, 0
+	return change
+}
+
+// levelChange takes the rtt of a reply, in ms, and describes the change if
+// the latest replies are all on another level than the ones before
+func (st *anycastState) levelChange(ms float64) string {
+	st.recent = append(st.recent, ms)
+	if len(st.recent) > anycastConfirm {
+		st.recent = st.recent[1:]
+	}
+	if len(st.level) >= anycastWindow/2 && len(st.recent) == anycastConfirm {
+		level := median(st.level)
+		shift := max(anycastShiftMin.Seconds()*1e3, level*anycastShiftFraction)
+		if slices.Min(st.recent)-level > shift || level-slices.Max(st.recent) > shift {
+			st.level = slices.Clone(st.recent)
+			st.recent = nil
+			return fmt.Sprintf("rtt %.1f→%.1f ms", level, median(st.level))
+		}
+	}
+	st.level = append(st.level, ms)
+	if len(st.level) > anycastWindow {
+		st.level = st.level[1:]
+	}
+	return ""
+}
+
+// median of xs, which isn't empty
+func median(xs []float64) float64 {
+	s := slices.Clone(xs)
+	slices.Sort(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+// Trace sweeps the TTL of client's requests every interval, until ctx is
+// done, and flags the next reply of target if the path's length or last
+// router before it changed. client must be one of its own, the sweeps
+// change its TTL.
+func (aw *AnycastWatcher) Trace(ctx context.Context, client *PingClient, target string, interval time.Duration) {
+	ttls := make([]int, traceMaxTTL)
+	for i := range ttls {
+		ttls[i] = i + 1
+	}
+	var last string
+	for {
+		if path := anycastPath(probeRound(ctx, client, ttls)); path != "" {
+			if last != "" && path != last {
+				aw.mu.Lock()
+				aw.pending[target] = fmt.Sprintf("path %s→%s", last, path)
+				aw.mu.Unlock()
+			}
+			last = path
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// anycastPath describes the end of the path a TTL sweep found, how many
+// hops away the target is and the last router before it, "" if the target
+// wasn't reached
+func anycastPath(results []Result) string {
+	// the last result is the client's own TTL
+	for i, r := range results[:len(results)-1] {
+		if r.Kind != KindReply {
+			continue
+		}
+		path := fmt.Sprintf("%d hops", i+1)
+		if i > 0 && results[i-1].Addr != "" {
+			path += " via " + results[i-1].Addr
+		}
+		return path
+	}
+	return ""
+}
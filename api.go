@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serveAPI is the HTTP interface of serve, for other systems to list, add
+// and remove targets, read their statistics and follow results as they
+// come in:
+//
+//	GET    /targets           every target and its statistics
+//	POST   /targets           start monitoring a target, as in a -config file
+//	GET    /targets/{target}  one target and its statistics
+//	DELETE /targets/{target}  stop monitoring a target
+//	GET    /groups            every group, its targets and their statistics together
+//	GET    /groups/{group}    one group
+//	GET    /sla               uptime of every target by month
+//	GET    /sla/{target}      uptime of one target
+//	GET    /results           server-sent events of results, ?target= to filter
+//	POST   /report            results from an agent, as JSON lines
+//	GET    /agents            every agent and its targets, ?target= to compare one
+//	POST   /reload            read the -config file again
+//	GET    /metrics           how serve itself is doing
+//	GET    /healthz           200 while serve is up
+//	GET    /readyz            200 while it's probing, 503 before
+//
+// With tokens every request but /healthz and /readyz needs one, as a bearer token, allowing reading,
+// reporting as an agent or managing targets.
+type serveAPI struct {
+	sched  *Scheduler
+	stats  *TargetStats
+	alerts *alerter
+	groups *groupTracker
+	sla    *SLATracker
+	hub    resultHub
+	agents vantagePoints
+	tokens apiTokens // nil to let anyone in
+
+	reporter *agentReporter // set when also an agent
+	started  time.Time
+
+	// start monitoring a target, returning its scheduler id. Called with mu
+	// held.
+	start func(tc targetConfig) (int, error)
+
+	mu      sync.Mutex
+	targets map[string][]int // scheduler ids by target, a target given twice has two
+
+	configPath string                    // -config, to reload
+	config     map[string][]targetConfig // targets from the config file, by target
+}
+
+// a target and its statistics
+type targetJSON struct {
+	Target string   `json:"target"`
+	Flow   string   `json:"flow,omitempty"` // which of the flows command's flows
+	Stats  Summary  `json:"stats"`
+	BGP    *BGPInfo `json:"bgp,omitempty"` // how the target is routed, ping -bgp
+}
+
+// a group, its targets and their statistics together
+type groupJSON struct {
+	Group   string   `json:"group"`
+	Targets []string `json:"targets"`
+	Stats   Summary  `json:"stats"`
+}
+
+// Initialize and return the API of a serve run
+func newServeAPI(sched *Scheduler, stats *TargetStats, alerts *alerter, sla *SLATracker, start func(targetConfig) (int, error)) *serveAPI {
+	return &serveAPI{
+		sched:   sched,
+		stats:   stats,
+		alerts:  alerts,
+		sla:     sla,
+		started: time.Now(),
+		start:   start,
+		targets: make(map[string][]int),
+		config:  make(map[string][]targetConfig),
+		hub:     resultHub{subs: make(map[chan Result]struct{})},
+	}
+}
+
+// track records that target is monitored under scheduler id
+func (api *serveAPI) track(target string, id int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.targets[target] = append(api.targets[target], id)
+}
+
+// handler returns the API's routes
+func (api *serveAPI) handler() http.Handler {
+	routes := http.NewServeMux()
+	routes.HandleFunc("GET /targets", api.require(permRead, api.list))
+	routes.HandleFunc("POST /targets", api.require(permManage, api.create))
+	// targets can be URLs in http mode, so take the rest of the path
+	routes.HandleFunc("GET /targets/{target...}", api.require(permRead, api.get))
+	routes.HandleFunc("DELETE /targets/{target...}", api.require(permManage, api.remove))
+	routes.HandleFunc("GET /groups", api.require(permRead, api.listGroups))
+	routes.HandleFunc("GET /groups/{group}", api.require(permRead, api.getGroup))
+	routes.HandleFunc("GET /sla", api.require(permRead, api.listSLA))
+	routes.HandleFunc("GET /sla/{target...}", api.require(permRead, api.getSLA))
+	routes.HandleFunc("GET /results", api.require(permRead, api.stream))
+	routes.HandleFunc("POST /report", api.require(permReport, api.report))
+	routes.HandleFunc("GET /agents", api.require(permRead, api.listAgents))
+	routes.HandleFunc("POST /reload", api.require(permManage, api.reloadHandler))
+	routes.HandleFunc("GET /metrics", api.require(permRead, api.metrics))
+	routes.HandleFunc("GET /healthz", api.healthz)
+	routes.HandleFunc("GET /readyz", api.readyz)
+	return routes
+}
+
+func (api *serveAPI) list(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	list := []targetJSON{}
+	for _, target := range api.stats.Targets() {
+		if _, ok := api.targets[target]; ok {
+			list = append(list, targetJSON{Target: target, Stats: api.stats.Get(target).Snapshot()})
+		}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (api *serveAPI) get(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+
+	api.mu.Lock()
+	_, ok := api.targets[target]
+	api.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not monitoring %s", target))
+		return
+	}
+	writeJSON(w, http.StatusOK, targetJSON{Target: target, Stats: api.stats.Get(target).Snapshot()})
+}
+
+func (api *serveAPI) create(w http.ResponseWriter, r *http.Request) {
+	var req targetConfig
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.check(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if _, ok := api.targets[req.Target]; ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("already monitoring %s", req.Target))
+		return
+	}
+	id, err := api.start(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	api.targets[req.Target] = []int{id}
+	writeJSON(w, http.StatusCreated, targetJSON{Target: req.Target, Stats: api.stats.Get(req.Target).Snapshot()})
+}
+
+func (api *serveAPI) remove(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if _, ok := api.targets[target]; !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not monitoring %s", target))
+		return
+	}
+	api.stop(target, true)
+	// it's gone until the config file is changed
+	delete(api.config, target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stop monitoring target, forgetting all about it if forget is set. Called
+// with mu held.
+func (api *serveAPI) stop(target string, forget bool) {
+	for _, id := range api.targets[target] {
+		api.sched.Remove(id)
+	}
+	delete(api.targets, target)
+	if forget {
+		api.stats.Remove(target)
+		api.alerts.Set(target, Thresholds{})
+		api.groups.Join(target, "")
+		api.sla.Remove(target)
+	}
+}
+
+func (api *serveAPI) listGroups(w http.ResponseWriter, r *http.Request) {
+	list := []groupJSON{}
+	for _, group := range api.groups.Groups() {
+		list = append(list, api.group(group))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (api *serveAPI) getGroup(w http.ResponseWriter, r *http.Request) {
+	group := r.PathValue("group")
+	if !slices.Contains(api.groups.Groups(), group) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no results for group %s", group))
+		return
+	}
+	writeJSON(w, http.StatusOK, api.group(group))
+}
+
+// group returns a group's targets and statistics
+func (api *serveAPI) group(group string) groupJSON {
+	return groupJSON{group, api.groups.Members(group), api.groups.stats.Get(group).Snapshot()}
+}
+
+func (api *serveAPI) listSLA(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.sla.Snapshot())
+}
+
+func (api *serveAPI) getSLA(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("target")
+	ts, ok := api.sla.Get(target)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no results for %s", target))
+		return
+	}
+	writeJSON(w, http.StatusOK, ts)
+}
+
+// take in results from an agent, tagged with its name they also go to
+// /results
+func (api *serveAPI) report(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(agentHeader)
+	if name == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing %s header", agentHeader))
+		return
+	}
+	agent := api.agents.get(name)
+	err := readResults(r.Body, func(res Result) {
+		if res.Tags == nil {
+			res.Tags = make(map[string]string)
+		}
+		res.Tags["agent"] = name
+		agent.stats.Add(res)
+		api.hub.Process(&res)
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *serveAPI) listAgents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.agents.list(r.URL.Query().Get("target")))
+}
+
+// what serve itself is doing
+type metricsJSON struct {
+	Uptime     float64 `json:"uptime_seconds"`
+	Goroutines int     `json:"goroutines"`
+	HeapBytes  uint64  `json:"heap_bytes"`
+	Targets    int64   `json:"targets"`
+	Sent       int64   `json:"sent"`
+	InFlight   int64   `json:"in_flight"`
+	Queued     int64   `json:"queued"`
+	MaxLag     float64 `json:"max_lag_ms"` // since metrics were last logged
+	Dropped    int64   `json:"dropped_results"`
+	LocalDrops int64   `json:"replies_dropped_locally"` // by a full socket buffer
+
+	// what serve adds to the RTTs it measures
+	SendDelayAvg float64 `json:"send_delay_avg_ms"`
+	SendDelayMax float64 `json:"send_delay_max_ms"`
+	RecvLagAvg   float64 `json:"receive_lag_avg_ms"`
+	RecvLagMax   float64 `json:"receive_lag_max_ms"`
+}
+
+func (api *serveAPI) metrics(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m := &api.sched.Metrics
+	sent := m.Sent.Load()
+
+	dropped := api.hub.dropped.Load() + overhead.Dropped.Load()
+	if api.reporter != nil {
+		dropped += api.reporter.droppedTotal.Load()
+	}
+	sendAvg, sendMax := overhead.SendDelay.ms()
+	recvAvg, recvMax := overhead.RecvLag.ms()
+	writeJSON(w, http.StatusOK, metricsJSON{
+		Uptime:     time.Since(api.started).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapBytes:  mem.HeapAlloc,
+		Targets:    m.Targets.Load(),
+		Sent:       sent,
+		InFlight:   sent - m.Completed.Load(),
+		Queued:     m.Queued.Load(),
+		MaxLag:     float64(m.MaxLag.Load()) / 1e6,
+		Dropped:    dropped,
+		LocalDrops: overhead.SocketDrops.Load(),
+
+		SendDelayAvg: sendAvg,
+		SendDelayMax: sendMax,
+		RecvLagAvg:   recvAvg,
+		RecvLagMax:   recvMax,
+	})
+}
+
+func (api *serveAPI) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (api *serveAPI) readyz(w http.ResponseWriter, r *http.Request) {
+	if !api.sched.Running() {
+		http.Error(w, "not probing yet", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// send results as server-sent events until the client goes away
+func (api *serveAPI) stream(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	ch := api.hub.subscribe()
+	defer api.hub.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case res := <-ch:
+			if target != "" && res.Target != target {
+				continue
+			}
+			b, err := json.Marshal(res)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			if rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// write v as the JSON response
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// write err as a JSON error response
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// how many results a subscriber can fall behind before missing some
+const hubQueue = 256
+
+// resultHub is a Stage passing results on to every subscriber. Subscribers
+// that don't keep up miss results rather than holding up probing.
+type resultHub struct {
+	mu      sync.Mutex
+	subs    map[chan Result]struct{}
+	dropped atomic.Int64 // results subscribers missed
+}
+
+func (h *resultHub) Process(r *Result) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- *r:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+	return true
+}
+
+func (h *resultHub) subscribe() chan Result {
+	ch := make(chan Result, hubQueue)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *resultHub) unsubscribe(ch chan Result) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
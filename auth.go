@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// permission is what an API token allows, each allows what the ones before
+// it do
+type permission int
+
+const (
+	permRead   permission = iota + 1 // list targets, stats and results
+	permReport                       // send results as an agent
+	permManage                       // add and remove targets
+)
+
+var permissionNames = map[string]permission{
+	"read":   permRead,
+	"report": permReport,
+	"manage": permManage,
+}
+
+// apiTokens are the tokens allowed to use the API, with what they allow
+type apiTokens map[string]permission
+
+// read tokens from a file, a token and its permission per line, ignoring
+// blank lines and # comments:
+//
+//	# dashboards
+//	3c8f...e1 read
+//	# frankfurt agent
+//	9a0b...44 report
+func loadTokens(path string) (apiTokens, error) {
+	lines, err := readTargets(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(apiTokens)
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s: want a token and its permission, got %q", path, line)
+		}
+		perm, ok := permissionNames[f[1]]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown permission %q, use read, report or manage", path, f[1])
+		}
+		tokens[f[0]] = perm
+	}
+	return tokens, nil
+}
+
+// allows returns what token allows, 0 if it isn't known. Every token is
+// compared in constant time so the time taken gives none of them away.
+func (t apiTokens) allows(token string) permission {
+	var perm permission
+	for known, p := range t {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			perm = p
+		}
+	}
+	return perm
+}
+
+// require wraps h to only serve requests with a bearer token allowing perm,
+// when the API has tokens
+func (api *serveAPI) require(perm permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.tokens == nil {
+			h(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch allowed := api.tokens.allows(token); {
+		case !ok || allowed == 0:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or unknown API token"))
+		case allowed < perm:
+			writeError(w, http.StatusForbidden, fmt.Errorf("API token doesn't allow this"))
+		default:
+			h(w, r)
+		}
+	}
+}
+
+// serverTLS returns the TLS config of the API, requiring client certificates
+// signed by clientCA if it's given
+func serverTLS(cert, key, clientCA string) (*tls.Config, error) {
+	c, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{c}, MinVersion: tls.VersionTLS12}
+	if clientCA != "" {
+		pool, err := loadCAs(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientTLS returns the TLS config agents connect to the controller with,
+// trusting ca if given rather than the system's CAs, and presenting cert if
+// given
+func clientTLS(cert, key, ca string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{c}
+	}
+	if ca != "" {
+		pool, err := loadCAs(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// read PEM certificates from path
+func loadCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	return pool, nil
+}
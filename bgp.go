@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// RIPEstat, whose data API has the routes RIS collectors see
+	ripeStatURL = "https://stat.ripe.net"
+
+	// longest the BGP lookup may hold up the summary
+	bgpTimeout = 10 * time.Second
+)
+
+// BGPInfo is how the internet routes to an address, by the routing tables
+// of a RIPE RIS route collector's peers: the most specific prefix covering
+// it, the networks announcing it, and the shortest AS path to it the
+// collector's peers have
+type BGPInfo struct {
+	Prefix  string   `json:"prefix,omitempty"` // "" if it isn't announced
+	Origins []string `json:"origin_as,omitempty"`
+	Vantage string   `json:"vantage,omitempty"` // the collector, e.g. RRC00
+	Where   string   `json:"vantage_location,omitempty"`
+	Path    string   `json:"as_path,omitempty"`
+	Peers   int      `json:"peers,omitempty"` // of the collector with a route
+}
+
+func (b BGPInfo) String() string {
+	if b.Prefix == "" {
+		return "not announced in BGP"
+	}
+	s := fmt.Sprintf("%s announced by AS%s", b.Prefix, strings.Join(b.Origins, ", AS"))
+	switch {
+	case b.Path != "":
+		s += fmt.Sprintf(", AS path from %s (%s) %s, shortest of %d peers", b.Vantage, b.Where, b.Path, b.Peers)
+	case b.Vantage != "":
+		s += fmt.Sprintf(", no route at %s", b.Vantage)
+	}
+	return s
+}
+
+// lookupBGP asks the RIPEstat API at base what prefix ip is in and who
+// announces it, and the AS path to it from the peers of RIS collector rrc,
+// e.g. rrc00, "" to not
+func lookupBGP(ctx context.Context, client *http.Client, base string, ip net.IP, rrc string) (BGPInfo, error) {
+	var info struct {
+		ASNs   []string `json:"asns"`
+		Prefix string   `json:"prefix"`
+	}
+	if err := ripeStat(ctx, client, base, "network-info", ip.String(), &info); err != nil {
+		return BGPInfo{}, err
+	}
+	b := BGPInfo{Prefix: info.Prefix, Origins: info.ASNs}
+	if b.Prefix == "" || rrc == "" {
+		return b, nil
+	}
+
+	var lg struct {
+		RRCs []struct {
+			RRC      string `json:"rrc"`
+			Location string `json:"location"`
+			Peers    []struct {
+				Path string `json:"as_path"`
+			} `json:"peers"`
+		} `json:"rrcs"`
+	}
+	if err := ripeStat(ctx, client, base, "looking-glass", b.Prefix, &lg); err != nil {
+		return b, err
+	}
+	b.Vantage = strings.ToUpper(rrc)
+	for _, c := range lg.RRCs {
+		if !strings.EqualFold(c.RRC, rrc) {
+			continue
+		}
+		b.Where = c.Location
+		for _, p := range c.Peers {
+			b.Peers++
+			if b.Path == "" || len(strings.Fields(p.Path)) < len(strings.Fields(b.Path)) {
+				b.Path = p.Path
+			}
+		}
+	}
+	return b, nil
+}
+
+// ripeStat gets the data of a RIPEstat data call about resource into data
+func ripeStat(ctx context.Context, client *http.Client, base, call, resource string, data any) error {
+	u := fmt.Sprintf("%s/data/%s/data.json?resource=%s&sourceapp=ping", strings.TrimSuffix(base, "/"), call, url.QueryEscape(resource))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", call, resp.Status)
+	}
+	var doc struct {
+		Status   string          `json:"status"`
+		Messages [][]string      `json:"messages"`
+		Data     json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&doc); err != nil {
+		return fmt.Errorf("%s: %v", call, err)
+	}
+	if doc.Status != "" && doc.Status != "ok" {
+		var msgs []string
+		for _, m := range doc.Messages {
+			msgs = append(msgs, strings.Join(m, ": "))
+		}
+		return fmt.Errorf("%s: %s %s", call, doc.Status, strings.Join(msgs, "; "))
+	}
+	return json.Unmarshal(doc.Data, data)
+}
+
+// bgpLookup runs lookupBGP in the background, for the summary to pick up
+type bgpLookup struct {
+	done chan struct{}
+	info BGPInfo
+	err  error
+}
+
+// startBGPLookup starts looking up ip's routes, with RIPEstat at base from
+// collector rrc
+func startBGPLookup(ctx context.Context, base string, ip net.IP, rrc string) *bgpLookup {
+	bl := &bgpLookup{done: make(chan struct{})}
+	go func() {
+		defer close(bl.done)
+		ctx, cancel := context.WithTimeout(ctx, bgpTimeout)
+		defer cancel()
+		bl.info, bl.err = lookupBGP(ctx, &http.Client{Timeout: bgpTimeout}, base, ip, rrc)
+	}()
+	return bl
+}
+
+// Wait for the lookup, returning its result or why there is none
+func (bl *bgpLookup) Wait() (BGPInfo, error) {
+	<-bl.done
+	return bl.info, bl.err
+}
+
+// private and other special addresses aren't routed on the internet, so
+// there's nothing to look up
+func globalUnicast(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !slices.ContainsFunc(nonGlobal, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+// ranges IsGlobalUnicast and IsPrivate let through that aren't routed on
+// the internet either: CGNAT, documentation and benchmarking addresses
+var nonGlobal = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"100.64.0.0/10", "192.0.2.0/24", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"} {
+		_, n, _ := net.ParseCIDR(s)
+		nets = append(nets, n)
+	}
+	return nets
+}()
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/bpf"
+)
+
+// icmp types the filters let through
+const (
+	icmpEchoReply    = 0
+	icmpDstUnreach   = 3
+	icmpTimeExceeded = 11
+
+	icmpv6DstUnreach   = 1
+	icmpv6PacketTooBig = 2
+	icmpv6TimeExceeded = 3
+	icmpv6EchoReply    = 129
+)
+
+// longest packet a filter passes on, more than any IP packet
+const filterSnapLen = 1 << 18
+
+// echoFilter returns a classic BPF program for a raw ICMP socket that only
+// passes echo replies and the errors quoting an echo request, with
+// identifier id. With a negative id the identifier isn't checked, for sockets
+// shared by many clients. If src is set echo replies are matched by coming
+// from it instead, whatever their identifier, in case a NAT rewrote it.
+//
+// IPv4 raw sockets see the IP header, IPv6 ones start at the ICMPv6 header.
+// Without the address to go by, src lets every IPv6 echo reply through.
+// Errors quoting an IPv6 request with extension headers are dropped.
+func echoFilter(ipv4 bool, id int, src net.IP) ([]bpf.RawInstruction, error) {
+	match := []bpf.Instruction{bpf.Jump{Skip: 0}, bpf.Jump{Skip: 0}}
+	if id >= 0 {
+		match[1] = bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(id & 0xffff), SkipFalse: 1}
+	}
+	return echoProgram(ipv4, id, src, match)
+}
+
+// shardFilter returns a classic BPF program passing what echoFilter passes
+// for a shared socket, but only for identifiers that are shard modulo
+// shards, for one of several sockets sharing the work, see Mux.Shards
+func shardFilter(ipv4 bool, shard, shards int) ([]bpf.RawInstruction, error) {
+	return echoProgram(ipv4, -1, nil, []bpf.Instruction{
+		bpf.ALUOpConstant{Op: bpf.ALUOpMod, Val: uint32(shards)},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(shard), SkipFalse: 1},
+	})
+}
+
+// echoProgram assembles the program of echoFilter, with match, two
+// instructions, deciding on the identifier in A: falling through accepts the
+// message, skipping one instruction past them rejects it
+func echoProgram(ipv4 bool, id int, src net.IP, match []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	var prog []bpf.Instruction
+	if ipv4 {
+		prog = []bpf.Instruction{
+			// X = IP header length, A = icmp type
+			bpf.LoadMemShift{Off: 0},
+			bpf.LoadIndirect{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: icmpEchoReply, SkipTrue: 2},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: icmpDstUnreach, SkipTrue: 3},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: icmpTimeExceeded, SkipTrue: 2, SkipFalse: 11},
+			// echo reply, load its identifier
+			bpf.LoadIndirect{Off: 4, Size: 2},
+			bpf.Jump{Skip: 6},
+			// error, X += length of the quoted IP header and load the
+			// quoted request's identifier
+			bpf.LoadIndirect{Off: 8, Size: 1},
+			bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0f},
+			bpf.ALUOpConstant{Op: bpf.ALUOpShiftLeft, Val: 2},
+			bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.TAX{},
+			bpf.LoadIndirect{Off: 8 + 4, Size: 2},
+		}
+		if id >= 0 && src.To4() != nil {
+			// echo reply, accept it if it's from src
+			prog[5] = bpf.LoadAbsolute{Off: 12, Size: 4}
+			prog[6] = bpf.JumpIf{Cond: bpf.JumpEqual, Val: binary.BigEndian.Uint32(src.To4()), SkipTrue: 8, SkipFalse: 9}
+		}
+	} else {
+		prog = []bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: icmpv6EchoReply, SkipTrue: 2},
+			// errors are the types from destination unreachable, through
+			// packet too big, to time exceeded
+			bpf.JumpIf{Cond: bpf.JumpLessThan, Val: icmpv6DstUnreach, SkipTrue: 7},
+			bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: icmpv6TimeExceeded, SkipTrue: 6, SkipFalse: 2},
+			// echo reply, load its identifier
+			bpf.LoadAbsolute{Off: 4, Size: 2},
+			bpf.Jump{Skip: 1},
+			// error, load the quoted request's identifier
+			bpf.LoadAbsolute{Off: 8 + 40 + 4, Size: 2},
+		}
+		if id >= 0 && src != nil {
+			// echo reply, as if it had our identifier
+			prog[4] = bpf.LoadConstant{Dst: bpf.RegA, Val: uint32(id & 0xffff)}
+		}
+	}
+
+	// A holds the identifier, the last two instructions accept or reject
+	prog = append(prog, match...)
+	prog = append(prog, bpf.RetConstant{Val: filterSnapLen}, bpf.RetConstant{Val: 0})
+	return bpf.Assemble(prog)
+}
@@ -0,0 +1,46 @@
+package main
+
+import "sync"
+
+// size of the pooled buffers replies are copied into, larger replies get a
+// buffer of their own
+const replyBufSize = 500
+
+// room for the IPv4 header (with options) raw sockets may pass along and
+// the ICMP header, on top of the payload
+const replyHeaderLen = 60 + 8
+
+// smallest read buffer, an ICMPv6 error quoting a request can fill a whole
+// minimum MTU packet
+const minReadLen = 1280
+
+// length of the buffer needed to read the reply to a request carrying size
+// payload bytes, or an error about it
+func replyLen(size int) int {
+	return max(size+replyHeaderLen, minReadLen)
+}
+
+// reply buffers are reused between probes so high rate and high target
+// count runs don't allocate one per packet
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, replyBufSize)
+		return &b
+	},
+}
+
+// get a buffer of at least n bytes, from the pool unless it is too small
+func getBuf(n int) *[]byte {
+	if n > replyBufSize {
+		b := make([]byte, n)
+		return &b
+	}
+	return bufPool.Get().(*[]byte)
+}
+
+// return a buffer to the pool once nothing refers to it anymore
+func putBuf(b *[]byte) {
+	if len(*b) == replyBufSize {
+		bufPool.Put(b)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// chart layout, in pixels
+const (
+	chartWidth  = 960
+	chartHeight = 420
+	chartLeft   = 76  // room for the RTT labels
+	chartRight  = 20  // margin right of the plots
+	chartTop    = 20  // margin above the RTT plot
+	chartRTT    = 300 // height of the RTT plot
+	chartGap    = 30  // between it and the loss strip, room for the time labels
+	chartLoss   = 30  // height of the loss strip
+)
+
+// colors of the targets' lines, in order, and of the rest of the chart
+var (
+	chartColors = []color.RGBA{
+		{0x1f, 0x77, 0xb4, 0xff}, {0xff, 0x7f, 0x0e, 0xff}, {0x2c, 0xa0, 0x2c, 0xff},
+		{0x94, 0x67, 0xbd, 0xff}, {0x8c, 0x56, 0x4b, 0xff}, {0x17, 0xbe, 0xcf, 0xff},
+	}
+	chartAxis = color.RGBA{0x44, 0x44, 0x44, 0xff}
+	chartGrid = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	chartLost = color.RGBA{0xd6, 0x27, 0x28, 0xff}
+)
+
+// rttChart collects the results of a run for a chart of every target's RTT
+// over time, and when probes were lost under it
+type rttChart struct {
+	targets []string // in the order first seen
+	series  map[string]*chartSeries
+}
+
+type chartSeries struct {
+	times []time.Time
+	rtts  []float64 // ms, NaN for lost probes
+}
+
+func newRTTChart() *rttChart {
+	return &rttChart{series: make(map[string]*chartSeries)}
+}
+
+// Add records r, late, duplicate and corrupt replies aren't charted
+func (c *rttChart) Add(r Result) {
+	if r.Kind.extra() {
+		return
+	}
+	s, ok := c.series[r.Target]
+	if !ok {
+		s = &chartSeries{}
+		c.series[r.Target] = s
+		c.targets = append(c.targets, r.Target)
+	}
+	rtt := math.NaN()
+	if r.Kind == KindReply {
+		rtt = r.RTT.Seconds() * 1e3
+	}
+	s.times = append(s.times, r.Time)
+	s.rtts = append(s.rtts, rtt)
+}
+
+// canvas is what a chart is drawn on, a PNG or an SVG
+type canvas interface {
+	line(x1, y1, x2, y2 int, c color.RGBA)
+	rect(x, y, w, h int, c color.RGBA)
+	text(x, y int, s string, c color.RGBA)
+}
+
+// Write renders the chart to w, as PNG or SVG by the extension of name
+func (c *rttChart) Write(w io.Writer, name string) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+		draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+		c.draw(pngCanvas{img})
+		return png.Encode(w, img)
+	case ".svg":
+		sc := &svgCanvas{}
+		c.draw(sc)
+		_, err := fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"11\">\n"+
+			"<rect width=\"100%%\" height=\"100%%\" fill=\"white\"/>\n%s</svg>\n", chartWidth, chartHeight, sc.b.String())
+		return err
+	}
+	return fmt.Errorf("unknown chart format %q, use .png or .svg", filepath.Ext(name))
+}
+
+// draw the chart on cv
+func (c *rttChart) draw(cv canvas) {
+	var start, end time.Time
+	maxRTT := 0.0
+	for _, s := range c.series {
+		for i, t := range s.times {
+			if start.IsZero() || t.Before(start) {
+				start = t
+			}
+			if t.After(end) {
+				end = t
+			}
+			if !math.IsNaN(s.rtts[i]) {
+				maxRTT = max(maxRTT, s.rtts[i])
+			}
+		}
+	}
+	maxRTT = niceCeil(maxRTT)
+	span := max(end.Sub(start), time.Second)
+
+	plotW := chartWidth - chartLeft - chartRight
+	x := func(t time.Time) int {
+		return chartLeft + int(float64(t.Sub(start))/float64(span)*float64(plotW))
+	}
+	y := func(rtt float64) int {
+		return chartTop + chartRTT - int(rtt/maxRTT*chartRTT)
+	}
+	lossTop := chartTop + chartRTT + chartGap
+
+	// grid and labels, RTT in quarters and time at the ends and middle
+	for i := range 5 {
+		rtt := maxRTT * float64(i) / 4
+		cv.line(chartLeft, y(rtt), chartLeft+plotW, y(rtt), chartGrid)
+		cv.text(4, y(rtt)+3, formatChartMS(rtt), chartAxis)
+	}
+	for i := range 3 {
+		t := start.Add(span * time.Duration(i) / 2)
+		label := t.Format("15:04:05")
+		cv.text(min(x(t)-24, chartWidth-60), chartTop+chartRTT+16, label, chartAxis)
+	}
+	cv.line(chartLeft, chartTop, chartLeft, chartTop+chartRTT, chartAxis)
+	cv.line(chartLeft, chartTop+chartRTT, chartLeft+plotW, chartTop+chartRTT, chartAxis)
+	cv.text(4, lossTop+chartLoss/2+3, "lost", chartAxis)
+	cv.rect(chartLeft, lossTop, plotW, chartLoss, chartGrid)
+
+	// a line per target, broken where probes were lost, which are marked in
+	// the strip below
+	for i, target := range c.targets {
+		s := c.series[target]
+		col := chartColors[i%len(chartColors)]
+		order := make([]int, len(s.times))
+		for j := range order {
+			order[j] = j
+		}
+		slices.SortStableFunc(order, func(a, b int) int { return s.times[a].Compare(s.times[b]) })
+
+		prev := -1
+		for _, j := range order {
+			if math.IsNaN(s.rtts[j]) {
+				cv.rect(x(s.times[j]), lossTop, 2, chartLoss, chartLost)
+				prev = -1
+				continue
+			}
+			if prev >= 0 {
+				cv.line(x(s.times[prev]), y(s.rtts[prev]), x(s.times[j]), y(s.rtts[j]), col)
+			} else {
+				cv.rect(x(s.times[j]), y(s.rtts[j]), 1, 1, col)
+			}
+			prev = j
+		}
+
+		// legend, top right
+		ly := chartTop + 4 + i*14
+		cv.rect(chartWidth-chartRight-180, ly-6, 10, 3, col)
+		cv.text(chartWidth-chartRight-165, ly, target, chartAxis)
+	}
+}
+
+// niceCeil rounds ms up to 1, 2 or 5 times a power of ten, for axis labels
+func niceCeil(ms float64) float64 {
+	if ms <= 0 {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(ms)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if ms <= m*p {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+// an RTT axis label
+func formatChartMS(ms float64) string {
+	if ms == math.Trunc(ms) {
+		return fmt.Sprintf("%.0f ms", ms)
+	}
+	return fmt.Sprintf("%g ms", math.Round(ms*1000)/1000)
+}
+
+// svgCanvas draws a chart as SVG elements
+type svgCanvas struct {
+	b strings.Builder
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (sc *svgCanvas) line(x1, y1, x2, y2 int, c color.RGBA) {
+	fmt.Fprintf(&sc.b, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"%s\"/>\n", x1, y1, x2, y2, svgColor(c))
+}
+
+func (sc *svgCanvas) rect(x, y, w, h int, c color.RGBA) {
+	fmt.Fprintf(&sc.b, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", x, y, w, h, svgColor(c))
+}
+
+func (sc *svgCanvas) text(x, y int, s string, c color.RGBA) {
+	fmt.Fprintf(&sc.b, "<text x=\"%d\" y=\"%d\" fill=\"%s\">%s</text>\n", x, y, svgColor(c), html.EscapeString(s))
+}
+
+// pngCanvas draws a chart on an image, with a small built in font as the
+// standard library has none
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func (pc pngCanvas) line(x1, y1, x2, y2 int, c color.RGBA) {
+	// Bresenham
+	dx, dy := abs(x2-x1), -abs(y2-y1)
+	sx, sy := 1, 1
+	if x1 > x2 {
+		sx = -1
+	}
+	if y1 > y2 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		pc.img.SetRGBA(x1, y1, c)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x1 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y1 += sy
+		}
+	}
+}
+
+func (pc pngCanvas) rect(x, y, w, h int, c color.RGBA) {
+	draw.Draw(pc.img, image.Rect(x, y, x+w, y+h), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// text draws s with its baseline at y, characters the font lacks as blanks
+func (pc pngCanvas) text(x, y int, s string, c color.RGBA) {
+	const scale = 2 // font pixels are 2x2
+	for _, r := range strings.ToLower(s) {
+		glyph := chartFont[r]
+		for row := range 5 {
+			for col := range 3 {
+				if glyph[row]&(4>>col) != 0 {
+					pc.rect(x+col*scale, y-10+row*scale, scale, scale, c)
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// chartFont is a 3x5 pixel font of what chart labels use: rows top to
+// bottom, the low 3 bits of each the pixels left to right
+var chartFont = map[rune][5]byte{
+	'0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 3, 1, 7},
+	'4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 2, 2},
+	'8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7}, '.': {0, 0, 0, 0, 2}, ':': {0, 2, 0, 2, 0},
+	'-': {0, 0, 7, 0, 0}, '/': {1, 1, 2, 4, 4}, '_': {0, 0, 0, 0, 7},
+	'a': {2, 5, 7, 5, 5}, 'b': {6, 5, 6, 5, 6}, 'c': {3, 4, 4, 4, 3}, 'd': {6, 5, 5, 5, 6},
+	'e': {7, 4, 6, 4, 7}, 'f': {7, 4, 6, 4, 4}, 'g': {3, 4, 5, 5, 3}, 'h': {5, 5, 7, 5, 5},
+	'i': {7, 2, 2, 2, 7}, 'j': {1, 1, 1, 5, 2}, 'k': {5, 5, 6, 5, 5}, 'l': {4, 4, 4, 4, 7},
+	'm': {5, 7, 7, 5, 5}, 'n': {6, 5, 5, 5, 5}, 'o': {2, 5, 5, 5, 2}, 'p': {6, 5, 6, 4, 4},
+	'q': {2, 5, 5, 6, 3}, 'r': {6, 5, 6, 5, 5}, 's': {3, 4, 2, 1, 6}, 't': {7, 2, 2, 2, 2},
+	'u': {5, 5, 5, 5, 7}, 'v': {5, 5, 5, 5, 2}, 'w': {5, 5, 7, 7, 5}, 'x': {5, 5, 2, 5, 5},
+	'y': {5, 5, 2, 2, 2}, 'z': {7, 1, 2, 4, 7},
+}
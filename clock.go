@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// Clock is the source of time used to measure RTTs and schedule probes, so
+// both can be driven by a fake clock in tests or by kernel timestamps later.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// TimestampSource is where the timestamps an RTT was computed from came from
+type TimestampSource string
+
+const (
+	TimestampUser     TimestampSource = "user"     // time.Now in this process
+	TimestampKernel   TimestampSource = "kernel"   // kernel software timestamps
+	TimestampHardware TimestampSource = "hardware" // taken by the NIC
+)
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// assertion is the verdict of assert, printed as JSON for CI pipelines
+type assertion struct {
+	Target    string   `json:"target"`
+	Pass      bool     `json:"pass"`
+	Failures  []string `json:"failures,omitempty"` // why it didn't pass
+	Reachable float64  `json:"reachable_after_ms,omitempty"`
+	Stats     *Summary `json:"stats,omitempty"`
+}
+
+// probe a host a set number of times and fail unless the network is as good
+// as required, for checks before and after changes
+func runAssert(args []string) int {
+	var pf probeFlags
+	fs := newFlagSet(lookupCommand("assert"))
+	pf.register(fs)
+	count := fs.Int("c", 10, "Send this many probes")
+	maxLoss := fs.Float64("max-loss", 0, "Fail if more than this percent of probes were lost")
+	maxRTT := fs.Duration("max-rtt", 0, "Fail if the average RTT was over this, 0 to not check")
+	maxP95 := fs.Duration("max-p95", 0, "Fail if the 95th percentile RTT was over this, 0 to not check")
+	maxP99 := fs.Duration("max-p99", 0, "Fail if the 99th percentile RTT was over this, 0 to not check")
+	within := fs.Duration("reachable-within", 0, "Wait up to this long for a first reply before counting probes, failing without one, 0 to not wait")
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *count < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	if err := pf.validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	// stdout is for the verdict
+	pf.format = "json"
+	pf.fallBack(pf.status())
+
+	prober, desc, err := pf.newProber(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Fprintf(pf.status(), "ASSERT %s\n", desc)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	verdict := assertion{Target: pf.resultTarget(fs.Arg(0))}
+	if *within > 0 {
+		after, err := waitReachable(ctx, prober, pf.interval, *within)
+		if errors.Is(err, ErrPermission) {
+			fmt.Println(err)
+			return 1
+		}
+		if err != nil {
+			verdict.Failures = append(verdict.Failures, err.Error())
+			return verdict.print()
+		}
+		verdict.Reachable = after.Seconds() * 1e3
+	}
+
+	stats := NewStats(pf.payload())
+	runner := &Runner{
+		Prober:   prober,
+		Interval: pf.interval,
+		Jitter:   float64(pf.jitter),
+		Clock:    SystemClock,
+		Handle:   Pipeline{StatsSink(stats)}.Handle,
+		Count:    *count,
+		Retry:    pf.retry(),
+	}
+	if err := runner.Run(ctx); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	sum := stats.Snapshot()
+	verdict.Stats = &sum
+	if ctx.Err() != nil {
+		// CI still gets a verdict to parse, failed with what was counted
+		fmt.Fprintln(pf.status(), "interrupted")
+		verdict.Failures = append(verdict.Failures, "interrupted")
+		return verdict.print()
+	}
+	if loss := sum.Loss(); loss > *maxLoss {
+		verdict.Failures = append(verdict.Failures,
+			fmt.Sprintf("%.1f%% of probes lost, more than -max-loss %g%%", loss, *maxLoss))
+	}
+	rtts := []struct {
+		what, flag string
+		ms         float64
+		max        time.Duration
+	}{
+		{"average", "max-rtt", sum.TotalTime / float64(max(sum.PacketIn, 1)), *maxRTT},
+		{"p95", "max-p95", sum.RTTs.Percentile(0.95), *maxP95},
+		{"p99", "max-p99", sum.RTTs.Percentile(0.99), *maxP99},
+	}
+	for _, rtt := range rtts {
+		if rtt.max <= 0 {
+			continue
+		}
+		switch got := time.Duration(rtt.ms * float64(time.Millisecond)); {
+		case sum.PacketIn == 0:
+			verdict.Failures = append(verdict.Failures, fmt.Sprintf("no replies to check against -%s", rtt.flag))
+		case got > rtt.max:
+			verdict.Failures = append(verdict.Failures,
+				fmt.Sprintf("%s rtt %v, more than -%s %v", rtt.what, got.Round(time.Microsecond), rtt.flag, rtt.max))
+		}
+	}
+	return verdict.print()
+}
+
+// waitReachable probes until a reply comes back, returning how long that
+// took, or an error if none did within timeout
+func waitReachable(ctx context.Context, prober Prober, interval, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		res, err := prober.Probe(ctx)
+		if errors.Is(err, ErrPermission) {
+			return 0, err
+		}
+		if res.Kind == KindReply && ctx.Err() == nil {
+			return time.Since(start), nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return 0, fmt.Errorf("interrupted")
+			}
+			return 0, fmt.Errorf("not reachable within %v", timeout)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// print the verdict and return the exit code it calls for
+func (a assertion) print() int {
+	a.Pass = len(a.Failures) == 0
+	json.NewEncoder(os.Stdout).Encode(a)
+	if !a.Pass {
+		return 1
+	}
+	return 0
+}
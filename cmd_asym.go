@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+)
+
+// one way delays differing by less than this, or a quarter of the RTT, are
+// within what ICMP timestamps' millisecond resolution and clock drift can
+// explain
+const asymFloor = 5 * time.Millisecond
+
+// the ms in a day, ICMP timestamps count from midnight UT and wrap
+const dayMS = 24 * 60 * 60 * 1000
+
+// asymSample is the outcome of one ICMP timestamp exchange
+type asymSample struct {
+	RTT     time.Duration
+	Forward time.Duration // our clock to the host's, as it was stamped on arrival
+	Return  time.Duration // the host's clock to ours, from when it was stamped on leaving
+}
+
+// estimate the forward and return one way delays to a host from ICMP
+// timestamp exchanges, and flag a path much slower one way than the other,
+// which traceroute, showing only the way there, can't show
+func runAsym(args []string) int {
+	fs := newFlagSet(lookupCommand("asym"))
+	count := fs.Int("c", 5, "Timestamp requests to send, the fastest exchange is the one judged")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	interval := fs.Duration("i", 200*time.Millisecond, "Wait between requests")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *count < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	addr, err := resolveIPAddr("ip4", fs.Arg(0))
+	if err != nil {
+		fmt.Println("ICMP timestamps are IPv4 only:", err)
+		return 1
+	}
+	// datagram ICMP sockets only carry echo requests
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		fmt.Println("ICMP timestamps need raw sockets:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("TIMESTAMP %s (%s)\n", fs.Arg(0), addr)
+	id := os.Getpid() & 0xffff
+	var best *asymSample
+	for seq := 0; seq < *count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		s, err := icmpTimestamp(conn, addr, id, seq, *timeout)
+		if err != nil {
+			fmt.Printf("seq=%d %v\n", seq, err)
+			continue
+		}
+		fmt.Printf("seq=%d rtt=%.1f ms forward≈%d ms return≈%d ms\n",
+			seq, s.RTT.Seconds()*1e3, s.Forward.Milliseconds(), s.Return.Milliseconds())
+		// the fastest exchange queued the least on the way
+		if best == nil || s.RTT < best.RTT {
+			best = &s
+		}
+	}
+	if best == nil {
+		fmt.Println("\nno timestamp replies, the host or a firewall doesn't answer them")
+		return 1
+	}
+
+	fmt.Printf("\nfastest exchange: rtt %.1f ms, forward ≈%d ms, return ≈%d ms\n",
+		best.RTT.Seconds()*1e3, best.Forward.Milliseconds(), best.Return.Milliseconds())
+	fmt.Println(best.judge())
+	return 0
+}
+
+// judge says whether the exchange shows the paths there and back differ
+func (s asymSample) judge() string {
+	if s.Forward < 0 || s.Return < 0 {
+		off := -min(s.Forward, s.Return)
+		return fmt.Sprintf("the host's clock is off ours by at least %d ms, its one way delays can't be told apart", off.Milliseconds())
+	}
+	diff := s.Forward - s.Return
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff < max(asymFloor, s.RTT/4) {
+		return "no significant asymmetry, both ways take about as long (if the host's clock agrees with ours)"
+	}
+	slow := "forward"
+	if s.Return > s.Forward {
+		slow = "return"
+	}
+	return fmt.Sprintf("ASYMMETRIC: the %s path takes %d ms longer, likely a different and longer route that way, which traceroute can't show (if the host's clock agrees with ours)",
+		slow, diff.Milliseconds())
+}
+
+// icmpTimestamp sends an ICMP timestamp request to dst and waits for the
+// reply
+func icmpTimestamp(conn *icmp.PacketConn, dst *net.IPAddr, id, seq int, timeout time.Duration) (asymSample, error) {
+	// identifier, sequence number, then the originate, receive and
+	// transmit timestamps, the host fills in the last two
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[0:2], uint16(id))
+	binary.BigEndian.PutUint16(b[2:4], uint16(seq))
+	start := time.Now()
+	binary.BigEndian.PutUint32(b[4:8], msSinceMidnight(start))
+	msg, err := (&icmp.Message{Type: xipv4.ICMPTypeTimestamp, Body: &icmp.RawBody{Data: b}}).Marshal(nil)
+	if err != nil {
+		return asymSample{}, err
+	}
+	if _, err := conn.WriteTo(msg, dst); err != nil {
+		return asymSample{}, classify(err)
+	}
+
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(start.Add(timeout))
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return asymSample{}, classify(err)
+		}
+		now := time.Now()
+		reply, err := icmp.ParseMessage(ProtocolICMP, buf[:n])
+		if err != nil || reply.Type != xipv4.ICMPTypeTimestampReply {
+			continue
+		}
+		body, ok := reply.Body.(*icmp.RawBody)
+		if !ok || len(body.Data) < 16 || !peer.(*net.IPAddr).IP.Equal(dst.IP) ||
+			binary.BigEndian.Uint16(body.Data[0:2]) != uint16(id) || binary.BigEndian.Uint16(body.Data[2:4]) != uint16(seq) {
+			continue
+		}
+		orig := binary.BigEndian.Uint32(body.Data[4:8])
+		recv := binary.BigEndian.Uint32(body.Data[8:12])
+		xmit := binary.BigEndian.Uint32(body.Data[12:16])
+		// the high bit marks timestamps that aren't ms since midnight UT
+		if recv&(1<<31) != 0 || xmit&(1<<31) != 0 {
+			return asymSample{}, errors.New("the host's timestamps aren't standard, they can't be compared")
+		}
+		return asymSample{
+			RTT:     now.Sub(start),
+			Forward: msBetween(orig, recv),
+			Return:  msBetween(xmit, msSinceMidnight(now)),
+		}, nil
+	}
+}
+
+// msSinceMidnight returns t as an ICMP timestamp
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight).Milliseconds())
+}
+
+// msBetween returns the time from ICMP timestamp a to b, the shorter way
+// around midnight
+func msBetween(a, b uint32) time.Duration {
+	d := (int64(b) - int64(a)) % dayMS
+	if d > dayMS/2 {
+		d -= dayMS
+	} else if d < -dayMS/2 {
+		d += dayMS
+	}
+	return time.Duration(d) * time.Millisecond
+}
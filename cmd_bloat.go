@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// probes in the first moments of the load aren't counted, TCP is still
+// ramping up
+const bloatRampUp = time.Second
+
+// size of the UDP packets of -udp load
+const bloatUDPSize = 1200
+
+// bloatGrades are the letter grades of a latency increase under load, the
+// first with an increase under its limit applies
+var bloatGrades = []struct {
+	limit time.Duration
+	grade string
+}{
+	{5 * time.Millisecond, "A+"},
+	{30 * time.Millisecond, "A"},
+	{60 * time.Millisecond, "B"},
+	{200 * time.Millisecond, "C"},
+	{400 * time.Millisecond, "D"},
+}
+
+// measure a host's RTT idle and then while the link is loaded, to show how
+// much the queues along the way (bufferbloat) add when it's busy
+func runBloat(args []string) int {
+	fs := newFlagSet(lookupCommand("bloat"))
+	idle := fs.Duration("idle", 5*time.Second, "How long to measure the idle RTT")
+	loaded := fs.Duration("w", 10*time.Second, "How long to load the link and measure the RTT under load")
+	interval := fs.Duration("i", 100*time.Millisecond, "Wait between probes")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	download := fs.String("download", "", "Load the link downloading this URL over and over")
+	upload := fs.String("upload", "", "Load the link uploading to this URL, which has to take POSTs of any size")
+	streams := fs.Int("streams", 4, "Parallel TCP streams of -download and -upload each")
+	udp := fs.String("udp", "", "Load the link sending UDP packets to this host:port")
+	udpRate := fs.Float64("udp-rate", 10, "Mbit/s of -udp load")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *download == "" && *upload == "" && *udp == "" {
+		fmt.Println("no load, give -download, -upload or -udp")
+		return 1
+	}
+	if *streams < 1 || *udpRate <= 0 || *loaded <= bloatRampUp {
+		fmt.Printf("-streams must be at least 1, -udp-rate positive and -w over %v\n", bloatRampUp)
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+
+	// timed in userspace, the kernel's send timestamps are taken after this
+	// host's own queues, which are as much part of the latency as any
+	client, err := New(fs.Arg(0), WithInterval(*interval), WithTimeout(*timeout), WithTimestamps(TimestampUser))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("BLOAT %s (%s)\n", fs.Arg(0), client.IPAddr)
+	fmt.Printf("idle for %v...\n", *idle)
+	idleSum, err := bloatPhase(ctx, client, *idle)
+	if err != nil || ctx.Err() != nil {
+		return bloatFailed(err)
+	}
+	if idleSum.PacketIn == 0 {
+		fmt.Println("no replies while idle, the host can't be tested")
+		return 1
+	}
+
+	// load the link, the probes go on
+	loadCtx, stopLoad := context.WithCancel(ctx)
+	var moved atomic.Int64
+	var wg sync.WaitGroup
+	var load []string
+	run := func(n int, f func()) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f()
+			}()
+		}
+	}
+	if *download != "" {
+		load = append(load, fmt.Sprintf("%d download streams", *streams))
+		run(*streams, func() { loadDownload(loadCtx, *download, &moved) })
+	}
+	if *upload != "" {
+		load = append(load, fmt.Sprintf("%d upload streams", *streams))
+		run(*streams, func() { loadUpload(loadCtx, *upload, &moved) })
+	}
+	if *udp != "" {
+		load = append(load, fmt.Sprintf("%g Mbit/s of UDP", *udpRate))
+		run(1, func() { loadUDP(loadCtx, *udp, *udpRate*1e6, &moved) })
+	}
+	fmt.Printf("loaded with %s for %v...\n", strings.Join(load, ", "), *loaded)
+	start := time.Now()
+	select {
+	case <-ctx.Done():
+	case <-time.After(bloatRampUp):
+	}
+	loadSum, err := bloatPhase(ctx, client, *loaded-bloatRampUp)
+	stopLoad()
+	wg.Wait()
+	if err != nil || ctx.Err() != nil {
+		return bloatFailed(err)
+	}
+	rate := float64(moved.Load()*8) / time.Since(start).Seconds()
+
+	fmt.Println()
+	fmt.Printf("idle:   %s\n", bloatLine(idleSum))
+	fmt.Printf("loaded: %s, under %s of load\n", bloatLine(loadSum), formatBits(rate))
+	if moved.Load() == 0 {
+		fmt.Println("the load moved nothing, check -download, -upload and -udp")
+		return 1
+	}
+	if loadSum.PacketIn == 0 {
+		fmt.Println("no replies under load, grade F")
+		return 1
+	}
+	ms := func(v float64) time.Duration { return time.Duration(v * float64(time.Millisecond)) }
+	median := ms(loadSum.RTTs.Percentile(0.5) - idleSum.RTTs.Percentile(0.5))
+	p90 := ms(loadSum.RTTs.Percentile(0.9) - idleSum.RTTs.Percentile(0.9))
+	fmt.Printf("latency increase under load: %+.1f ms median, %+.1f ms p90\n", median.Seconds()*1e3, p90.Seconds()*1e3)
+	fmt.Printf("grade %s\n", bloatGrade(median))
+	return 0
+}
+
+// probe with client for d, and return the statistics
+func bloatPhase(ctx context.Context, client *PingClient, d time.Duration) (Summary, error) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	stats := NewStats(0)
+	runner := &Runner{
+		Prober:   client,
+		Interval: client.Interval,
+		Clock:    SystemClock,
+		Handle:   Pipeline{StatsSink(stats)}.Handle,
+	}
+	err := runner.Run(ctx)
+	return stats.Snapshot(), err
+}
+
+// print why bloat stopped early
+func bloatFailed(err error) int {
+	if err != nil {
+		fmt.Println(err)
+	}
+	return 1
+}
+
+// a phase's RTTs and loss in a line
+func bloatLine(s Summary) string {
+	if s.PacketIn == 0 {
+		return fmt.Sprintf("%d probes, no replies", s.PacketOut)
+	}
+	return fmt.Sprintf("%d probes, rtt median %.1f ms, p90 %.1f ms, %.1f%% loss",
+		s.PacketOut, s.RTTs.Percentile(0.5), s.RTTs.Percentile(0.9), s.Loss())
+}
+
+// the letter grade of a latency increase
+func bloatGrade(increase time.Duration) string {
+	for _, g := range bloatGrades {
+		if increase < g.limit {
+			return g.grade
+		}
+	}
+	return "F"
+}
+
+// download url over and over until ctx is done, counting the bytes
+func loadDownload(ctx context.Context, url string, moved *atomic.Int64) {
+	for ctx.Err() == nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			logger.Warn("download load", "url", url, "err", err)
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("download load", "url", url, "err", err)
+				sleepCtx(ctx, time.Second)
+			}
+			continue
+		}
+		io.Copy(countWriter{moved}, resp.Body)
+		resp.Body.Close()
+		loadStatus(ctx, "download load", url, resp)
+	}
+}
+
+// upload to url until ctx is done, counting the bytes
+func loadUpload(ctx context.Context, url string, moved *atomic.Int64) {
+	for ctx.Err() == nil {
+		// an endless body, cut off when ctx is done
+		body := io.TeeReader(zeroReader{}, countWriter{moved})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+		if err != nil {
+			logger.Warn("upload load", "url", url, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Warn("upload load", "url", url, "err", err)
+				sleepCtx(ctx, time.Second)
+			}
+			continue
+		}
+		resp.Body.Close()
+		loadStatus(ctx, "upload load", url, resp)
+	}
+}
+
+// warn about, and wait out, error statuses of load requests rather than
+// try again straight away
+func loadStatus(ctx context.Context, what, url string, resp *http.Response) {
+	if resp.StatusCode >= 400 && ctx.Err() == nil {
+		logger.Warn(what, "url", url, "status", resp.Status)
+		sleepCtx(ctx, time.Second)
+	}
+}
+
+// send UDP packets to addr at rate bits per second until ctx is done,
+// counting the bytes
+func loadUDP(ctx context.Context, addr string, rate float64, moved *atomic.Int64) {
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		logger.Warn("udp load", "addr", addr, "err", err)
+		return
+	}
+	// not connected, so nothing listening there doesn't fail the sends,
+	// they load the link all the same
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.Warn("udp load", "addr", addr, "err", err)
+		return
+	}
+	defer conn.Close()
+	packet := make([]byte, bloatUDPSize)
+	bucket := NewTokenBucket(rate/(bloatUDPSize*8), 1, SystemClock)
+	for bucket.Wait(ctx) == nil {
+		if n, err := conn.WriteToUDP(packet, dst); err == nil {
+			moved.Add(int64(n))
+		}
+	}
+}
+
+// wait for d, or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// countWriter counts and discards what's written to it
+type countWriter struct{ n *atomic.Int64 }
+
+func (w countWriter) Write(b []byte) (int, error) {
+	w.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// zeroReader reads endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"time"
+)
+
+// estimate the bottleneck bandwidth to a host by packet pairs: two probes
+// sent back to back leave the slowest link on the way spaced by the time it
+// takes to carry one, and their replies keep that spacing
+func runBW(args []string) int {
+	fs := newFlagSet(lookupCommand("bw"))
+	count := fs.Int("c", 20, "Probe pairs to send, more give a steadier estimate")
+	size := fs.Int("s", 0, "Size (in bytes) of the probes, 0 to fill the interface MTU, bigger ones are spaced further apart")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	interval := fs.Duration("i", 200*time.Millisecond, "Wait between pairs")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *count < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	if *size < 0 || *size > MaxSize {
+		fmt.Printf("-s must be between 0 and %d\n", MaxSize)
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+
+	addr, err := resolveIPAddr("ip", fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mtu, dev, err := routeMTU(addr)
+	if err != nil {
+		fmt.Println("finding the interface MTU:", err)
+		return 1
+	}
+	headers := 20 + 8
+	if addr.IP.To4() == nil {
+		headers = 40 + 8
+	}
+	if *size == 0 {
+		*size = min(mtu-headers, MaxSize)
+	}
+	// what the links carry of each probe
+	wire := *size + headers
+
+	client, err := New(addr.String(), WithSize(*size), WithTimeout(*timeout))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("BW %s (%s) via %s, pairs of %d byte packets\n", fs.Arg(0), addr, dev, wire)
+	var rates []float64
+	userTimed := 0 // pairs without kernel timestamps
+	for n := 0; n < *count; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		// a round of a single hop at the client's own TTL is a pair
+		pair := probeRound(ctx, client, []int{client.TTL})
+		if ctx.Err() != nil {
+			break
+		}
+		first, second := pair[0], pair[1]
+		if first.Kind != KindReply || second.Kind != KindReply {
+			fmt.Printf("pair %d: lost\n", n)
+			continue
+		}
+		gap := second.Recv.Sub(first.Recv)
+		if gap <= 0 {
+			fmt.Printf("pair %d: replies arrived together or swapped\n", n)
+			continue
+		}
+		rate := float64(wire*8) / gap.Seconds()
+		rates = append(rates, rate)
+		if first.Stamp == TimestampUser || second.Stamp == TimestampUser {
+			userTimed++
+		}
+		fmt.Printf("pair %d: rtt %.1f ms, %.3f ms apart ≈ %s\n", n, first.RTT.Seconds()*1e3, gap.Seconds()*1e3, formatBits(rate))
+	}
+	if len(rates) == 0 {
+		fmt.Println("\nno pair came back whole, the bandwidth can't be estimated")
+		return 1
+	}
+
+	// cross traffic squeezes pairs apart or together, the median holds up
+	slices.Sort(rates)
+	fmt.Printf("\nbottleneck ≈ %s, median of %d pairs from %s to %s\n",
+		formatBits(rates[len(rates)/2]), len(rates), formatBits(rates[0]), formatBits(rates[len(rates)-1]))
+	if userTimed > 0 {
+		fmt.Printf("%d of %d pairs timed in userspace, without kernel timestamps, their estimates are rough\n", userTimed, len(rates))
+	}
+	return 0
+}
+
+// formatBits returns a rate in bits per second for people
+func formatBits(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.1f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.0f kbit/s", bps/1e3)
+	}
+}
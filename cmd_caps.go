@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	pingGroupRange = "/proc/sys/net/ipv4/ping_group_range"
+	pingSysctlConf = "/etc/sysctl.d/60-ping.conf" // keeps the range after a reboot
+)
+
+// let non-root users send ICMP, either by giving the binary CAP_NET_RAW or
+// by allowing a group unprivileged ICMP sockets
+func runInstallCaps(args []string) int {
+	fs := newFlagSet(lookupCommand("install-caps"))
+	sysctl := fs.Bool("sysctl", false, "Allow a group unprivileged ICMP sockets instead of setting the capability")
+	gid := fs.Int("gid", sudoGID(), "Group to allow with -sysctl, the sudo user's by default")
+	groups := fs.String("range", "", "Set ping_group_range to these groups with -sysctl, e.g. 100-1000, instead of adding -gid")
+	parseFlags(fs, args)
+
+	if runtime.GOOS != "linux" {
+		fmt.Println("install-caps is only needed on Linux")
+		return 1
+	}
+	if os.Geteuid() != 0 {
+		fmt.Println("install-caps needs root, run it with sudo")
+		return 1
+	}
+
+	if *sysctl {
+		if *groups != "" {
+			lo, hi, err := parseGroupRange(*groups)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			return setPingGroups(lo, hi)
+		}
+		if *gid < 0 {
+			fmt.Println("no group to allow, pass -gid")
+			return 1
+		}
+		return allowPingGroup(*gid)
+	}
+
+	// the binary to set the capability on, this one by default
+	path := fs.Arg(0)
+	if path == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		path = exe
+	}
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	out, err := exec.Command("setcap", "cap_net_raw+ep", path).CombinedOutput()
+	if err != nil {
+		fmt.Printf("setcap: %v %s\n", err, strings.TrimSpace(string(out)))
+		fmt.Println("is libcap installed? it provides setcap")
+		return 1
+	}
+	fmt.Printf("%s can now open raw sockets without sudo, rebuilding it drops the capability\n", path)
+	return 0
+}
+
+// add gid to ping_group_range, now and after reboots. It's a single range,
+// so a group that isn't next to it can't be added without allowing every
+// group in between, that takes an explicit -range.
+func allowPingGroup(gid int) int {
+	b, err := os.ReadFile(pingGroupRange)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	lo, hi, err := addPingGroup(string(b), gid)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return setPingGroups(lo, hi)
+}
+
+// return the range of groups cur (ping_group_range) becomes with gid added,
+// an error if that would add other groups too
+func addPingGroup(cur string, gid int) (int, int, error) {
+	f := strings.Fields(cur)
+	if len(f) != 2 {
+		return 0, 0, fmt.Errorf("can't parse ping_group_range %q", cur)
+	}
+	lo, err1 := strconv.Atoi(f[0])
+	hi, err2 := strconv.Atoi(f[1])
+	switch {
+	case err1 != nil || err2 != nil:
+		return 0, 0, fmt.Errorf("can't parse ping_group_range %q", cur)
+	case lo > hi:
+		// empty, the default is "1 0"
+		return gid, gid, nil
+	case gid >= lo-1 && gid <= hi+1:
+		return min(lo, gid), max(hi, gid), nil
+	}
+	wlo, whi := min(lo, gid), max(hi, gid)
+	return 0, 0, fmt.Errorf("groups %d-%d may send ICMP, adding group %d would allow every group in %d-%d; pass -range %d-%d to accept that",
+		lo, hi, gid, wlo, whi, wlo, whi)
+}
+
+// parse a range of groups given as lo-hi, or a single group
+func parseGroupRange(s string) (int, int, error) {
+	from, to, isRange := strings.Cut(s, "-")
+	if !isRange {
+		to = from
+	}
+	lo, err1 := strconv.Atoi(from)
+	hi, err2 := strconv.Atoi(to)
+	if err1 != nil || err2 != nil || lo < 0 || lo > hi {
+		return 0, 0, fmt.Errorf("bad group range %q, want lo-hi", s)
+	}
+	return lo, hi, nil
+}
+
+// set ping_group_range to lo-hi, now and after reboots
+func setPingGroups(lo, hi int) int {
+	value := fmt.Sprintf("%d %d", lo, hi)
+	if err := os.WriteFile(pingGroupRange, []byte(value), 0644); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	conf := fmt.Sprintf("# written by ping install-caps\nnet.ipv4.ping_group_range = %s\n", value)
+	if err := os.WriteFile(pingSysctlConf, []byte(conf), 0644); err != nil {
+		fmt.Printf("set for now, but %v\n", err)
+		return 1
+	}
+	fmt.Printf("net.ipv4.ping_group_range is now %q, groups %d-%d can send ICMP without sudo\n", value, lo, hi)
+	return 0
+}
+
+// the group of the user that ran sudo, -1 if not run through sudo
+func sudoGID() int {
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return -1
+	}
+	return gid
+}
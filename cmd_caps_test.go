@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAddPingGroup(t *testing.T) {
+	for _, tt := range []struct {
+		cur    string
+		gid    int
+		lo, hi int
+		ok     bool
+	}{
+		{"1\t0\n", 1000, 1000, 1000, true}, // empty
+		{"100\t200\n", 150, 100, 200, true},
+		{"100\t200\n", 201, 100, 201, true},
+		{"100\t200\n", 99, 99, 200, true},
+		{"0\t0\n", 1000, 0, 0, false}, // would allow groups 1-999 too
+		{"100\t200\n", 50, 0, 0, false},
+		{"garbage", 1000, 0, 0, false},
+	} {
+		lo, hi, err := addPingGroup(tt.cur, tt.gid)
+		if (err == nil) != tt.ok || lo != tt.lo || hi != tt.hi {
+			t.Errorf("addPingGroup(%q, %d) = %d, %d, %v", tt.cur, tt.gid, lo, hi, err)
+		}
+	}
+}
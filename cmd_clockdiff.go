@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// ICMP timestamps are whole ms, so each bound is only good to within this
+const clockdiffResolution = time.Millisecond
+
+// estimate how far a host's clock is off ours from ICMP timestamp
+// exchanges, like clockdiff
+func runClockdiff(args []string) int {
+	fs := newFlagSet(lookupCommand("clockdiff"))
+	count := fs.Int("c", 10, "Timestamp requests to send")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	interval := fs.Duration("i", 200*time.Millisecond, "Wait between requests")
+	maxOffset := fs.Duration("max-offset", 0, "Exit with 1 if the host's clock may be off ours by more than this, 0 to not")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *count < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	addr, err := resolveIPAddr("ip4", fs.Arg(0))
+	if err != nil {
+		fmt.Println("ICMP timestamps are IPv4 only:", err)
+		return 1
+	}
+	// datagram ICMP sockets only carry echo requests
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		fmt.Println("ICMP timestamps need raw sockets:", err)
+		return 1
+	}
+	defer conn.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("CLOCKDIFF %s (%s)\n", fs.Arg(0), addr)
+	id := os.Getpid() & 0xffff
+	var samples []asymSample
+	for seq := 0; seq < *count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(*interval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		s, err := icmpTimestamp(conn, addr, id, seq, *timeout)
+		if err != nil {
+			fmt.Printf("seq=%d %v\n", seq, err)
+			continue
+		}
+		lo, hi := s.offsetBounds()
+		fmt.Printf("seq=%d rtt=%.1f ms offset=%+d ms (%+d to %+d)\n",
+			seq, s.RTT.Seconds()*1e3, ((lo + hi) / 2).Milliseconds(), lo.Milliseconds(), hi.Milliseconds())
+		samples = append(samples, s)
+	}
+	if len(samples) == 0 {
+		fmt.Println("\nno timestamp replies, the host or a firewall doesn't answer them")
+		return 1
+	}
+
+	lo, hi := clockOffset(samples)
+	offset := (lo + hi) / 2
+	fmt.Printf("\n%d of %d exchanges, offset %+d ms ±%d ms\n", len(samples), *count, offset.Milliseconds(), ((hi - lo) / 2).Milliseconds())
+	switch {
+	case hi < 0:
+		fmt.Printf("%s's clock is behind ours by %d to %d ms\n", fs.Arg(0), -hi.Milliseconds(), -lo.Milliseconds())
+	case lo > 0:
+		fmt.Printf("%s's clock is ahead of ours by %d to %d ms\n", fs.Arg(0), lo.Milliseconds(), hi.Milliseconds())
+	default:
+		fmt.Printf("%s's clock agrees with ours to within %d ms\n", fs.Arg(0), max(-lo, hi).Milliseconds())
+	}
+	if *maxOffset > 0 && max(-lo, hi) > *maxOffset {
+		fmt.Printf("FAIL: the clock may be off by %d ms, more than -max-offset %v\n", max(-lo, hi).Milliseconds(), *maxOffset)
+		return 1
+	}
+	return 0
+}
+
+// offsetBounds returns the range the host's clock is ahead of ours in, by
+// what the exchange shows. Neither way can have taken less than no time,
+// so the host stamped the request no earlier than we sent it, and the reply
+// no later than we got it, by our clock.
+func (s asymSample) offsetBounds() (lo, hi time.Duration) {
+	return -s.Return - clockdiffResolution, s.Forward + clockdiffResolution
+}
+
+// clockOffset returns the range the host's clock is ahead of ours in, where
+// every exchange's bounds overlap. If they don't, the clocks drifted or an
+// exchange was off by more than the resolution, and the fastest exchange,
+// with the tightest bounds, is all there is to go by.
+func clockOffset(samples []asymSample) (lo, hi time.Duration) {
+	lo, hi = samples[0].offsetBounds()
+	fastest := samples[0]
+	for _, s := range samples[1:] {
+		slo, shi := s.offsetBounds()
+		lo, hi = max(lo, slo), min(hi, shi)
+		if s.RTT < fastest.RTT {
+			fastest = s
+		}
+	}
+	if lo > hi {
+		return fastest.offsetBounds()
+	}
+	return lo, hi
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+// probe two hosts side by side with the same settings, to tell whether a
+// problem is on the path both share or only one of them
+func runCompare(args []string) int {
+	var pf probeFlags
+	fs := newFlagSet(lookupCommand("compare"))
+	pf.register(fs)
+	pf.registerSummary(fs)
+	count := fs.Int("c", 0, "Stop after this many probes of each, 0 to go on until interrupted")
+	deadline := fs.Duration("w", 0, "Stop after this long, 0 to go on until interrupted")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 2 {
+		fmt.Println("need two hosts to compare")
+		return 1
+	}
+	if err := pf.validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	pf.fallBack(pf.status())
+
+	sums, ok := compareHosts(&pf, [2]string{fs.Arg(0), fs.Arg(1)}, *count, *deadline)
+	if !ok {
+		return 1
+	}
+	pf.printSummary("compare", []targetJSON{
+		{Target: pf.resultTarget(fs.Arg(0)), Stats: sums[0]},
+		{Target: pf.resultTarget(fs.Arg(1)), Stats: sums[1]},
+	}, nil)
+	return 0
+}
+
+// probe two hosts in step until count probes of each, the deadline or an
+// interrupt, printing them side by side, and return their statistics. ok is
+// false if probing couldn't start.
+func compareHosts(pf *probeFlags, hosts [2]string, count int, deadline time.Duration) (sums [2]Summary, ok bool) {
+	// both probed in step, so each gets its own identifier in case they're
+	// the same host
+	var sides [2]compareSide
+	for i := range sides {
+		prober, desc, err := pf.newProber(hosts[i], WithID(os.Getpid()+i))
+		if err != nil {
+			fmt.Println(err)
+			return sums, false
+		}
+		if c, ok := prober.(io.Closer); ok {
+			defer c.Close()
+		}
+		sides[i].prober, sides[i].desc = prober, desc
+		sides[i].target = pf.resultTarget(hosts[i])
+		sides[i].stats = NewStats(pf.payload())
+		// in text mode the rows below are printed instead of every result
+		out := io.Writer(pf.results())
+		if pf.format == "text" {
+			out = io.Discard
+		}
+		sides[i].pipeline = pf.output(out, StatsSink(sides[i].stats))
+	}
+	fmt.Fprintf(pf.status(), "COMPARE %s vs %s\n", sides[0].desc, sides[1].desc)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	width := max(len(sides[0].target), len(sides[1].target), len("timeout"))
+	if pf.format == "text" {
+		fmt.Fprintf(pf.results(), "%-6s  %*s  %*s  %10s\n", "seq", width, sides[0].target, width, sides[1].target, "diff")
+	}
+	for seq := 1; count == 0 || seq <= count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(jitter(pf.interval, float64(pf.jitter))):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		var res [2]Result
+		var errs [2]error
+		var wg sync.WaitGroup
+		for i := range sides {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res[i], errs[i] = sides[i].prober.Probe(ctx)
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			// interrupted mid probe, the results are meaningless
+			break
+		}
+		for i := range sides {
+			if errors.Is(errs[i], ErrPermission) {
+				fmt.Println(errs[i])
+				return sums, false
+			}
+			sides[i].pipeline.Handle(res[i])
+			sides[i].handleLate()
+		}
+		if pf.format == "text" {
+			fmt.Fprintf(pf.results(), "%-6d  %*s  %*s  %10s\n", seq,
+				width, compareCell(res[0]), width, compareCell(res[1]), compareDiff(res[0], res[1]))
+		}
+	}
+
+	w := pf.status()
+	a, b := sides[0].stats.Snapshot(), sides[1].stats.Snapshot()
+	a.Fprint(w, sides[0].target+" statistics")
+	b.Fprint(w, sides[1].target+" statistics")
+	fmt.Fprintf(w, "\n------ %s vs %s ------\n", sides[0].target, sides[1].target)
+	fmt.Fprintf(w, "%-6s  %*s  %*s  %10s\n", "", width, sides[0].target, width, sides[1].target, "diff")
+	la, lb := a.Loss(), b.Loss()
+	fmt.Fprintf(w, "%-6s  %*s  %*s  %10s\n", "loss",
+		width, fmt.Sprintf("%.1f%%", la), width, fmt.Sprintf("%.1f%%", lb), fmt.Sprintf("%+.1f%%", lb-la))
+	if a.PacketIn > 0 && b.PacketIn > 0 {
+		rows := []struct {
+			name string
+			a, b float64
+		}{
+			{"min", a.RTTMin, b.RTTMin},
+			{"avg", a.TotalTime / float64(a.PacketIn), b.TotalTime / float64(b.PacketIn)},
+			{"max", a.RTTMax, b.RTTMax},
+			{"p50", a.RTTs.Percentile(0.5), b.RTTs.Percentile(0.5)},
+			{"p90", a.RTTs.Percentile(0.9), b.RTTs.Percentile(0.9)},
+			{"p99", a.RTTs.Percentile(0.99), b.RTTs.Percentile(0.99)},
+		}
+		for _, row := range rows {
+			fmt.Fprintf(w, "%-6s  %*s  %*s  %10s\n", row.name,
+				width, fmt.Sprintf("%.1f ms", row.a), width, fmt.Sprintf("%.1f ms", row.b),
+				fmt.Sprintf("%+.1f ms", row.b-row.a))
+		}
+	}
+	return [2]Summary{a, b}, true
+}
+
+// one of the hosts compare probes
+type compareSide struct {
+	target   string
+	desc     string
+	prober   Prober
+	stats    *Stats
+	pipeline Pipeline
+}
+
+// hand over the late and duplicate replies that came in since the last probe
+func (s *compareSide) handleLate() {
+	if lp, ok := s.prober.(lateProber); ok {
+		for _, res := range lp.Late() {
+			s.pipeline.Handle(res)
+		}
+	}
+}
+
+// how a probe went, for a column of compare
+func compareCell(r Result) string {
+	switch r.Kind {
+	case KindReply:
+		return fmt.Sprintf("%.1f ms", r.RTT.Seconds()*1e3)
+	case KindTimeout:
+		return "timeout"
+	}
+	return "error"
+}
+
+// how much slower the second host answered, blank unless both did
+func compareDiff(a, b Result) string {
+	if a.Kind != KindReply || b.Kind != KindReply {
+		return ""
+	}
+	return fmt.Sprintf("%+.1f ms", (b.RTT-a.RTT).Seconds()*1e3)
+}
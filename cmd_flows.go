@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how much more loss, in percent, or slower median RTT, at least this much
+// and flowSlowFraction of the fastest, makes a flow stand out from the rest
+const (
+	flowLossGap      = 5.0
+	flowSlowGap      = time.Millisecond
+	flowSlowFraction = 0.1
+)
+
+// probe one host over several flows at once, each with its own DSCP, flow
+// label, identifier or port, to show flows that are policed or hashed onto
+// another path than the rest
+func runFlows(args []string) int {
+	var pf probeFlags
+	fs := newFlagSet(lookupCommand("flows"))
+	pf.register(fs)
+	pf.registerSummary(fs)
+	var flows flowFlag
+	fs.Var(&flows, "flow", "A flow to probe over, comma separated key=value of dscp, ecn, label and id (icmp) or port (tcp), e.g. dscp=ef,label=7 (repeatable)")
+	n := fs.Int("n", 4, "Without -flow, probe over this many flows that only differ in ICMP identifier")
+	count := fs.Int("c", 20, "Stop after this many probes over each flow, 0 to go on until interrupted")
+	deadline := fs.Duration("w", 0, "Stop after this long, 0 to go on until interrupted")
+	parseFlags(fs, args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if err := pf.validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	pf.fallBack(pf.status())
+	if len(flows) == 0 {
+		if pf.mode != "icmp" {
+			fmt.Printf("-m %s flows only differ by what -flow sets\n", pf.mode)
+			return 1
+		}
+		if *n < 2 {
+			fmt.Println("-n must be at least 2")
+			return 1
+		}
+		for i := range *n {
+			flows = append(flows, flowSpec{name: fmt.Sprintf("id=%d", (os.Getpid()+i)&0xffff), dscp: -1, label: -1, id: os.Getpid() + i})
+		}
+	}
+	for _, f := range flows {
+		if err := f.check(pf.mode); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	host := fs.Arg(0)
+	sides := make([]compareSide, len(flows))
+	targets := make([]targetJSON, len(flows))
+	for i, f := range flows {
+		fpf := f.flags(pf)
+		if err := fpf.validate(); err != nil {
+			fmt.Printf("flow %s: %v\n", f.name, err)
+			return 1
+		}
+		id := os.Getpid() + i
+		if f.id >= 0 {
+			id = f.id
+		}
+		prober, desc, err := fpf.newProber(host, WithID(id))
+		if err != nil {
+			fmt.Printf("flow %s: %v\n", f.name, err)
+			return 1
+		}
+		if c, ok := prober.(io.Closer); ok {
+			defer c.Close()
+		}
+		sides[i].prober, sides[i].desc = prober, desc
+		sides[i].target = f.name
+		targets[i] = targetJSON{Target: fpf.resultTarget(host), Flow: f.name}
+		sides[i].stats = NewStats(fpf.payload())
+		// results are tagged with their flow to tell them apart in json
+		fpf.tags = tagFlag{"flow": f.name}
+		for k, v := range pf.tags {
+			fpf.tags[k] = v
+		}
+		out := io.Writer(pf.results())
+		if pf.format == "text" {
+			out = io.Discard
+		}
+		sides[i].pipeline = fpf.output(out, StatsSink(sides[i].stats))
+	}
+	fmt.Fprintf(pf.status(), "FLOWS %s over %d flows\n", sides[0].desc, len(sides))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	width := len("timeout")
+	for _, s := range sides {
+		width = max(width, len(s.target))
+	}
+	rows := pf.format == "text" && !pf.quiet
+	if rows {
+		fmt.Fprintf(pf.results(), "%-6s", "seq")
+		for _, s := range sides {
+			fmt.Fprintf(pf.results(), "  %*s", width, s.target)
+		}
+		fmt.Fprintln(pf.results())
+	}
+	// every flow is probed at the same time so they see the same load
+	for seq := 1; *count == 0 || seq <= *count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(jitter(pf.interval, float64(pf.jitter))):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		res := make([]Result, len(sides))
+		errs := make([]error, len(sides))
+		var wg sync.WaitGroup
+		for i := range sides {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res[i], errs[i] = sides[i].prober.Probe(ctx)
+			}()
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			// interrupted mid probe, the results are meaningless
+			break
+		}
+		for i := range sides {
+			if errors.Is(errs[i], ErrPermission) {
+				fmt.Println(errs[i])
+				return 1
+			}
+			sides[i].pipeline.Handle(res[i])
+			sides[i].handleLate()
+		}
+		if rows {
+			fmt.Fprintf(pf.results(), "%-6d", seq)
+			for _, r := range res {
+				fmt.Fprintf(pf.results(), "  %*s", width, compareCell(r))
+			}
+			fmt.Fprintln(pf.results())
+		}
+	}
+
+	sums := make([]Summary, len(sides))
+	for i := range sides {
+		sums[i] = sides[i].stats.Snapshot()
+		targets[i].Stats = sums[i]
+	}
+	fprintFlows(pf.status(), host, sides, sums, width)
+	pf.printSummary("flows", targets, nil)
+	return 0
+}
+
+// print the RTT distribution and loss of every flow side by side, marking
+// the ones that stand out from the best of them
+func fprintFlows(w io.Writer, host string, sides []compareSide, sums []Summary, width int) {
+	bestLoss, bestP50 := 100.0, 0.0
+	for _, s := range sums {
+		bestLoss = min(bestLoss, s.Loss())
+		if s.PacketIn > 0 {
+			if p50 := s.RTTs.Percentile(0.5); bestP50 == 0 || p50 < bestP50 {
+				bestP50 = p50
+			}
+		}
+	}
+	slow := max(bestP50*flowSlowFraction, flowSlowGap.Seconds()*1e3)
+
+	fmt.Fprintf(w, "\n------ %s flows ------\n", host)
+	fmt.Fprintf(w, "%-*s  %5s  %6s  %9s  %9s  %9s  %9s  %9s\n", width, "flow", "sent", "loss", "min", "p50", "p90", "p99", "max")
+	var differ bool
+	for i, s := range sums {
+		fmt.Fprintf(w, "%-*s  %5d  %5.1f%%", width, sides[i].target, s.PacketOut, s.Loss())
+		if s.PacketIn > 0 {
+			for _, ms := range []float64{s.RTTMin, s.RTTs.Percentile(0.5), s.RTTs.Percentile(0.9), s.RTTs.Percentile(0.99), s.RTTMax} {
+				fmt.Fprintf(w, "  %9s", fmt.Sprintf("%.1f ms", ms))
+			}
+		} else {
+			fmt.Fprintf(w, "  %9s  %9s  %9s  %9s  %9s", "-", "-", "-", "-", "-")
+		}
+		var notes []string
+		if s.Loss() >= bestLoss+flowLossGap {
+			notes = append(notes, fmt.Sprintf("%+.1f%% loss", s.Loss()-bestLoss))
+		}
+		if s.PacketIn > 0 && s.RTTs.Percentile(0.5)-bestP50 >= slow {
+			notes = append(notes, fmt.Sprintf("p50 %+.1f ms", s.RTTs.Percentile(0.5)-bestP50))
+		}
+		if len(notes) > 0 {
+			differ = true
+			fmt.Fprintf(w, "  <- %s", strings.Join(notes, ", "))
+		}
+		fmt.Fprintln(w)
+	}
+	if differ {
+		fmt.Fprintln(w, "flows differ, some are policed or take another path (ECMP) than the rest")
+	} else {
+		fmt.Fprintln(w, "all flows alike")
+	}
+}
+
+// flowSpec is one flow of the flows command, what its probes set unlike
+// the others'. Fields left -1 (0 for port, "" for ecn) are the flags'.
+type flowSpec struct {
+	name  string
+	dscp  DSCP
+	ecn   ECN
+	label int
+	id    int
+	port  int
+}
+
+// flags returns pf with what f sets instead
+func (f flowSpec) flags(pf probeFlags) probeFlags {
+	if f.dscp >= 0 {
+		pf.dscp = dscpFlag(f.dscp)
+	}
+	if f.ecn != "" {
+		pf.ecn = string(f.ecn)
+	}
+	if f.label >= 0 {
+		pf.flow = f.label
+	}
+	if f.port > 0 {
+		pf.port = f.port
+	}
+	return pf
+}
+
+// check that f only sets what probes of mode can differ in
+func (f flowSpec) check(mode string) error {
+	if mode != "icmp" && (f.label >= 0 || f.id >= 0 || f.ecn != "") {
+		return fmt.Errorf("flow %s: label, id and ecn need -m icmp", f.name)
+	}
+	if mode != "tcp" && f.port > 0 {
+		return fmt.Errorf("flow %s: port needs -m tcp", f.name)
+	}
+	return nil
+}
+
+// parseFlow reads a flow given as comma separated key=value, e.g.
+// dscp=ef,label=7
+func parseFlow(s string) (flowSpec, error) {
+	f := flowSpec{name: s, dscp: -1, label: -1, id: -1}
+	for _, field := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return f, fmt.Errorf("flow %q: %q is not key=value", s, field)
+		}
+		var err error
+		switch k {
+		case "dscp":
+			f.dscp, err = parseDSCP(v)
+		case "ecn":
+			f.ecn, err = parseECN(v)
+		case "label":
+			f.label, err = strconv.Atoi(v)
+			if err == nil && (f.label < 0 || f.label > 0xfffff) {
+				err = fmt.Errorf("invalid flow label %d, must be between 0 and %d", f.label, 0xfffff)
+			}
+		case "id":
+			f.id, err = strconv.Atoi(v)
+			if err == nil && (f.id < 0 || f.id > 0xffff) {
+				err = fmt.Errorf("invalid identifier %d, must be between 0 and %d", f.id, 0xffff)
+			}
+		case "port":
+			f.port, err = strconv.Atoi(v)
+			if err == nil && (f.port < 1 || f.port > 0xffff) {
+				err = fmt.Errorf("invalid port %d", f.port)
+			}
+		default:
+			err = fmt.Errorf("unknown key %q, use dscp, ecn, label, id or port", k)
+		}
+		if err != nil {
+			return f, fmt.Errorf("flow %q: %w", s, err)
+		}
+	}
+	return f, nil
+}
+
+// flowFlag collects repeated -flow flags
+type flowFlag []flowSpec
+
+func (f *flowFlag) String() string {
+	var names []string
+	for _, spec := range *f {
+		names = append(names, spec.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func (f *flowFlag) Set(s string) error {
+	spec, err := parseFlow(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// a test of frag: probes of one size and fragmentation setting
+type fragTest struct {
+	name string
+	size int
+	frag Fragmentation
+
+	replies, damaged, tooBig, timeouts int
+	mtu                                int // from the last fragmentation needed error, 0 if none or local
+}
+
+// check how the path to a host handles fragments: probes bigger than the
+// outgoing interface's MTU are sent with DF clear, to see whether their
+// fragments get through and are reassembled, and with DF set, to see
+// whether they're refused the way path MTU discovery needs
+func runFrag(args []string) int {
+	fs := newFlagSet(lookupCommand("frag"))
+	count := fs.Int("c", 3, "Probes sent for each test")
+	size := fs.Int("s", 0, "Size (in bytes) of the big probes, 0 for 500 more than the interface MTU")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	interval := fs.Duration("i", 200*time.Millisecond, "Wait between probes")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *count < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	if *size < 0 || *size > MaxSize {
+		fmt.Printf("-s must be between 0 and %d\n", MaxSize)
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+
+	addr, err := resolveIPAddr("ip", fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mtu, dev, err := routeMTU(addr)
+	if err != nil {
+		fmt.Println("finding the interface MTU:", err)
+		return 1
+	}
+	big := *size
+	if big == 0 {
+		big = min(mtu+500, MaxSize)
+	}
+	fmt.Printf("FRAG %s (%s) via %s mtu %d, %d byte probes\n", fs.Arg(0), addr, dev, mtu, big)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tests := []*fragTest{
+		{name: "small", size: DefaultSize},
+		{name: "fragmented", size: big, frag: FragAllow},
+		{name: "DF set", size: big, frag: FragDeny},
+	}
+	for i, test := range tests {
+		// each with its own socket, and identifier so late replies to one
+		// aren't taken for another's
+		client, err := New(addr.String(), WithSize(test.size), WithTimeout(*timeout),
+			WithFragmentation(test.frag), WithID(os.Getpid()+i))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		err = test.run(ctx, client, *count, *interval)
+		client.Close()
+		if ctx.Err() != nil {
+			return 1
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println(test)
+	}
+
+	fmt.Println()
+	ok := true
+	for _, line := range diagnoseFrag(tests[0], tests[1], tests[2], mtu) {
+		if line.bad {
+			ok = false
+		}
+		fmt.Println(line.text)
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// send count probes with client
+func (t *fragTest) run(ctx context.Context, client *PingClient, count int, interval time.Duration) error {
+	for n := 0; n < count; n++ {
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		res, err := client.Probe(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var me *MTUError
+		switch {
+		case errors.Is(err, ErrPermission):
+			return err
+		case err == nil && res.Kind == KindReply:
+			t.replies++
+		case errors.Is(err, ErrFragNeeded):
+			t.tooBig++
+			if errors.As(err, &me) {
+				t.mtu = me.MTU
+			}
+		case errors.Is(err, ErrTimeout):
+			t.timeouts++
+		}
+		for _, late := range client.Late() {
+			if errors.Is(late.Err, errDamaged) {
+				t.damaged++
+			}
+		}
+	}
+	return nil
+}
+
+func (t *fragTest) String() string {
+	df := "DF default"
+	switch t.frag {
+	case FragAllow:
+		df = "DF clear"
+	case FragDeny:
+		df = "DF set"
+	}
+	line := fmt.Sprintf("%-10s  %5d bytes  %-10s  %d/%d replies", t.name, t.size, df, t.replies, t.sent())
+	if t.damaged > 0 {
+		line += fmt.Sprintf(", %d damaged", t.damaged)
+	}
+	if t.tooBig > 0 {
+		line += fmt.Sprintf(", %d fragmentation needed", t.tooBig)
+		if t.mtu > 0 {
+			line += fmt.Sprintf(" (mtu %d)", t.mtu)
+		}
+	}
+	return line
+}
+
+// probes sent that got an answer or timed out, others failed some other way
+func (t *fragTest) sent() int {
+	return t.replies + t.tooBig + t.timeouts
+}
+
+// a line of frag's diagnosis, bad if it's a problem
+type fragFinding struct {
+	text string
+	bad  bool
+}
+
+// explain what the tests found
+func diagnoseFrag(small, frag, df *fragTest, mtu int) []fragFinding {
+	if small.replies == 0 {
+		return []fragFinding{{"no replies to small probes, the host can't be tested", true}}
+	}
+
+	var found []fragFinding
+	switch {
+	case frag.replies == frag.sent() && frag.damaged == 0:
+		found = append(found, fragFinding{"fragments traverse the path and are reassembled intact", false})
+	case frag.damaged > 0:
+		found = append(found, fragFinding{"fragmented replies come back damaged, something reassembles them wrong", true})
+	case frag.replies == 0:
+		found = append(found, fragFinding{"fragmented probes are lost while small ones get through, something on the path drops fragments (a firewall, NAT or the host itself)", true})
+	default:
+		found = append(found, fragFinding{fmt.Sprintf("%d of %d fragmented probes lost, more than small ones", frag.sent()-frag.replies, frag.sent()), true})
+	}
+
+	switch {
+	case df.tooBig > 0 && df.mtu > 0:
+		found = append(found, fragFinding{fmt.Sprintf("DF probes too big for the path are refused with fragmentation needed, mtu %d, path MTU discovery works", df.mtu), false})
+	case df.tooBig > 0:
+		found = append(found, fragFinding{fmt.Sprintf("DF probes too big for the interface MTU %d are refused before leaving this host", mtu), false})
+	case df.replies > 0:
+		found = append(found, fragFinding{fmt.Sprintf("DF probes of %d bytes got through, the path MTU is at least that", df.size), false})
+	default:
+		found = append(found, fragFinding{"DF probes vanish without a fragmentation needed error, a path MTU black hole, run pmtu to find its size", true})
+	}
+	return found
+}
+
+// routeMTU returns the MTU and name of the interface packets to addr leave
+// through
+func routeMTU(addr *net.IPAddr) (int, string, error) {
+	r, err := lookupRoute(addr, 0, "")
+	if err != nil {
+		return 0, "", err
+	}
+	ifi, err := net.InterfaceByName(r.Dev)
+	if err != nil {
+		return 0, "", err
+	}
+	return ifi.MTU, ifi.Name, nil
+}
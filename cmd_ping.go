@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// ping a single host until interrupted, then print statistics
+func runPing(args []string) int {
+	var pf probeFlags
+	fs := newFlagSet(lookupCommand("ping"))
+	pf.register(fs)
+	pf.registerEvents(fs)
+	pf.registerSummary(fs)
+	count := fs.Int("c", 0, "Stop after sending this many probes, 0 to go on until interrupted")
+	deadline := fs.Duration("w", 0, "Stop after this long, 0 to go on until interrupted")
+	maxLoss := fs.Float64("max-loss", -1, "Exit with 1 if more than this percent of probes were lost, -1 to not")
+	maxRTT := fs.Duration("max-rtt", 0, "Exit with 1 if the average RTT was over this, 0 to not")
+	graph := fs.Bool("graph", false, "Draw the RTTs of the latest probes as a live chart instead of printing every result")
+	progress := fs.Bool("progress", true, "Show a progress bar with how long is left of runs with -c or -w, on terminals")
+	untilDown := fs.Duration("until-down", 0, "Print nothing while the host answers, and exit with 0 once it hasn't for this long")
+	downRun := fs.String("until-down-run", "", "Run this program when -until-down exits, with the result in its environment as for -hook")
+	wol := fs.String("wol", "", "Wake the host with a Wake-on-LAN packet to this MAC address first, and wait for it to answer")
+	wolAddr := fs.String("wol-addr", wolAddr, "Where to send the Wake-on-LAN packet, the network's broadcast address")
+	wolTimeout := fs.Duration("wol-timeout", 2*time.Minute, "How long to wait for a woken host to answer")
+	both := fs.Bool("both", false, "Probe the host's IPv4 and IPv6 addresses side by side, and say which answers better")
+	hops := fs.Bool("hops", false, "Estimate how many hops away the host is first, by sweeping the TTL up from 1, and show it in the summary")
+	showOverhead := fs.Bool("overhead", false, "Show what this host added to the RTTs, how late probes went out and replies were handled, with the summary")
+	maxFails := fs.Int("max-consecutive-fail", 0, fmt.Sprintf("Stop, and exit with %d, once this many probes in a row got no reply, 0 to not", exitConsecutiveFail))
+	anycastTrace := fs.Duration("anycast-trace", 0, "With -anycast, also sweep the TTL this often and flag the path's length or last router changing, 0 to not")
+	confirmLimit := fs.Bool("ratelimit-confirm", false, fmt.Sprintf("When losses look like the host rate limiting ICMP answers, probe %dx slower for %d probes to confirm", policerSlowdown, policerConfirm))
+	bgp := fs.Bool("bgp", false, "Look up the host's prefix, origin AS and AS path on RIPEstat, and show them with the summary")
+	bgpFrom := fs.String("bgp-from", "rrc00", "RIPE RIS route collector whose peers the -bgp AS path is from, e.g. rrc00 (Amsterdam) or rrc11 (New York), \"\" for none")
+	bgpAPI := fs.String("bgp-api", ripeStatURL, "RIPEstat to ask for -bgp, or a mirror of its data API")
+	whois := fs.Bool("whois", false, "Look up who the host's address is registered to with RDAP first, and print the organization and abuse contact")
+	whoisServer := fs.String("whois-server", rdapURL, "RDAP server to ask for -whois, or one that redirects to the right registry")
+	dnsEvery := fs.Duration("dns-every", 0, "Look up the host's name again this often, timing it apart from the RTTs, 0 to only look it up at start")
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if err := pf.validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	var mac net.HardwareAddr
+	if *wol != "" {
+		var err error
+		if mac, err = parseMAC(*wol); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	if *hops && pf.mode != "icmp" {
+		fmt.Println("-hops needs -m icmp")
+		return 1
+	}
+	if *maxFails < 0 {
+		fmt.Println("-max-consecutive-fail can't be negative")
+		return 1
+	}
+	if *anycastTrace > 0 && (pf.mode != "icmp" || !pf.anycast) {
+		fmt.Println("-anycast-trace needs -anycast and -m icmp")
+		return 1
+	}
+	if *confirmLimit && (pf.mode != "icmp" || pf.pps > 0) {
+		fmt.Println("-ratelimit-confirm needs -m icmp, and no -pps")
+		return 1
+	}
+	if (*bgp || *whois) && pf.mode != "icmp" {
+		fmt.Println("-bgp and -whois need -m icmp")
+		return 1
+	}
+	if *dnsEvery > 0 && pf.mode != "icmp" {
+		fmt.Println("-dns-every needs -m icmp")
+		return 1
+	}
+	if *both && pf.mode != "icmp" && pf.mode != "tcp" {
+		fmt.Println("-both needs -m icmp or tcp")
+		return 1
+	}
+	pf.fallBack(pf.status())
+
+	if *both {
+		v4, v6, err := resolveBoth(fs.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		sums, ok := compareHosts(&pf, [2]string{v4, v6}, *count, *deadline)
+		if !ok {
+			return 1
+		}
+		printBothVerdict(pf.status(), sums[0], sums[1])
+		pf.printSummary("ping", []targetJSON{{Target: v4, Stats: sums[0]}, {Target: v6, Stats: sums[1]}}, nil)
+		return 0
+	}
+
+	prober, desc, err := pf.newProber(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	// name resolution is timed apart, a slow ping is often a slow lookup
+	dns := &DNSTimer{}
+	client, _ := prober.(*PingClient)
+	if client != nil && client.ResolveTime > 0 {
+		desc += fmt.Sprintf(", resolved in %.1f ms", client.ResolveTime.Seconds()*1e3)
+		if resolveFrom != resolveSystem {
+			desc += " from " + resolveFrom
+		}
+		switch {
+		case isMDNSName(fs.Arg(0)) && (resolveFrom == resolveSystem || resolveFrom == resolveDNS):
+			desc += " by mDNS"
+		case pf.resolver != "":
+			desc += " by " + pf.resolver
+		}
+		dns.Record(client.ResolveTime)
+	}
+	fmt.Fprintf(pf.status(), "PING %s\n", desc)
+	// which way probes leave, for when they go out the wrong interface
+	if client != nil {
+		route, err := lookupRoute(client.IPAddr, pf.mark, pf.vrf)
+		if err != nil {
+			fmt.Fprintf(pf.status(), "ROUTE none: %v\n", err)
+		} else {
+			fmt.Fprintf(pf.status(), "ROUTE %s\n", route)
+		}
+	}
+
+	// who owns the address, for triage before the first reply
+	if *whois && client != nil {
+		if !globalUnicast(client.IPAddr.IP) {
+			fmt.Fprintf(pf.status(), "WHOIS %s isn't a public address\n", client.IPAddr)
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), rdapTimeout)
+			w, err := lookupWhois(ctx, &http.Client{Timeout: rdapTimeout}, *whoisServer, client.IPAddr.IP)
+			cancel()
+			if err != nil {
+				fmt.Fprintln(pf.status(), "WHOIS lookup failed:", err)
+			} else {
+				fmt.Fprintf(pf.status(), "WHOIS %s\n", w)
+			}
+		}
+	}
+
+	// who routes the host is looked up meanwhile, for the summary
+	var routing *bgpLookup
+	if *bgp && client != nil && globalUnicast(client.IPAddr.IP) {
+		routing = startBGPLookup(context.Background(), *bgpAPI, client.IPAddr.IP, *bgpFrom)
+	}
+
+	// ctrl-c, or the deadline, stops probing, after which the statistics
+	// are printed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	// a sleeping host is woken, and pinging starts once it's up
+	if mac != nil {
+		if err := sendWakeOnLAN(mac, *wolAddr, pf.control()); err != nil {
+			fmt.Println("sending Wake-on-LAN packet:", err)
+			return 1
+		}
+		fmt.Fprintf(pf.status(), "WAKE %s via %s, waiting up to %v\n", mac, *wolAddr, *wolTimeout)
+		took, err := waitReachable(ctx, prober, pf.interval, *wolTimeout)
+		if err != nil {
+			fmt.Fprintln(pf.status(), err)
+			return 1
+		}
+		fmt.Fprintf(pf.status(), "%s woke up after %.1fs\n", fs.Arg(0), took.Seconds())
+	}
+
+	// a quick TTL sweep for how far away the host is, before the probes
+	// that are counted
+	var hopCount int
+	if client != nil && *hops {
+		hopCount, err = estimateHops(ctx, client, traceMaxTTL, pf.timeout)
+		if ctx.Err() != nil {
+			return 1
+		}
+		switch {
+		case err != nil:
+			fmt.Fprintln(pf.status(), "estimating hops:", err)
+		case hopCount == 0:
+			fmt.Fprintf(pf.status(), "%s not reached within %d hops\n", fs.Arg(0), traceMaxTTL)
+		}
+	}
+
+	// results are tagged, counted and then written out
+	clock := SystemClock
+	stats := NewStats(pf.payload())
+	sinks := []Stage{dns, StatsSink(stats)}
+	out := io.Writer(pf.results())
+	var down *Result
+	if *untilDown > 0 {
+		// watchdog: silent until the host stops answering
+		out = io.Discard
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		sinks = append(sinks, downWatch(*untilDown, clock, func(r Result) {
+			down = &r
+			cancel()
+		}))
+	}
+	failed := false
+	if *maxFails > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		sinks = append(sinks, failStreak(*maxFails, func() {
+			failed = true
+			cancel()
+		}))
+	}
+	if *graph {
+		if !isTerminal(pf.results()) || pf.format != "text" {
+			fmt.Println("-graph needs text output to a terminal")
+			return 1
+		}
+		out = io.Discard
+		sinks = append(sinks, NewGraph(pf.results(), terminalWidth(pf.results())-10))
+	}
+	// evenly spaced losses are often the host's ICMP rate limit
+	var policer *PolicerDetector
+	if pf.mode == "icmp" {
+		policer = &PolicerDetector{W: pf.status()}
+		sinks = append(sinks, policer)
+	}
+	var bar *Progress
+	if *progress && !*graph && (*count > 0 || *deadline > 0) && isTerminal(pf.status()) {
+		bar = NewProgress(pf.status(), *count, *deadline)
+		sinks = append(sinks, bar)
+		out = bar.Writer(out)
+		go bar.Run(ctx)
+	}
+	pipeline := pf.output(out, sinks...)
+	defer pf.closeHooks()
+	if *dnsEvery > 0 && client != nil && client.ResolveTime > 0 {
+		go dns.Run(ctx, client.Addr, client.IPAddr, *dnsEvery)
+	}
+	if *anycastTrace > 0 {
+		// the sweeps change the TTL, so they get a client of their own
+		tracer, _, err := pf.newProber(client.IPAddr.String(), WithID(os.Getpid()+1))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer tracer.(*PingClient).Close()
+		for _, stage := range pipeline {
+			if aw, ok := stage.(*AnycastWatcher); ok {
+				go aw.Trace(ctx, tracer.(*PingClient), pf.resultTarget(fs.Arg(0)), *anycastTrace)
+			}
+		}
+	}
+
+	// MAIN LOOP
+	// Continuously probes the server until ctrl-c is entered
+	runner := &Runner{
+		Prober:   prober,
+		Interval: pf.interval,
+		Jitter:   float64(pf.jitter),
+		Clock:    clock,
+		Handle:   pipeline.Handle,
+		Count:    *count,
+		Retry:    pf.retry(),
+	}
+	if *confirmLimit {
+		interval := runner.Interval
+		policer.Slow = func(slow bool) {
+			runner.Interval = interval
+			if slow {
+				runner.Interval *= policerSlowdown
+			}
+		}
+	}
+	if pf.pps > 0 {
+		// send at the given rate without waiting for replies, the bucket
+		// holds a single token so the rate is never exceeded
+		runner.Limiter = NewTokenBucket(pf.pps, 1, clock)
+		runner.Overlap = true
+		runner.Handle = pipeline.Sync()
+		if !isSet(fs, "i") {
+			runner.Interval = 0
+		}
+	}
+	err = runner.Run(ctx)
+	if bar != nil {
+		bar.Stop()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *untilDown > 0 {
+		if down == nil {
+			fmt.Fprintln(pf.status(), "stopped before the host went down")
+			return 1
+		}
+		fmt.Fprintf(pf.status(), "%s is DOWN, no reply for %v\n", fs.Arg(0), *untilDown)
+		if *downRun != "" {
+			if err := (&Hook{Command: *downRun}).exec(*down, "down"); err != nil {
+				fmt.Fprintln(pf.status(), "running -until-down-run:", err)
+				return 1
+			}
+		}
+		return 0
+	}
+	sum := stats.Snapshot()
+	sum.Hops = hopCount
+	sum.Fprint(pf.status(), "Ping Statistics")
+	overhead.Fprint(pf.status(), *showOverhead)
+	overhead.FprintDrops(pf.status())
+	if policer != nil {
+		policer.Fprint(pf.status())
+	}
+	target := targetJSON{Target: pf.resultTarget(fs.Arg(0)), Stats: sum}
+	switch {
+	case routing != nil:
+		if info, err := routing.Wait(); err != nil {
+			fmt.Fprintln(pf.status(), "bgp: looking it up:", err)
+		} else {
+			fmt.Fprintln(pf.status(), "bgp:", info)
+			target.BGP = &info
+		}
+	case *bgp && client != nil:
+		fmt.Fprintf(pf.status(), "bgp: %s isn't routed on the internet\n", client.IPAddr)
+	}
+	code := 0
+	failure := sum.check(*maxLoss, *maxRTT)
+	if failed {
+		failure = fmt.Errorf("FAIL: %d probes in a row got no reply, stopped by -max-consecutive-fail", *maxFails)
+		code = exitConsecutiveFail
+	} else if failure != nil {
+		code = 1
+	}
+	if failure != nil {
+		fmt.Fprintln(pf.status(), failure)
+	}
+	pf.printSummary("ping", []targetJSON{target}, failure)
+	return code
+}
+
+// exit code of runs stopped by -max-consecutive-fail, for scripts to tell
+// from other failures
+const exitConsecutiveFail = 3
+
+// failStreak returns a Stage calling stop once n probes in a row got no
+// reply
+func failStreak(n int, stop func()) Stage {
+	streak := 0
+	return StageFunc(func(r *Result) bool {
+		switch {
+		case r.Kind == KindReply:
+			streak = 0
+		case !r.Kind.extra():
+			streak++
+			if streak == n {
+				stop()
+			}
+		}
+		return true
+	})
+}
+
+// downWatch returns a Stage calling down with the result that shows the
+// host hasn't answered for window by clock, once. That's measured from when
+// the first unanswered probe since the last reply was sent, not from the
+// reply, so a long interval between probes isn't taken for the host being
+// down.
+func downWatch(window time.Duration, clock Clock, down func(Result)) Stage {
+	var unanswered time.Time // send time of the first probe since the last reply, zero after a reply
+	fired := false
+	return StageFunc(func(r *Result) bool {
+		switch {
+		case r.Kind == KindReply:
+			unanswered = time.Time{}
+			return true
+		case r.Kind.extra() || fired:
+			return true
+		case unanswered.IsZero():
+			unanswered = r.Time
+		}
+		if clock.Since(unanswered) >= window {
+			fired = true
+			d := *r
+			d.Kind = KindDown
+			down(d)
+		}
+		return true
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDownWatch(t *testing.T) {
+	clock := newFakeClock()
+	var down []Result
+	watch := downWatch(30*time.Second, clock, func(r Result) { down = append(down, r) })
+
+	// probes a minute apart that time out after 5s
+	probe := func(seq int, kind Kind) {
+		r := Result{Seq: seq, Kind: kind, Time: clock.Now()}
+		if kind == KindTimeout {
+			clock.Advance(5 * time.Second)
+		}
+		watch.Process(&r)
+		clock.Advance(time.Minute - 5*time.Second)
+	}
+
+	probe(0, KindReply)
+	probe(1, KindTimeout)
+	if len(down) != 0 {
+		t.Fatalf("down after one lost probe: %+v", down)
+	}
+	probe(2, KindReply)
+	probe(3, KindTimeout)
+	probe(4, KindTimeout)
+	probe(5, KindTimeout)
+	if len(down) != 1 || down[0].Seq != 4 || down[0].Kind != KindDown {
+		t.Errorf("got %+v, want down once at seq 4", down)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// how a DF probe of some size went
+type pmtuOutcome int
+
+const (
+	pmtuFits     pmtuOutcome = iota // answered
+	pmtuTooBig                      // refused with fragmentation needed
+	pmtuVanished                    // no answer and no error, the black hole signature
+)
+
+// find the path MTU to a host by probing with DF set, and tell a path that
+// refuses packets too big for it from a black hole that drops them without
+// a word, which stalls TCP connections once they send full sized packets
+func runPMTU(args []string) int {
+	fs := newFlagSet(lookupCommand("pmtu"))
+	tries := fs.Int("c", 2, "Probes of each size before it's taken as not getting through")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if *tries < 1 {
+		fmt.Println("-c must be at least 1")
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+
+	addr, err := resolveIPAddr("ip", fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	mtu, dev, err := routeMTU(addr)
+	if err != nil {
+		fmt.Println("finding the interface MTU:", err)
+		return 1
+	}
+	// sizes are of whole packets, like MTUs, the IP and ICMP headers come
+	// off for the body
+	headers := 20 + 8
+	if addr.IP.To4() == nil {
+		headers = 40 + 8
+	}
+	mtu = min(mtu, MaxSize+28)
+
+	client, err := New(addr.String(), WithTimeout(*timeout), WithFragmentation(FragDeny))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("PMTU %s (%s) via %s mtu %d\n", fs.Arg(0), addr, dev, mtu)
+	var from string // router that reported fragmentation needed
+	probe := func(size int) (pmtuOutcome, int, error) {
+		client.SetSize(size - headers)
+		for n := 0; n < *tries; n++ {
+			res, err := client.Probe(ctx)
+			if ctx.Err() != nil {
+				return 0, 0, ctx.Err()
+			}
+			var me *MTUError
+			switch {
+			case errors.Is(err, ErrPermission):
+				return 0, 0, err
+			case err == nil && res.Kind == KindReply:
+				fmt.Printf("%6d bytes  fits\n", size)
+				return pmtuFits, 0, nil
+			case errors.As(err, &me):
+				from = res.Addr
+				fmt.Printf("%6d bytes  too big, fragmentation needed from %s, mtu %d\n", size, res.Addr, me.MTU)
+				return pmtuTooBig, me.MTU, nil
+			case errors.Is(err, ErrFragNeeded):
+				// refused by this host, knowing the path MTU from before
+				fmt.Printf("%6d bytes  too big for the path MTU this host knows of\n", size)
+				return pmtuTooBig, 0, nil
+			}
+		}
+		fmt.Printf("%6d bytes  vanished\n", size)
+		return pmtuVanished, 0, nil
+	}
+
+	// the interface MTU first, which replies are read into a buffer sized
+	// for, then the smallest size has to get through for the rest to mean
+	// anything
+	full, hint, err := probe(mtu)
+	if err != nil {
+		return pmtuFailed(err)
+	}
+	if full == pmtuFits {
+		fmt.Printf("\npath MTU %d, the interface MTU, no black hole\n", mtu)
+		return 0
+	}
+	lo, hi := headers+DefaultSize, mtu-1
+	small, _, err := probe(lo)
+	if err != nil {
+		return pmtuFailed(err)
+	}
+	if small != pmtuFits {
+		fmt.Println("\nno replies to small probes, the host can't be tested")
+		return 1
+	}
+
+	// binary search for the biggest size that fits, trying what routers
+	// report first, nothing bigger gets past them. lo fits, hi+1 doesn't.
+	vanished, refused := 0, 0
+	count := func(outcome pmtuOutcome) {
+		switch outcome {
+		case pmtuTooBig:
+			refused++
+		case pmtuVanished:
+			vanished++
+		}
+	}
+	count(full)
+	for lo < hi {
+		if hint > 0 {
+			hi = max(min(hi, hint), lo)
+		}
+		next := lo + (hi-lo+1)/2
+		if hint > lo && hint <= hi {
+			next = hint
+		}
+		var outcome pmtuOutcome
+		outcome, hint, err = probe(next)
+		if err != nil {
+			return pmtuFailed(err)
+		}
+		count(outcome)
+		if outcome == pmtuFits {
+			lo = next
+		} else {
+			hi = next - 1
+		}
+	}
+
+	fmt.Println()
+	switch {
+	case vanished > 0 && refused == 0:
+		fmt.Printf("MTU black hole: DF packets of up to %d bytes get through, bigger ones vanish without a fragmentation needed error.\n", lo)
+		fmt.Printf("Something on the path has an MTU of %d and doesn't say so, or its errors are filtered, so TCP connections stall once they send full sized packets. Lower the MTU of %s to %d, or clamp the TCP MSS.\n", lo, dev, lo)
+		return 1
+	case from != "":
+		fmt.Printf("path MTU %d, reported by %s, path MTU discovery works\n", lo, from)
+	default:
+		fmt.Printf("path MTU %d\n", lo)
+	}
+	return 0
+}
+
+// print why pmtu stopped early
+func pmtuFailed(err error) int {
+	if !errors.Is(err, context.Canceled) {
+		fmt.Println(err)
+	}
+	return 1
+}
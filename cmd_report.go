@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// summarize results saved with -o json, read from files or stdin
+func runReport(args []string) int {
+	if len(args) > 0 && args[0] == "sla" {
+		return runReportSLA(args[1:])
+	}
+
+	fs := newFlagSet(lookupCommand("report"))
+	chartPath := fs.String("chart", "", "Also draw RTT over time and lost probes of every target to this .png or .svg file")
+	parseFlags(fs, args)
+
+	stats := NewTargetStats(0)
+	chart := newRTTChart()
+	if !readResultFiles(fs.Args(), func(r Result) {
+		stats.Add(r)
+		chart.Add(r)
+	}) {
+		return 1
+	}
+	stats.Fprint(os.Stdout)
+
+	if *chartPath != "" {
+		if err := writeChart(chart, *chartPath); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// draw chart to the file at path
+func writeChart(chart *rttChart, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := chart.Write(f, path); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// report the uptime, outages and time to recover of every target
+func runReportSLA(args []string) int {
+	fs := newFlagSet(&command{name: "report sla", args: "[flags] [file...]", short: "report the uptime of every target in results saved with -o json"})
+	period := fs.String("period", "month", "Report uptime per day, month or all")
+	gap := fs.Duration("gap", DefaultSLAGap, "Don't count longer gaps between probes, the monitor wasn't running")
+	asJSON := fs.Bool("json", false, "Write the report as JSON")
+	parseFlags(fs, args)
+
+	sla, err := NewSLATracker(*period, *gap)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !readResultFiles(fs.Args(), func(r Result) { sla.Process(&r) }) {
+		return 1
+	}
+
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(sla.Snapshot())
+	} else {
+		sla.Fprint(os.Stdout)
+	}
+	return 0
+}
+
+// read results from every file in paths, or stdin if there are none,
+// printing any error
+func readResultFiles(paths []string, fn func(Result)) bool {
+	if len(paths) == 0 {
+		if err := readResults(os.Stdin, fn); err != nil {
+			fmt.Println(err)
+			return false
+		}
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		err = readResults(f, fn)
+		f.Close()
+		if err != nil {
+			fmt.Printf("%s: %v\n", path, err)
+			return false
+		}
+	}
+	return true
+}
+
+// decode a stream of JSON results, calling fn for each
+func readResults(r io.Reader, fn func(Result)) error {
+	dec := json.NewDecoder(r)
+	for {
+		var res Result
+		err := dec.Decode(&res)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(res)
+	}
+}
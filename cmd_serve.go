@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how often serve -state saves, a crash loses at most this much
+const stateInterval = time.Minute
+
+// continuously probe several hosts at once, printing every result
+func runServe(args []string) int {
+	var pf probeFlags
+	fs := newFlagSet(lookupCommand("serve"))
+	pf.register(fs)
+	pf.registerEvents(fs)
+	pf.registerSummary(fs)
+	file := fs.String("f", "", "Read targets from file, one per line")
+	config := fs.String("config", "", "Read targets, and when to probe them, from a JSON file")
+	metrics := fs.Duration("metrics", 0, "Log scheduler metrics this often, 0 to not")
+	addr := fs.String("http", "", "Serve the HTTP API on this address, e.g. localhost:8080")
+	controller := fs.String("report", "", "Also send results to the controller, a serve -http, at this URL")
+	agent := fs.String("agent", hostname(), "Name to report results to the controller under")
+	tokensPath := fs.String("api-tokens", "", "Require the API tokens in this file, with what each allows")
+	tlsCert := fs.String("tls-cert", "", "Serve the API over HTTPS with this certificate")
+	tlsKey := fs.String("tls-key", "", "Key of -tls-cert")
+	tlsClientCA := fs.String("tls-client-ca", "", "Require API clients to have a certificate signed by these CAs")
+	reportToken := fs.String("report-token", "", "API token to report to the controller with")
+	reportCert := fs.String("report-cert", "", "Client certificate to report to the controller with")
+	reportKey := fs.String("report-key", "", "Key of -report-cert")
+	reportCA := fs.String("report-ca", "", "Trust these CAs for the controller rather than the system's")
+	pprofAddr := fs.String("pprof", "", "Serve runtime profiles (net/http/pprof) on this loopback address, e.g. localhost:6060, to profile serve itself")
+	sockets := fs.Int("sockets", 1, "Spread probes over this many ICMP sockets per address family, each read on its own CPU, when one can't keep up with the rate")
+	statePath := fs.String("state", "", "Keep statistics, uptime and target states in this file across restarts")
+	parseFlags(fs, args)
+
+	if err := pf.validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *sockets < 1 {
+		fmt.Println("-sockets must be at least 1")
+		return 1
+	}
+	pf.fallBack(pf.status())
+
+	var targets []targetConfig
+	for _, target := range fs.Args() {
+		targets = append(targets, targetConfig{Target: target})
+	}
+	if *file != "" {
+		lines, err := readTargets(*file)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, target := range lines {
+			targets = append(targets, targetConfig{Target: target})
+		}
+	}
+	var configTargets []targetConfig
+	var configGroups map[string]groupConfig
+	if *config != "" {
+		c, err := loadConfig(*config)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		configTargets, configGroups = c.Targets, c.Groups
+	}
+	if len(targets) == 0 && len(configTargets) == 0 && *addr == "" {
+		fmt.Println("no targets to monitor")
+		return 1
+	}
+
+	var tokens apiTokens
+	if *tokensPath != "" {
+		var err error
+		if tokens, err = loadTokens(*tokensPath); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	var serverConfig, reportConfig *tls.Config
+	if *tlsCert != "" {
+		var err error
+		if serverConfig, err = serverTLS(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	} else if *tlsClientCA != "" {
+		fmt.Println("-tls-client-ca needs -tls-cert")
+		return 1
+	}
+	if *controller != "" {
+		var err error
+		if reportConfig, err = clientTLS(*reportCert, *reportKey, *reportCA); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	stats := NewTargetStats(pf.payload())
+	sched := &Scheduler{Jitter: float64(pf.jitter), Retry: pf.retry()}
+	if pf.pps > 0 {
+		sched.Limiter = NewTokenBucket(pf.pps, 1, SystemClock)
+	}
+
+	// every icmp target shares one socket per address family, or -sockets,
+	// each with its own identifier so even duplicate targets get their own
+	// replies
+	mux := NewMux()
+	mux.Shards = *sockets
+	defer mux.Close()
+
+	alerts := newAlerter("target")
+	groups := newGroupTracker(pf.payload())
+	groups.SetThresholds(configGroups)
+	nextID := os.Getpid()
+	start := func(tc targetConfig) (int, error) {
+		window, err := tc.window()
+		if err != nil {
+			return 0, err
+		}
+		tpf := tc.flags(pf)
+		if tpf.mode != pf.mode {
+			tpf.fallBack(io.Discard)
+		}
+		prober, desc, err := tpf.newProber(tc.Target, WithMux(mux), WithID(nextID))
+		if err != nil {
+			return 0, err
+		}
+		nextID++
+		if tc.Schedule != "" {
+			desc += fmt.Sprintf(" when %q", tc.Schedule)
+		}
+		fmt.Fprintf(pf.status(), "MONITOR %s\n", desc)
+
+		target := tpf.resultTarget(tc.Target)
+		if tpf.payload() != pf.payload() {
+			stats.Track(target, tpf.payload())
+		}
+		alerts.Set(target, tc.thresholds())
+		groups.Join(target, tc.Group)
+		return sched.AddWindowed(prober, tpf.interval, window), nil
+	}
+	sla, _ := NewSLATracker("month", DefaultSLAGap)
+	api := newServeAPI(sched, stats, alerts, sla, start)
+	api.tokens = tokens
+	api.groups = groups
+	// groups first to tag results before they're sent on
+	sinks := []Stage{groups, StatsSink(stats), alerts, sla, &api.hub}
+	if *controller != "" {
+		reporter := newAgentReporter(*controller, *agent, *reportToken, reportConfig)
+		api.reporter = reporter
+		sinks = append(sinks, reporter)
+		done := make(chan struct{})
+		go func() {
+			reporter.run(ctx)
+			close(done)
+		}()
+		// send the last results before exiting
+		defer func() {
+			stop()
+			<-done
+		}()
+	}
+	pipeline := pf.output(pf.results(), sinks...)
+	defer pf.closeHooks()
+	sched.Handle = pipeline.Handle
+
+	for _, tc := range targets {
+		id, err := start(tc)
+		if err != nil {
+			logger.Error("skipping target", "target", tc.Target, "err", err)
+			continue
+		}
+		api.track(tc.Target, id)
+	}
+	api.configPath = *config
+	api.reload(configTargets)
+	if *config != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(hup)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					if err := api.reloadConfig(); err != nil {
+						logger.Error("reloading config", "err", err)
+					}
+				}
+			}
+		}()
+	}
+
+	// state is loaded after the targets are started, alerts only restore
+	// targets with thresholds
+	persist := []persistent{stats, sla, alerts, groups}
+	for _, stage := range pipeline {
+		if p, ok := stage.(persistent); ok {
+			persist = append(persist, p)
+		}
+	}
+	if *statePath != "" {
+		saved, err := loadState(*statePath, persist)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if !saved.IsZero() {
+			fmt.Fprintf(pf.status(), "RESTORED state saved %s\n", saved.Format(time.RFC3339))
+		}
+		go func() {
+			ticker := time.NewTicker(stateInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := saveState(*statePath, persist); err != nil {
+						logger.Error("saving state", "path", *statePath, "err", err)
+					}
+				}
+			}
+		}()
+	}
+
+	if *pprofAddr != "" {
+		srv, at, err := servePprof(*pprofAddr)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer srv.Close()
+		fmt.Fprintf(pf.status(), "profiles at http://%s/debug/pprof/\n", at)
+	}
+
+	if *addr != "" {
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		scheme := "http"
+		if serverConfig != nil {
+			ln = tls.NewListener(ln, serverConfig)
+			scheme = "https"
+		}
+		if tokens == nil && serverConfig == nil && !isLoopback(ln.Addr()) {
+			logger.Warn("API open to anyone who can reach it, see -api-tokens and -tls-client-ca", "addr", ln.Addr())
+		}
+		srv := &http.Server{Handler: api.handler()}
+		go srv.Serve(ln)
+		defer srv.Close()
+		fmt.Fprintf(pf.status(), "API listening on %s://%s\n", scheme, ln.Addr())
+	}
+
+	if *metrics > 0 {
+		go func() {
+			ticker := time.NewTicker(*metrics)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					sched.Metrics.Log()
+				}
+			}
+		}()
+	}
+
+	if err := sched.Run(ctx); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if *statePath != "" {
+		if err := saveState(*statePath, persist); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	stats.Fprint(pf.status())
+	groups.Fprint(pf.status())
+	overhead.FprintDrops(pf.status())
+	summary := []targetJSON{}
+	for _, target := range stats.Targets() {
+		summary = append(summary, targetJSON{Target: target, Stats: stats.Get(target).Snapshot()})
+	}
+	pf.printSummary("serve", summary, nil)
+	return 0
+}
+
+// report whether addr only accepts connections from this machine
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return ok && tcp.IP.IsLoopback()
+}
+
+// the name of this machine, for -agent
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "agent"
+	}
+	return name
+}
+
+// read targets from a file, one per line, ignoring blank lines and # comments
+func readTargets(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		targets = append(targets, line)
+	}
+	return targets, scanner.Err()
+}
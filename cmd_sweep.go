@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+)
+
+const (
+	sweepMaxHosts = 1 << 16 // largest network sweep will scan
+	sweepParallel = 64      // default probes in flight at once
+)
+
+// ping every address in a network, or every target in a file, once and
+// report the ones that answer
+func runSweep(args []string) int {
+	fs := newFlagSet(lookupCommand("sweep"))
+	size := fs.Int("s", DefaultSize, "Size (in bytes) of ping message")
+	timeout := fs.Duration("W", time.Second, "Time to wait for a reply")
+	file := fs.String("f", "", "Read targets from file, one per line")
+	parallel := fs.Int("parallel", sweepParallel, "Max probes in flight at once")
+	pps := fs.Float64("pps", 0, "Send at most this many probes per second across all workers, 0 for no limit")
+	sockets := fs.Int("sockets", 1, "Spread probes over this many ICMP sockets per address family, each read on its own CPU, when one can't keep up with the rate")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	if *parallel < 1 {
+		fmt.Println("-parallel must be at least 1")
+		return 1
+	}
+	if *sockets < 1 {
+		fmt.Println("-sockets must be at least 1")
+		return 1
+	}
+	if *pps < 0 {
+		fmt.Println("-pps must not be negative")
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+
+	var feed func(ctx context.Context, jobs chan<- string)
+	switch {
+	case fs.NArg() > 0:
+		prefix, err := netip.ParsePrefix(fs.Arg(0))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		prefix = prefix.Masked()
+
+		hostBits := prefix.Addr().BitLen() - prefix.Bits()
+		if hostBits > 16 {
+			fmt.Printf("%s has more than %d addresses\n", prefix, sweepMaxHosts)
+			return 1
+		}
+		fmt.Printf("SWEEP %s\n", prefix)
+		feed = func(ctx context.Context, jobs chan<- string) {
+			for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+				if !isNetworkOrBroadcast(prefix, addr) && !enqueue(ctx, jobs, addr.String()) {
+					return
+				}
+			}
+		}
+	case *file != "":
+		targets, err := readTargets(*file)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("SWEEP %s (%d targets)\n", *file, len(targets))
+		feed = func(ctx context.Context, jobs chan<- string) {
+			for _, target := range targets {
+				if !enqueue(ctx, jobs, target) {
+					return
+				}
+			}
+		}
+	default:
+		fmt.Println("missing network, e.g. 192.168.1.0/24, or -f file")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// all addresses share one socket, or -sockets
+	mux := NewMux()
+	mux.Shards = *sockets
+	defer mux.Close()
+
+	var mu sync.Mutex // guards up, total and denied
+	var denied error
+	up, total := 0, 0
+
+	// a fixed pool of workers takes targets from jobs, which only has room
+	// for as many as there are workers, so at most parallel probes (and
+	// sockets, memory and NAT entries for them) are in use at once
+	jobs := make(chan string, *parallel)
+	// and with -pps, all of them share one rate
+	var limiter RateLimiter
+	if *pps > 0 {
+		limiter = NewTokenBucket(*pps, 1, SystemClock)
+	}
+	var wg sync.WaitGroup
+	for i := range *parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every worker has its own identifier, so a target listed twice
+			// doesn't get the other worker's replies
+			id := os.Getpid() + i
+			for target := range jobs {
+				if limiter != nil && limiter.Wait(ctx) != nil {
+					// interrupted waiting for a token, drain what's queued
+					continue
+				}
+				res, err := sweepOne(ctx, mux, target, id, *size, *timeout)
+				if ctx.Err() != nil && res.Kind != KindReply {
+					// interrupted, the target wasn't really probed
+					continue
+				}
+
+				mu.Lock()
+				total++
+				if errors.Is(err, ErrPermission) {
+					denied = err
+					stop()
+				}
+				if res.Kind == KindReply {
+					up++
+					fmt.Printf("%s is alive (%.1f ms)\n", target, res.RTT.Seconds()*1e3)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	feed(ctx, jobs)
+	close(jobs)
+	wg.Wait()
+
+	if denied != nil {
+		fmt.Println(denied)
+		return 1
+	}
+	fmt.Printf("\n%d of %d hosts up\n", up, total)
+	return 0
+}
+
+// ping a single sweep target once
+func sweepOne(ctx context.Context, mux *Mux, target string, id, size int, timeout time.Duration) (Result, error) {
+	if ctx.Err() != nil {
+		return Result{}, ctx.Err()
+	}
+	client, err := New(target, WithSize(size), WithTimeout(timeout), WithMux(mux), WithID(id))
+	if err != nil {
+		logger.Warn("skipping target", "target", target, "err", err)
+		return Result{}, err
+	}
+	defer client.Close()
+	return client.Probe(ctx)
+}
+
+// hand a target to the workers, waiting for one to be free. Returns false
+// once the sweep is interrupted.
+func enqueue(ctx context.Context, jobs chan<- string, target string) bool {
+	select {
+	case jobs <- target:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// the first and last address of IPv4 networks larger than /31 aren't hosts
+func isNetworkOrBroadcast(prefix netip.Prefix, addr netip.Addr) bool {
+	if !addr.Is4() || prefix.Bits() >= 31 {
+		return false
+	}
+	return addr == prefix.Addr() || !prefix.Contains(addr.Next())
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"time"
+)
+
+const (
+	traceMaxTTL  = 30 // give up after this many hops
+	traceQueries = 3  // probes sent per hop
+	maxQueries   = 10 // most probes -queries sends per hop
+)
+
+// print the route to a host by sending probes with increasing TTLs
+func runTrace(args []string) int {
+	fs := newFlagSet(lookupCommand("trace"))
+	mode := fs.String("m", "icmp", "Probe with icmp echo requests, tcp SYNs to -p where those are filtered, or udp datagrams to ports up from -p like classic traceroute")
+	port := fs.Int("p", 0, fmt.Sprintf("Port to send tcp SYNs to, or the first of the udp probes, 80 and %d if 0", udpTraceBasePort))
+	size := fs.Int("s", DefaultSize, "Size (in bytes) of ping message")
+	timeout := fs.Duration("W", 2*time.Second, "Time to wait for a reply")
+	ecnFlag := fs.String("ecn", "", "Mark probes ECN capable with ect0 or ect1, and show the codepoint each hop got them with")
+	mark := fs.Int("fwmark", 0, "Firewall mark (SO_MARK) of probes for policy routing, 0 for none (Linux only)")
+	vrf := fs.String("vrf", "", "Send probes through this VRF device, or any other network device (Linux only)")
+	firstTTL := fs.Int("first-ttl", 1, "Start at this hop, e.g. to skip the local network")
+	maxTTL := fs.Int("max-ttl", traceMaxTTL, "Give up after this many hops")
+	queries := fs.Int("queries", traceQueries, "Probes sent per hop")
+	parallel := fs.Bool("parallel", false, fmt.Sprintf("Probe all hops at once, up to %d probes, rather than one hop after another; quicker, but routers that rate limit their answers show as * more often", traceBatch))
+	rounds := fs.Int("loss", 0, "After the trace, probe every hop and the host this many rounds, or until interrupted, and say at which hop loss starts")
+	registerNetns(fs)
+	parseFlags(fs, args)
+
+	ecn, err := parseECN(*ecnFlag)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if *mode != "icmp" && *mode != "tcp" && *mode != "udp" {
+		fmt.Printf("invalid -m %q, must be icmp, tcp or udp\n", *mode)
+		return 1
+	}
+	if *mode != "icmp" && (isSet(fs, "s") || ecn != "") {
+		fmt.Println("-s and -ecn need -m icmp")
+		return 1
+	}
+	if *port == 0 {
+		*port = 80
+		if *mode == "udp" {
+			*port = udpTraceBasePort
+		}
+	}
+	if *port < 1 || *port > 0xffff {
+		fmt.Printf("invalid port %d\n", *port)
+		return 1
+	}
+	if *maxTTL < 1 || *maxTTL > 255 {
+		fmt.Printf("invalid -max-ttl %d, must be between 1 and 255\n", *maxTTL)
+		return 1
+	}
+	if *firstTTL < 1 || *firstTTL > *maxTTL {
+		fmt.Printf("invalid -first-ttl %d, must be between 1 and -max-ttl\n", *firstTTL)
+		return 1
+	}
+	if *queries < 1 || *queries > maxQueries {
+		fmt.Printf("invalid -queries %d, must be between 1 and %d\n", *queries, maxQueries)
+		return 1
+	}
+	if *rounds < 0 {
+		fmt.Println("-loss can't be negative")
+		return 1
+	}
+	if fs.NArg() == 0 {
+		fmt.Println("mising hostname")
+		return 1
+	}
+	if icmpUnavailable(os.Stdout) {
+		return 1
+	}
+	// Linux doesn't pass ICMP errors to datagram sockets
+	if access, _ := detectICMP(); access == accessDgram && runtime.GOOS == "linux" {
+		fmt.Println("trace needs raw sockets on Linux")
+		return 1
+	}
+
+	var client hopProber
+	switch *mode {
+	case "udp":
+		tracer, err := NewUDPTracer(fs.Arg(0), *port, *timeout)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer tracer.Close()
+		tracer.Control = (&probeFlags{mark: *mark, vrf: *vrf}).control()
+		fmt.Printf("traceroute to %s (%s), %d hops max, udp ports from %d\n", fs.Arg(0), tracer.IPAddr, *maxTTL, *port)
+		client = tracer
+	case "tcp":
+		tracer, err := NewTCPTracer(fs.Arg(0), *port, *timeout)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer tracer.Close()
+		tracer.Control = (&probeFlags{mark: *mark, vrf: *vrf}).control()
+		fmt.Printf("traceroute to %s (%s), %d hops max, tcp port %d\n", fs.Arg(0), tracer.IPAddr, *maxTTL, *port)
+		client = tracer
+	default:
+		pc, err := New(fs.Arg(0), WithSize(*size), WithTimeout(*timeout), WithTTL(1), WithECN(ecn), WithMark(*mark), WithVRF(*vrf))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer pc.Close()
+		fmt.Printf("traceroute to %s (%s), %d hops max\n", fs.Arg(0), pc.IPAddr, *maxTTL)
+		client = pc
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var hops []Hop
+	if *parallel {
+		hops = traceParallel(ctx, client, *firstTTL, *maxTTL, *queries)
+		if ctx.Err() != nil {
+			return 1
+		}
+		for _, hop := range hops {
+			for _, r := range hop.Results {
+				if errors.Is(r.Err, ErrPermission) {
+					fmt.Println(r.Err)
+					return 1
+				}
+			}
+			fmt.Println(hop)
+		}
+	} else {
+		for ttl := *firstTTL; ttl <= *maxTTL; ttl++ {
+			if err := client.SetTTL(ttl); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+
+			hop := Hop{TTL: ttl}
+			for q := 0; q < *queries; q++ {
+				res, err := client.Probe(ctx)
+				if ctx.Err() != nil {
+					return 1
+				}
+				if errors.Is(err, ErrPermission) {
+					fmt.Println(err)
+					return 1
+				}
+				hop.Results = append(hop.Results, res)
+			}
+
+			fmt.Println(hop)
+			hops = append(hops, hop)
+			if hop.Reached() {
+				break
+			}
+		}
+	}
+	if *rounds == 0 {
+		return 0
+	}
+
+	// end to end probes go out with the usual TTL
+	if err := client.SetTTL(DefaultTTL); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Printf("\nprobing %d hops and the host, %d rounds\n", len(hops), *rounds)
+	ctx, stop = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	counts, e2e := measureHopLoss(ctx, client, hops, *rounds)
+	for _, h := range append(counts, e2e) {
+		fmt.Printf("%2d  %-15s  %3d/%-3d lost  %5.1f%%\n", h.TTL, h.Addr, h.Lost, h.Sent, h.loss())
+	}
+	fmt.Println()
+	for _, line := range attributeLoss(counts, e2e) {
+		fmt.Println(line)
+	}
+	return 0
+}
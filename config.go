@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// serveConfig is the JSON file serve reads targets from with -config:
+//
+//	{
+//	  "defaults": {"interval": "5s", "max_loss": 20},
+//	  "groups": {"dns-servers": {"max_loss": 5}},
+//	  "targets": [
+//	    {"target": "www.google.com"},
+//	    {"target": "9.9.9.9", "mode": "dns", "group": "dns-servers"},
+//	    {"target": "8.8.8.8", "mode": "dns", "group": "dns-servers"},
+//	    {"target": "intranet.example.com", "schedule": "* 9-17 * * mon-fri"},
+//	    {"target": "1.1.1.1", "schedule": "@hourly", "window": "5m"},
+//	    {"target": "example.com", "mode": "http", "timeout": "3s", "max_rtt": "500ms"}
+//	  ]
+//	}
+//
+// Settings left out of a target come from defaults, and those left out of
+// defaults from the command line. Targets in a group are also reported on
+// together, alerting on the group's own thresholds.
+type serveConfig struct {
+	Defaults targetConfig           `json:"defaults"`
+	Groups   map[string]groupConfig `json:"groups"`
+	Targets  []targetConfig         `json:"targets"`
+}
+
+// targetConfig is a target of serve and how to probe it
+type targetConfig struct {
+	Target string `json:"target"`
+	Group  string `json:"group,omitempty"` // reported on with the other targets in it
+
+	// cron expression of when to probe, always if empty. Probing goes on
+	// for Window from every time it matches, a minute by default.
+	Schedule string       `json:"schedule,omitempty"`
+	Window   jsonDuration `json:"window,omitempty"`
+
+	// how to probe, the command line flags when not set
+	Mode     string       `json:"mode,omitempty"`
+	Port     int          `json:"port,omitempty"`
+	Size     *int         `json:"size,omitempty"` // 0 is a valid size
+	Interval jsonDuration `json:"interval,omitempty"`
+	Timeout  jsonDuration `json:"timeout,omitempty"`
+
+	// alert when over these over the last alertWindow probes, never if zero
+	MaxLoss float64      `json:"max_loss,omitempty"` // percent
+	MaxRTT  jsonDuration `json:"max_rtt,omitempty"`  // average
+}
+
+// jsonDuration is a time.Duration written as a string like "5m" in JSON
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// read and check a serve config file
+func loadConfig(path string) (*serveConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c serveConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for group, gc := range c.Groups {
+		if group == "" {
+			return nil, fmt.Errorf("%s: group without a name", path)
+		}
+		if gc.MaxRTT < 0 || gc.MaxLoss < 0 || gc.MaxLoss > 100 {
+			return nil, fmt.Errorf("%s: group %s: invalid thresholds", path, group)
+		}
+	}
+	for i, tc := range c.Targets {
+		c.Targets[i] = tc.withDefaults(c.Defaults)
+		if err := c.Targets[i].check(); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return &c, nil
+}
+
+// check the target's settings
+func (tc targetConfig) check() error {
+	if tc.Target == "" {
+		return fmt.Errorf("target without an address")
+	}
+	if tc.Window < 0 || tc.Interval < 0 || tc.Timeout < 0 || tc.MaxRTT < 0 {
+		return fmt.Errorf("%s: negative duration", tc.Target)
+	}
+	if tc.MaxLoss < 0 || tc.MaxLoss > 100 {
+		return fmt.Errorf("%s: invalid max_loss %v, must be between 0 and 100", tc.Target, tc.MaxLoss)
+	}
+	if tc.Port < 0 || tc.Port > 65535 {
+		return fmt.Errorf("%s: invalid port %d", tc.Target, tc.Port)
+	}
+	switch tc.Mode {
+	case "", "icmp", "tcp", "http", "dns":
+	default:
+		return fmt.Errorf("%s: unknown mode %q", tc.Target, tc.Mode)
+	}
+	if tc.Size != nil && (*tc.Size < 0 || *tc.Size > MaxSize) {
+		return fmt.Errorf("%s: invalid size %d, must be between 0 and %d", tc.Target, *tc.Size, MaxSize)
+	}
+	if _, err := tc.window(); err != nil {
+		return fmt.Errorf("%s: %w", tc.Target, err)
+	}
+	return nil
+}
+
+// window returns when to probe the target, nil for always
+func (tc targetConfig) window() (Window, error) {
+	if tc.Schedule == "" {
+		return nil, nil
+	}
+	spec, err := parseCron(tc.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	length := time.Duration(tc.Window)
+	if length == 0 {
+		length = time.Minute
+	}
+	return cronWindow{spec: spec, length: length}, nil
+}
+
+// withDefaults returns tc with the settings it leaves out taken from d
+func (tc targetConfig) withDefaults(d targetConfig) targetConfig {
+	if tc.Group == "" {
+		tc.Group = d.Group
+	}
+	if tc.Schedule == "" {
+		tc.Schedule = d.Schedule
+	}
+	if tc.Window == 0 {
+		tc.Window = d.Window
+	}
+	if tc.Mode == "" {
+		tc.Mode = d.Mode
+	}
+	if tc.Port == 0 {
+		tc.Port = d.Port
+	}
+	if tc.Size == nil {
+		tc.Size = d.Size
+	}
+	if tc.Interval == 0 {
+		tc.Interval = d.Interval
+	}
+	if tc.Timeout == 0 {
+		tc.Timeout = d.Timeout
+	}
+	if tc.MaxLoss == 0 {
+		tc.MaxLoss = d.MaxLoss
+	}
+	if tc.MaxRTT == 0 {
+		tc.MaxRTT = d.MaxRTT
+	}
+	return tc
+}
+
+// flags returns the probe flags of the target, pf with its settings applied
+func (tc targetConfig) flags(pf probeFlags) probeFlags {
+	if tc.Mode != "" {
+		pf.mode = tc.Mode
+	}
+	if tc.Port != 0 {
+		pf.port = tc.Port
+	}
+	if tc.Size != nil {
+		pf.size = *tc.Size
+	}
+	if tc.Interval != 0 {
+		pf.interval = time.Duration(tc.Interval)
+	}
+	if tc.Timeout != 0 {
+		pf.timeout = time.Duration(tc.Timeout)
+	}
+	return pf
+}
+
+// thresholds returns when to alert on the target
+func (tc targetConfig) thresholds() Thresholds {
+	return Thresholds{MaxLoss: tc.MaxLoss, MaxRTT: time.Duration(tc.MaxRTT)}
+}
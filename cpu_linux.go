@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// pinThread keeps the calling OS thread on cpu, see runtime.LockOSThread
+func pinThread(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
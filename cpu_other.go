@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// pinning threads to CPUs is only implemented on Linux
+func pinThread(cpu int) error {
+	return errors.New("pinning threads to CPUs is only supported on Linux")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed cron expression: minute, hour, day of month, month
+// and day of week, each a set of values as a bitmask
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+
+	domAny, dowAny bool // the day fields were *, see matchDay
+}
+
+// shorthands for common schedules
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDays   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a standard 5 field cron expression, e.g. "*/5 9-17 * *
+// mon-fri". Fields take *, numbers, ranges, steps and lists of those, and
+// months and days of the week also names.
+func parseCron(expr string) (*cronSpec, error) {
+	if m, ok := cronMacros[expr]; ok {
+		expr = m
+	}
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron expression %q needs 5 fields", expr)
+	}
+
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseCronField(f[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	// sunday is 0 or 7
+	if c.dow, err = parseCronField(f[4], 0, 7, cronDays); err != nil {
+		return nil, err
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = f[2] == "*", f[4] == "*"
+
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression %q never matches", expr)
+	}
+	return &c, nil
+}
+
+// parse a comma separated list of values, ranges and steps between min
+// and max. names, if given, are accepted for the values from min on.
+func parseCronField(s string, min, max int, names []string) (uint64, error) {
+	value := func(v string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(v, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid cron value %q, must be between %d and %d", v, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid cron step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			// a single value with a step runs to the end, like 5/15
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid cron range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// report whether the day of t matches. As in cron, when both day fields are
+// restricted either may match.
+func (c *cronSpec) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute at or after t the expression matches, zero
+// if it doesn't within 5 years (like February 30th)
+func (c *cronSpec) next(t time.Time) time.Time {
+	if r := t.Truncate(time.Minute); !r.Equal(t) {
+		t = r.Add(time.Minute)
+	}
+
+	// skip whole months, days and hours that don't match
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, mon, d := t.Date()
+		switch {
+		case c.month&(1<<int(mon)) == 0:
+			t = time.Date(y, mon+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(y, mon, d+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(y, mon, d, t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronWindow is a Window open for length from every time a cron expression
+// matches. With a length of a minute "* 9-17 * * mon-fri" is business hours,
+// with an hour "0 * * * *" is always open.
+type cronWindow struct {
+	spec   *cronSpec
+	length time.Duration
+}
+
+// Next returns t if the window is open at t, otherwise when it opens next
+func (w cronWindow) Next(t time.Time) time.Time {
+	// the first match in the last length, or the next one if there was none
+	m := w.spec.next(t.Add(-w.length + 1))
+	if !m.After(t) {
+		return t
+	}
+	return m
+}
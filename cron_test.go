@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// a Tuesday
+	at := func(day, hour, minute, sec int) time.Time {
+		return time.Date(2020, 4, day, hour, minute, sec, 0, time.UTC)
+	}
+	for _, tt := range []struct {
+		expr     string
+		from, to time.Time
+	}{
+		{"*/5 9-17 * * mon-fri", at(14, 12, 3, 0), at(14, 12, 5, 0)},
+		{"*/5 9-17 * * mon-fri", at(14, 12, 5, 0), at(14, 12, 5, 0)},
+		{"*/5 9-17 * * mon-fri", at(14, 12, 5, 1), at(14, 12, 10, 0)},
+		{"*/5 9-17 * * mon-fri", at(14, 17, 58, 0), at(15, 9, 0, 0)},
+		{"*/5 9-17 * * mon-fri", at(17, 18, 0, 0), at(20, 9, 0, 0)}, // friday evening
+		{"5/15 * * * *", at(14, 12, 6, 0), at(14, 12, 20, 0)},
+		{"0,30 * * * *", at(14, 12, 1, 0), at(14, 12, 30, 0)},
+		{"30 2 * * 7", at(14, 12, 0, 0), at(19, 2, 30, 0)},  // sunday as 7
+		{"0 0 13 * fri", at(14, 12, 0, 0), at(17, 0, 0, 0)}, // either day field
+		{"0 12 * jan,jul *", at(14, 12, 0, 0), time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)},
+		{"@daily", at(14, 12, 0, 30), at(15, 0, 0, 0)},
+		{"@yearly", at(14, 12, 0, 0), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(tt.from); !got.Equal(tt.to) {
+			t.Errorf("%q after %v: got %v, want %v", tt.expr, tt.from, got, tt.to)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"0 0 30 feb *", // never matches
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded", expr)
+		}
+	}
+}
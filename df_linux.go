@@ -0,0 +1,38 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment sets DF on every packet sent on c, so routers drop the
+// ones too big for a link and say so, or clears it so they're fragmented.
+// IPv6 routers never fragment, clearing it lets this host fragment packets
+// too big for the path.
+func setDontFragment(c syscall.Conn, ipv4, df bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv4 {
+			mode := unix.IP_PMTUDISC_DONT
+			if df {
+				mode = unix.IP_PMTUDISC_DO
+			}
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, mode)
+			return
+		}
+		mode := unix.IPV6_PMTUDISC_DONT
+		if df {
+			mode = unix.IPV6_PMTUDISC_DO
+		}
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, mode)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
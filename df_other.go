@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setting DF is only implemented on Linux
+func setDontFragment(c syscall.Conn, ipv4, df bool) error {
+	return errors.New("setting DF is only supported on Linux")
+}
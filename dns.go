@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DNSTimer is a Stage putting how long the latest lookup of the target's
+// name took on the next result, so it's reported next to the RTTs, which
+// don't include it, rather than mistaken for them
+type DNSTimer struct {
+	pending atomic.Int64 // nanoseconds, 0 if nothing new
+}
+
+// Record a lookup that took took, for the next result
+func (d *DNSTimer) Record(took time.Duration) {
+	d.pending.Store(int64(max(took, 1)))
+}
+
+func (d *DNSTimer) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	if took := d.pending.Swap(0); took > 0 {
+		r.DNS = time.Duration(took)
+	}
+	return true
+}
+
+// Run looks up host again every interval until ctx is done, recording how
+// long each lookup took and warning when it no longer resolves to addr,
+// which keeps being probed
+func (d *DNSTimer) Run(ctx context.Context, host string, addr *net.IPAddr, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		addrs, took, err := timeLookup(ctx, host)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("resolving target again", "target", host, "took", took, "err", err)
+			continue
+		}
+		d.Record(took)
+		found := false
+		for _, a := range addrs {
+			found = found || a.IP.Equal(addr.IP)
+		}
+		if !found {
+			logger.Warn("target resolves to other addresses now, still probing the first",
+				"target", host, "probing", addr, "resolves_to", addrs)
+		}
+	}
+}
+
+// timeLookup resolves host, and returns how long that took
+func timeLookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	start := time.Now()
+	addrs, err := lookupIPAddr(ctx, host)
+	return addrs, time.Since(start), err
+}
+
+// useResolver makes every lookup ask the DNS server at server instead of
+// the system's, see parseResolver, and returns it with its port
+func useResolver(server string) (string, error) {
+	server, err := parseResolver(server)
+	if err != nil {
+		return "", err
+	}
+	net.DefaultResolver = controlResolver(server, nil)
+	return server, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// looks up the names of DNS over TLS and HTTPS servers, which can't be
+// looked up with themselves
+var bootstrapResolver = net.DefaultResolver
+
+// resolverDial returns how Go's resolver connects to server: plainly to
+// host:port, over TLS to tls://host:port, or by posting its queries to an
+// https:// URL. "" leaves the address it was going to use.
+func resolverDial(server string, d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	u, _ := url.Parse(server)
+	switch {
+	case server == "":
+		return d.DialContext
+	case u != nil && u.Scheme == "tls":
+		conf := &tls.Config{ServerName: u.Hostname()}
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			// not a PacketConn, so queries are framed for TCP
+			return (&tls.Dialer{NetDialer: d, Config: conf}).DialContext(ctx, "tcp", u.Host)
+		}
+	case u != nil && u.Scheme == "https":
+		client := &http.Client{Transport: &http.Transport{
+			DialContext:       d.DialContext,
+			ForceAttemptHTTP2: true,
+		}}
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &dohConn{url: server, client: client}, nil
+		}
+	default:
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return d.DialContext(ctx, network, server)
+		}
+	}
+}
+
+// parseResolver checks a -resolver server, and returns it with the default
+// port if it has none: 53, or 853 for DNS over TLS
+func parseResolver(server string) (string, error) {
+	bad := fmt.Errorf("-resolver must be address[:port], tls://host[:port] or an https:// URL, not %q", server)
+	u, err := url.Parse(server)
+	switch {
+	case err == nil && u.Scheme == "https":
+		if u.Host == "" {
+			return "", bad
+		}
+		return server, nil
+	case err == nil && u.Scheme == "tls":
+		if u.Hostname() == "" || u.Path != "" {
+			return "", bad
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "853")
+		}
+		return u.String(), nil
+	}
+	addr := server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", bad
+	}
+	return addr, nil
+}
+
+// dohConn carries Go's resolver's queries to a DNS over HTTPS server, each
+// one written is posted and its answer read back, framed as for TCP
+type dohConn struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	deadline time.Time
+	answers  bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	// a query, after its length
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("dns over https: query not framed")
+	}
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("dns over https: %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(answer) > 0xffff {
+		return 0, errors.New("dns over https: answer too big")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.answers.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+	c.answers.Write(answer)
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answers.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// the address of a dohConn, its URL
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
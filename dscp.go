@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DSCP is a Differentiated Services codepoint, the high six bits of the IPv4
+// TOS or IPv6 traffic class field (RFC 2474)
+type DSCP int
+
+// named codepoints, the class selectors, assured forwarding classes and
+// expedited forwarding
+var dscpNames = map[string]DSCP{
+	"be": 0, "cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46, "va": 44, "le": 1,
+}
+
+// parseDSCP reads a codepoint by name, e.g. ef or af41, or number
+func parseDSCP(s string) (DSCP, error) {
+	if d, ok := dscpNames[strings.ToLower(s)]; ok {
+		return d, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("unknown DSCP %q, use a name like ef or af41, or 0 to 63", s)
+	}
+	return DSCP(n), nil
+}
+
+// String returns the name of d if it has one, its number otherwise
+func (d DSCP) String() string {
+	for _, name := range []string{"ef", "va", "le"} {
+		if dscpNames[name] == d {
+			return name
+		}
+	}
+	switch {
+	case d == 0:
+		return "be"
+	case d&7 == 0:
+		return fmt.Sprintf("cs%d", d>>3)
+	case d&1 == 0 && d>>3 >= 1 && d>>3 <= 4 && (d>>1)&3 != 0:
+		return fmt.Sprintf("af%d%d", d>>3, (d>>1)&3)
+	}
+	return strconv.Itoa(int(d))
+}
+
+// tos returns the TOS or traffic class byte of requests sent with d and
+// ECN codepoint e
+func (d DSCP) tos(e ECN) int {
+	return int(d)<<2 | e.bits()
+}
+
+// dscpFlag is a flag taking a DSCP by name or number
+type dscpFlag DSCP
+
+func (f *dscpFlag) String() string { return DSCP(*f).String() }
+
+func (f *dscpFlag) Set(s string) error {
+	d, err := parseDSCP(s)
+	if err != nil {
+		return err
+	}
+	*f = dscpFlag(d)
+	return nil
+}
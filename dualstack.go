@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// RTTs of the two families closer than this are about as fast
+const bothTolerance = time.Millisecond
+
+// resolveBoth returns the first IPv4 and IPv6 addresses of host, for -both
+func resolveBoth(host string) (v4, v6 string, err error) {
+	if net.ParseIP(host) != nil {
+		return "", "", fmt.Errorf("-both needs a hostname, %s is an address", host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return "", "", err
+	}
+	for _, a := range addrs {
+		switch {
+		case a.IP.To4() != nil && v4 == "":
+			v4 = a.IP.String()
+		case a.IP.To4() == nil && v6 == "":
+			v6 = a.String()
+		}
+	}
+	switch {
+	case v4 == "":
+		return "", "", fmt.Errorf("-both needs an A record for %s", host)
+	case v6 == "":
+		return "", "", fmt.Errorf("-both needs an AAAA record for %s", host)
+	}
+	return v4, v6, nil
+}
+
+// printBothVerdict says which family of a host answered better, to tell
+// whether clients racing them (Happy Eyeballs) would do better on one
+func printBothVerdict(w io.Writer, v4, v6 Summary) {
+	fmt.Fprintf(w, "\n------ IPv4 vs IPv6 ------\n")
+	l4, l6 := v4.Loss(), v6.Loss()
+	switch {
+	case v4.PacketIn == 0 && v6.PacketIn == 0:
+		fmt.Fprintln(w, "neither IPv4 nor IPv6 answered")
+		return
+	case v6.PacketIn == 0:
+		fmt.Fprintln(w, "IPv6 is broken, only IPv4 answered: clients trying IPv6 first wait for Happy Eyeballs to fall back")
+		return
+	case v4.PacketIn == 0:
+		fmt.Fprintln(w, "IPv4 is broken, only IPv6 answered")
+		return
+	}
+	if l4 != l6 {
+		worse, loss := "IPv6", l6
+		if l4 > l6 {
+			worse, loss = "IPv4", l4
+		}
+		fmt.Fprintf(w, "%s loses more probes, %.1f%% against %.1f%%\n", worse, loss, min(l4, l6))
+	}
+
+	// medians, a few slow replies shouldn't decide it
+	m4, m6 := v4.RTTs.Percentile(0.5), v6.RTTs.Percentile(0.5)
+	diff := time.Duration((m6 - m4) * float64(time.Millisecond))
+	switch {
+	case diff.Abs() < bothTolerance:
+		fmt.Fprintf(w, "IPv4 and IPv6 are about as fast, %.1f ms and %.1f ms median\n", m4, m6)
+	case diff > 0:
+		fmt.Fprintf(w, "IPv4 is faster by %.1f ms median (%.1f ms against %.1f ms)\n", diff.Seconds()*1e3, m4, m6)
+	default:
+		fmt.Fprintf(w, "IPv6 is faster by %.1f ms median (%.1f ms against %.1f ms)\n", -diff.Seconds()*1e3, m6, m4)
+	}
+}
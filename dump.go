@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/icmp"
+)
+
+// held while dumping a packet, so dumps of concurrent probes don't mix
+var dumpMu sync.Mutex
+
+// dumpPacket writes an ICMP message sent to or recieved from peer to w, its
+// header fields and then a hex dump of every byte
+func dumpPacket(w io.Writer, sent, ipv4 bool, b []byte, peer net.Addr, ttl int) {
+	var line strings.Builder
+	if sent {
+		fmt.Fprintf(&line, "> sent %d bytes to %v", len(b), peer)
+	} else {
+		fmt.Fprintf(&line, "< recieved %d bytes from %v", len(b), peer)
+		if ttl >= 0 {
+			fmt.Fprintf(&line, " ttl=%d", ttl)
+		}
+	}
+	line.WriteString(": ")
+	line.WriteString(describeICMP(ipv4, b, sent))
+
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	fmt.Fprintln(w, line.String())
+	io.WriteString(w, hex.Dump(b))
+}
+
+// describe the header fields of an ICMP message
+func describeICMP(ipv4 bool, b []byte, sent bool) string {
+	if len(b) < 4 {
+		return "truncated"
+	}
+	proto := ProtocolICMP
+	if !ipv4 {
+		proto = ProtocolICMPv6
+	}
+	desc := fmt.Sprintf("code=%d checksum=%#04x", b[1], binary.BigEndian.Uint16(b[2:4]))
+	if sent && !ipv4 {
+		desc += " (filled in by the kernel)"
+	}
+
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return fmt.Sprintf("type=%d %s, unparsable: %v", b[0], desc, err)
+	}
+	desc = fmt.Sprintf("type=%v %s", msg.Type, desc)
+	var quoted []byte
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		return fmt.Sprintf("%s id=%d seq=%d data=%d bytes", desc, body.ID, body.Seq, len(body.Data))
+	case *icmp.TimeExceeded:
+		quoted = body.Data
+	case *icmp.DstUnreach:
+		quoted = body.Data
+	case *icmp.PacketTooBig:
+		desc += fmt.Sprintf(" mtu=%d", body.MTU)
+		quoted = body.Data
+	}
+	if dst, id, seq, ok := quotedEcho(quoted, ipv4); ok {
+		desc += fmt.Sprintf(", quoting request to %v id=%d seq=%d", dst, id, seq)
+	}
+	return desc
+}
@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+// ECN is an Explicit Congestion Notification codepoint, the low two bits of
+// the IPv4 TOS or IPv6 traffic class field (RFC 3168)
+type ECN string
+
+const (
+	ECNNotECT ECN = "not-ect" // not ECN capable
+	ECNECT1   ECN = "ect1"    // ECN capable, the L4S identifier (RFC 9331)
+	ECNECT0   ECN = "ect0"    // ECN capable, classic
+	ECNCE     ECN = "ce"      // congestion experienced, set by a router
+)
+
+// every codepoint, indexed by its bits
+var ecnCodepoints = [...]ECN{ECNNotECT, ECNECT1, ECNECT0, ECNCE}
+
+// ecnOf returns the codepoint of a TOS or traffic class byte
+func ecnOf(tos int) ECN {
+	return ecnCodepoints[tos&3]
+}
+
+// bits returns the value of e in the TOS or traffic class field
+func (e ECN) bits() int {
+	for i, cp := range ecnCodepoints {
+		if cp == e {
+			return i
+		}
+	}
+	return 0
+}
+
+// parseECN checks a codepoint for requests to be sent with, "" for none
+func parseECN(s string) (ECN, error) {
+	switch e := ECN(s); e {
+	case "", ECNECT0, ECNECT1:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown ECN codepoint %q, use ect0 or ect1", s)
+}
+
+// quotedECN returns the codepoint our request arrived with at the router
+// that quoted its IP header in an ICMP error, "" if it's cut short
+func quotedECN(data []byte, isIPv4 bool) ECN {
+	if len(data) < 2 {
+		return ""
+	}
+	if isIPv4 {
+		return ecnOf(int(data[1]))
+	}
+	// the traffic class straddles the first two bytes
+	return ecnOf(int(data[1] >> 4))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// descriptive environment variable names for the single letter flags
+var envNames = map[string]string{
+	"s": "SIZE",
+	"t": "TTL",
+	"i": "INTERVAL",
+	"W": "TIMEOUT",
+	"m": "MODE",
+	"p": "PORT",
+	"o": "OUTPUT",
+	"q": "QUIET",
+}
+
+// and for the commands where -c and -w are how many probes to send and for
+// how long, elsewhere they mean something else and are PING_C and PING_W
+var probeEnvNames = map[string]string{
+	"c": "COUNT",
+	"w": "DEADLINE",
+}
+
+var probeEnvCommands = map[string]bool{"ping": true, "compare": true, "assert": true, "flows": true}
+
+// return the environment variable that sets flag name of command cmd, e.g.
+// PING_INTERVAL for -i and PING_LOG_LEVEL for -log-level
+func envName(cmd, name string) string {
+	if long, ok := envNames[name]; ok {
+		name = long
+	} else if long, ok := probeEnvNames[name]; ok && probeEnvCommands[cmd] {
+		name = long
+	}
+	return "PING_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets every flag in fs that has a PING_* environment variable.
+// It must be called before fs.Parse so flags on the command line still win.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(fs.Name(), f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(fs.Name(), f.Name), e)
+		}
+	})
+	return err
+}
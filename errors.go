@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// kinds of probe failures, check for them with errors.Is
+var (
+	ErrTimeout         = errors.New("request timed out")
+	ErrHostUnreachable = errors.New("destination host unreachable")
+	ErrTTLExceeded     = errors.New("time to live exceeded")
+	ErrPermission      = errors.New("permission denied (raw sockets need root)")
+	ErrCorrupt         = errors.New("corrupted reply")
+	ErrFragNeeded      = errors.New("fragmentation needed")
+)
+
+// MTUError is the reason of an ErrFragNeeded from a router, the largest
+// packet it can forward on
+type MTUError struct {
+	MTU int
+}
+
+func (e *MTUError) Error() string {
+	return fmt.Sprintf("next hop mtu %d", e.MTU)
+}
+
+// the problem of corrupted replies that came back cut short or with their
+// payload damaged, rather than with a bad header
+var errDamaged = errors.New("payload damaged")
+
+// returned when the platform or socket can't provide kernel timestamps
+var errTimestampsUnsupported = errors.New("kernel timestamps not supported")
+
+// SendError is a request that couldn't be sent, or its socket set up or
+// read. Those are often passing, e.g. while an interface flaps or a route
+// changes, and worth trying again on a new socket, see Runner.Retry.
+type SendError struct {
+	Err error
+}
+
+func (e *SendError) Error() string { return e.Err.Error() }
+func (e *SendError) Unwrap() error { return e.Err }
+
+// ProbeError is returned by probes that failed in a known way. Kind is one of
+// the Err* values above, From is the address that reported the failure (e.g.
+// the router that sent a time exceeded message) and Err the underlying error.
+type ProbeError struct {
+	Kind error
+	From string
+	Err  error
+}
+
+func (e *ProbeError) Error() string {
+	msg := e.Kind.Error()
+	if e.From != "" {
+		msg = "from " + e.From + ": " + msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ProbeError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// classify wraps err in a ProbeError if it is a failure we know about
+func classify(err error) error {
+	var pe *ProbeError
+	if err == nil || errors.As(err, &pe) {
+		return err
+	}
+
+	var kind error
+	var ne net.Error
+	switch {
+	case errors.As(err, &ne) && ne.Timeout():
+		kind = ErrTimeout
+	case errors.Is(err, os.ErrPermission):
+		kind = ErrPermission
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		kind = ErrHostUnreachable
+	case errors.Is(err, syscall.EMSGSIZE):
+		// too big to send without fragmenting, by what the kernel knows of
+		// the path
+		kind = ErrFragNeeded
+	default:
+		return err
+	}
+	return &ProbeError{Kind: kind, Err: err}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// probeFlags are the flags shared by every command that sends probes
+type probeFlags struct {
+	size     int
+	ttl      int
+	port     int
+	interval time.Duration
+	jitter   percentFlag
+	timeout  time.Duration
+	mode     string
+	format   string
+	pps      float64
+	quiet    bool
+	tags     tagFlag
+	stamps   string
+	flow     int
+	dscp     dscpFlag
+	ecn      string
+	mark     int
+	vrf      string
+	resolver string
+	resolve  string
+	static   staticMapFlag
+	llmnr    bool
+	retries  int
+	backoff  time.Duration
+	dump     bool
+	trend    bool
+	avg      int
+
+	// state change events, see registerEvents
+	events     bool
+	downAfter  int
+	upAfter    int
+	flap       int
+	anomaly    float64
+	anycast    bool
+	hook       string
+	scriptPath string
+	script     *Script // loaded from scriptPath by validate
+	notify     bool
+	onDown     string
+	onUp       string
+	onSlow     string
+	slowRTT    time.Duration
+	hooks      []*Hook // running the commands above, started by output
+
+	// a JSON summary on stdout at exit, see registerSummary
+	summaryJSON bool
+	started     time.Time
+}
+
+// register adds the probe flags to fs
+func (pf *probeFlags) register(fs *flag.FlagSet) {
+	pf.tags = tagFlag{}
+	pf.static = staticMapFlag{}
+	fs.IntVar(&pf.size, "s", DefaultSize, "Size (in bytes) of ping message")
+	fs.IntVar(&pf.ttl, "t", DefaultTTL, "Time to live, number L3 hops before packet dies")
+	fs.DurationVar(&pf.interval, "i", DefaultInterval, "Wait time between sending each packet")
+	fs.Var(&pf.jitter, "interval-jitter", "Move every interval randomly by up to this percent of it either way, e.g. 20%")
+	fs.DurationVar(&pf.timeout, "W", DefaultTimeout, "Time to wait for a reply")
+	fs.StringVar(&pf.mode, "m", "icmp", "Probe type: icmp, tcp, http or dns")
+	fs.IntVar(&pf.port, "p", 80, "Port to connect to in tcp mode")
+	fs.StringVar(&pf.format, "o", "text", "Output format: text or json")
+	fs.Float64Var(&pf.pps, "pps", 0, "Send this many probes per second without waiting for replies, 0 to wait for each reply")
+	fs.BoolVar(&pf.quiet, "q", false, "Quiet, only print failed probes and the summary")
+	fs.IntVar(&pf.avg, "avg", 0, "Show the average RTT of each target's last this many replies with every reply, 0 to not")
+	fs.BoolVar(&pf.trend, "trend", false, fmt.Sprintf("Mark replies slower (▲), faster (▼) or about as fast (=) as the average of the last %d", trendWindow))
+	fs.Var(pf.tags, "tag", "Add key=value to every result (repeatable)")
+	fs.StringVar(&pf.stamps, "timestamps", "kernel", "Measure RTT with kernel, hardware or user timestamps")
+	fs.IntVar(&pf.flow, "flowlabel", 0, "IPv6 flow label of every request, 0 to let the kernel pick")
+	fs.Var(&pf.dscp, "dscp", "DSCP of probes by name or number, e.g. ef, af41 or 46")
+	fs.StringVar(&pf.ecn, "ecn", "", "Mark requests ECN capable with ect0 or ect1, and show the codepoint replies come back with")
+	fs.IntVar(&pf.mark, "fwmark", 0, "Firewall mark (SO_MARK) of probes for policy routing, 0 for none (Linux only)")
+	fs.StringVar(&pf.vrf, "vrf", "", "Send probes through this VRF device, or any other network device (Linux only)")
+	registerNetns(fs)
+	fs.StringVar(&pf.resolver, "resolver", "", "Look up names with this DNS server instead of the system's: address[:port], tls://host[:port] for DNS over TLS or an https:// URL for DNS over HTTPS (names in /etc/hosts still come from there)")
+	fs.StringVar(&pf.resolve, "resolve-from", "", "Look up host names only in the hosts file, only with DNS, or only in -static-map: hosts, dns or static, \"\" for the system's usual way (system)")
+	fs.Var(pf.static, "static-map", "Give host this address, host=ip, instead of looking it up; implies -resolve-from static (repeatable)")
+	registerLLMNR(fs, &pf.llmnr)
+	fs.IntVar(&pf.retries, "retries", 3, "Try probes that couldn't be sent again this many times on a new socket, e.g. while an interface flaps, before reporting them")
+	fs.DurationVar(&pf.backoff, "retry-backoff", 100*time.Millisecond, fmt.Sprintf("Wait before the first retry, doubling with every send failing in a row up to %v", maxRetryBackoff))
+	fs.BoolVar(&pf.dump, "vv", false, "Print every ICMP packet sent and recieved, its header fields and a hex dump")
+}
+
+// percentFlag is a flag given in percent, with or without the %, holding
+// the fraction
+type percentFlag float64
+
+func (p *percentFlag) String() string {
+	return strconv.FormatFloat(float64(*p)*100, 'g', -1, 64) + "%"
+}
+
+func (p *percentFlag) Set(s string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a percentage", s)
+	}
+	if f < 0 || f > 100 {
+		return fmt.Errorf("%q must be between 0%% and 100%%", s)
+	}
+	*p = percentFlag(f / 100)
+	return nil
+}
+
+// registerSummary adds the flag for printing a JSON summary at exit, for
+// commands that print statistics
+func (pf *probeFlags) registerSummary(fs *flag.FlagSet) {
+	fs.BoolVar(&pf.summaryJSON, "summary-json", false, "Print the statistics as one JSON document on stdout at exit, with results and everything else on stderr")
+	pf.started = time.Now()
+}
+
+// registerNetns adds -netns to fs, for every command that sends probes.
+// parseFlags enters the namespace before the command opens its sockets.
+func registerNetns(fs *flag.FlagSet) {
+	fs.String("netns", "", "Probe from this network namespace, named by ip netns or a path (Linux only)")
+}
+
+// registerEvents adds the flags for printing up and down events instead of
+// every result, and flagging unusual RTTs, for commands that probe the same
+// targets over and over
+func (pf *probeFlags) registerEvents(fs *flag.FlagSet) {
+	fs.BoolVar(&pf.events, "events", false, "Only print when a target goes up or down")
+	fs.IntVar(&pf.downAfter, "down-after", 3, "Lost probes in a row before a target is down")
+	fs.IntVar(&pf.upAfter, "up-after", 2, "Replies in a row before a target is up")
+	fs.Float64Var(&pf.anomaly, "anomaly", 0, "Flag replies this many standard deviations off the target's usual RTT, 0 to not")
+	fs.BoolVar(&pf.anycast, "anycast", false, "Flag replies that look like they come from another anycast instance, by the reply TTL or RTT level changing for good")
+	fs.BoolVar(&pf.notify, "notify", false, "Show desktop notifications when a target goes up or down, or -threshold-rtt is crossed")
+	fs.StringVar(&pf.hook, "hook", "", "Run this program for every result, and with -events every up and down event, with the result on its stdin as JSON")
+	fs.StringVar(&pf.scriptPath, "script", "", "Call this Starlark script's on_result for every result, and with -events its on_event for every up and down event")
+	fs.StringVar(&pf.onDown, "on-down", "", "Run this shell command when a target goes down, with the result in HOOK_* variables")
+	fs.StringVar(&pf.onUp, "on-up", "", "Run this shell command when a target comes up, with the result in HOOK_* variables")
+	fs.StringVar(&pf.onSlow, "on-threshold", "", "Run this shell command when replies go over -threshold-rtt, and when they're back under")
+	fs.DurationVar(&pf.slowRTT, "threshold-rtt", 0, "RTT that -notify and -on-threshold react to replies going over, 0 for none")
+	fs.IntVar(&pf.flap, "flap", 6, fmt.Sprintf("Stop reporting a target that changes between replies and losses more than this often in %d probes, 0 to not", flapWindow))
+}
+
+// check the flags that only accept a fixed set of values
+func (pf *probeFlags) validate() error {
+	if pf.size < 0 || pf.size > MaxSize {
+		return fmt.Errorf("invalid size %d, must be between 0 and %d", pf.size, MaxSize)
+	}
+	if pf.retries < 0 || pf.backoff <= 0 {
+		return fmt.Errorf("-retries can't be negative, and -retry-backoff must be positive")
+	}
+	if pf.flow < 0 || pf.flow > 0xfffff {
+		return fmt.Errorf("invalid flow label %d, must be between 0 and %d", pf.flow, 0xfffff)
+	}
+	if pf.mark < 0 || int64(pf.mark) > math.MaxUint32 {
+		return fmt.Errorf("invalid fwmark %d, must be between 0 and %d", pf.mark, uint32(math.MaxUint32))
+	}
+	if pf.vrf != "" {
+		if _, err := net.InterfaceByName(pf.vrf); err != nil {
+			return fmt.Errorf("unknown VRF %q: %w", pf.vrf, err)
+		}
+	}
+	if _, err := parseECN(pf.ecn); err != nil {
+		return err
+	}
+	if pf.notify {
+		if _, err := notifyCommand(context.Background(), "", ""); err != nil {
+			return err
+		}
+	}
+	if pf.scriptPath != "" {
+		s, err := LoadScript(pf.scriptPath)
+		if err != nil {
+			return err
+		}
+		pf.script = s
+	}
+	if pf.onSlow != "" && pf.slowRTT <= 0 {
+		return fmt.Errorf("-on-threshold needs -threshold-rtt")
+	}
+	if (pf.events || pf.watching()) && (pf.downAfter < 1 || pf.upAfter < 1) {
+		return fmt.Errorf("-down-after and -up-after must be at least 1")
+	}
+	if (pf.events || pf.watching()) && (pf.flap < 0 || pf.flap >= flapWindow) {
+		return fmt.Errorf("invalid -flap %d, must be between 0 and %d", pf.flap, flapWindow-1)
+	}
+	if pf.avg < 0 {
+		return fmt.Errorf("invalid -avg %d, must not be negative", pf.avg)
+	}
+	if pf.anomaly < 0 {
+		return fmt.Errorf("invalid -anomaly %g, must not be negative", pf.anomaly)
+	}
+	if pf.format != "text" && pf.format != "json" {
+		return fmt.Errorf("unknown output format %q", pf.format)
+	}
+	switch TimestampSource(pf.stamps) {
+	case TimestampKernel, TimestampHardware, TimestampUser:
+	default:
+		return fmt.Errorf("unknown timestamp source %q, use kernel, hardware or user", pf.stamps)
+	}
+	if pf.mode == "dns" && resolveFrom != resolveSystem {
+		return errors.New("-resolve-from doesn't apply to -m dns, it probes DNS itself")
+	}
+	switch pf.mode {
+	case "icmp", "tcp", "http", "dns":
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", pf.mode)
+}
+
+// newProber returns a prober for addr in the selected mode, and a
+// description of what is being probed for the PING header line. opts are
+// passed on to New in icmp mode.
+func (pf *probeFlags) newProber(addr string, opts ...Option) (Prober, string, error) {
+	switch pf.mode {
+	case "tcp":
+		hostport := net.JoinHostPort(addr, strconv.Itoa(pf.port))
+		tp := NewTCPProber(hostport, pf.timeout)
+		tp.Control = pf.control()
+		return tp, hostport + " (tcp)", nil
+	case "http":
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		hp := NewHTTPProber(addr, pf.timeout)
+		if control := pf.control(); control != nil {
+			hp.Client = controlClient(pf.timeout, control)
+		}
+		return hp, addr + " (http)", nil
+	case "dns":
+		dp := NewDNSProber(addr, pf.timeout)
+		if control := pf.control(); control != nil {
+			dp.Resolver = controlResolver(pf.resolver, control)
+		}
+		return dp, addr + " (dns)", nil
+	}
+
+	opts = append([]Option{
+		WithSize(pf.size),
+		WithTTL(pf.ttl),
+		WithInterval(pf.interval),
+		WithTimeout(pf.timeout),
+		WithTimestamps(TimestampSource(pf.stamps)),
+		WithFlowLabel(pf.flow),
+		WithDSCP(DSCP(pf.dscp)),
+		WithECN(ECN(pf.ecn)),
+		WithMark(pf.mark),
+		WithVRF(pf.vrf),
+	}, opts...)
+	if pf.dump {
+		opts = append(opts, WithDump(pf.status()))
+	}
+	client, err := New(addr, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	return client, fmt.Sprintf("%s (%s)", addr, client.IPAddr), nil
+}
+
+// control returns a function setting the socket options asked for on the
+// connections of the tcp, http and dns modes, nil if there are none
+func (pf *probeFlags) control() func(network, address string, rc syscall.RawConn) error {
+	var fns []func(network, address string, rc syscall.RawConn) error
+	if pf.dscp != 0 {
+		fns = append(fns, tosControl(DSCP(pf.dscp)))
+	}
+	if pf.mark != 0 {
+		fns = append(fns, markControl(pf.mark))
+	}
+	if pf.vrf != "" {
+		fns = append(fns, deviceControl(pf.vrf))
+	}
+	if len(fns) == 0 {
+		return nil
+	}
+	return func(network, address string, rc syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(network, address, rc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// resultTarget returns the Target of the results of probing addr
+func (pf *probeFlags) resultTarget(addr string) string {
+	switch pf.mode {
+	case "tcp":
+		return net.JoinHostPort(addr, strconv.Itoa(pf.port))
+	case "http":
+		if !strings.Contains(addr, "://") {
+			return "http://" + addr
+		}
+	}
+	return addr
+}
+
+// payload returns the message size probes carry, for payload integrity statistics
+func (pf *probeFlags) payload() int {
+	if pf.mode == "icmp" {
+		return pf.size
+	}
+	return 0
+}
+
+// retry returns how probes that couldn't be sent are retried
+func (pf *probeFlags) retry() RetryPolicy {
+	return RetryPolicy{Attempts: pf.retries, Backoff: pf.backoff, Max: maxRetryBackoff}
+}
+
+// watching reports whether anything reacts to events while every result is
+// still printed
+func (pf *probeFlags) watching() bool {
+	return pf.notify || pf.onDown != "" || pf.onUp != "" || pf.onSlow != ""
+}
+
+// onEvent returns what to do on the events of an EventWatcher
+func (pf *probeFlags) onEvent() func(event string, r Result) {
+	commands := map[string]*Hook{}
+	if pf.onDown != "" {
+		commands["down"] = pf.addHook(NewShellHook(pf.onDown))
+	}
+	if pf.onUp != "" {
+		commands["up"] = pf.addHook(NewShellHook(pf.onUp))
+	}
+	if pf.onSlow != "" {
+		h := pf.addHook(NewShellHook(pf.onSlow))
+		commands["slow"], commands["fast"] = h, h
+	}
+	return func(event string, r Result) {
+		if pf.notify {
+			notifyEvent(event, r)
+		}
+		if h, ok := commands[event]; ok {
+			h.Run(r, event)
+		}
+	}
+}
+
+// addHook keeps the started Hook h to be stopped by closeHooks
+func (pf *probeFlags) addHook(h *Hook) *Hook {
+	pf.hooks = append(pf.hooks, h)
+	return h
+}
+
+// closeHooks waits for the commands hooks still have to run
+func (pf *probeFlags) closeHooks() {
+	for _, h := range pf.hooks {
+		h.Close()
+	}
+}
+
+// status returns where header and summary lines go, stderr when results
+// are JSON so stdout stays machine readable
+func (pf *probeFlags) status() io.Writer {
+	if pf.format == "json" || pf.summaryJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// results returns where results are printed, stdout unless that's kept for
+// the -summary-json document
+func (pf *probeFlags) results() *os.File {
+	if pf.summaryJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// printSummary prints the -summary-json document of a run of command, if
+// asked for. failure is why the run failed, nil if it didn't.
+func (pf *probeFlags) printSummary(command string, targets []targetJSON, failure error) {
+	if !pf.summaryJSON {
+		return
+	}
+	doc := summaryDoc{
+		Command: command,
+		Start:   pf.started,
+		End:     time.Now(),
+		Targets: targets,
+
+		LocalDrops: overhead.SocketDrops.Load(),
+	}
+	if failure != nil {
+		doc.Failure = failure.Error()
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(doc); err != nil {
+		logger.Error("writing summary", "err", err)
+	}
+}
+
+// output returns the stages that tag, filter and print results, stats
+// sinks are inserted by the caller before the filters
+func (pf *probeFlags) output(w io.Writer, stats ...Stage) Pipeline {
+	var pipeline Pipeline
+	if len(pf.tags) > 0 {
+		pipeline = append(pipeline, TagEnricher(pf.tags))
+	}
+	if pf.anomaly > 0 {
+		pipeline = append(pipeline, NewAnomalyDetector(pf.anomaly))
+	}
+	if pf.anycast {
+		pipeline = append(pipeline, NewAnycastWatcher())
+	}
+	if pf.trend {
+		pipeline = append(pipeline, NewTrendMarker(trendWindow))
+	}
+	if pf.avg > 0 {
+		pipeline = append(pipeline, NewMovingAverage(pf.avg))
+	}
+	pipeline = append(pipeline, stats...)
+	if pf.watching() {
+		pipeline = append(pipeline, NewEventWatcher(pf.downAfter, pf.upAfter, pf.flap, pf.slowRTT, pf.onEvent()))
+	}
+	var hooks []*Hook
+	if pf.hook != "" {
+		hooks = append(hooks, pf.addHook(NewHook(pf.hook)))
+	}
+	if pf.script != nil {
+		hooks = append(hooks, pf.addHook(NewScriptHook(pf.script)))
+	}
+	for _, hook := range hooks {
+		pipeline = append(pipeline, hook)
+	}
+	if pf.events {
+		pipeline = append(pipeline, NewStateTracker(pf.downAfter, pf.upAfter, pf.flap))
+		for _, hook := range hooks {
+			pipeline = append(pipeline, hook.Events())
+		}
+	}
+	if pf.quiet {
+		pipeline = append(pipeline, KindFilter(KindTimeout, KindError, KindCorrupt, KindUp, KindDown, KindFlapping))
+	}
+	if pf.format == "json" {
+		pipeline = append(pipeline, JSONSink(w))
+	} else {
+		pipeline = append(pipeline, TextSink(w))
+	}
+	return pipeline
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// from linux/in6.h, x/sys doesn't have them
+const (
+	ipv6FlowLabelMgr = 32  // IPV6_FLOWLABEL_MGR
+	ipv6FlowInfoSend = 33  // IPV6_FLOWINFO_SEND
+	ipv6FlActionGet  = 0   // IPV6_FL_A_GET
+	ipv6FlShareAny   = 255 // IPV6_FL_S_ANY
+	ipv6FlFlagCreate = 1   // IPV6_FL_F_CREATE
+)
+
+// leaseFlowLabel asks the kernel for flow label to dst on c, and to take the
+// label of each packet from its destination address. Linux only sends
+// labels leased this way.
+func leaseFlowLabel(c syscall.Conn, label uint32, dst net.IP) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// struct in6_flowlabel_req
+	req := make([]byte, 32)
+	copy(req[0:16], dst.To16())
+	binary.BigEndian.PutUint32(req[16:20], label)
+	req[20] = ipv6FlActionGet
+	req[21] = ipv6FlShareAny
+	binary.NativeEndian.PutUint16(req[22:24], ipv6FlFlagCreate)
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(int(fd), unix.IPPROTO_IPV6, ipv6FlowLabelMgr, string(req))
+		if serr == nil {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, ipv6FlowInfoSend, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// writeFlow sends b to dst, on the interface with index scope if it's
+// link-local, with flow label, which net can't put in the destination address
+func writeFlow(c syscall.Conn, b []byte, dst *net.IPAddr, scope int, label uint32) (int, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	sa := unix.RawSockaddrInet6{Family: unix.AF_INET6, Scope_id: uint32(scope)}
+	copy(sa.Addr[:], dst.IP.To16())
+	// sin6_flowinfo is in network byte order
+	var fi [4]byte
+	binary.BigEndian.PutUint32(fi[:], label)
+	sa.Flowinfo = binary.NativeEndian.Uint32(fi[:])
+
+	var n uintptr
+	var errno syscall.Errno
+	err = rc.Write(func(fd uintptr) bool {
+		var p unsafe.Pointer
+		if len(b) > 0 {
+			p = unsafe.Pointer(&b[0])
+		}
+		n, _, errno = unix.Syscall6(unix.SYS_SENDTO, fd, uintptr(p), uintptr(len(b)), 0,
+			uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+		return errno != unix.EAGAIN
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "write", Net: "ip6", Addr: dst, Err: errno}
+	}
+	return int(n), nil
+}
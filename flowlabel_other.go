@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errFlowLabelUnsupported = errors.New("flow labels are only supported on Linux")
+
+// flow labels are only implemented on Linux
+func leaseFlowLabel(c syscall.Conn, label uint32, dst net.IP) error {
+	return errFlowLabelUnsupported
+}
+
+func writeFlow(c syscall.Conn, b []byte, dst *net.IPAddr, scope int, label uint32) (int, error) {
+	return 0, errFlowLabelUnsupported
+}
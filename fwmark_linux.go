@@ -0,0 +1,32 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setMark sets the firewall mark of every packet sent on c, which policy
+// routing rules can pick a route by. Needs CAP_NET_ADMIN.
+func setMark(c syscall.Conn, mark int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return markControl(mark)("", "", rc)
+}
+
+// markControl returns a net.Dialer Control function setting the firewall
+// mark of every connection dialed
+func markControl(mark int) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
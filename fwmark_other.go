@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errMarkUnsupported = errors.New("firewall marks are only supported on Linux")
+
+// firewall marks are only implemented on Linux
+func setMark(c syscall.Conn, mark int) error {
+	return errMarkUnsupported
+}
+
+func markControl(mark int) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		return errMarkUnsupported
+	}
+}
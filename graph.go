@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+)
+
+const graphHeight = 10 // rows of the live graph
+
+// eighths of a block, for the top of every column
+var graphBlocks = []rune(" ▁▂▃▄▅▆▇█")
+
+// Graph is a Stage drawing the RTTs of the last Width probes as a block
+// chart on a terminal, redrawn in place after every result, like gping.
+// Lost probes are an x on the bottom row.
+type Graph struct {
+	Width int
+
+	w     io.Writer
+	mu    sync.Mutex
+	rtts  []float64 // ms, NaN for lost probes, oldest first
+	drawn bool      // whether there's a graph to draw over
+}
+
+// Initialize and return a Graph of width probes drawn on w
+func NewGraph(w io.Writer, width int) *Graph {
+	return &Graph{Width: width, w: w}
+}
+
+func (g *Graph) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	rtt := math.NaN()
+	if r.Kind == KindReply {
+		rtt = r.RTT.Seconds() * 1e3
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rtts = append(g.rtts, rtt)
+	if len(g.rtts) > g.Width {
+		g.rtts = g.rtts[len(g.rtts)-g.Width:]
+	}
+	g.draw(r)
+	return true
+}
+
+// draw the graph over the last one, called with mu held
+func (g *Graph) draw(r *Result) {
+	top, lost := 0.0, 0
+	for _, rtt := range g.rtts {
+		if math.IsNaN(rtt) {
+			lost++
+		} else {
+			top = max(top, rtt)
+		}
+	}
+	top = niceCeil(top)
+
+	var b strings.Builder
+	if g.drawn {
+		// back to the top of the last graph
+		fmt.Fprintf(&b, "\033[%dA", graphHeight+1)
+	}
+	last := "lost"
+	if r.Kind == KindReply {
+		last = fmt.Sprintf("%.1f ms", r.RTT.Seconds()*1e3)
+	}
+	fmt.Fprintf(&b, "\r\033[K%s %s_seq=%d %s, %d of the last %d lost\n", r.Target, r.Proto, r.Seq, last, lost, len(g.rtts))
+	for row := range graphHeight {
+		label := "        "
+		switch row {
+		case 0:
+			label = fmt.Sprintf("%7s ", formatChartMS(top))
+		case graphHeight - 1:
+			label = fmt.Sprintf("%7s ", "0 ms")
+		}
+		b.WriteString("\r\033[K" + label + "│")
+		// eighths of a block below this row
+		below := (graphHeight - 1 - row) * 8
+		for _, rtt := range g.rtts {
+			if math.IsNaN(rtt) {
+				if row == graphHeight-1 {
+					b.WriteRune('x')
+				} else {
+					b.WriteRune(' ')
+				}
+				continue
+			}
+			level := int(math.Round(rtt/top*graphHeight*8)) - below
+			b.WriteRune(graphBlocks[min(max(level, 0), 8)])
+		}
+		b.WriteByte('\n')
+	}
+	g.drawn = true
+	io.WriteString(g.w, b.String())
+}
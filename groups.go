@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// groupTracker is a Stage adding the results of targets in a group, like
+// "dns-servers", to the group's statistics and alerts, so they're judged
+// together as well as one by one. Results are tagged with their group.
+type groupTracker struct {
+	mu      sync.Mutex
+	members map[string]string // group of every target in one
+
+	stats   *TargetStats // by group
+	alerts  *alerter     // by group
+	configs map[string]groupConfig
+}
+
+// groupConfig are the thresholds of a group, over its targets' probes
+type groupConfig struct {
+	MaxLoss float64      `json:"max_loss,omitempty"` // percent
+	MaxRTT  jsonDuration `json:"max_rtt,omitempty"`  // average
+}
+
+// Initialize and return a groupTracker without groups
+func newGroupTracker(msgSize int) *groupTracker {
+	return &groupTracker{
+		members: make(map[string]string),
+		stats:   NewTargetStats(msgSize),
+		alerts:  newAlerter("group"),
+	}
+}
+
+// Join puts target in group, "" to take it out of its group
+func (g *groupTracker) Join(target, group string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if group == "" {
+		delete(g.members, target)
+		return
+	}
+	g.members[target] = group
+}
+
+// SetThresholds replaces the thresholds of every group
+func (g *groupTracker) SetThresholds(groups map[string]groupConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for group := range g.configs {
+		if _, ok := groups[group]; !ok {
+			g.alerts.Set(group, Thresholds{})
+		}
+	}
+	for group, gc := range groups {
+		// unchanged groups keep their latest probes
+		if g.configs[group] != gc {
+			g.alerts.Set(group, gc.thresholds())
+		}
+	}
+	g.configs = groups
+}
+
+// Members returns the targets of group, nil if it has none
+func (g *groupTracker) Members(group string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var targets []string
+	for target, in := range g.members {
+		if in == group {
+			targets = append(targets, target)
+		}
+	}
+	slices.Sort(targets)
+	return targets
+}
+
+// Groups returns every group that had results
+func (g *groupTracker) Groups() []string {
+	return g.stats.Targets()
+}
+
+func (g *groupTracker) Process(r *Result) bool {
+	g.mu.Lock()
+	group, ok := g.members[r.Target]
+	g.mu.Unlock()
+	if !ok {
+		return true
+	}
+
+	if r.Tags == nil {
+		r.Tags = make(map[string]string)
+	}
+	r.Tags["group"] = group
+
+	gr := *r
+	gr.Target = group
+	g.stats.Add(gr)
+	g.alerts.Process(&gr)
+	return true
+}
+
+// Fprint writes a statistics summary for every group to w
+func (g *groupTracker) Fprint(w io.Writer) {
+	for _, group := range g.Groups() {
+		g.stats.Get(group).Snapshot().Fprint(w, "group "+group+" statistics")
+	}
+}
+
+func (g *groupTracker) stateName() string { return "groups" }
+
+func (g *groupTracker) saveState() any { return g.stats.saveState() }
+
+func (g *groupTracker) loadState(b json.RawMessage) error { return g.stats.loadState(b) }
+
+// thresholds returns when to alert on the group
+func (gc groupConfig) thresholds() Thresholds {
+	return Thresholds{MaxLoss: gc.MaxLoss, MaxRTT: time.Duration(gc.MaxRTT)}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// RTTs are counted in log-linear buckets, like an HDR histogram: exact below
+// histLinear microseconds, then every power of two is split in histLinear/2
+// buckets, so a percentile is off by at most about 3% however long the run
+// and memory stays fixed.
+const (
+	histLinear  = 32
+	histShift   = 4         // log2(histLinear) - 1
+	histMax     = 1<<31 - 1 // microseconds, about 35 minutes, longer rtts count as this
+	histBuckets = histLinear / 2 * (32 - histShift)
+)
+
+// rttHistogram counts RTTs, safe for concurrent use
+type rttHistogram struct {
+	counts [histBuckets]atomic.Int64
+}
+
+// record a round trip time
+func (h *rttHistogram) add(rtt time.Duration) {
+	h.counts[histBucket(rtt)].Add(1)
+}
+
+// copy the counts, nil if nothing was recorded
+func (h *rttHistogram) snapshot() RTTHistogram {
+	var counts RTTHistogram
+	for i := range h.counts {
+		if n := h.counts[i].Load(); n > 0 {
+			if counts == nil {
+				counts = make(RTTHistogram, histBuckets)
+			}
+			counts[i] = n
+		}
+	}
+	return counts
+}
+
+// RTTHistogram is a copy of the RTT counts of a run, by bucket
+type RTTHistogram []int64
+
+// Percentile returns the RTT in ms that q (0 to 1) of the replies were faster
+// than or as fast as, 0 without replies
+func (h RTTHistogram) Percentile(q float64) float64 {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(q * float64(total)))
+	rank = max(rank, 1)
+	var seen int64
+	for i, n := range h {
+		seen += n
+		if seen >= rank {
+			lo, width := histRange(i)
+			return (float64(lo) + float64(width-1)/2) / 1e3
+		}
+	}
+	return 0
+}
+
+// return the bucket counting rtt
+func histBucket(rtt time.Duration) int {
+	us := uint64(max(rtt.Microseconds(), 0))
+	us = min(us, histMax)
+	if us < histLinear {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 1 - histShift
+	return histLinear/2*shift + int(us>>shift)
+}
+
+// return the lowest rtt in microseconds bucket i counts, and how many
+// microseconds it spans
+func histRange(i int) (uint64, uint64) {
+	if i < histLinear {
+		return uint64(i), 1
+	}
+	shift := i/(histLinear/2) - 1
+	return uint64(i%(histLinear/2)+histLinear/2) << shift, 1 << shift
+}
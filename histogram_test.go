@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistBucket(t *testing.T) {
+	// every rtt falls in the range of its bucket
+	for us := uint64(0); us < 1<<20; us = us*9/8 + 1 {
+		i := histBucket(time.Duration(us) * time.Microsecond)
+		if lo, width := histRange(i); us < lo || us >= lo+width {
+			t.Errorf("%dus in bucket %d of %d-%dus", us, i, lo, lo+width-1)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	// 1ms to 100ms, one of each
+	var spread []time.Duration
+	for ms := 1; ms <= 100; ms++ {
+		spread = append(spread, time.Duration(ms)*time.Millisecond)
+	}
+	for _, tt := range []struct {
+		rtts []time.Duration
+		q    float64
+		want float64 // ms, give or take 3%
+	}{
+		{nil, 0.5, 0},
+		{[]time.Duration{10 * time.Microsecond}, 0.5, 0.01}, // exact
+		{[]time.Duration{-time.Millisecond}, 0.5, 0},
+		{spread, 0, 1},
+		{spread, 0.5, 50},
+		{spread, 0.9, 90},
+		{spread, 0.99, 99},
+		{spread, 1, 100},
+		{[]time.Duration{time.Hour}, 0.5, histMax / 1e3}, // capped
+	} {
+		var h rttHistogram
+		for _, rtt := range tt.rtts {
+			h.add(rtt)
+		}
+		if got := h.snapshot().Percentile(tt.q); math.Abs(got-tt.want) > tt.want*0.03 {
+			t.Errorf("p%g of %d rtts = %.3fms, want %.3fms", tt.q*100, len(tt.rtts), got, tt.want)
+		}
+	}
+}
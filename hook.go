@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	hookQueue   = 256              // runs waiting for the hook before newer ones are dropped
+	hookTimeout = 10 * time.Second // a hook running longer is killed
+)
+
+// Hook runs a user's program for results, so they can react to them, e.g.
+// restart an interface when a target goes down, without changing ping. The
+// result is on the program's stdin as a JSON line, and its main fields, and
+// what happened, are in HOOK_* environment variables. Runs happen one at a
+// time, in order, in the background so a slow program doesn't hold up
+// probing.
+type Hook struct {
+	Command string // path of the program
+	Shell   bool   // or a command line for the system's shell, see NewShellHook
+
+	script *Script // or a script to call instead, see NewScriptHook
+
+	queue chan hookRun
+	done  chan struct{}
+
+	mu      sync.Mutex
+	dropped int // runs dropped since the last warning
+}
+
+// a result a hook runs for, and what happened: "result" for every result,
+// or an event like "down"
+type hookRun struct {
+	r     Result
+	event string
+}
+
+// Initialize and start a Hook running the program at path
+func NewHook(path string) *Hook {
+	return (&Hook{Command: path}).start()
+}
+
+// Initialize and start a Hook running command in the system's shell, for
+// one line commands like -on-down's
+func NewShellHook(command string) *Hook {
+	return (&Hook{Command: command, Shell: true}).start()
+}
+
+// Initialize and start a Hook calling s
+func NewScriptHook(s *Script) *Hook {
+	return (&Hook{Command: s.Path, script: s}).start()
+}
+
+// start running the hook for what's queued
+func (h *Hook) start() *Hook {
+	h.queue, h.done = make(chan hookRun, hookQueue), make(chan struct{})
+	go h.run()
+	return h
+}
+
+func (h *Hook) Process(r *Result) bool {
+	h.Run(*r, "result")
+	return true
+}
+
+// Run queues a run of the hook for r, dropping it if too many are queued
+func (h *Hook) Run(r Result, event string) {
+	select {
+	case h.queue <- hookRun{r, event}:
+	default:
+		h.mu.Lock()
+		h.dropped++
+		h.mu.Unlock()
+	}
+}
+
+// Events returns a Stage running the hook for up, down and flapping events
+// only, to follow a StateTracker
+func (h *Hook) Events() Stage {
+	return StageFunc(func(r *Result) bool {
+		switch r.Kind {
+		case KindUp, KindDown, KindFlapping:
+			h.Run(*r, string(r.Kind))
+		}
+		return true
+	})
+}
+
+// Close waits for the runs already queued. Nil hooks are fine, for runs
+// without one.
+func (h *Hook) Close() {
+	if h == nil {
+		return
+	}
+	close(h.queue)
+	<-h.done
+}
+
+// run the hook for everything queued until closed
+func (h *Hook) run() {
+	defer close(h.done)
+	for run := range h.queue {
+		h.mu.Lock()
+		if h.dropped > 0 {
+			logger.Warn("hook not keeping up, dropped runs", "hook", h.Command, "dropped", h.dropped)
+			h.dropped = 0
+		}
+		h.mu.Unlock()
+
+		if err := h.exec(run.r, run.event); err != nil {
+			logger.Error("running hook", "hook", h.Command, "target", run.r.Target, "event", run.event, "err", err)
+		}
+	}
+}
+
+// run the hook once for r, now
+func (h *Hook) exec(r Result, event string) error {
+	if h.script != nil {
+		return h.script.call(r, event)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Command)
+	if h.Shell {
+		cmd = shellCommand(ctx, h.Command)
+	}
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"HOOK_EVENT="+event,
+		"HOOK_KIND="+string(r.Kind),
+		"HOOK_TARGET="+r.Target,
+		"HOOK_ADDR="+r.Addr,
+		"HOOK_PROTO="+r.Proto,
+		"HOOK_SEQ="+strconv.Itoa(r.Seq),
+		fmt.Sprintf("HOOK_RTT_MS=%.3f", r.RTT.Seconds()*1e3),
+	)
+	if r.Err != nil {
+		cmd.Env = append(cmd.Env, "HOOK_ERROR="+r.Err.Error())
+	}
+	return cmd.Run()
+}
+
+// shellCommand returns command run by the system's shell
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
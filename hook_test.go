@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts here")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+
+	// -hook runs a program, spaces in its path and all
+	program := filepath.Join(dir, "on result.sh")
+	script := "#!/bin/sh\necho \"$HOOK_EVENT $HOOK_TARGET\" >> '" + out + "'\n"
+	if err := os.WriteFile(program, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHook(program)
+	h.Run(Result{Target: "example.com"}, "result")
+	h.Close()
+
+	// -on-down and friends run a command line in the shell
+	h = NewShellHook("echo \"$HOOK_EVENT $HOOK_KIND\" >> '" + out + "'")
+	h.Run(Result{Kind: KindDown}, "down")
+	h.Close()
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(string(b)), []string{"result", "example.com", "down", "down"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("hooks wrote %q, want %q", got, want)
+	}
+
+	// runs without a hook close it all the same
+	var none *Hook
+	none.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// wait between rounds of trace -loss
+const lossRoundInterval = time.Second
+
+// hopLoss counts the probes sent to a hop of a trace, or end to end, and
+// how many got no answer
+type hopLoss struct {
+	TTL  int
+	Addr string // "" for hops that never answered
+	Sent int
+	Lost int
+}
+
+func (h hopLoss) loss() float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return float64(h.Lost) / float64(h.Sent) * 100
+}
+
+func (h hopLoss) name() string {
+	if h.Addr == "" {
+		return fmt.Sprintf("hop %d", h.TTL)
+	}
+	return fmt.Sprintf("hop %d (%s)", h.TTL, h.Addr)
+}
+
+// hopProber sends the probes of a trace, ICMP echo requests from a
+// PingClient or TCP SYNs from a TCPTracer
+type hopProber interface {
+	Probe(ctx context.Context) (Result, error)
+	SetTTL(ttl int) error
+	// Round probes with each of ttls at once, plus once end to end
+	Round(ctx context.Context, ttls []int) []Result
+	// the host's address, and the TTL of end to end probes
+	host() (string, int)
+}
+
+// Round probes with each of ttls at once, see probeRound
+func (pc *PingClient) Round(ctx context.Context, ttls []int) []Result {
+	return probeRound(ctx, pc, ttls)
+}
+
+func (pc *PingClient) host() (string, int) {
+	return pc.IPAddr.String(), pc.TTL
+}
+
+// probeRound sends a probe with each of ttls at once, plus one with the
+// client's own TTL for end to end, and returns their results in that order
+func probeRound(ctx context.Context, client *PingClient, ttls []int) []Result {
+	ttl := client.TTL
+	results := make([]Result, len(ttls)+1)
+	var wg sync.WaitGroup
+	var expires []func()
+	var wait time.Duration
+	for i, hop := range append(append([]int(nil), ttls...), ttl) {
+		if err := client.SetTTL(hop); err != nil {
+			results[i] = Result{Kind: KindError, TTL: -1, Err: err}
+			continue
+		}
+		wg.Add(1)
+		expire, timeout := client.ProbeAsync(func(r Result, err error) {
+			results[i] = r
+			wg.Done()
+		})
+		expires = append(expires, expire)
+		wait = max(wait, timeout)
+	}
+	client.SetTTL(ttl)
+
+	answered := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-ctx.Done():
+	case <-time.After(wait):
+	}
+	for _, expire := range expires {
+		expire()
+	}
+	<-answered
+	client.Late()
+	return results
+}
+
+// measureHopLoss probes every hop of a trace and the host, rounds times or
+// until ctx is done, and returns how many probes each lost
+func measureHopLoss(ctx context.Context, hp hopProber, hops []Hop, rounds int) ([]hopLoss, hopLoss) {
+	counts := make([]hopLoss, len(hops))
+	ttls := make([]int, len(hops))
+	for i, hop := range hops {
+		counts[i].TTL = hop.TTL
+		ttls[i] = hop.TTL
+	}
+	addr, ttl := hp.host()
+	e2e := hopLoss{TTL: ttl, Addr: addr}
+
+	for round := 0; round < rounds; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(lossRoundInterval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		results := hp.Round(ctx, ttls)
+		if ctx.Err() != nil {
+			// interrupted mid round, its probes didn't get their chance
+			break
+		}
+		for i, r := range results {
+			c := &e2e
+			if i < len(counts) {
+				c = &counts[i]
+			}
+			c.Sent++
+			if r.Addr == "" || r.Kind == KindTimeout {
+				c.Lost++
+			} else if c.Addr == "" {
+				c.Addr = r.Addr
+			}
+		}
+	}
+	return counts, e2e
+}
+
+// attributeLoss explains the loss of a trace -loss run: where it's likely
+// introduced, the first hop from which every hop after loses about as much
+// as the host does end to end, and which hops only look lossy because they
+// rate limit the ICMP errors they send
+func attributeLoss(hops []hopLoss, e2e hopLoss) []string {
+	var found []string
+	// hops that never answer tell nothing about loss
+	var answering []hopLoss
+	for _, h := range hops {
+		if h.Lost < h.Sent {
+			answering = append(answering, h)
+		} else if h.Sent > 0 {
+			found = append(found, fmt.Sprintf("%s never answers, it isn't counted", h.name()))
+		}
+	}
+	if e2e.Sent == 0 {
+		return append(found, "no probes sent")
+	}
+
+	// loss at a hop that later hops don't share is the router not
+	// answering, not dropping what it forwards
+	for i, h := range answering {
+		after := e2e.loss()
+		for _, later := range answering[i+1:] {
+			after = min(after, later.loss())
+		}
+		if h.loss() > after {
+			found = append(found, fmt.Sprintf("%s doesn't answer %.0f%% of probes but hops after it lose only %.0f%%, likely ICMP rate limiting rather than loss",
+				h.name(), h.loss(), after))
+		}
+	}
+
+	if e2e.Lost == 0 {
+		return append(found, fmt.Sprintf("no loss end to end over %d probes", e2e.Sent))
+	}
+
+	// the first hop from which every hop after loses at least half as much
+	// as end to end
+	start := len(answering)
+	for i := len(answering) - 1; i >= 0; i-- {
+		if answering[i].loss() < e2e.loss()/2 {
+			break
+		}
+		start = i
+	}
+	switch {
+	case start == len(answering):
+		found = append(found, fmt.Sprintf("loss likely introduced at the host itself, or its last link: %.0f%% end to end, less at every hop before", e2e.loss()))
+	case start == 0:
+		found = append(found, fmt.Sprintf("loss likely introduced at %s or the link to it from this host: %.0f%% there and at every hop after, %.0f%% end to end",
+			answering[0].name(), answering[0].loss(), e2e.loss()))
+	default:
+		found = append(found, fmt.Sprintf("loss likely introduced at %s: %.0f%% there and at every hop after, %.0f%% end to end, %.0f%% at %s before it",
+			answering[start].name(), answering[start].loss(), e2e.loss(), answering[start-1].loss(), answering[start-1].name()))
+	}
+	return found
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// longest a hop of a TTL sweep is waited for, silent routers would make it
+// crawl otherwise
+const hopSweepWait = time.Second
+
+// estimateHops sweeps the TTL of client's requests up from 1, a probe each,
+// and returns the first that reached the target, 0 if none up to maxTTL
+// did. It's a quick guess of how far away the target is rather than a
+// traceroute: a lost probe makes it come out too high. The client's TTL is
+// put back after, and late answers to the sweep dropped so they aren't
+// counted with the probes after it.
+func estimateHops(ctx context.Context, client *PingClient, maxTTL int, wait time.Duration) (int, error) {
+	ttl := client.TTL
+	defer func() {
+		client.SetTTL(ttl)
+		client.Late()
+	}()
+	for hop := 1; hop <= maxTTL; hop++ {
+		if err := client.SetTTL(hop); err != nil {
+			return 0, err
+		}
+		hopCtx, cancel := context.WithTimeout(ctx, min(wait, hopSweepWait))
+		res, err := client.Probe(hopCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if errors.Is(err, ErrPermission) {
+			return 0, err
+		}
+		if res.Kind == KindReply {
+			return hop, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// icmpErrors listens on a raw socket for the ICMP errors about the probes of
+// a TCPTracer or UDPTracer, and hands each to the probe waiting for it by the
+// source port it quotes, every probe is sent from a port of its own
+type icmpErrors struct {
+	dst   net.IP
+	proto byte // of the probes, IPPROTO_TCP or IPPROTO_UDP
+	ipv4  bool
+	conn  *icmp.PacketConn
+
+	mu      sync.Mutex
+	waiting map[int]chan hopAnswer // by local port
+}
+
+// an ICMP error about a probe of ours, err is nil for port unreachable from
+// the host, which means it was reached
+type hopAnswer struct {
+	from string
+	at   time.Time
+	err  error
+	mpls []MPLSLabel
+}
+
+// listen for ICMP errors about probes of proto to dst
+func listenICMPErrors(dst net.IP, proto byte) (*icmpErrors, error) {
+	ie := &icmpErrors{
+		dst:     dst,
+		proto:   proto,
+		ipv4:    dst.To4() != nil,
+		waiting: make(map[int]chan hopAnswer),
+	}
+	network, listen := "ip6:ipv6-icmp", "::"
+	if ie.ipv4 {
+		network, listen = "ip4:icmp", "0.0.0.0"
+	}
+	var err error
+	if ie.conn, err = icmp.ListenPacket(network, listen); err != nil {
+		return nil, classify(err)
+	}
+	go ie.receive()
+	return ie, nil
+}
+
+// wait has the error about the probe from port sent on answers, until
+// forget
+func (ie *icmpErrors) wait(port int, answers chan hopAnswer) {
+	ie.mu.Lock()
+	ie.waiting[port] = answers
+	ie.mu.Unlock()
+}
+
+func (ie *icmpErrors) forget(port int) {
+	ie.mu.Lock()
+	delete(ie.waiting, port)
+	ie.mu.Unlock()
+}
+
+func (ie *icmpErrors) Close() error {
+	return ie.conn.Close()
+}
+
+// read ICMP errors and hand the ones about our probes to them
+func (ie *icmpErrors) receive() {
+	proto, portUnreachable := ProtocolICMPv6, 4
+	if ie.ipv4 {
+		proto, portUnreachable = ProtocolICMP, 3
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := ie.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		a := hopAnswer{from: peer.String(), at: now}
+		var quoted []byte
+		switch body := msg.Body.(type) {
+		case *icmp.TimeExceeded:
+			quoted, a.err, a.mpls = body.Data, ErrTTLExceeded, mplsLabels(body.Extensions)
+		case *icmp.DstUnreach:
+			quoted, a.err = body.Data, ErrHostUnreachable
+			if msg.Code == portUnreachable {
+				a.err = nil
+			}
+		default:
+			continue
+		}
+		port, ok := ie.quotedPort(quoted)
+		if !ok {
+			continue
+		}
+		ie.mu.Lock()
+		answers, ok := ie.waiting[port]
+		ie.mu.Unlock()
+		if !ok {
+			continue
+		}
+		select {
+		case answers <- a:
+		default:
+		}
+	}
+}
+
+// quotedPort returns the source port of the probe quoted in an ICMP error,
+// if it was one to dst
+func (ie *icmpErrors) quotedPort(data []byte) (int, bool) {
+	var dst net.IP
+	var l4 []byte
+	if ie.ipv4 {
+		if len(data) < 20 {
+			return 0, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		if data[9] != ie.proto || len(data) < ihl+2 {
+			return 0, false
+		}
+		dst, l4 = data[16:20], data[ihl:]
+	} else {
+		if len(data) < 42 || data[6] != ie.proto {
+			return 0, false
+		}
+		dst, l4 = data[24:40], data[40:]
+	}
+	if !dst.Equal(ie.dst) {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(l4[0:2])), true
+}
+
+// result of the probe started at start that a was about
+func (a hopAnswer) result(res Result, start time.Time) (Result, error) {
+	res.RTT = a.at.Sub(start)
+	res.Addr = a.from
+	res.MPLS = a.mpls
+	return complete(res, a.err)
+}
+
+// probeTTLs probes with each of ttls at once, plus once with ttl for end to
+// end, like probeRound, for probers that send from sockets of their own
+func probeTTLs(ctx context.Context, ttls []int, ttl int, probe func(context.Context, int) (Result, error)) []Result {
+	ttls = append(append([]int(nil), ttls...), ttl)
+	results := make([]Result, len(ttls))
+	var wg sync.WaitGroup
+	for i, ttl := range ttls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _ = probe(ctx, ttl)
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// longest to wait for an LLMNR or NetBIOS answer, Windows waits about
+	// as long
+	llmnrTimeout = time.Second
+
+	// how often the query is sent again while no one has answered
+	llmnrResend = 250 * time.Millisecond
+
+	// NetBIOS names are 15 characters at most, the 16th says what the name
+	// is of, 0x00 for a workstation
+	netbiosNameLen = 15
+)
+
+var (
+	llmnrGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 252), Port: 5355}
+	llmnrGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::1:3"), Port: 5355}
+)
+
+// whether single-label names DNS can't look up are asked for on the LAN with
+// LLMNR and NetBIOS, as Windows does, set by parseFlags from -llmnr which is
+// only offered on Windows
+var nameFallback bool
+
+// names without a dot, like a Windows machine's, that LLMNR and NetBIOS
+// answer for
+func isSingleLabel(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	return name != "" && !strings.Contains(name, ".")
+}
+
+// lookupLANName asks the LAN who has name, a single label, with LLMNR and
+// then NetBIOS, the way Windows falls back when DNS doesn't know a name
+func lookupLANName(ctx context.Context, name string) ([]net.IPAddr, error) {
+	addrs, err := queryLLMNR(ctx, name)
+	if err == nil {
+		return addrs, nil
+	}
+	if len(name) > netbiosNameLen {
+		return nil, err
+	}
+	if addrs, nberr := queryNetBIOS(ctx, name); nberr == nil {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no answer to LLMNR or NetBIOS query", Name: name, IsNotFound: true}
+}
+
+// queryLLMNR asks the LAN for the addresses of name with Link-Local
+// Multicast Name Resolution (RFC 4795), DNS queries to a multicast group
+// that the machine with the name answers, one question a query
+func queryLLMNR(ctx context.Context, name string) ([]net.IPAddr, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	var queries [][]byte
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		q, err := (&dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(os.Getpid()) + uint16(i)},
+			Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+		}).Pack()
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queryMulticast(ctx, "LLMNR", qname, llmnrGroup4, llmnrGroup6, llmnrTimeout, llmnrResend, queries...)
+}
+
+// queryNetBIOS broadcasts a NetBIOS name query (RFC 1002 4.2.12) for name on
+// every IPv4 network the host is on, for machines that only answer those,
+// like older Windows and Samba servers. NetBIOS only has IPv4 addresses.
+func queryNetBIOS(ctx context.Context, name string) ([]net.IPAddr, error) {
+	dsts, err := broadcastAddrs()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	id := uint16(os.Getpid())
+	query := netbiosQuery(id, name)
+
+	ctx, cancel := context.WithTimeout(ctx, llmnrTimeout)
+	defer cancel()
+	answers := make(chan []net.IPAddr, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if addrs := netbiosAddrs(buf[:n], id); len(addrs) > 0 {
+				answers <- addrs
+				return
+			}
+		}
+	}()
+
+	resend := time.NewTicker(llmnrResend)
+	defer resend.Stop()
+	for {
+		for _, dst := range dsts {
+			conn.WriteToUDP(query, dst)
+		}
+		select {
+		case addrs := <-answers:
+			return addrs, nil
+		case <-resend.C:
+		case <-ctx.Done():
+			return nil, &net.DNSError{Err: "no answer to NetBIOS query", Name: name, IsTimeout: true, IsNotFound: true}
+		}
+	}
+}
+
+// netbiosQuery returns a broadcast name query for the workstation name
+func netbiosQuery(id uint16, name string) []byte {
+	q := binary.BigEndian.AppendUint16(nil, id)
+	// a recursion desired, broadcast query, of one question
+	q = append(q, 0x01, 0x10, 0, 1, 0, 0, 0, 0, 0, 0)
+	// the name, upper case and padded with spaces, then its suffix, each
+	// half byte as a letter from A
+	padded := fmt.Sprintf("%-15s\x00", strings.ToUpper(name))
+	q = append(q, 32)
+	for i := 0; i < len(padded); i++ {
+		q = append(q, 'A'+padded[i]>>4, 'A'+padded[i]&0x0f)
+	}
+	// of type NB, class IN
+	return append(q, 0, 0, 0x20, 0, 1)
+}
+
+// netbiosAddrs returns the addresses in an answer to the name query id
+func netbiosAddrs(msg []byte, id uint16) []net.IPAddr {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.ID != id || !h.Response || h.RCode != dnsmessage.RCodeSuccess {
+		return nil
+	}
+	if p.SkipAllQuestions() != nil {
+		return nil
+	}
+	var addrs []net.IPAddr
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type != 0x20 {
+			p.SkipAnswer()
+			continue
+		}
+		rr, err := p.UnknownResource()
+		if err != nil {
+			break
+		}
+		// two bytes of flags, then the address, for each of the name's
+		for d := rr.Data; len(d) >= 6; d = d[6:] {
+			addrs = append(addrs, net.IPAddr{IP: net.IPv4(d[2], d[3], d[4], d[5])})
+		}
+	}
+	return addrs
+}
+
+// the broadcast addresses of the IPv4 networks of the interfaces that are up
+// and can broadcast, at the NetBIOS name service port
+func broadcastAddrs() ([]*net.UDPAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var dsts []*net.UDPAddr
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || ipn.IP.To4() == nil || len(ipn.Mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i, b := range ipn.IP.To4() {
+				bcast[i] = b | ^ipn.Mask[i]
+			}
+			dsts = append(dsts, &net.UDPAddr{IP: bcast, Port: 137})
+		}
+	}
+	if len(dsts) == 0 {
+		return nil, errors.New("NetBIOS: no IPv4 network to broadcast on")
+	}
+	return dsts, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "flag"
+
+// -llmnr is only offered on Windows, where names are looked up that way
+func registerLLMNR(fs *flag.FlagSet, on *bool) {}
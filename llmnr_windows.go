@@ -0,0 +1,9 @@
+package main
+
+import "flag"
+
+// registerLLMNR adds -llmnr to fs, to look up names the way Windows' own
+// ping does when asked to
+func registerLLMNR(fs *flag.FlagSet, on *bool) {
+	fs.BoolVar(on, "llmnr", false, "Ask the LAN with LLMNR, then NetBIOS, for names without a dot that DNS can't look up, as Windows' own ping does")
+}
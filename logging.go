@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// level of the messages that are logged, set with -log-level
+var logLevel = new(slog.LevelVar)
+
+// logger is used for diagnostics, results and summaries still go to stdout
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// logLevelFlag is a flag.Value setting logLevel
+type logLevelFlag struct{}
+
+func (logLevelFlag) String() string {
+	return strings.ToLower(logLevel.Level().String())
+}
+
+func (logLevelFlag) Set(s string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", s)
+	}
+	logLevel.Set(level)
+	return nil
+}
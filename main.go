@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand of the cli, e.g. `ping trace example.com`
+type command struct {
+	name  string                  // verb used on the command line
+	args  string                  // positional arguments, for usage
+	short string                  // one line description
+	run   func(args []string) int // runs the command, returns exit code
+}
+
+var commands []*command
+
+func init() {
+	// set here rather than in the declaration because help refers to it
+	commands = []*command{
+		{"ping", "[flags] host", "send probes to a host until interrupted", runPing},
+		{"trace", "[flags] host", "print the route packets take to a host", runTrace},
+		{"frag", "[flags] host", "check whether fragmented probes get through to a host, and DF ones are refused", runFrag},
+		{"pmtu", "[flags] host", "find the path MTU to a host, and whether the path is an MTU black hole", runPMTU},
+		{"bw", "[flags] host", "estimate the bottleneck bandwidth to a host from how far apart replies to back to back probes arrive", runBW},
+		{"bloat", "[flags] host", "grade how much a host's RTT grows while the link is loaded (bufferbloat)", runBloat},
+		{"asym", "[flags] host", "estimate the one way delays to a host from ICMP timestamps, to spot asymmetric paths", runAsym},
+		{"clockdiff", "[flags] host", "estimate how far a host's clock is off ours from ICMP timestamps", runClockdiff},
+		{"compare", "[flags] host host", "probe two hosts side by side, e.g. your ISP and a service", runCompare},
+		{"flows", "[flags] host", "probe a host over several flows at once, e.g. DSCP classes or flow labels, to spot per-flow policing or ECMP paths", runFlows},
+		{"assert", "[flags] host", "fail unless probes of a host meet the given limits, for CI", runAssert},
+		{"sweep", "[flags] [cidr]", "find which hosts in a network or file answer", runSweep},
+		{"serve", "[flags] host...", "continuously monitor several hosts", runServe},
+		{"report", "[sla] [flags] [file...]", "summarize results saved with -o json, or the uptime of targets", runReport},
+		{"install-caps", "[flags] [binary]", "let non-root users send ICMP (run with sudo)", runInstallCaps},
+		{"help", "[command]", "show help for a command", runHelp},
+	}
+}
+
+// find a command by name
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns the flag set of a command, its usage lists the command's
+// arguments before the flags
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: ping %s %s\n\n%s\n\nflags:\n", cmd.name, cmd.args, cmd.short)
+		fs.PrintDefaults()
+	}
+	fs.Var(logLevelFlag{}, "log-level", "Diagnostics to log: debug, info, warn or error")
+	return fs
+}
+
+// parse a command's flags from the environment and then args, exits on error
+func parseFlags(fs *flag.FlagSet, args []string) {
+	// every flag can also be set with a PING_* environment variable
+	if err := applyEnv(fs); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	fs.Parse(args)
+
+	// commands that send probes open their sockets in -netns
+	if f := fs.Lookup("netns"); f != nil && f.Value.String() != "" {
+		if err := enterNetns(f.Value.String()); err != nil {
+			fmt.Println("entering network namespace:", err)
+			os.Exit(1)
+		}
+	}
+	// and look names up with -resolver
+	if f := fs.Lookup("resolver"); f != nil && f.Value.String() != "" {
+		server, err := useResolver(f.Value.String())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		f.Value.Set(server)
+		resolverServer = server
+	}
+	// and from where -resolve-from says
+	if f := fs.Lookup("resolve-from"); f != nil {
+		m, _ := fs.Lookup("static-map").Value.(staticMapFlag)
+		if err := useResolveFrom(f.Value.String(), m); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if f := fs.Lookup("llmnr"); f != nil {
+		nameFallback = f.Value.String() == "true"
+	}
+}
+
+// report whether flag name was given, on the command line or in the
+// environment
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func runHelp(args []string) int {
+	if len(args) > 0 {
+		if cmd := lookupCommand(args[0]); cmd != nil && cmd.name != "help" {
+			cmd.run([]string{"-h"})
+			return 0
+		}
+	}
+
+	fmt.Println("usage: ping [command] [flags] args\n\ncommands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-13s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Println("\nwithout a command, ping is assumed. run `ping help <command>` for its flags")
+	return 0
+}
+
+func main() {
+	args := os.Args[1:]
+
+	// ./ping {addr = IP || DomainName} still works without the ping verb
+	cmd := lookupCommand("ping")
+	if len(args) > 0 {
+		if c := lookupCommand(args[0]); c != nil {
+			cmd, args = c, args[1:]
+		}
+	}
+
+	os.Exit(cmd.run(args))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// longest to wait for a device to answer an mDNS query
+	mdnsTimeout = 2 * time.Second
+
+	// how often the query is sent again while no one has answered, as
+	// datagrams on Wi-Fi get lost
+	mdnsResend = 500 * time.Millisecond
+)
+
+var (
+	mdnsGroup4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// .local names are the LAN's own, answered by the devices themselves with
+// multicast DNS rather than by a DNS server
+func isMDNSName(host string) bool {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.HasSuffix(name, ".local")
+}
+
+// queryMDNS asks the LAN for the addresses of a .local name with multicast
+// DNS, like printers and Macs are found. Go's resolver only does that
+// through the system's, if it has one set up for it. The query is sent from
+// a port of its own, so the device answers it straight back (a one-shot
+// query, RFC 6762 5.1).
+func queryMDNS(ctx context.Context, name string) ([]net.IPAddr, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	query, err := (&dnsmessage.Message{
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+			{Name: qname, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	return queryMulticast(ctx, "mDNS", qname, mdnsGroup4, mdnsGroup6, mdnsTimeout, mdnsResend, query)
+}
+
+// queryMulticast sends queries about qname to group4 and group6 on every
+// interface that can multicast, again every resend, until an answer with
+// addresses of qname comes back or timeout passes. proto names the protocol
+// in errors.
+func queryMulticast(ctx context.Context, proto string, qname dnsmessage.Name, group4, group6 *net.UDPAddr, timeout, resend time.Duration, queries ...[]byte) ([]net.IPAddr, error) {
+	ifaces, err := multicastInterfaces()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", proto, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	answers := make(chan []net.IPAddr, 1)
+	var sends []func()
+	if c4, err := net.ListenUDP("udp4", nil); err == nil {
+		defer c4.Close()
+		pc := ipv4.NewPacketConn(c4)
+		pc.SetMulticastLoopback(true)
+		sends = append(sends, func() {
+			for _, ifi := range ifaces {
+				if pc.SetMulticastInterface(&ifi) == nil {
+					for _, q := range queries {
+						pc.WriteTo(q, nil, group4)
+					}
+				}
+			}
+		})
+		go readMDNS(c4, qname, answers)
+	}
+	if c6, err := net.ListenUDP("udp6", nil); err == nil {
+		defer c6.Close()
+		pc := ipv6.NewPacketConn(c6)
+		pc.SetMulticastLoopback(true)
+		sends = append(sends, func() {
+			for _, ifi := range ifaces {
+				if pc.SetMulticastInterface(&ifi) == nil {
+					for _, q := range queries {
+						pc.WriteTo(q, nil, group6)
+					}
+				}
+			}
+		})
+		go readMDNS(c6, qname, answers)
+	}
+
+	ticker := time.NewTicker(resend)
+	defer ticker.Stop()
+	for {
+		for _, send := range sends {
+			send()
+		}
+		select {
+		case addrs := <-answers:
+			return addrs, nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, &net.DNSError{Err: "no answer to " + proto + " query", Name: strings.TrimSuffix(qname.String(), "."), IsTimeout: true, IsNotFound: true}
+		}
+	}
+}
+
+// readMDNS reads answers to the queries for qname from conn until it's
+// closed, and sends on the addresses of the first one that has some. LLMNR
+// answers are in the same format.
+func readMDNS(conn *net.UDPConn, qname dnsmessage.Name, answers chan<- []net.IPAddr) {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Response {
+			continue
+		}
+		var addrs []net.IPAddr
+		// devices put the records of the name in the additional section
+		// too, when answering for another of theirs
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			if !strings.EqualFold(rr.Header.Name.String(), qname.String()) {
+				continue
+			}
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+			case *dnsmessage.AAAAResource:
+				// a link-local address is only any use on the interface
+				// it was answered on, which only an IPv6 answer says
+				a := net.IPAddr{IP: net.IP(body.AAAA[:])}
+				if a.IP.IsLinkLocalUnicast() {
+					if from.Zone == "" {
+						continue
+					}
+					a.Zone = from.Zone
+				}
+				addrs = append(addrs, a)
+			}
+		}
+		if len(addrs) > 0 {
+			select {
+			case answers <- addrs:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// the interfaces that are up and can multicast, other than loopback unless
+// it's the only one
+func multicastInterfaces() ([]net.Interface, error) {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces, loopback []net.Interface
+	for _, ifi := range all {
+		switch {
+		case ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0:
+		case ifi.Flags&net.FlagLoopback != 0:
+			loopback = append(loopback, ifi)
+		default:
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	if len(ifaces) == 0 {
+		ifaces = loopback
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no interface can multicast")
+	}
+	return ifaces, nil
+}
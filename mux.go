@@ -0,0 +1,448 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+)
+
+// Mux shares one raw ICMP socket per address family between many
+// PingClients, so monitoring or sweeping thousands of targets doesn't need
+// thousands of sockets. A reader goroutine per socket hands every message to
+// the client it belongs to, matched by identifier and address; the client
+// then checks the sequence number as usual.
+//
+// Messages are read and written in batches, using recvmmsg/sendmmsg on Linux,
+// so sweeps and high rates don't cost a syscall per packet.
+//
+// At tens of thousands of packets a second a single reader can't keep up,
+// with Shards set clients are spread over that many sockets by identifier,
+// each only passed its own clients' messages by a filter and read on its own
+// CPU. A reply with an identifier rewritten by a NAT then only finds its
+// client if it lands on the same socket.
+//
+// The TTL is a socket option, so it is shared by every client of a socket.
+type Mux struct {
+	Shards int // sockets per address family, 0 for one
+
+	mu    sync.Mutex
+	conns map[bool][]*muxConn // by ipv4, then shard
+}
+
+// max messages moved per syscall
+const muxBatchSize = 16
+
+// receive buffer of a shared socket, big enough for the burst of replies a
+// sweep of many hosts at once gets back
+const muxReadBuffer = 4 << 20
+
+// a shared socket and the clients reading from it
+type muxConn struct {
+	t       *icmpTransport
+	ipv4    bool
+	mu      sync.Mutex
+	clients map[muxKey]*muxTransport
+	byAddr  map[netip.Addr][]*muxTransport // for echo replies with a rewritten identifier
+	sendq   chan *muxSend                  // writes waiting to be batched
+	closed  chan struct{}
+}
+
+// a write queued on a shared socket
+type muxSend struct {
+	b    []byte
+	dst  net.Addr
+	done chan error
+}
+
+// identifies the client a message is for
+type muxKey struct {
+	id   int
+	addr netip.Addr
+}
+
+// a message routed to a client
+type muxPacket struct {
+	buf  *[]byte // pooled buffer holding data, returned once read
+	data []byte
+	ttl  int
+	peer net.Addr
+}
+
+// Initialize and return a Mux, sockets are opened on first use
+func NewMux() *Mux {
+	return &Mux{conns: make(map[bool][]*muxConn)}
+}
+
+// Transport returns a Transport for the client using identifier id to ping
+// dst. Every client of the mux needs a distinct identifier/destination pair.
+func (m *Mux) Transport(ipv4 bool, id int, dst *net.IPAddr) (Transport, error) {
+	// Linux sets the identifier of requests on datagram sockets to the
+	// socket's port, so clients can't share one and get their own instead
+	if access, _ := detectICMP(); access == accessDgram && runtime.GOOS == "linux" {
+		t, err := listenICMPDgram(ipv4)
+		if err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.conns[ipv4]; !ok {
+		conns, err := m.listen(ipv4)
+		if err != nil {
+			return nil, err
+		}
+		m.conns[ipv4] = conns
+	}
+	conns := m.conns[ipv4]
+	mc := conns[(id&0xffff)%len(conns)]
+
+	t := &muxTransport{
+		mc:     mc,
+		key:    muxKey{id: id & 0xffff, addr: ipKey(dst.IP, dst.Zone)},
+		ch:     make(chan muxPacket, 8),
+		done:   make(chan error, 1),
+		wake:   make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	mc.mu.Lock()
+	mc.clients[t.key] = t
+	mc.byAddr[t.key.addr] = append(mc.byAddr[t.key.addr], t)
+	mc.mu.Unlock()
+	return t, nil
+}
+
+// open the shared sockets of an address family, and start reading and
+// writing them
+func (m *Mux) listen(ipv4 bool) ([]*muxConn, error) {
+	shards := max(m.Shards, 1)
+	conns := make([]*muxConn, 0, shards)
+	for shard := range shards {
+		t, err := listenICMP(ipv4)
+		if err != nil {
+			for _, mc := range conns {
+				close(mc.closed)
+				mc.t.Close()
+			}
+			return nil, err
+		}
+		if err := t.SetReadBuffer(muxReadBuffer); err != nil {
+			logger.Debug("can't grow socket receive buffer", "err", err)
+		}
+		if shards == 1 {
+			err = t.setFilter(-1, nil)
+		} else {
+			err = t.setShardFilter(shard, shards)
+		}
+		if err != nil {
+			// every socket gets every message, and drops the other shards'
+			logger.Debug("can't filter socket", "err", err)
+		}
+		conns = append(conns, &muxConn{
+			t:       t,
+			ipv4:    ipv4,
+			clients: make(map[muxKey]*muxTransport),
+			byAddr:  make(map[netip.Addr][]*muxTransport),
+			sendq:   make(chan *muxSend, muxBatchSize),
+			closed:  make(chan struct{}),
+		})
+	}
+	for shard, mc := range conns {
+		cpu := -1
+		if shards > 1 {
+			cpu = shard % runtime.NumCPU()
+		}
+		go mc.read(cpu)
+		go mc.write()
+	}
+	return conns, nil
+}
+
+// Close closes the shared sockets
+func (m *Mux) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for ipv4, conns := range m.conns {
+		for _, mc := range conns {
+			close(mc.closed)
+			mc.t.Close()
+		}
+		delete(m.conns, ipv4)
+	}
+	return nil
+}
+
+// read messages from the socket and route them until it is closed, on the
+// given CPU if it isn't -1
+func (mc *muxConn) read(cpu int) {
+	if cpu >= 0 {
+		// the thread stays with this goroutine, and so on the CPU
+		runtime.LockOSThread()
+		if err := pinThread(cpu); err != nil {
+			logger.Debug("can't pin socket reader to CPU", "cpu", cpu, "err", err)
+		}
+	}
+
+	ms := make([]xipv4.Message, muxBatchSize)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, 1<<16)}
+		ms[i].OOB = make([]byte, mc.t.oobSize())
+	}
+
+	for {
+		n, err := mc.t.ReadBatch(ms)
+		if err != nil {
+			return
+		}
+		for _, m := range ms[:n] {
+			mc.route(m.Buffers[0][:m.N], mc.t.parseTTL(m.OOB[:m.NN]), m.Addr)
+		}
+	}
+}
+
+// hand a message to the client it is for, if any
+func (mc *muxConn) route(b []byte, ttl int, peer net.Addr) {
+	proto := ProtocolICMP
+	if !mc.ipv4 {
+		proto = ProtocolICMPv6
+	}
+
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		return
+	}
+
+	var key muxKey
+	_, echo := msg.Body.(*icmp.Echo)
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		key = muxKey{id: body.ID, addr: ipKey(addrIP(peer), addrZone(peer))}
+	case *icmp.TimeExceeded:
+		dst, id, _, ok := quotedEcho(body.Data, mc.ipv4)
+		if !ok {
+			return
+		}
+		key = muxKey{id: id, addr: ipKey(dst, addrZone(peer))}
+	case *icmp.DstUnreach:
+		dst, id, _, ok := quotedEcho(body.Data, mc.ipv4)
+		if !ok {
+			return
+		}
+		key = muxKey{id: id, addr: ipKey(dst, addrZone(peer))}
+	default:
+		return
+	}
+
+	mc.mu.Lock()
+	t, ok := mc.clients[key]
+	if !ok && echo && len(mc.byAddr[key.addr]) == 1 {
+		// a NAT may have rewritten the identifier, if the client pinging
+		// the address finds its nonce in the reply it's still its own
+		t, ok = mc.byAddr[key.addr][0], true
+	}
+	var fn func([]byte, RecvInfo)
+	if ok {
+		fn = t.fn
+	}
+	mc.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// clients with a handler get the message right away, without a copy
+	if fn != nil {
+		fn(b, RecvInfo{Peer: peer, TTL: ttl})
+		return
+	}
+
+	pb := getBuf(len(b))
+	pkt := muxPacket{buf: pb, data: (*pb)[:copy(*pb, b)], ttl: ttl, peer: peer}
+	select {
+	case t.ch <- pkt:
+	default:
+		putBuf(pb)
+		logger.Debug("dropping message, client not reading", "target", key.addr)
+	}
+}
+
+// send queued writes, coalescing whatever is waiting into one batch
+func (mc *muxConn) write() {
+	ms := make([]xipv4.Message, muxBatchSize)
+	reqs := make([]*muxSend, 0, muxBatchSize)
+
+	for {
+		select {
+		case req := <-mc.sendq:
+			reqs = append(reqs[:0], req)
+		case <-mc.closed:
+			return
+		}
+
+	drain:
+		for len(reqs) < muxBatchSize {
+			select {
+			case req := <-mc.sendq:
+				reqs = append(reqs, req)
+			default:
+				break drain
+			}
+		}
+
+		for i, req := range reqs {
+			ms[i] = xipv4.Message{Buffers: [][]byte{req.b}, Addr: req.dst}
+		}
+
+		// WriteBatch may send only part of the batch
+		sent := 0
+		for sent < len(reqs) {
+			n, err := mc.t.WriteBatch(ms[sent:len(reqs)])
+			if err != nil {
+				for _, req := range reqs[sent:] {
+					req.done <- err
+				}
+				break
+			}
+			for _, req := range reqs[sent : sent+n] {
+				req.done <- nil
+			}
+			sent += n
+		}
+	}
+}
+
+// return an IP in a form usable as a map key. Link-local addresses keep
+// their zone, the same one can be on several links.
+func ipKey(ip net.IP, zone string) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	addr = addr.Unmap()
+	if addr.Is6() && (addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()) {
+		addr = addr.WithZone(zone)
+	}
+	return addr
+}
+
+// muxTransport is one client's view of a shared socket
+type muxTransport struct {
+	mc   *muxConn
+	key  muxKey
+	ch   chan muxPacket         // messages for ReadFrom
+	fn   func([]byte, RecvInfo) // or the handler set with OnReceive, guarded by mc.mu
+	done chan error             // result of this client's queued write
+
+	mu       sync.Mutex
+	deadline time.Time
+	wake     chan struct{} // closed when the deadline changes
+	closed   chan struct{} // closed by Close
+}
+
+// WriteTo queues b to be sent with the next batch and waits until it is
+func (t *muxTransport) WriteTo(b []byte, dst net.Addr) (int, error) {
+	select {
+	case t.mc.sendq <- &muxSend{b: b, dst: dst, done: t.done}:
+	case <-t.mc.closed:
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case err := <-t.done:
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	case <-t.mc.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (t *muxTransport) ReadFrom(b []byte) (int, RecvInfo, error) {
+	for {
+		t.mu.Lock()
+		deadline, wake := t.deadline, t.wake
+		t.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, RecvInfo{TTL: -1}, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case pkt := <-t.ch:
+			n := copy(b, pkt.data)
+			putBuf(pkt.buf)
+			return n, RecvInfo{Peer: pkt.peer, TTL: pkt.ttl}, nil
+		case <-timeout:
+			return 0, RecvInfo{TTL: -1}, os.ErrDeadlineExceeded
+		case <-t.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, RecvInfo{TTL: -1}, net.ErrClosed
+		case <-t.mc.closed:
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, RecvInfo{TTL: -1}, net.ErrClosed
+		case <-wake:
+			// deadline changed, check it again
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// OnReceive has fn called with every message for this client, from the
+// goroutine reading the shared socket, instead of queueing them for ReadFrom.
+// fn must not block.
+func (t *muxTransport) OnReceive(fn func(b []byte, info RecvInfo)) {
+	t.mc.mu.Lock()
+	defer t.mc.mu.Unlock()
+	t.fn = fn
+}
+
+func (t *muxTransport) SetReadDeadline(deadline time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.deadline = deadline
+	close(t.wake)
+	t.wake = make(chan struct{})
+	return nil
+}
+
+// SetTTL sets the ttl of the shared socket, for every client of the mux
+func (t *muxTransport) SetTTL(ttl int) error {
+	return t.mc.t.SetTTL(ttl)
+}
+
+// Close stops routing messages to this client, the shared socket stays open
+func (t *muxTransport) Close() error {
+	t.mc.mu.Lock()
+	defer t.mc.mu.Unlock()
+	if _, ok := t.mc.clients[t.key]; ok {
+		delete(t.mc.clients, t.key)
+		close(t.closed)
+	}
+	clients := slices.DeleteFunc(t.mc.byAddr[t.key.addr], func(c *muxTransport) bool { return c == t })
+	if len(clients) == 0 {
+		delete(t.mc.byAddr, t.key.addr)
+	} else {
+		t.mc.byAddr[t.key.addr] = clients
+	}
+	return nil
+}
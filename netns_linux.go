@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// where ip netns keeps the namespaces it names
+const netnsDir = "/var/run/netns"
+
+// enterNetns moves the process into the network namespace name, one named
+// by ip netns or the path of one like /proc/<pid>/ns/net, so every socket
+// is opened in it. Namespaces belong to threads and Go runs on many, so like
+// ip netns exec this starts the program over inside it. Returns straight
+// away once in it.
+func enterNetns(name string) error {
+	path := name
+	if !strings.Contains(name, "/") {
+		path = filepath.Join(netnsDir, name)
+	}
+	target, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	self, err := os.Stat("/proc/self/ns/net")
+	if err != nil {
+		return err
+	}
+	if os.SameFile(target, self) {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// never unlocked, the thread is left in the namespace for exec
+	runtime.LockOSThread()
+	if err := unix.Setns(int(f.Fd()), unix.CLONE_NEWNET); err != nil {
+		return err
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// a notification command taking longer than this is killed
+const notifyTimeout = 5 * time.Second
+
+// notifyEvent shows a desktop notification for an event of an
+// EventWatcher, so nobody has to watch the terminal
+func notifyEvent(event string, r Result) {
+	switch event {
+	case "up":
+		notify(r.Target+" is UP", fmt.Sprintf("%s_seq=%d time=%.1f ms", r.Proto, r.Seq, r.RTT.Seconds()*1e3))
+	case "down":
+		notify(r.Target+" is DOWN", fmt.Sprint(r.Err))
+	case "flapping":
+		notify(r.Target+" is FLAPPING", "not reporting its state until it settles")
+	case "slow":
+		notify(r.Target+" is slow", fmt.Sprintf("%.1f ms", r.RTT.Seconds()*1e3))
+	case "fast":
+		notify(r.Target+" is fast again", fmt.Sprintf("%.1f ms", r.RTT.Seconds()*1e3))
+	}
+}
+
+// notifyCommand returns the command showing a desktop notification on
+// this system
+func notifyCommand(ctx context.Context, title, body string) (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.CommandContext(ctx, "osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run", title, body), nil
+	case "windows", "plan9", "js", "wasip1":
+		return nil, fmt.Errorf("desktop notifications aren't supported on %s", runtime.GOOS)
+	}
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return nil, fmt.Errorf("desktop notifications need notify-send: %w", err)
+	}
+	return exec.CommandContext(ctx, "notify-send", "--app-name=ping", title, body), nil
+}
+
+// notify shows a desktop notification in the background
+func notify(title, body string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		cmd, err := notifyCommand(ctx, title, body)
+		if err == nil {
+			err = cmd.Run()
+		}
+		if err != nil {
+			logger.Error("desktop notification", "title", title, "err", err)
+		}
+	}()
+}
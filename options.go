@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// default settings used when an option is not provided
+const (
+	DefaultSize     = 64
+	DefaultTTL      = 64
+	DefaultInterval = time.Second
+	DefaultTimeout  = 5 * time.Second
+
+	// largest message body that fits in an IPv4 packet, 65535 minus the IP
+	// and ICMP headers. Bodies that don't fit the path MTU are fragmented.
+	MaxSize = 65535 - 20 - 8
+)
+
+// Option configures a PingClient, see New
+type Option func(*PingClient)
+
+// WithSize sets the message body size (bytes)
+func WithSize(size int) Option {
+	return func(pc *PingClient) {
+		pc.MsgSize = size
+	}
+}
+
+// WithTTL sets the time to live (IPv4) or hop limit (IPv6) of each request
+func WithTTL(ttl int) Option {
+	return func(pc *PingClient) {
+		pc.TTL = ttl
+	}
+}
+
+// WithInterval sets the delay between consecutive requests
+func WithInterval(d time.Duration) Option {
+	return func(pc *PingClient) {
+		pc.Interval = d
+	}
+}
+
+// WithTimeout sets how long to wait for a reply before giving up
+func WithTimeout(d time.Duration) Option {
+	return func(pc *PingClient) {
+		pc.Timeout = d
+	}
+}
+
+// WithTransport makes the client use t instead of opening a raw ICMP socket
+func WithTransport(t Transport) Option {
+	return func(pc *PingClient) {
+		pc.Transport = t
+	}
+}
+
+// WithClock makes the client measure time with c instead of the system clock
+func WithClock(c Clock) Option {
+	return func(pc *PingClient) {
+		pc.Clock = c
+	}
+}
+
+// WithMux makes the client send and recieve through m's shared socket
+// instead of opening a socket of its own
+func WithMux(m *Mux) Option {
+	return func(pc *PingClient) {
+		pc.mux = m
+	}
+}
+
+// WithID sets the icmp identifier of requests, by default the process id
+func WithID(id int) Option {
+	return func(pc *PingClient) {
+		pc.ID = id & 0xffff
+	}
+}
+
+// WithFlowLabel sets the flow label of requests to IPv6 targets, keeping it
+// the same for every request so they are hashed onto the same path
+func WithFlowLabel(label int) Option {
+	return func(pc *PingClient) {
+		pc.FlowLabel = label & 0xfffff
+	}
+}
+
+// WithDSCP sets the DSCP of requests, so they get the treatment routers on
+// the path give that class of traffic
+func WithDSCP(d DSCP) Option {
+	return func(pc *PingClient) {
+		pc.DSCP = d
+	}
+}
+
+// WithECN marks requests as ECN capable with codepoint e, ect0 or ect1, so
+// the codepoint replies and ICMP errors come back with shows whether routers
+// on the path set CE or clear it
+func WithECN(e ECN) Option {
+	return func(pc *PingClient) {
+		pc.ECN = e
+	}
+}
+
+// WithMark sets the firewall mark of requests, so policy routing rules can
+// send them a different way than the main routing table would (Linux only)
+func WithMark(mark int) Option {
+	return func(pc *PingClient) {
+		pc.Mark = mark
+	}
+}
+
+// Fragmentation is whether requests may be fragmented on the way, by the
+// DF (don't fragment) bit for IPv4
+type Fragmentation string
+
+const (
+	FragDefault Fragmentation = ""      // up to the system, Linux sets DF on requests that fit the path MTU
+	FragAllow   Fragmentation = "allow" // DF clear, requests too big for a link are fragmented
+	FragDeny    Fragmentation = "deny"  // DF set, requests too big for a link are dropped, by the router with a fragmentation needed error
+)
+
+// WithFragmentation sets whether requests may be fragmented (Linux only)
+func WithFragmentation(f Fragmentation) Option {
+	return func(pc *PingClient) {
+		pc.Frag = f
+	}
+}
+
+// WithVRF binds the client's socket to the VRF device named dev, so
+// requests are routed in that VRF's table (Linux only)
+func WithVRF(dev string) Option {
+	return func(pc *PingClient) {
+		pc.VRF = dev
+	}
+}
+
+// WithTimestamps chooses where the timestamps RTTs are measured with come
+// from: the kernel (the default), the NIC or this process. Sources the
+// platform doesn't support fall back to the next one.
+func WithTimestamps(source TimestampSource) Option {
+	return func(pc *PingClient) {
+		pc.Timestamps = source
+	}
+}
+
+// WithDump writes a hex dump of every packet sent and recieved to w
+func WithDump(w io.Writer) Option {
+	return func(pc *PingClient) {
+		pc.Dump = w
+	}
+}
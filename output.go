@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// jsonResult is the JSON encoding of a Result
+type jsonResult struct {
+	Kind   Kind      `json:"kind"`
+	Proto  string    `json:"proto"`
+	Target string    `json:"target"`
+	Addr   string    `json:"addr,omitempty"`
+	Seq    int       `json:"seq"`
+	Size   int       `json:"size"`
+	TTL    int       `json:"ttl,omitempty"`
+	RTT    float64   `json:"rtt_ms"`
+	DNS    float64   `json:"dns_ms,omitempty"`
+	Time   time.Time `json:"time"`
+	Err    string    `json:"error,omitempty"`
+
+	Stamp TimestampSource `json:"timestamp,omitempty"`
+
+	Anomaly   float64     `json:"anomaly_sigma,omitempty"`
+	Trend     Trend       `json:"trend,omitempty"`
+	Avg       float64     `json:"avg_ms,omitempty"`
+	ECN       ECN         `json:"ecn,omitempty"`
+	Rewritten bool        `json:"id_rewritten,omitempty"`
+	MPLS      []MPLSLabel `json:"mpls,omitempty"`
+	Anycast   string      `json:"anycast_change,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	jr := jsonResult{
+		Kind:   r.Kind,
+		Proto:  r.Proto,
+		Target: r.Target,
+		Addr:   r.Addr,
+		Seq:    r.Seq,
+		Size:   r.Size,
+		RTT:    r.RTT.Seconds() * 1e3,
+		DNS:    r.DNS.Seconds() * 1e3,
+		Time:   r.Time,
+		Tags:   r.Tags,
+		Stamp:  r.Stamp,
+
+		Anomaly:   r.Anomaly,
+		Trend:     r.Trend,
+		Avg:       r.Avg.Seconds() * 1e3,
+		ECN:       r.ECN,
+		Rewritten: r.IDRewritten,
+		MPLS:      r.MPLS,
+		Anycast:   r.Anycast,
+	}
+	if r.TTL >= 0 {
+		jr.TTL = r.TTL
+	}
+	if r.Err != nil {
+		jr.Err = r.Err.Error()
+	}
+	return json.Marshal(jr)
+}
+
+func (r *Result) UnmarshalJSON(b []byte) error {
+	var jr jsonResult
+	if err := json.Unmarshal(b, &jr); err != nil {
+		return err
+	}
+
+	*r = Result{
+		Kind:   jr.Kind,
+		Proto:  jr.Proto,
+		Target: jr.Target,
+		Addr:   jr.Addr,
+		Seq:    jr.Seq,
+		Size:   jr.Size,
+		TTL:    jr.TTL,
+		RTT:    time.Duration(jr.RTT * float64(time.Millisecond)),
+		DNS:    time.Duration(jr.DNS * float64(time.Millisecond)),
+		Time:   jr.Time,
+		Tags:   jr.Tags,
+		Stamp:  jr.Stamp,
+
+		Anomaly:     jr.Anomaly,
+		Trend:       jr.Trend,
+		Avg:         time.Duration(jr.Avg * float64(time.Millisecond)),
+		ECN:         jr.ECN,
+		IDRewritten: jr.Rewritten,
+		MPLS:        jr.MPLS,
+		Anycast:     jr.Anycast,
+	}
+	if jr.TTL == 0 {
+		r.TTL = -1
+	}
+	if jr.Err != "" {
+		r.Err = errors.New(jr.Err)
+	}
+	return nil
+}
+
+// format a result as a human readable line
+func formatText(r Result) string {
+	switch r.Kind {
+	case KindReply, KindDup, KindLate:
+		line := fmt.Sprintf("%d bytes recieved from %s %s_seq=%d",
+			r.Size, r.Addr, r.Proto, r.Seq)
+		if r.TTL >= 0 {
+			line += fmt.Sprintf(" ttl=%d", r.TTL)
+		}
+		line += fmt.Sprintf(" time=%.1f ms", r.RTT.Seconds()*1e3)
+		if r.DNS > 0 {
+			line += fmt.Sprintf(" dns=%.1f ms", r.DNS.Seconds()*1e3)
+		}
+		if r.Avg > 0 {
+			line += fmt.Sprintf(" avg=%.1f ms", r.Avg.Seconds()*1e3)
+		}
+		if r.Trend != "" {
+			line += " " + r.Trend.arrow()
+		}
+		if r.ECN != "" {
+			line += " ecn=" + string(r.ECN)
+		}
+		switch r.Kind {
+		case KindDup:
+			line += " (DUP!)"
+		case KindLate:
+			line += " (LATE!)"
+		}
+		if r.IDRewritten {
+			line += " (ID REWRITTEN!)"
+		}
+		if r.Anomaly != 0 {
+			line += fmt.Sprintf(" (ANOMALY %+.1fσ)", r.Anomaly)
+		}
+		if r.Anycast != "" {
+			line += " (ANYCAST SWITCH? " + r.Anycast + ")"
+		}
+		return line
+	case KindTimeout:
+		line := fmt.Sprintf("request timeout for %s %s_seq=%d", r.Target, r.Proto, r.Seq)
+		if r.DNS > 0 {
+			line += fmt.Sprintf(" dns=%.1f ms", r.DNS.Seconds()*1e3)
+		}
+		return line
+	case KindUp:
+		return fmt.Sprintf("%s is UP %s_seq=%d time=%.1f ms", r.Target, r.Proto, r.Seq, r.RTT.Seconds()*1e3)
+	case KindDown:
+		return fmt.Sprintf("%s is DOWN %s_seq=%d %v", r.Target, r.Proto, r.Seq, r.Err)
+	case KindFlapping:
+		return fmt.Sprintf("%s is FLAPPING, not reporting its state until it settles", r.Target)
+	default:
+		return fmt.Sprintf("%s %s_seq=%d %v", r.Target, r.Proto, r.Seq, r.Err)
+	}
+}
+
+// summaryDoc is what -summary-json prints at exit, the statistics of every
+// target whatever format results were printed in
+type summaryDoc struct {
+	Command string       `json:"command"`
+	Start   time.Time    `json:"start"`
+	End     time.Time    `json:"end"`
+	Targets []targetJSON `json:"targets"`
+	Failure string       `json:"failure,omitempty"` // why the run failed, e.g. -max-loss was exceeded
+
+	// replies dropped by a full socket buffer, counted as lost in the stats
+	LocalDrops int64 `json:"replies_dropped_locally,omitempty"`
+}
+
+// jsonSummary is the JSON encoding of a Summary
+type jsonSummary struct {
+	Sent     int      `json:"sent"`
+	Received int      `json:"received"`
+	Late     int      `json:"late,omitempty"`
+	Dups     int      `json:"duplicates,omitempty"`
+	Corrupt  int      `json:"corrupted,omitempty"`
+	Damaged  int      `json:"damaged,omitempty"`
+	Loss     float64  `json:"loss_percent"`
+	Hops     int      `json:"hops,omitempty"`
+	DNS      *jsonDNS `json:"dns_ms,omitempty"`
+	RTT      *jsonRTT `json:"rtt_ms,omitempty"`
+
+	Stamps map[TimestampSource]int `json:"timestamps,omitempty"`
+	ECN    map[ECN]int             `json:"ecn,omitempty"`
+}
+
+// name lookup times in ms, only present when lookups were timed
+type jsonDNS struct {
+	Lookups int     `json:"lookups"`
+	Min     float64 `json:"min"`
+	Avg     float64 `json:"avg"`
+	Max     float64 `json:"max"`
+}
+
+// rtt statistics in ms, only present when replies came back
+type jsonRTT struct {
+	Min float64 `json:"min"`
+	Avg float64 `json:"avg"`
+	Max float64 `json:"max"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+func (s Summary) MarshalJSON() ([]byte, error) {
+	js := jsonSummary{
+		Sent:     s.PacketOut,
+		Received: s.PacketIn,
+		Late:     s.Late,
+		Dups:     s.Dups,
+		Corrupt:  s.Corrupted,
+		Damaged:  s.Damaged,
+		Loss:     s.Loss(),
+		Hops:     s.Hops,
+		Stamps:   s.Stamps,
+		ECN:      s.ECN,
+	}
+	if s.DNSLookups > 0 {
+		js.DNS = &jsonDNS{Lookups: s.DNSLookups, Min: s.DNSMin, Avg: s.DNSTotal / float64(s.DNSLookups), Max: s.DNSMax}
+	}
+	if s.PacketIn > 0 {
+		js.RTT = &jsonRTT{
+			Min: s.RTTMin,
+			Avg: s.TotalTime / float64(s.PacketIn),
+			Max: s.RTTMax,
+			P50: s.RTTs.Percentile(0.5),
+			P90: s.RTTs.Percentile(0.9),
+			P99: s.RTTs.Percentile(0.99),
+		}
+	}
+	return json.Marshal(js)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// requests with room for it start their data with when they were sent and
+// a random nonce, see stampPayload
+const stampLen = 16
+
+// and with more room, a CRC32 of the rest of their data after that, see
+// sealPayload
+const (
+	crcLen  = 4
+	headLen = stampLen + crcLen
+)
+
+// stampPayload fills head with the time since the client's epoch a request
+// was sent at, and its nonce. Replies echo both, which times them however
+// late they are matched with their request, and tells stale or replayed
+// replies from ones to the request.
+func stampPayload(head []byte, sent time.Duration, nonce uint64) {
+	binary.BigEndian.PutUint64(head[0:8], uint64(sent))
+	binary.BigEndian.PutUint64(head[8:16], nonce)
+}
+
+// sealPayload puts the CRC32 of the stamp at the start of head and of tail,
+// the rest of the data, after the stamp. Replies echoing data whose CRC
+// doesn't match were damaged on the way, which tells them from lost ones.
+func sealPayload(head, tail []byte) {
+	sum := crc32.Update(crc32.ChecksumIEEE(head[:stampLen]), crc32.IEEETable, tail)
+	binary.BigEndian.PutUint32(head[stampLen:headLen], sum)
+}
+
+// payloadCRCOK reports whether the CRC sealPayload put in data still
+// matches the rest of it
+func payloadCRCOK(data []byte) bool {
+	sum := crc32.Update(crc32.ChecksumIEEE(data[:stampLen]), crc32.IEEETable, data[headLen:])
+	return binary.BigEndian.Uint32(data[stampLen:headLen]) == sum
+}
+
+// echoPacket is a marshaled echo request that is built once and then only
+// has its sequence number, the start of its data and checksum updated for
+// every probe
+type echoPacket struct {
+	b    []byte
+	id   int    // icmp identifier it was built with
+	sum  uint32 // ones' complement sum of b with zero sequence number and checksum, and data as built
+	ipv4 bool   // the kernel fills in ICMPv6 checksums itself
+}
+
+// marshal an echo request carrying data, with sequence number 0
+func newEchoPacket(ipv4Msg bool, id int, data []byte) (*echoPacket, error) {
+	var msgType icmp.Type = ipv4.ICMPTypeEcho
+	if !ipv4Msg {
+		msgType = ipv6.ICMPTypeEchoRequest
+	}
+	m := icmp.Message{
+		Type: msgType, Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: 0, Data: data},
+	}
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &echoPacket{b: b, id: id, ipv4: ipv4Msg}
+	if ipv4Msg {
+		b[2], b[3] = 0, 0
+		for i := 0; i+1 < len(b); i += 2 {
+			p.sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			p.sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	return p, nil
+}
+
+// checksumOK reports whether the checksum of ICMP message b is right, which
+// the kernel doesn't check for raw IPv4 sockets
+func checksumOK(b []byte) bool {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return s == 0xffff
+}
+
+// set the sequence number, and the start of the data to head, updating the
+// checksum to match, and return the packet to send. The data has to have
+// been built with zeros where head goes, and head be of even length.
+func (p *echoPacket) withSeq(seq int, head []byte) []byte {
+	binary.BigEndian.PutUint16(p.b[6:8], uint16(seq))
+	copy(p.b[8:], head)
+	if p.ipv4 {
+		s := p.sum + uint32(uint16(seq))
+		for i := 0; i+1 < len(head); i += 2 {
+			s += uint32(binary.BigEndian.Uint16(head[i:]))
+		}
+		for s > 0xffff {
+			s = s>>16 + s&0xffff
+		}
+		binary.BigEndian.PutUint16(p.b[2:4], ^uint16(s))
+	}
+	return p.b
+}
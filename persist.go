@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistent is implemented by the parts of serve that keep their state
+// across restarts with -state: counters, uptime, whether targets are up
+type persistent interface {
+	stateName() string // key of the state in the file
+	saveState() any    // the state, as something JSON can encode
+	loadState(b json.RawMessage) error
+}
+
+// stateFile is what serve -state writes
+type stateFile struct {
+	Saved time.Time                  `json:"saved"`
+	State map[string]json.RawMessage `json:"state"`
+}
+
+// saveState writes the state of ps to path, replacing it in one go so a
+// crash while writing never leaves half a file
+func saveState(path string, ps []persistent) error {
+	sf := stateFile{Saved: time.Now(), State: make(map[string]json.RawMessage)}
+	for _, p := range ps {
+		b, err := json.Marshal(p.saveState())
+		if err != nil {
+			return fmt.Errorf("saving %s: %w", p.stateName(), err)
+		}
+		sf.State[p.stateName()] = b
+	}
+	b, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores the state of ps from path, returning when it was
+// saved. A missing file is a first run and not an error.
+func loadState(path string, ps []persistent) (time.Time, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	var sf stateFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, p := range ps {
+		if b, ok := sf.State[p.stateName()]; ok {
+			if err := p.loadState(b); err != nil {
+				return time.Time{}, fmt.Errorf("%s: %s: %w", path, p.stateName(), err)
+			}
+		}
+	}
+	return sf.Saved, nil
+}
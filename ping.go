@@ -15,11 +15,17 @@ package main
 
 import (
 	"bytes"
-	"flag"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
 	"os"
-	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/icmp"
@@ -32,221 +38,514 @@ const (
 	ProtocolICMPv6 = 58 //https://godoc.org/golang.org/x/net/internal/iana
 )
 
-// We use this client to send ICMP echo requests to the server
+// We use this client to send ICMP echo requests to the server. Probes are
+// serialized, so a client can be shared between goroutines.
 type PingClient struct {
-	IPAddr    *net.IPAddr // IP addr of server being pinged
-	Addr      string      // domain name or IP addr of server being pinged
-	PacketOut int         // number of packets sent
-	PacketIn  int         // number of packets recieved
-	IPv4      bool        // server addr is IPv4
-	Seq       int         // icmp sequence number
-	TotalTime float64     // total rtt time for average
-	RTTMax    float64     // max rtt time
-	RTTMin    float64     // min rtt time
-	MsgSize   int         // message body size (bytes)
-	PLost     int         // total packets lost
+	mu sync.Mutex // held while probing
+
+	IPAddr    *net.IPAddr   // IP addr of server being pinged
+	Addr      string        // domain name or IP addr of server being pinged
+	IPv4      bool          // server addr is IPv4
+	ID        int           // icmp identifier
+	Seq       int           // icmp sequence number
+	MsgSize   int           // message body size (bytes)
+	TTL       int           // time to live / hop limit of requests
+	Interval  time.Duration // delay between requests
+	Timeout   time.Duration // how long to wait for a reply
+	Transport Transport     // connection used to send/receive messages
+	Clock     Clock         // time source for RTT measurement
+
+	// measure RTT with kernel (or NIC) timestamps where supported
+	Timestamps TimestampSource
+	FlowLabel  int           // IPv6 flow label of requests, 0 for none
+	DSCP       DSCP          // DSCP of requests, 0 for best effort
+	ECN        ECN           // ECN codepoint of requests, "" for not ECN capable
+	Mark       int           // firewall mark of requests, 0 for none
+	VRF        string        // VRF device the socket is bound to, "" for none
+	Frag       Fragmentation // whether requests may be fragmented, FragDefault to leave it to the system
+	Dump       io.Writer     // write every packet sent and recieved here, nil to not
+
+	ResolveTime time.Duration // how long resolving Addr took, 0 if it's an address
+
+	mux   *Mux        // shared socket to use instead of opening one, see WithMux
+	epoch time.Time   // what the times in requests are relative to, see stampPayload
+	data  []byte      // message body, built once
+	pkt   *echoPacket // marshaled request, built once
+
+	rewriteSeen atomic.Bool // a reply came back with another identifier, warned about once
+
+	rmu       sync.Mutex        // guards the receive loop's state below
+	receiving Transport         // what the receive loop reads, nil before it runs
+	sent      map[int]*inflight // recent requests by sequence number
+	oldest    int               // sequence number of the oldest request in sent
+	late      []Result          // late and duplicate replies not yet collected
+	readErr   error             // why the receive loop stopped
 }
 
-// Initialize and return a new PingClient
-func NewClient(addr string, msgSize int) (*PingClient, error) {
-	// resolve ip address
-	ipaddr, err := net.ResolveIPAddr("ip", addr)
+// Initialize and return a new PingClient, configured by opts
+func New(addr string, opts ...Option) (*PingClient, error) {
+	// resolve ip address, timing it unless it's already one
+	start := time.Now()
+	ipaddr, err := resolveIPAddr("ip", addr)
+	var resolveTime time.Duration
+	if net.ParseIP(strings.Split(addr, "%")[0]) == nil {
+		resolveTime = time.Since(start)
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
+	// link-local addresses are only unique per interface
+	if err := checkZone(ipaddr); err != nil {
+		return nil, err
+	}
+
 	// determine ipv4 or ipv6
-	isIPv4 := (len(ipaddr.IP) == net.IPv4len)
+	isIPv4 := ipaddr.IP.To4() != nil
+
+	pc := &PingClient{
+		IPAddr:   ipaddr,
+		Addr:     addr,
+		IPv4:     isIPv4,
+		ID:       os.Getpid() & 0xffff, // example in docs does this
+		Seq:      0,
+		MsgSize:  DefaultSize,
+		TTL:      DefaultTTL,
+		Interval: DefaultInterval,
+		Timeout:  DefaultTimeout,
+		Clock:    SystemClock,
+
+		Timestamps:  TimestampKernel,
+		ResolveTime: resolveTime,
+	}
+	for _, opt := range opts {
+		opt(pc)
+	}
+	pc.epoch = pc.Clock.Now()
 
-	fmt.Printf("PING %s (%s)\n", addr, ipaddr)
+	// open sets the ttl of the transports it opens, injected ones skip it
+	if pc.Transport != nil {
+		if err := pc.Transport.SetTTL(pc.TTL); err != nil {
+			return nil, err
+		}
+	}
 
-	return &PingClient{
-		IPAddr:    ipaddr,
-		Addr:      addr,
-		PacketOut: 0,
-		PacketIn:  0,
-		IPv4:      isIPv4,
-		Seq:       0,
-		TotalTime: 0,
-		RTTMax:    -1e5,
-		RTTMin:    1e5,
-		MsgSize:   msgSize,
-		PLost:     0,
-	}, nil
+	return pc, nil
 }
 
-// send a single ICMP echo request to server
-func (pc *PingClient) Ping(ttl int) error {
-	var proto int
-	var network string
-	var msgType icmp.Type
+// Initialize and return a new PingClient
+//
+// Deprecated: use New with WithSize
+func NewClient(addr string, msgSize int) (*PingClient, error) {
+	return New(addr, WithSize(msgSize))
+}
 
-	if pc.IPv4 {
-		proto = ProtocolICMP
-		network = "ip4:icmp"
-		msgType = ipv4.ICMPTypeEcho
+// return the client's transport, opening a raw ICMP socket and starting the
+// receive loop on first use
+func (pc *PingClient) conn() (Transport, error) {
+	if pc.Transport == nil {
+		t, err := pc.open()
+		if err != nil {
+			return nil, err
+		}
+		pc.Transport = t
+	}
+
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+	if pc.receiving != pc.Transport {
+		pc.receiving = pc.Transport
+		// shared sockets hand us our messages, others need reading
+		if pt, ok := pc.Transport.(pushTransport); ok {
+			pt.OnReceive(pc.handle)
+		} else {
+			go pc.receive(pc.Transport)
+		}
+	}
+	return pc.Transport, nil
+}
+
+// open the transport to ping through
+func (pc *PingClient) open() (Transport, error) {
+	// flow labels, DSCP, ECN, marks, VRFs and DF are set per socket, so
+	// those clients don't share one
+	var t Transport
+	if pc.mux != nil && (pc.IPv4 || pc.FlowLabel == 0) && pc.DSCP == 0 && pc.ECN == "" && pc.Mark == 0 && pc.VRF == "" && pc.Frag == FragDefault {
+		mt, err := pc.mux.Transport(pc.IPv4, pc.ID, pc.IPAddr)
+		if err != nil {
+			return nil, err
+		}
+		t = mt
 	} else {
-		proto = ProtocolICMPv6
-		network = "ip6:ipv6-icmp"
-		msgType = ipv6.ICMPTypeEchoRequest
+		it, err := listenICMP(pc.IPv4)
+		if err != nil {
+			return nil, err
+		}
+		// let the kernel drop other processes' icmp traffic, but not replies
+		// from the target with a rewritten identifier
+		if err := it.setFilter(pc.ID, pc.IPAddr.IP); err != nil {
+			logger.Debug("can't filter socket", "target", pc.Addr, "err", err)
+		}
+		if pc.FlowLabel != 0 && !pc.IPv4 {
+			if err := it.setFlowLabel(pc.FlowLabel, pc.IPAddr); err != nil {
+				it.Close()
+				return nil, fmt.Errorf("setting flow label: %w", err)
+			}
+		}
+		if pc.DSCP != 0 || pc.ECN != "" {
+			if err := it.setTOS(pc.DSCP, pc.ECN); err != nil {
+				it.Close()
+				return nil, fmt.Errorf("setting DSCP and ECN: %w", err)
+			}
+		}
+		if pc.Mark != 0 {
+			if err := it.setMark(pc.Mark); err != nil {
+				it.Close()
+				return nil, fmt.Errorf("setting fwmark: %w", err)
+			}
+		}
+		if pc.VRF != "" {
+			if err := it.bindDevice(pc.VRF); err != nil {
+				it.Close()
+				return nil, fmt.Errorf("binding to VRF %s: %w", pc.VRF, err)
+			}
+		}
+		if pc.Frag != FragDefault {
+			if err := it.setDontFragment(pc.Frag == FragDeny); err != nil {
+				it.Close()
+				return nil, fmt.Errorf("setting DF: %w", err)
+			}
+		}
+		t = it
 	}
 
-	// listen to icmp replies
-	c, err := icmp.ListenPacket(network, "0.0.0.0")
-	if err != nil {
-		return err
+	// the kernel picks the identifier of datagram sockets on Linux
+	if it, ok := t.(*icmpTransport); ok {
+		if id, ok := it.echoID(); ok {
+			pc.ID = id
+		}
+	}
+
+	// fall back to userspace timing if the kernel can't timestamp packets
+	if it, ok := t.(*icmpTransport); ok && pc.Timestamps != TimestampUser {
+		if err := it.enableTimestamps(pc.Timestamps == TimestampHardware); err != nil {
+			logger.Debug("using userspace timestamps", "target", pc.Addr, "err", err)
+		}
 	}
 
 	// set up ttl
-	if pc.IPv4 {
-		c.IPv4PacketConn().SetTTL(ttl)
-	} else {
-		c.IPv6PacketConn().SetHopLimit(ttl)
+	if err := t.SetTTL(pc.TTL); err != nil {
+		t.Close()
+		return nil, err
 	}
+	return t, nil
+}
 
-	// make message
-	messageData := bytes.Repeat([]byte("a"), pc.MsgSize)
-	m := icmp.Message{
-		Type: msgType, Code: 0,
-		Body: &icmp.Echo{
-			ID:   os.Getpid() & 0xffff, // example in docs does this
-			Seq:  pc.Seq,
-			Data: messageData,
-		},
+// Reopen closes the client's transport, so the next request opens a new
+// one, and forgets why the old one failed. Requests waiting on the old one
+// time out.
+func (pc *PingClient) Reopen() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.Transport == nil {
+		return nil
 	}
-	pc.Seq++
-	pc.PacketOut++
+	err := pc.Transport.Close()
+	pc.Transport = nil
+	pc.rmu.Lock()
+	pc.receiving, pc.readErr = nil, nil
+	pc.rmu.Unlock()
+	return err
+}
 
-	marsh, err := m.Marshal(nil)
-	if err != nil {
-		return err
+// Close releases the client's transport
+func (pc *PingClient) Close() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.Transport == nil {
+		return nil
 	}
+	return pc.Transport.Close()
+}
 
-	// send the message
-	start := time.Now()
-	n, err := c.WriteTo(marsh, pc.IPAddr)
+// return the message body, only rebuilding it when MsgSize changes
+func (pc *PingClient) payload() []byte {
+	if len(pc.data) != pc.MsgSize {
+		pc.data = bytes.Repeat([]byte("a"), pc.MsgSize)
+		// zeros where every request puts its stamp and CRC, see send
+		clear(pc.data[:min(pc.MsgSize, headLen)])
+	}
+	return pc.data
+}
+
+// return the marshaled request carrying data, only rebuilding it when the
+// body or identifier change
+func (pc *PingClient) packet(data []byte) (*echoPacket, error) {
+	if pc.pkt == nil || pc.pkt.id != pc.ID || len(pc.pkt.b)-8 != len(data) {
+		pkt, err := newEchoPacket(pc.IPv4, pc.ID, data)
+		if err != nil {
+			return nil, err
+		}
+		pc.pkt = pkt
+	}
+	return pc.pkt, nil
+}
+
+// SetTTL changes the time to live of the following requests
+func (pc *PingClient) SetTTL(ttl int) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.TTL = ttl
+	if pc.Transport == nil {
+		return nil
+	}
+	return pc.Transport.SetTTL(ttl)
+}
+
+// SetSize changes the message body size of the following requests. Replies
+// are read into a buffer sized for the first request sent, so send the
+// biggest first.
+func (pc *PingClient) SetSize(size int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.MsgSize = size
+}
+
+// send a single ICMP echo request to server
+func (pc *PingClient) Ping() (Result, error) {
+	return pc.Probe(context.Background())
+}
+
+// Probe sends a single ICMP echo request and waits for the reply. Only
+// sending is serialized, so probes from several goroutines can be waiting
+// for their replies at the same time.
+func (pc *PingClient) Probe(ctx context.Context) (Result, error) {
+	res, fl, err := pc.send(nil)
 	if err != nil {
-		return err
-	} else if n != len(marsh) {
-		return fmt.Errorf("error marshalling message\n")
+		return complete(res, err)
 	}
+	return pc.wait(ctx, fl)
+}
 
-	// wait for reply
-	reply := make([]byte, 500)
-	err = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+// ProbeAsync sends a single ICMP echo request without waiting for the
+// reply. done is called once, from another goroutine, with the result when
+// the reply or an error arrives, or with a timeout when expire is called
+// first. The caller is expected to call expire after timeout.
+func (pc *PingClient) ProbeAsync(done func(Result, error)) (expire func(), timeout time.Duration) {
+	res, fl, err := pc.send(func(a answer) {
+		done(pc.finish(a))
+	})
 	if err != nil {
-		return err
+		done(complete(res, err))
+		return func() {}, 0
 	}
+	return func() { pc.expireAsync(fl) }, pc.Timeout
+}
 
-	// read reply message
-	n, _, err = c.ReadFrom(reply)
+// send the next echo request. Its answer is passed to done if set,
+// otherwise the caller waits for it.
+func (pc *PingClient) send(done func(answer)) (Result, *inflight, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	res := Result{
+		Proto:  "icmp",
+		Target: pc.Addr,
+		Seq:    pc.Seq,
+		TTL:    -1,
+		Time:   pc.Clock.Now(),
+	}
+
+	// listen to icmp replies
+	c, err := pc.conn()
 	if err != nil {
-		return err
+		return res, nil, &SendError{err}
 	}
 
-	duration := time.Since(start)
-	dur_ms := duration.Seconds() * 1e3
+	// make message
+	messageData := pc.payload()
+	pkt, err := pc.packet(messageData)
+	if err != nil {
+		return res, nil, err
+	}
+	start := pc.Clock.Now()
+	var head []byte
+	var nonce uint64
+	if len(messageData) >= stampLen {
+		var stamp [headLen]byte
+		nonce = rand.Uint64() | 1 // never 0, which means no nonce
+		stampPayload(stamp[:], start.Sub(pc.epoch), nonce)
+		head = stamp[:stampLen]
+		if len(messageData) >= headLen {
+			sealPayload(stamp[:], messageData[headLen:])
+			head = stamp[:]
+		}
+	}
+	marsh := pkt.withSeq(pc.Seq, head)
+	pc.Seq++
 
-	// keep track of max/min RTT times
-	if dur_ms < pc.RTTMin {
-		pc.RTTMin = dur_ms
+	// the receive loop hands us the reply once it arrives
+	fl := &inflight{seq: res.Seq, start: start, data: messageData, nonce: nonce, done: done}
+	if done == nil {
+		fl.reply = make(chan answer, 1)
 	}
-	if dur_ms > pc.RTTMax {
-		pc.RTTMax = dur_ms
+	if ts, ok := c.(sendTimestamper); ok {
+		fl.sendID, fl.sentOn = ts.NextWrite(), ts
+	}
+	if err := pc.track(fl); err != nil {
+		return res, nil, &SendError{err}
 	}
-	pc.TotalTime += dur_ms
 
-	// parse reply
-	rMsg, err := icmp.ParseMessage(proto, reply[:n])
+	// send the message, dumped first so it's never printed after its reply
+	if pc.Dump != nil {
+		dumpPacket(pc.Dump, true, pc.IPv4, marsh, pc.IPAddr, -1)
+	}
+	n, err := c.WriteTo(marsh, pc.IPAddr)
+	if err == nil && n != len(marsh) {
+		err = fmt.Errorf("error marshalling message")
+	}
 	if err != nil {
-		return err
+		pc.forget(fl)
+		return res, nil, &SendError{err}
 	}
 
-	if n == 0 {
-		fmt.Println("time limit exceeded")
-	} else {
-		pc.PacketIn++
-		pLost := 0
-
-		switch p := rMsg.Body.(type) {
-		case *icmp.Echo:
-			// definetly lost data
-			if len(p.Data) < len(messageData) {
-				pLost += len(messageData) - len(p.Data)
-				for i := 0; i < len(p.Data); i++ {
-					if messageData[i] != p.Data[i] {
-						pLost++
-					}
-				}
-			} else { // check if we lost data
-				for i := 0; i < len(messageData); i++ {
-					if messageData[i] != p.Data[i] {
-						pLost++
-					}
-				}
-
-				lossPercent := (float64(pLost) / float64(len(messageData))) * 100
-
-				fmt.Printf("%d bytes recieved (%.1f%% loss) from %s icmp_seq=%d time=%.1f ms\n",
-					len(p.Data), lossPercent, pc.IPAddr, pc.Seq, dur_ms)
-			}
+	return res, fl, nil
+}
+
+// wait for the answer to a request, but no longer than the timeout or the
+// caller allows
+func (pc *PingClient) wait(ctx context.Context, fl *inflight) (Result, error) {
+	wait := pc.Timeout
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < wait {
+		wait = time.Until(d)
+	}
+
+	var a answer
+	select {
+	case a = <-fl.reply:
+	case <-pc.Clock.After(wait):
+		var ok bool
+		if a, ok = pc.expire(fl); !ok {
+			return complete(pc.result(fl), os.ErrDeadlineExceeded)
 		}
+	case <-ctx.Done():
+		pc.expire(fl)
+		return complete(pc.result(fl), ctx.Err())
 	}
+	return pc.finish(a)
+}
 
-	return nil
+// turn the answer to a request into its result
+func (pc *PingClient) finish(a answer) (Result, error) {
+	if a.err != nil {
+		return complete(a.res, a.err)
+	}
+	res := a.res
+
+	// the kernel's timestamps leave out our own scheduling delays. They're
+	// looked up on the transport the request went out on, which Reopen may
+	// have replaced since.
+	res.Stamp = TimestampUser
+	if a.sentOn != nil && !a.info.Time.IsZero() {
+		if sent, src, ok := a.sentOn.SendTime(a.sendID); ok {
+			res.RTT = a.info.Time.Sub(sent)
+			res.Recv = a.info.Time
+			res.Stamp = TimestampKernel
+			if src == TimestampHardware && a.info.Source == TimestampHardware {
+				res.Stamp = TimestampHardware
+			}
+		}
+	}
+	return complete(res, nil)
 }
 
-func main() {
-	var msgSize, ttl int
+// type of the echo replies we expect
+func (pc *PingClient) replyType() icmp.Type {
+	if pc.IPv4 {
+		return ipv4.ICMPTypeEchoReply
+	}
+	return ipv6.ICMPTypeEchoReply
+}
 
-	flag.IntVar(&msgSize, "s", 64, "Size (in bytes) of ping message")
-	flag.IntVar(&ttl, "t", 64, "Time to live, number L3 hops before packet dies")
-	flag.Parse()
+// return the IP of a socket address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
 
-	addr := flag.Arg(0) // ./ping {addr = IP || DomainName}
+// return the zone of a socket address
+func addrZone(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.Zone
+	case *net.UDPAddr:
+		return a.Zone
+	}
+	return ""
+}
 
-	if flag.NArg() == 0 {
-		fmt.Println("mising hostname")
-		os.Exit(1)
+// checkZone makes sure an IPv6 link-local address has a zone, naming the
+// interface to ping it through, and turns numeric zones into interface
+// names which is how the kernel reports the zone of replies
+func checkZone(addr *net.IPAddr) error {
+	if addr.Zone == "" {
+		if addr.IP.To4() == nil && (addr.IP.IsLinkLocalUnicast() || addr.IP.IsLinkLocalMulticast()) {
+			return fmt.Errorf("%s is link-local, add the interface to ping it on, e.g. %s%%eth0", addr.IP, addr.IP)
+		}
+		return nil
 	}
 
-	// new ping client
-	client, err := NewClient(addr, msgSize)
+	ifi, err := net.InterfaceByName(addr.Zone)
+	if index, aerr := strconv.Atoi(addr.Zone); err != nil && aerr == nil {
+		ifi, err = net.InterfaceByIndex(index)
+	}
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
-
-	// set up ctrl-c signal to exit
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
-	go func(client *PingClient) {
-		for _ = range sigchan {
-			var loss float64 = 100
-			if client.PacketIn > 0 {
-				loss = (float64(client.PLost) / float64(client.PacketOut*client.MsgSize)) * 100
-			}
-			fmt.Println("\n------ Ping Statistics ------")
-			fmt.Printf("packets sent: %d, packets received: %d, %.0f%% loss\n",
-				client.PacketOut, client.PacketIn, loss)
-			if client.PacketIn > 0 {
-				fmt.Printf("rtt min/avg/max = %.1f/%.1f/%.1f ms\n",
-					client.RTTMin, client.TotalTime/float64(client.PacketIn), client.RTTMax)
-			}
-			os.Exit(0)
-		}
-	}(client)
+		return fmt.Errorf("unknown interface %q in %s", addr.Zone, addr)
+	}
+	addr.Zone = ifi.Name
+	return nil
+}
 
-	// MAIN LOOP
-	// Continuously pings the server until ctrl-c is entered, which
-	// then prints the ping statistics
-	for {
-		err = client.Ping(ttl)
-		if err != nil {
-			fmt.Println(err)
+// fromTarget reports whether peer is the address being pinged, in the same
+// zone if both have one
+func (pc *PingClient) fromTarget(peer net.Addr) bool {
+	zone := addrZone(peer)
+	return addrIP(peer).Equal(pc.IPAddr.IP) &&
+		(zone == "" || pc.IPAddr.Zone == "" || zone == pc.IPAddr.Zone)
+}
+
+// quotedEcho returns the destination, identifier and sequence number of the
+// echo request quoted in the payload of an ICMP error message
+func quotedEcho(data []byte, isIPv4 bool) (net.IP, int, int, bool) {
+	var hdrLen int
+	var dst net.IP
+	if isIPv4 {
+		if len(data) < ipv4.HeaderLen {
+			return nil, 0, 0, false
 		}
-		time.Sleep(time.Second * 1) // ping once per second
+		hdrLen = int(data[0]&0x0f) * 4
+		dst = net.IP(data[16:20])
+	} else {
+		if len(data) < ipv6.HeaderLen {
+			return nil, 0, 0, false
+		}
+		hdrLen = ipv6.HeaderLen
+		dst = net.IP(data[24:40])
 	}
 
+	// type, code, checksum, identifier, sequence number
+	if len(data) < hdrLen+8 {
+		return nil, 0, 0, false
+	}
+	echo := data[hdrLen:]
+	return dst, int(binary.BigEndian.Uint16(echo[4:6])), int(binary.BigEndian.Uint16(echo[6:8])), true
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// fakeTransport is a Transport that never touches the network. Every
+// request written to it is answered with the messages respond returns for
+// it, handed straight to the client like a Mux does, so tests see the same
+// outcome every run.
+type fakeTransport struct {
+	respond  func(req *icmp.Echo, dst net.Addr) [][]byte
+	writeErr error // returned by every write instead, if set
+
+	mu   sync.Mutex
+	fn   func([]byte, RecvInfo)
+	ttl  int
+	sent []*icmp.Echo // every request written
+	peer net.Addr     // where the last one went
+}
+
+func (t *fakeTransport) WriteTo(b []byte, dst net.Addr) (int, error) {
+	if t.writeErr != nil {
+		return 0, t.writeErr
+	}
+	msg, err := icmp.ParseMessage(ProtocolICMP, b)
+	if err != nil {
+		return 0, err
+	}
+	req := msg.Body.(*icmp.Echo)
+	t.mu.Lock()
+	t.sent = append(t.sent, req)
+	t.peer = dst
+	t.mu.Unlock()
+	if t.respond != nil {
+		for _, reply := range t.respond(req, dst) {
+			t.push(reply)
+		}
+	}
+	return len(b), nil
+}
+
+// push hands the client a message from the last request's destination, as
+// if it just arrived
+func (t *fakeTransport) push(b []byte) {
+	t.mu.Lock()
+	fn, peer := t.fn, t.peer
+	t.mu.Unlock()
+	fn(b, RecvInfo{Peer: peer, TTL: 57})
+}
+
+func (t *fakeTransport) OnReceive(fn func(b []byte, info RecvInfo)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fn = fn
+}
+
+func (t *fakeTransport) ReadFrom(b []byte) (int, RecvInfo, error) {
+	return 0, RecvInfo{}, errors.New("fakeTransport is only pushed to")
+}
+
+func (t *fakeTransport) SetReadDeadline(time.Time) error { return nil }
+
+func (t *fakeTransport) SetTTL(ttl int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ttl = ttl
+	return nil
+}
+
+func (t *fakeTransport) Close() error { return nil }
+
+// marshal an IPv4 message, panicking on failure
+func marshalICMP(typ icmp.Type, code int, body icmp.MessageBody) []byte {
+	b, err := (&icmp.Message{Type: typ, Code: code, Body: body}).Marshal(nil)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// the echo reply to req, with its data passed through damage first if set
+func echoReply(req *icmp.Echo, damage func([]byte)) []byte {
+	data := append([]byte(nil), req.Data...)
+	if damage != nil {
+		damage(data)
+	}
+	return marshalICMP(ipv4.ICMPTypeEchoReply, 0, &icmp.Echo{ID: req.ID, Seq: req.Seq, Data: data})
+}
+
+// a destination unreachable error about req to dst, quoting its header
+func unreachable(req *icmp.Echo, dst net.Addr) []byte {
+	quoted := make([]byte, ipv4.HeaderLen)
+	quoted[0] = 0x45
+	copy(quoted[16:20], addrIP(dst).To4())
+	quoted = append(quoted, marshalICMP(ipv4.ICMPTypeEcho, 0, req)[:8]...)
+	return marshalICMP(ipv4.ICMPTypeDestinationUnreachable, 1, &icmp.DstUnreach{Data: quoted})
+}
+
+// a client pinging a documentation address through ft
+func newFakeClient(t *testing.T, ft *fakeTransport, opts ...Option) *PingClient {
+	t.Helper()
+	opts = append([]Option{WithTransport(ft), WithTimeout(50 * time.Millisecond)}, opts...)
+	pc, err := New("192.0.2.1", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func TestPingReply(t *testing.T) {
+	ft := &fakeTransport{respond: func(req *icmp.Echo, _ net.Addr) [][]byte {
+		return [][]byte{echoReply(req, nil)}
+	}}
+	pc := newFakeClient(t, ft, WithTTL(7))
+	if ft.ttl != 7 {
+		t.Errorf("injected transport has ttl %d, want 7", ft.ttl)
+	}
+
+	for seq := 0; seq < 3; seq++ {
+		res, err := pc.Ping()
+		if err != nil {
+			t.Fatalf("seq %d: %v", seq, err)
+		}
+		if res.Kind != KindReply || res.Seq != seq || res.Size != DefaultSize || res.TTL != 57 {
+			t.Errorf("seq %d: got %+v", seq, res)
+		}
+		if res.Addr != "192.0.2.1" {
+			t.Errorf("seq %d: reply from %q", seq, res.Addr)
+		}
+	}
+	if late := pc.Late(); len(late) != 0 {
+		t.Errorf("unexpected late results %+v", late)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	ft := &fakeTransport{}
+	pc := newFakeClient(t, ft)
+
+	res, err := pc.Ping()
+	if !errors.Is(err, ErrTimeout) || res.Kind != KindTimeout {
+		t.Fatalf("got %+v, %v, want a timeout", res, err)
+	}
+
+	// the reply turning up after all is reported as late
+	ft.push(echoReply(ft.sent[0], nil))
+	late := pc.Late()
+	if len(late) != 1 || late[0].Kind != KindLate || late[0].Seq != 0 {
+		t.Errorf("got late results %+v, want seq 0 late", late)
+	}
+}
+
+func TestPingCorrupt(t *testing.T) {
+	ft := &fakeTransport{respond: func(req *icmp.Echo, _ net.Addr) [][]byte {
+		return [][]byte{echoReply(req, func(data []byte) { data[len(data)-1] ^= 0xff })}
+	}}
+	pc := newFakeClient(t, ft)
+
+	// damaged replies don't answer the probe, which may still get a good one
+	res, err := pc.Ping()
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %+v, %v, want a timeout", res, err)
+	}
+	late := pc.Late()
+	if len(late) != 1 || late[0].Kind != KindCorrupt || !errors.Is(late[0].Err, errDamaged) {
+		t.Errorf("got late results %+v, want one damaged reply", late)
+	}
+}
+
+func TestPingCorruptLoss(t *testing.T) {
+	ft := &fakeTransport{respond: func(req *icmp.Echo, _ net.Addr) [][]byte {
+		if req.Seq == 0 {
+			return [][]byte{echoReply(req, func(data []byte) { data[0] ^= 0xff })}
+		}
+		return [][]byte{echoReply(req, nil)}
+	}}
+	pc := newFakeClient(t, ft)
+	stats := NewStats(DefaultSize)
+
+	// the damaged reply leaves its probe lost, and is counted on its own too
+	for seq := 0; seq < 2; seq++ {
+		res, _ := pc.Ping()
+		stats.Add(res)
+		for _, late := range pc.Late() {
+			stats.Add(late)
+		}
+	}
+	sum := stats.Snapshot()
+	if sum.Loss() != 50 || sum.Damaged != 1 || sum.PacketIn != 1 {
+		t.Errorf("got %.1f%% loss, %d damaged, %d received, want 50%%, 1 and 1", sum.Loss(), sum.Damaged, sum.PacketIn)
+	}
+}
+
+func TestPingDuplicate(t *testing.T) {
+	ft := &fakeTransport{respond: func(req *icmp.Echo, _ net.Addr) [][]byte {
+		return [][]byte{echoReply(req, nil), echoReply(req, nil)}
+	}}
+	pc := newFakeClient(t, ft)
+
+	if res, err := pc.Ping(); err != nil || res.Kind != KindReply {
+		t.Fatalf("got %+v, %v, want a reply", res, err)
+	}
+	late := pc.Late()
+	if len(late) != 1 || late[0].Kind != KindDup || late[0].Seq != 0 {
+		t.Errorf("got late results %+v, want seq 0 duplicated", late)
+	}
+}
+
+func TestPingError(t *testing.T) {
+	ft := &fakeTransport{respond: func(req *icmp.Echo, dst net.Addr) [][]byte {
+		return [][]byte{unreachable(req, dst)}
+	}}
+	pc := newFakeClient(t, ft)
+
+	res, err := pc.Ping()
+	if !errors.Is(err, ErrHostUnreachable) || res.Kind != KindError {
+		t.Errorf("got %+v, %v, want host unreachable", res, err)
+	}
+
+	// requests that can't be sent are worth retrying
+	ft.writeErr = errors.New("network is down")
+	_, err = pc.Ping()
+	var serr *SendError
+	if !errors.As(err, &serr) || !errors.Is(err, ft.writeErr) {
+		t.Errorf("got %v, want a send error", err)
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	clock := newFakeClock()
+	ft := &fakeTransport{respond: func(req *icmp.Echo, _ net.Addr) [][]byte {
+		clock.Advance(30 * time.Millisecond)
+		return [][]byte{echoReply(req, nil)}
+	}}
+	pc := newFakeClient(t, ft, WithClock(clock))
+
+	res, err := pc.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RTT != 30*time.Millisecond || res.Stamp != TimestampUser {
+		t.Errorf("got rtt %v from %s timestamps, want 30ms from user ones", res.RTT, res.Stamp)
+	}
+
+	// replies timed by the stamp they echo, however late they're matched
+	ft.respond = nil
+	if _, err := pc.Ping(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	clock.Advance(time.Second)
+	ft.push(echoReply(ft.sent[1], nil))
+	late := pc.Late()
+	if len(late) != 1 || late[0].RTT != time.Second+pc.Timeout {
+		t.Errorf("got late results %+v, want one with rtt %v", late, time.Second+pc.Timeout)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Stage is one step results flow through on their way out of a run. Filters
+// drop results by returning false, enrichers fill in fields of r and sinks
+// write r somewhere.
+type Stage interface {
+	Process(r *Result) bool
+}
+
+// StageFunc adapts a function to a Stage
+type StageFunc func(r *Result) bool
+
+func (f StageFunc) Process(r *Result) bool {
+	return f(r)
+}
+
+// Pipeline passes results through its stages in order
+type Pipeline []Stage
+
+// Handle sends r through the pipeline, stopping at the first stage that
+// drops it
+func (p Pipeline) Handle(r Result) {
+	for _, s := range p {
+		if !s.Process(&r) {
+			return
+		}
+	}
+}
+
+// Sync returns a handler that sends results through p one at a time, for
+// runners in several goroutines sharing one pipeline
+func (p Pipeline) Sync() func(Result) {
+	var mu sync.Mutex
+	return func(r Result) {
+		mu.Lock()
+		defer mu.Unlock()
+		p.Handle(r)
+	}
+}
+
+// Recorder is anything that accumulates results, like Stats
+type Recorder interface {
+	Add(r Result)
+}
+
+// StatsSink records every result in stats
+func StatsSink(stats Recorder) Stage {
+	return StageFunc(func(r *Result) bool {
+		stats.Add(*r)
+		return true
+	})
+}
+
+// TextSink writes results to w as human readable lines
+func TextSink(w io.Writer) Stage {
+	return StageFunc(func(r *Result) bool {
+		fmt.Fprintln(w, formatText(*r))
+		return true
+	})
+}
+
+// JSONSink writes results to w as one JSON object per line
+func JSONSink(w io.Writer) Stage {
+	enc := json.NewEncoder(w)
+	return StageFunc(func(r *Result) bool {
+		if err := enc.Encode(r); err != nil {
+			logger.Error("writing result", "target", r.Target, "seq", r.Seq, "err", err)
+		}
+		return true
+	})
+}
+
+// KindFilter only lets results of the given kinds through
+func KindFilter(kinds ...Kind) Stage {
+	return StageFunc(func(r *Result) bool {
+		for _, k := range kinds {
+			if r.Kind == k {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// TagEnricher adds the given tags to every result
+func TagEnricher(tags map[string]string) Stage {
+	return StageFunc(func(r *Result) bool {
+		if r.Tags == nil {
+			r.Tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			r.Tags[k] = v
+		}
+		return true
+	})
+}
+
+// tagFlag collects repeated -tag key=value flags
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	var pairs []string
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t tagFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("tag %q is not key=value", s)
+	}
+	t[k] = v
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// latest probes looked at for a pattern
+	policerWindow = 60
+
+	// evenly spaced losses, or replies, it takes to be a pattern rather
+	// than chance
+	policerEvents = 5
+
+	// how many times slower, and for how many probes, -ratelimit-confirm
+	// probes to see if the losses go away
+	policerSlowdown = 4
+	policerConfirm  = 20
+)
+
+// PolicerDetector is a Stage looking for the losses of a host that rate
+// limits its ICMP answers: every Nth probe lost, or when most are, the
+// answers evenly spaced, the way a token bucket lets them through. Loss on
+// the way rarely looks like that. It warns on W once found, and if Slow is
+// set calls it to probe policerSlowdown times slower for policerConfirm
+// probes, and again with false after: a policer's losses go away at the
+// lower rate, the network's don't. It handles the results of one target.
+type PolicerDetector struct {
+	W    io.Writer
+	Slow func(slow bool)
+
+	lost     []bool  // latest probes, oldest first
+	found    string  // the pattern, "" until found
+	fastLoss float64 // percent of lost when found
+	slowing  bool
+	slowSent int
+	slowLost int
+	verdict  string // what probing slower showed
+}
+
+func (pd *PolicerDetector) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	lost := r.Kind != KindReply
+	if pd.slowing {
+		pd.slowSent++
+		if lost {
+			pd.slowLost++
+		}
+		if pd.slowSent == policerConfirm {
+			pd.confirm()
+		}
+		return true
+	}
+
+	pd.lost = append(pd.lost, lost)
+	if len(pd.lost) > policerWindow {
+		pd.lost = pd.lost[1:]
+	}
+	if pd.found != "" {
+		return true
+	}
+	found, ok := policerPattern(pd.lost)
+	if !ok {
+		return true
+	}
+	pd.found = found
+	pd.fastLoss = 0
+	for _, l := range pd.lost {
+		if l {
+			pd.fastLoss++
+		}
+	}
+	pd.fastLoss = pd.fastLoss * 100 / float64(len(pd.lost))
+	logger.Info("losses look like ICMP rate limiting", "target", r.Target, "pattern", found)
+	fmt.Fprintf(pd.W, "WARNING: %s, evenly spaced like the host rate limits ICMP answers; that loss may be the host's, not the network's\n", found)
+	if pd.Slow != nil {
+		fmt.Fprintf(pd.W, "probing %dx slower for %d probes to confirm\n", policerSlowdown, policerConfirm)
+		pd.slowing = true
+		pd.Slow(true)
+	}
+	return true
+}
+
+// confirm compares the loss at the slower rate with the loss before, and
+// goes back to the old rate
+func (pd *PolicerDetector) confirm() {
+	pd.slowing = false
+	pd.Slow(false)
+	slowLoss := float64(pd.slowLost) * 100 / float64(pd.slowSent)
+	if slowLoss <= pd.fastLoss/2 {
+		pd.verdict = fmt.Sprintf("confirmed, %.0f%% lost at %dx slower against %.0f%% before: the host rate limits its answers", slowLoss, policerSlowdown, pd.fastLoss)
+	} else {
+		pd.verdict = fmt.Sprintf("not confirmed, %.0f%% lost even at %dx slower against %.0f%% before: the loss looks real", slowLoss, policerSlowdown, pd.fastLoss)
+	}
+	fmt.Fprintf(pd.W, "RATE LIMIT %s\n", pd.verdict)
+}
+
+// Fprint writes what was found, if anything, for the summary
+func (pd *PolicerDetector) Fprint(w io.Writer) {
+	if pd.found == "" {
+		return
+	}
+	fmt.Fprintf(w, "loss looks like the host rate limiting ICMP answers (%s)", pd.found)
+	if pd.verdict != "" {
+		fmt.Fprintf(w, ", %s", pd.verdict)
+	} else if !pd.slowing {
+		fmt.Fprint(w, ", -ratelimit-confirm to check by probing slower")
+	}
+	fmt.Fprintln(w)
+}
+
+// policerPattern looks for evenly spaced losses in lost, or evenly spaced
+// replies if most were lost, that go on to the latest probe, and describes
+// them
+func policerPattern(lost []bool) (string, bool) {
+	n := 0
+	for _, l := range lost {
+		if l {
+			n++
+		}
+	}
+	// whichever is rarer, losses or replies, is what's spaced out
+	rare := n*2 <= len(lost)
+	var at []int
+	for i, l := range lost {
+		if l == rare {
+			at = append(at, i)
+		}
+	}
+	if len(at) < policerEvents {
+		return "", false
+	}
+	minGap, maxGap := len(lost), 0
+	for i := 1; i < len(at); i++ {
+		minGap, maxGap = min(minGap, at[i]-at[i-1]), max(maxGap, at[i]-at[i-1])
+	}
+	if minGap < 2 || maxGap-minGap > 1 || len(lost)-1-at[len(at)-1] > maxGap {
+		return "", false
+	}
+	every := float64(at[len(at)-1]-at[0]) / float64(len(at)-1)
+	if rare {
+		return fmt.Sprintf("1 in %.1f probes lost", every), true
+	}
+	return fmt.Sprintf("only 1 in %.1f probes answered", every), true
+}
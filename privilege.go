@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// how this process can send ICMP
+type icmpAccess int
+
+const (
+	accessRaw   icmpAccess = iota // raw sockets, root or CAP_NET_RAW
+	accessDgram                   // unprivileged datagram sockets, see ping_group_range
+	accessNone
+)
+
+// detectICMP finds out, once, which ICMP sockets this process may open by
+// trying them. The error is why raw sockets can't be used.
+var detectICMP = sync.OnceValues(func() (icmpAccess, error) {
+	var rawErr error
+	if runtime.GOOS != "darwin" {
+		t, err := listenRaw(true)
+		if err == nil {
+			t.Close()
+			return accessRaw, nil
+		}
+		// e.g. no IPv4 at all, opening the real socket will say so
+		if !errors.Is(err, os.ErrPermission) {
+			return accessRaw, nil
+		}
+		rawErr = err
+	}
+
+	t, err := listenICMPDgram(true)
+	if err != nil {
+		if rawErr == nil {
+			rawErr = err
+		}
+		return accessNone, rawErr
+	}
+	t.Close()
+	return accessDgram, rawErr
+})
+
+// icmpUnavailable reports whether ICMP can't be sent at all, explaining why
+// and how to fix it on w if so. Falling back to unprivileged sockets is
+// only mentioned, that's the norm on macOS so it isn't there.
+func icmpUnavailable(w io.Writer) bool {
+	access, err := detectICMP()
+	switch access {
+	case accessRaw:
+		return false
+	case accessDgram:
+		if runtime.GOOS != "darwin" {
+			fmt.Fprintf(w, "raw sockets not permitted (%v), using unprivileged ICMP sockets\n", err)
+		}
+		return false
+	}
+
+	fmt.Fprintf(w, "can't send ICMP: %v\n", err)
+	fmt.Fprint(w, `raw ICMP sockets need root or CAP_NET_RAW, and unprivileged ICMP sockets
+need the user's group in net.ipv4.ping_group_range. To fix this either
+  run as root:                       sudo `+os.Args[0]+` ...
+  let the binary open raw sockets:   sudo `+os.Args[0]+` install-caps
+  allow unprivileged ICMP sockets:   sudo `+os.Args[0]+` install-caps -sysctl
+`)
+	return true
+}
+
+// fallBack switches icmp probes to tcp connects when ICMP can't be sent,
+// saying so on w
+func (pf *probeFlags) fallBack(w io.Writer) {
+	if pf.mode != "icmp" || !icmpUnavailable(w) {
+		return
+	}
+	fmt.Fprintf(w, "falling back to tcp connects to port %d\n\n", pf.port)
+	pf.mode = "tcp"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Prober sends a single probe to a target and reports what came back. It is
+// implemented by the ICMP PingClient as well as the TCP, HTTP and DNS probes
+// so scheduling, statistics and output only have to be written once.
+type Prober interface {
+	Probe(ctx context.Context) (Result, error)
+}
+
+// Kind is the outcome of a probe
+type Kind string
+
+const (
+	KindReply   Kind = "reply"   // the target answered
+	KindTimeout Kind = "timeout" // no answer before the deadline
+	KindError   Kind = "error"   // the probe failed, see Result.Err
+	KindDup     Kind = "dup"     // a duplicate answer to an earlier probe
+	KindLate    Kind = "late"    // an answer to a probe that already timed out
+	KindCorrupt Kind = "corrupt" // an answer damaged on the way, see Result.Err
+)
+
+// extra reports whether results of kind k are answers to a probe that
+// already has its result, rather than the outcome of one
+func (k Kind) extra() bool {
+	return k == KindLate || k == KindDup || k == KindCorrupt
+}
+
+// Result is the outcome of a single probe. It is what probers return and what
+// every output format is rendered from.
+type Result struct {
+	Kind   Kind          // reply, timeout, error, dup, late or corrupt
+	Proto  string        // probe type (icmp, tcp, http, dns)
+	Target string        // target being probed
+	Addr   string        // address that answered
+	Seq    int           // probe sequence number
+	Size   int           // bytes recieved
+	TTL    int           // ttl / hop limit of the reply, -1 if unknown
+	RTT    time.Duration // round trip time
+	DNS    time.Duration // how long a lookup of the target's name just before took, 0 if there was none
+	Time   time.Time     // when the probe was sent
+	Recv   time.Time     // when the reply arrived, zero without one
+	Err    error         // why the probe failed, nil for replies
+
+	Stamp TimestampSource // where the timestamps RTT was measured with came from
+
+	Anomaly float64       // standard deviations the RTT is off its baseline, 0 if it isn't
+	Trend   Trend         // how the RTT compares to the target's recent replies, "" if not judged
+	Avg     time.Duration // moving average RTT of the target's latest replies, 0 if not kept
+
+	// ECN codepoint the reply came back with, or for ICMP errors the one the
+	// request reached the router with, "" unless requests set one
+	ECN ECN
+
+	IDRewritten bool // the reply came back with another identifier than the request's, by a NAT
+
+	Anycast string // what changed if the reply looks like it's from another anycast instance, see AnycastWatcher
+
+	MPLS []MPLSLabel // label stack the router that answered had the probe under, RFC 4950
+
+	Tags map[string]string // extra labels added by pipeline stages
+}
+
+// complete sets the result kind from the probe error, every Probe
+// implementation returns through it
+func complete(res Result, err error) (Result, error) {
+	err = classify(err)
+	switch {
+	case err == nil:
+		res.Kind = KindReply
+	case errors.Is(err, ErrTimeout):
+		res.Kind = KindTimeout
+	default:
+		res.Kind = KindError
+	}
+	res.Err = err
+	return res, err
+}
+
+// seqCounter hands out probe sequence numbers, it is safe for concurrent use
+type seqCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+// return the next sequence number
+func (c *seqCounter) next() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n++
+	return c.n - 1
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// TCPProber measures the time it takes to open a TCP connection
+type TCPProber struct {
+	Addr    string        // host:port to connect to
+	Timeout time.Duration // how long to wait for the handshake
+	Clock   Clock         // time source for RTT measurement
+	seq     seqCounter
+
+	// sets socket options of connections, see net.Dialer, nil for none
+	Control func(network, address string, rc syscall.RawConn) error
+}
+
+// Initialize and return a new TCPProber
+func NewTCPProber(addr string, timeout time.Duration) *TCPProber {
+	return &TCPProber{Addr: addr, Timeout: timeout, Clock: SystemClock}
+}
+
+// Probe connects to the target and closes the connection straight away
+func (tp *TCPProber) Probe(ctx context.Context) (Result, error) {
+	res := Result{
+		Proto:  "tcp",
+		Target: tp.Addr,
+		Seq:    tp.seq.next(),
+		Time:   tp.Clock.Now(),
+	}
+
+	d := net.Dialer{Timeout: tp.Timeout, Control: tp.Control}
+	start := tp.Clock.Now()
+	conn, err := resolvingDial(&d)(ctx, "tcp", tp.Addr)
+	if err != nil {
+		return complete(res, err)
+	}
+	res.RTT = tp.Clock.Since(start)
+	res.Addr = conn.RemoteAddr().String()
+	conn.Close()
+
+	return complete(res, nil)
+}
+
+// HTTPProber measures the time until the response headers of a GET request
+type HTTPProber struct {
+	URL    string       // url to request
+	Client *http.Client // client used to send requests
+	Clock  Clock        // time source for RTT measurement
+	seq    seqCounter
+}
+
+// Initialize and return a new HTTPProber
+func NewHTTPProber(url string, timeout time.Duration) *HTTPProber {
+	return &HTTPProber{
+		URL:    url,
+		Client: controlClient(timeout, nil),
+		Clock:  SystemClock,
+	}
+}
+
+// controlClient returns a client like the default one whose connections get
+// their socket options set by control, see net.Dialer, and hosts looked up
+// from where -resolve-from says
+func controlClient(timeout time.Duration, control func(network, address string, rc syscall.RawConn) error) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = resolvingDial(&net.Dialer{Control: control})
+	return &http.Client{Timeout: timeout, Transport: tr}
+}
+
+// Probe sends a GET request and reads the response body
+func (hp *HTTPProber) Probe(ctx context.Context) (Result, error) {
+	res := Result{
+		Proto:  "http",
+		Target: hp.URL,
+		Seq:    hp.seq.next(),
+		Time:   hp.Clock.Now(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hp.URL, nil)
+	if err != nil {
+		return complete(res, err)
+	}
+
+	start := hp.Clock.Now()
+	resp, err := hp.Client.Do(req)
+	if err != nil {
+		return complete(res, err)
+	}
+	defer resp.Body.Close()
+	res.RTT = hp.Clock.Since(start)
+	res.Addr = req.URL.Host
+
+	n, _ := io.Copy(io.Discard, resp.Body)
+	res.Size = int(n)
+
+	return complete(res, nil)
+}
+
+// DNSProber measures how long it takes to resolve a name
+type DNSProber struct {
+	Name     string        // name to resolve
+	Timeout  time.Duration // how long to wait for an answer
+	Resolver *net.Resolver // resolver used for lookups
+	Clock    Clock         // time source for RTT measurement
+	seq      seqCounter
+}
+
+// Initialize and return a new DNSProber using the system resolver
+func NewDNSProber(name string, timeout time.Duration) *DNSProber {
+	return &DNSProber{
+		Name:     name,
+		Timeout:  timeout,
+		Resolver: net.DefaultResolver,
+		Clock:    SystemClock,
+	}
+}
+
+// controlResolver returns a resolver asking server, see resolverDial, or
+// the system's servers for "", whose queries get their socket options set
+// by control. The system's resolver library can't be told, so names are
+// looked up by Go's own.
+func controlResolver(server string, control func(network, address string, rc syscall.RawConn) error) *net.Resolver {
+	d := &net.Dialer{Control: control, Resolver: bootstrapResolver}
+	return &net.Resolver{PreferGo: true, Dial: resolverDial(server, d)}
+}
+
+// Probe looks up the name's addresses
+func (dp *DNSProber) Probe(ctx context.Context) (Result, error) {
+	res := Result{
+		Proto:  "dns",
+		Target: dp.Name,
+		Seq:    dp.seq.next(),
+		Time:   dp.Clock.Now(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dp.Timeout)
+	defer cancel()
+
+	start := dp.Clock.Now()
+	addrs, err := dp.Resolver.LookupHost(ctx, dp.Name)
+	if err != nil {
+		return complete(res, err)
+	}
+	res.RTT = dp.Clock.Since(start)
+	res.Addr = addrs[0]
+
+	return complete(res, nil)
+}
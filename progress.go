@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressWidth = 30 // characters of the bar itself
+
+// Progress is a Stage drawing a progress bar of a run bounded by a count of
+// probes or a deadline at the bottom of the terminal, with how long is left
+// and the loss so far. Output written through Writer goes above it.
+type Progress struct {
+	w        io.Writer // the terminal
+	count    int       // probes to send, 0 if unbounded
+	deadline time.Duration
+	start    time.Time
+
+	mu      sync.Mutex
+	done    int
+	lost    int
+	stopped bool
+}
+
+// Initialize and return a Progress drawn on w for a run of count probes or
+// deadline, whichever is first, 0 for none
+func NewProgress(w io.Writer, count int, deadline time.Duration) *Progress {
+	return &Progress{w: w, count: count, deadline: deadline, start: time.Now()}
+}
+
+// isTerminal reports whether w is a terminal, the only place progress is
+// drawn
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *Progress) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if r.Kind != KindReply {
+		p.lost++
+	}
+	p.draw()
+	return true
+}
+
+// Writer returns out, which has to go to the same terminal, with the bar
+// moved below everything written to it
+func (p *Progress) Writer(out io.Writer) io.Writer {
+	return progressWriter{p, out}
+}
+
+type progressWriter struct {
+	p   *Progress
+	out io.Writer
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.mu.Lock()
+	defer pw.p.mu.Unlock()
+	pw.p.clear()
+	n, err := pw.out.Write(b)
+	pw.p.draw()
+	return n, err
+}
+
+// Run redraws the bar every second, for the time left to count down while
+// nothing comes in, until ctx is done
+func (p *Progress) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// Stop takes the bar off the terminal for good
+func (p *Progress) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	p.stopped = true
+}
+
+func (p *Progress) clear() {
+	if p.stopped {
+		return
+	}
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+// draw the bar over the current line, called with mu held
+func (p *Progress) draw() {
+	if p.stopped {
+		return
+	}
+	elapsed := time.Since(p.start)
+	var frac float64
+	var left time.Duration
+	if p.count > 0 && p.done > 0 {
+		frac = float64(p.done) / float64(p.count)
+		left = time.Duration(float64(elapsed) / frac * (1 - frac))
+	}
+	if p.deadline > 0 {
+		if f := float64(elapsed) / float64(p.deadline); f > frac {
+			frac, left = f, p.deadline-elapsed
+		}
+	}
+	frac = min(frac, 1)
+	left = max(left, 0)
+
+	filled := int(frac * progressWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", progressWidth-filled)
+	var loss float64
+	if p.done > 0 {
+		loss = float64(p.lost) / float64(p.done) * 100
+	}
+	status := fmt.Sprintf("[%s] %3.0f%%", bar, frac*100)
+	if p.count > 0 {
+		status += fmt.Sprintf(" %d/%d", p.done, p.count)
+	}
+	status += fmt.Sprintf(" loss %.1f%% ETA %v", loss, left.Round(time.Second))
+	fmt.Fprint(p.w, "\r\033[K"+status)
+}
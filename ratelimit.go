@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter governs how fast probes are sent. Wait blocks until the next
+// probe may go out, or ctx is done.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket is a RateLimiter that allows rate probes per second on
+// average, with bursts of up to burst probes. It is safe for concurrent use
+// so several senders can share one limit.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64 // max tokens in the bucket
+	tokens float64 // tokens currently available
+	last   time.Time
+	clock  Clock
+}
+
+// Initialize and return a full TokenBucket
+func NewTokenBucket(rate float64, burst int, clock Clock) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// Wait takes a token from the bucket, sleeping until one is available.
+// Tokens are reserved before sleeping, so oversleeping doesn't lower the
+// rate: the next caller's wait is shorter to make up for it.
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	// take the token, going into debt if it hasn't been added yet
+	tb.tokens--
+	if tb.tokens >= 0 {
+		tb.mu.Unlock()
+		return nil
+	}
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		// give the reserved token back
+		tb.mu.Lock()
+		tb.tokens++
+		tb.mu.Unlock()
+		return ctx.Err()
+	case <-tb.clock.After(wait):
+		return nil
+	}
+}
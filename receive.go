@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// how many sent requests are remembered, so replies to them can still be
+// reported as late or duplicate
+const lateWindow = 1024
+
+// requests are also forgotten once they are this many timeouts old, which
+// keeps memory bounded when monitoring many targets
+const lateTimeouts = 3
+
+// how many late and duplicate results are held until collected with Late
+const lateQueue = 256
+
+// an echo request sent by a PingClient
+type inflight struct {
+	seq    int
+	start  time.Time       // when it was sent
+	data   []byte          // message body sent, without its stamp
+	nonce  uint64          // random number the request carried, 0 for none, see stampPayload
+	reply  chan answer     // gets the first answer, buffered, for Probe
+	done   func(answer)    // or is called with it, for ProbeAsync
+	sendID uint32          // number of the message for the transport's send timestamps
+	sentOn sendTimestamper // transport it was sent on, if that has send timestamps
+
+	answered bool // a reply or error came back
+	expired  bool // the probe gave up waiting
+}
+
+// what came back for a request
+type answer struct {
+	res    Result
+	info   RecvInfo
+	err    error
+	sendID uint32          // of the request, see inflight
+	sentOn sendTimestamper // of the request, see inflight
+}
+
+// pushTransport is implemented by transports that hand every recieved
+// message to a function instead of being read, like the clients of a Mux.
+// b is only valid during the call.
+type pushTransport interface {
+	OnReceive(fn func(b []byte, info RecvInfo))
+}
+
+// receive reads every message arriving on t and routes it to the request it
+// answers, independent of when requests are sent
+func (pc *PingClient) receive(t Transport) {
+	buf := make([]byte, replyLen(pc.MsgSize))
+	for {
+		n, info, err := t.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			pc.stopReceiving(t, err)
+			return
+		}
+		pc.handle(buf[:n], info)
+	}
+}
+
+// handle a recieved message. Answers to requests the probe already gave up
+// on, and repeated answers, are queued for Late.
+func (pc *PingClient) handle(b []byte, info RecvInfo) {
+	now := pc.Clock.Now()
+	if !info.Time.IsZero() {
+		overhead.RecvLag.add(now.Sub(info.Time))
+	}
+	proto := ProtocolICMP
+	if !pc.IPv4 {
+		proto = ProtocolICMPv6
+	}
+
+	if pc.Dump != nil {
+		dumpPacket(pc.Dump, false, pc.IPv4, b, info.Peer, info.TTL)
+	}
+
+	msg, err := icmp.ParseMessage(proto, b)
+	if err != nil {
+		logger.Debug("ignoring unparsable message", "target", pc.Addr,
+			"from", info.Peer, "err", err)
+		return
+	}
+
+	switch body := msg.Body.(type) {
+	case *icmp.Echo:
+		if msg.Type != pc.replyType() || !pc.fromTarget(info.Peer) {
+			break
+		}
+		// NATs can rewrite the identifier, the nonce still tells our
+		// replies apart
+		rewritten := body.ID != pc.ID&0xffff
+		if rewritten && !pc.carriesNonce(body.Seq, body.Data) {
+			break
+		}
+		if rewritten && !pc.rewriteSeen.Swap(true) {
+			logger.Warn("echo identifier rewritten on the path, matching replies by their nonce",
+				"target", pc.Addr, "sent", pc.ID&0xffff, "got", body.ID)
+		}
+		// ICMPv6 checksums cover the IP addresses, the kernel checks those
+		switch {
+		case pc.IPv4 && !checksumOK(b):
+			pc.corrupt(body.Seq, info, fmt.Errorf("bad checksum %#04x", binary.BigEndian.Uint16(b[2:4])))
+			return
+		case msg.Code != 0:
+			pc.corrupt(body.Seq, info, fmt.Errorf("echo reply with code %d", msg.Code))
+			return
+		}
+		if err := pc.checkNonce(body.Seq, body.Data); err != nil {
+			pc.corrupt(body.Seq, info, err)
+			return
+		}
+		if err := pc.checkPayload(body.Seq, body.Data); err != nil {
+			pc.corrupt(body.Seq, info, err)
+			return
+		}
+		pc.deliver(body.Seq, func(fl *inflight) answer {
+			res := pc.result(fl)
+			res.Addr = info.Peer.String()
+			res.TTL = info.TTL
+			res.RTT = now.Sub(fl.start)
+			res.Recv = now
+			res.Size = len(body.Data)
+			res.IDRewritten = rewritten
+			if fl.nonce != 0 {
+				// time it by the stamp it echoed, checked by checkNonce
+				sent := pc.epoch.Add(time.Duration(binary.BigEndian.Uint64(body.Data[:8])))
+				res.RTT = now.Sub(sent)
+			}
+			if pc.ECN != "" {
+				res.ECN = info.ECN
+			}
+			return answer{res: res, info: info}
+		})
+		return
+	case *icmp.TimeExceeded:
+		if seq, ok := pc.quotedSeq(body.Data); ok {
+			failed := pc.failed(info, now, body.Data, ErrTTLExceeded)
+			labels := mplsLabels(body.Extensions)
+			pc.deliver(seq, func(fl *inflight) answer {
+				a := failed(fl)
+				a.res.MPLS = labels
+				return a
+			})
+			return
+		}
+	case *icmp.DstUnreach:
+		if seq, ok := pc.quotedSeq(body.Data); ok {
+			// code 4 is fragmentation needed, with the next hop's MTU in
+			// the header
+			if pc.IPv4 && msg.Code == 4 {
+				pc.deliver(seq, pc.tooBig(info, now, body.Data, int(binary.BigEndian.Uint16(b[6:8]))))
+				return
+			}
+			pc.deliver(seq, pc.failed(info, now, body.Data, ErrHostUnreachable))
+			return
+		}
+	case *icmp.PacketTooBig:
+		if seq, ok := pc.quotedSeq(body.Data); ok {
+			pc.deliver(seq, pc.tooBig(info, now, body.Data, body.MTU))
+			return
+		}
+	}
+	logger.Debug("ignoring message for someone else", "target", pc.Addr,
+		"from", info.Peer, "type", msg.Type)
+}
+
+// the result of a request before anything came back
+func (pc *PingClient) result(fl *inflight) Result {
+	return Result{
+		Proto:  "icmp",
+		Target: pc.Addr,
+		Seq:    fl.seq,
+		TTL:    -1,
+		Time:   fl.start,
+	}
+}
+
+// checkNonce returns an error if a reply to request seq doesn't echo the
+// nonce the request was sent with, because it's a stale reply to an earlier
+// request with the same sequence number or a replayed one
+func (pc *PingClient) checkNonce(seq int, data []byte) error {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	// replies to unknown requests are ignored by deliver
+	fl, ok := pc.sent[seq&0xffff]
+	if !ok || fl.nonce == 0 {
+		return nil
+	}
+	if len(data) < stampLen {
+		return fmt.Errorf("reply of %d bytes cut short before its nonce", len(data))
+	}
+	if nonce := binary.BigEndian.Uint64(data[8:16]); nonce != fl.nonce {
+		return fmt.Errorf("nonce %#x isn't the request's, stale or replayed reply", nonce)
+	}
+	return nil
+}
+
+// checkPayload returns an error if a reply to request seq came back with
+// its data cut short or damaged, by the CRC the request was sealed with or,
+// for requests too small for one, comparing the data byte by byte
+func (pc *PingClient) checkPayload(seq int, data []byte) error {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	fl, ok := pc.sent[seq&0xffff]
+	if !ok {
+		return nil
+	}
+	if len(data) < len(fl.data) {
+		return fmt.Errorf("%w, cut short to %d of %d bytes", errDamaged, len(data), len(fl.data))
+	}
+	if len(fl.data) >= headLen {
+		if !payloadCRCOK(data[:len(fl.data)]) {
+			return fmt.Errorf("%w, CRC32 doesn't match", errDamaged)
+		}
+		return nil
+	}
+	// the stamp is checked by checkNonce
+	from := 0
+	if fl.nonce != 0 {
+		from = stampLen
+	}
+	if n := differingBytes(fl.data[from:], data[from:]); n > 0 {
+		return fmt.Errorf("%w, %d of %d bytes differ", errDamaged, n, len(fl.data))
+	}
+	return nil
+}
+
+// carriesNonce reports whether data is the body of a reply to a request
+// still remembered, by the nonce the request was sent with
+func (pc *PingClient) carriesNonce(seq int, data []byte) bool {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	fl, ok := pc.sent[seq&0xffff]
+	return ok && fl.nonce != 0 && len(data) >= stampLen &&
+		binary.BigEndian.Uint64(data[8:16]) == fl.nonce
+}
+
+// return the sequence number of our request quoted in an ICMP error
+func (pc *PingClient) quotedSeq(data []byte) (int, bool) {
+	dst, id, seq, ok := quotedEcho(data, pc.IPv4)
+	if !ok || !dst.Equal(pc.IPAddr.IP) || id != pc.ID&0xffff {
+		return 0, false
+	}
+	return seq, true
+}
+
+// build the answer for an ICMP error about a request, quoted is the start
+// of the request as the router sending it got it
+func (pc *PingClient) failed(info RecvInfo, now time.Time, quoted []byte, kind error) func(*inflight) answer {
+	ecn := quotedECN(quoted, pc.IPv4)
+	return func(fl *inflight) answer {
+		res := pc.result(fl)
+		res.Addr = info.Peer.String()
+		res.TTL = info.TTL
+		res.RTT = now.Sub(fl.start)
+		if pc.ECN != "" {
+			res.ECN = ecn
+		}
+		return answer{res: res, info: info, err: &ProbeError{Kind: kind, From: res.Addr}}
+	}
+}
+
+// like failed, for a router that couldn't forward a request bigger than mtu
+// without fragmenting it
+func (pc *PingClient) tooBig(info RecvInfo, now time.Time, quoted []byte, mtu int) func(*inflight) answer {
+	failed := pc.failed(info, now, quoted, ErrFragNeeded)
+	return func(fl *inflight) answer {
+		a := failed(fl)
+		a.err.(*ProbeError).Err = &MTUError{MTU: mtu}
+		return a
+	}
+}
+
+// queue a reply to request seq that came back damaged. It doesn't answer
+// the request, which may still get a good reply.
+func (pc *PingClient) corrupt(seq int, info RecvInfo, problem error) {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	res := Result{Proto: "icmp", Target: pc.Addr, Seq: seq, TTL: info.TTL}
+	if fl, ok := pc.sent[seq&0xffff]; ok {
+		res = pc.result(fl)
+		res.TTL = info.TTL
+	}
+	res.Kind = KindCorrupt
+	res.Addr = info.Peer.String()
+	res.Err = &ProbeError{Kind: ErrCorrupt, From: res.Addr, Err: problem}
+	pc.queueLate(res)
+}
+
+// hand the answer to request seq to the probe waiting for it, or queue it
+// as late or duplicate if nobody is waiting anymore
+func (pc *PingClient) deliver(seq int, build func(*inflight) answer) {
+	pc.rmu.Lock()
+	fl, ok := pc.sent[seq&0xffff]
+	if !ok {
+		pc.rmu.Unlock()
+		logger.Debug("ignoring answer to unknown request", "target", pc.Addr, "seq", seq)
+		return
+	}
+	a := build(fl)
+	a.sendID, a.sentOn = fl.sendID, fl.sentOn
+
+	var done func(answer)
+	switch {
+	case !fl.answered && !fl.expired:
+		fl.answered = true
+		if fl.done != nil {
+			done = fl.done
+		} else {
+			fl.reply <- a
+		}
+	case a.err != nil:
+		// errors about requests we stopped caring about aren't interesting
+	case fl.answered:
+		a.res.Kind = KindDup
+		pc.queueLate(a.res)
+	default:
+		fl.answered = true
+		a.res.Kind = KindLate
+		pc.queueLate(a.res)
+	}
+	pc.rmu.Unlock()
+
+	if done != nil {
+		done(a)
+	}
+}
+
+// queue a late or duplicate result, dropping the oldest if nobody collects
+func (pc *PingClient) queueLate(res Result) {
+	res.Stamp = TimestampUser
+	if len(pc.late) == lateQueue {
+		pc.late = pc.late[1:]
+		overhead.Dropped.Add(1)
+	}
+	pc.late = append(pc.late, res)
+}
+
+// Late returns the late, duplicate and corrupt replies recieved since the
+// last call.
+// Their results don't count as probes of their own.
+func (pc *PingClient) Late() []Result {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	late := pc.late
+	pc.late = nil
+	return late
+}
+
+// remember a request about to be sent, so the answer can be handed to it
+func (pc *PingClient) track(fl *inflight) error {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	if pc.readErr != nil {
+		return pc.readErr
+	}
+	if pc.sent == nil {
+		pc.sent = make(map[int]*inflight)
+		pc.oldest = fl.seq
+	}
+	pc.sent[fl.seq&0xffff] = fl
+
+	// forget the oldest requests once there are too many or they're too old
+	// for an answer to still be expected
+	cutoff := fl.start.Add(-lateTimeouts * pc.Timeout)
+	for ; pc.oldest < fl.seq; pc.oldest++ {
+		old, ok := pc.sent[pc.oldest&0xffff]
+		if !ok || old.seq != pc.oldest {
+			continue
+		}
+		if fl.seq-pc.oldest < lateWindow && old.start.After(cutoff) {
+			break
+		}
+		delete(pc.sent, pc.oldest&0xffff)
+	}
+	return nil
+}
+
+// give up waiting for a request, returning its answer if it raced in
+func (pc *PingClient) expire(fl *inflight) (answer, bool) {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+
+	if fl.answered {
+		return <-fl.reply, true
+	}
+	fl.expired = true
+	return answer{}, false
+}
+
+// stop expecting an answer to a request that couldn't be sent
+func (pc *PingClient) forget(fl *inflight) {
+	pc.rmu.Lock()
+	defer pc.rmu.Unlock()
+	fl.answered, fl.expired = true, true
+}
+
+// give up waiting for a request sent with ProbeAsync, its done function is
+// called with a timeout unless an answer came back already
+func (pc *PingClient) expireAsync(fl *inflight) {
+	pc.rmu.Lock()
+	if fl.answered || fl.expired {
+		pc.rmu.Unlock()
+		return
+	}
+	fl.expired = true
+	pc.rmu.Unlock()
+
+	fl.done(answer{res: pc.result(fl), err: os.ErrDeadlineExceeded})
+}
+
+// fail every waiting probe, and later ones, once the transport t can't be
+// read anymore
+func (pc *PingClient) stopReceiving(t Transport, err error) {
+	pc.rmu.Lock()
+	if t != pc.receiving {
+		// closed by Reopen, there's a new one
+		pc.rmu.Unlock()
+		return
+	}
+	logger.Debug("receive loop stopped", "target", pc.Addr, "err", err)
+	pc.readErr = err
+
+	var waiting []*inflight
+	for _, fl := range pc.sent {
+		if fl.answered || fl.expired {
+			continue
+		}
+		fl.answered = true
+		if fl.done != nil {
+			waiting = append(waiting, fl)
+		} else {
+			fl.reply <- answer{res: pc.result(fl), err: err}
+		}
+	}
+	pc.rmu.Unlock()
+
+	for _, fl := range waiting {
+		fl.done(answer{res: pc.result(fl), err: err})
+	}
+}
+
+// count the payload bytes that came back different from what was sent, got
+// is at least as long
+func differingBytes(sent, got []byte) int {
+	n := 0
+	for i := range sent {
+		if sent[i] != got[i] {
+			n++
+		}
+	}
+	return n
+}
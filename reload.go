@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// reload replaces the targets that came from the config file with configs.
+// Targets whose settings didn't change go on being probed as they were,
+// changed ones are started again with their new settings, and ones that
+// are gone are stopped.
+func (api *serveAPI) reload(configs []targetConfig) (started, stopped int) {
+	next := make(map[string][]targetConfig)
+	var order []string
+	for _, tc := range configs {
+		if _, ok := next[tc.Target]; !ok {
+			order = append(order, tc.Target)
+		}
+		next[tc.Target] = append(next[tc.Target], tc)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for target, prev := range api.config {
+		tcs, ok := next[target]
+		if ok && reflect.DeepEqual(prev, tcs) {
+			continue
+		}
+		// changed targets keep their statistics
+		api.stop(target, !ok)
+		delete(api.config, target)
+		stopped++
+	}
+	for _, target := range order {
+		if _, ok := api.config[target]; ok {
+			continue
+		}
+		if _, ok := api.targets[target]; ok {
+			logger.Error("skipping config target, already monitored from the command line or API", "target", target)
+			continue
+		}
+		for _, tc := range next[target] {
+			id, err := api.start(tc)
+			if err != nil {
+				logger.Error("skipping target", "target", tc.Target, "err", err)
+				continue
+			}
+			api.targets[target] = append(api.targets[target], id)
+		}
+		api.config[target] = next[target]
+		started++
+	}
+	return started, stopped
+}
+
+// reloadConfig reads the config file again and applies it
+func (api *serveAPI) reloadConfig() error {
+	if api.configPath == "" {
+		return fmt.Errorf("serve wasn't started with -config")
+	}
+	c, err := loadConfig(api.configPath)
+	if err != nil {
+		return err
+	}
+	api.groups.SetThresholds(c.Groups)
+	started, stopped := api.reload(c.Targets)
+	logger.Info("reloaded config", "path", api.configPath, "started", started, "stopped", stopped)
+	return nil
+}
+
+func (api *serveAPI) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if err := api.reloadConfig(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
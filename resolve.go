@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// where the names of targets are looked up, see -resolve-from
+const (
+	resolveSystem = "system" // the hosts file, then DNS, or as the system's configured
+	resolveHosts  = "hosts"  // only the hosts file
+	resolveDNS    = "dns"    // only DNS, skipping the hosts file
+	resolveStatic = "static" // only -static-map
+)
+
+var (
+	// where names are looked up, set by parseFlags from -resolve-from
+	resolveFrom = resolveSystem
+
+	// the names -static-map gives addresses, lower case
+	staticHosts staticMapFlag
+
+	// the -resolver server, "" for the system's
+	resolverServer string
+)
+
+// useResolveFrom makes names be looked up from source, with the addresses
+// of m for static. m without a source means static.
+func useResolveFrom(source string, m staticMapFlag) error {
+	if source == "" {
+		source = resolveSystem
+		if len(m) > 0 {
+			source = resolveStatic
+		}
+	}
+	switch source {
+	case resolveSystem, resolveHosts, resolveDNS:
+		if len(m) > 0 {
+			return errors.New("-static-map needs -resolve-from static")
+		}
+	case resolveStatic:
+		if len(m) == 0 {
+			return errors.New("-resolve-from static needs -static-map")
+		}
+	default:
+		return fmt.Errorf("invalid -resolve-from %q, must be system, hosts, dns or static", source)
+	}
+	if resolverServer != "" && source != resolveSystem && source != resolveDNS {
+		return fmt.Errorf("-resolver only applies to -resolve-from system or dns, not %s", source)
+	}
+	resolveFrom, staticHosts = source, m
+	return nil
+}
+
+// resolveIPAddr looks up host like net.ResolveIPAddr, but from where
+// -resolve-from says: an address of network, ip4, ip6 or ip for either
+// preferring IPv4
+func resolveIPAddr(network, host string) (*net.IPAddr, error) {
+	if !ownLookup(host) {
+		return net.ResolveIPAddr(network, host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+	defer cancel()
+	addrs, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var first *net.IPAddr
+	for _, a := range addrs {
+		v4 := a.IP.To4() != nil
+		switch {
+		case network == "ip4" && !v4, network == "ip6" && v4:
+			continue
+		case v4:
+			return &a, nil
+		case first == nil:
+			first = &a
+		}
+	}
+	if first == nil {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+	}
+	return first, nil
+}
+
+// lookupIPAddr returns the addresses of host, from where -resolve-from says,
+// .local names from mDNS unless that's only the hosts file or -static-map,
+// and with -llmnr single-label names DNS fails for from the LAN
+func lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	// addresses are what they are, wherever names come from
+	if ip, zone, _ := strings.Cut(host, "%"); net.ParseIP(ip) != nil {
+		return []net.IPAddr{{IP: net.ParseIP(ip), Zone: zone}}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if isMDNSName(name) && (resolveFrom == resolveSystem || resolveFrom == resolveDNS) {
+		return queryMDNS(ctx, name)
+	}
+	switch resolveFrom {
+	case resolveHosts:
+		return lookupHostsFile(hostsPath(), name)
+	case resolveStatic:
+		if addrs := staticHosts[name]; len(addrs) > 0 {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "not in -static-map", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	var err error
+	if resolveFrom == resolveDNS {
+		addrs, err = queryDNS(ctx, name)
+	} else {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil && nameFallback && isSingleLabel(name) {
+		if found, lerr := lookupLANName(ctx, name); lerr == nil {
+			return found, nil
+		}
+	}
+	return addrs, err
+}
+
+// ownLookup says whether host is looked up here rather than by Go's
+// resolver as it is
+func ownLookup(host string) bool {
+	return resolveFrom != resolveSystem || isMDNSName(host) || nameFallback && isSingleLabel(host)
+}
+
+// resolvingDial returns a dial function like d's, that looks the host of
+// the address up from where -resolve-from says rather than d's resolver
+func resolvingDial(d *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || !ownLookup(host) {
+			return d.DialContext(ctx, network, address)
+		}
+		addrs, err := lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var last error
+		for _, a := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(a.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			last = err
+		}
+		return nil, last
+	}
+}
+
+// the system's hosts file
+func hostsPath() string {
+	if runtime.GOOS == "windows" {
+		return os.Getenv("SystemRoot") + `\System32\drivers\etc\hosts`
+	}
+	return "/etc/hosts"
+}
+
+// lookupHostsFile returns the addresses the hosts file at path gives name
+func lookupHostsFile(path, name string) ([]net.IPAddr, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []net.IPAddr
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip, zone, _ := strings.Cut(fields[0], "%")
+		addr := net.IPAddr{IP: net.ParseIP(ip), Zone: zone}
+		if addr.IP == nil {
+			continue
+		}
+		for _, h := range fields[1:] {
+			if strings.ToLower(strings.TrimSuffix(h, ".")) == name {
+				addrs = append(addrs, addr)
+				break
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "not in " + path, Name: name, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// queryDNS looks name up with DNS alone, asking the -resolver server or the
+// first nameserver of /etc/resolv.conf for its A and AAAA records. Go's
+// resolver can't be kept from the hosts file. Names are taken as fully
+// qualified, without search domains.
+func queryDNS(ctx context.Context, name string) ([]net.IPAddr, error) {
+	server := resolverServer
+	if server == "" {
+		var err error
+		if server, err = systemNameserver(); err != nil {
+			return nil, err
+		}
+	}
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	var addrs []net.IPAddr
+	var last error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		found, err := exchangeDNS(ctx, server, qname, qtype)
+		if err != nil {
+			last = err
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) == 0 {
+		if last == nil {
+			last = &net.DNSError{Err: "no such host", Name: name, Server: server, IsNotFound: true}
+		}
+		return nil, last
+	}
+	return addrs, nil
+}
+
+// exchangeDNS asks server for the qtype records of qname, over how
+// -resolver reaches it, and returns the addresses in the answer
+func exchangeDNS(ctx context.Context, server string, qname dnsmessage.Name, qtype dnsmessage.Type) ([]net.IPAddr, error) {
+	id := uint16(os.Getpid())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, err
+	}
+	dial := resolverDial(resolverServer, &net.Dialer{Resolver: bootstrapResolver})
+	conn, err := dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// DNS over TLS and HTTPS are framed as for TCP
+	_, packet := conn.(net.PacketConn)
+	if !packet {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0xffff)
+	var n int
+	if packet {
+		n, err = conn.Read(buf)
+	} else {
+		if _, err = io.ReadFull(conn, buf[:2]); err == nil {
+			n = int(binary.BigEndian.Uint16(buf[:2]))
+			_, err = io.ReadFull(conn, buf[:n])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	switch {
+	case msg.ID != id:
+		return nil, &net.DNSError{Err: "answer to another query", Name: qname.String(), Server: server}
+	case msg.RCode == dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: qname.String(), Server: server, IsNotFound: true}
+	case msg.RCode != dnsmessage.RCodeSuccess:
+		return nil, &net.DNSError{Err: "server answered " + msg.RCode.String(), Name: qname.String(), Server: server}
+	}
+	var addrs []net.IPAddr
+	for _, rr := range msg.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IPAddr{IP: net.IP(body.A[:])})
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IPAddr{IP: net.IP(body.AAAA[:])})
+		}
+	}
+	return addrs, nil
+}
+
+// the first nameserver of /etc/resolv.conf, with port 53
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("-resolve-from dns needs -resolver here: %v", err)
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf, -resolve-from dns needs -resolver")
+}
+
+// staticMapFlag collects repeated -static-map host=ip flags
+type staticMapFlag map[string][]net.IPAddr
+
+func (m staticMapFlag) String() string {
+	var pairs []string
+	for host, addrs := range m {
+		for _, a := range addrs {
+			pairs = append(pairs, host+"="+a.String())
+		}
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (m staticMapFlag) Set(s string) error {
+	host, addr, ok := strings.Cut(s, "=")
+	ip, zone, _ := strings.Cut(addr, "%")
+	if !ok || host == "" || net.ParseIP(ip) == nil {
+		return fmt.Errorf("%q is not host=ip", s)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	m[host] = append(m[host], net.IPAddr{IP: net.ParseIP(ip), Zone: zone})
+	return nil
+}
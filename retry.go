@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// longest wait between retries of probes that couldn't be sent
+const maxRetryBackoff = 30 * time.Second
+
+// RetryPolicy is how probes that couldn't be sent, see SendError, are tried
+// again: on a new socket, after a wait that doubles with every send failing
+// in a row, from Backoff up to Max
+type RetryPolicy struct {
+	Attempts int           // retries of a probe before its error is reported, 0 to not retry
+	Backoff  time.Duration // wait after the first failure
+	Max      time.Duration // longest wait, 0 for no limit
+}
+
+// wait returns how long to wait after failures sends failed in a row
+func (p RetryPolicy) wait(failures int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < failures && (p.Max == 0 || d < p.Max); i++ {
+		d *= 2
+	}
+	if p.Max > 0 {
+		d = min(d, p.Max)
+	}
+	return d
+}
+
+// retryable reports whether err is from a probe that couldn't be sent for
+// a reason that may pass. Permission won't be granted by trying again, and a
+// request too big for the path stays too big.
+func retryable(err error) bool {
+	var se *SendError
+	return errors.As(err, &se) && !errors.Is(err, ErrPermission) && !errors.Is(err, ErrFragNeeded)
+}
+
+// reopener is implemented by probers with a socket that can be replaced,
+// see PingClient.Reopen
+type reopener interface {
+	Reopen() error
+}
+
+// replace the socket of p, if it has one, before a retry
+func reopen(p Prober) {
+	if ro, ok := p.(reopener); ok {
+		if err := ro.Reopen(); err != nil {
+			logger.Debug("closing socket for a retry", "err", err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// the main routing table, not worth naming
+const mainTable = 254
+
+// Route is the way packets to a destination leave this host
+type Route struct {
+	Dev     string // interface they're sent out of
+	Src     net.IP // source address they get
+	Gateway net.IP // next hop, nil for destinations on the link
+	Table   int    // routing table the route was found in, 0 if unknown
+}
+
+// String describes r like ip route get does
+func (r Route) String() string {
+	var s string
+	if r.Gateway != nil {
+		s = "via " + r.Gateway.String() + " "
+	}
+	s += "dev " + r.Dev
+	if r.Src != nil {
+		s += " src " + r.Src.String()
+	}
+	if r.Table != 0 && r.Table != mainTable {
+		s += fmt.Sprintf(" table %d", r.Table)
+	}
+	return s
+}
+
+// dialRoute finds the route to dst by the local address the system picks
+// for it, connecting a UDP socket sends nothing. That doesn't show the
+// gateway. control sets socket options that change the route, nil for none.
+func dialRoute(dst *net.IPAddr, control func(network, address string, rc syscall.RawConn) error) (Route, error) {
+	d := net.Dialer{Control: control}
+	c, err := d.Dial("udp", (&net.UDPAddr{IP: dst.IP, Zone: dst.Zone, Port: 9}).String())
+	if err != nil {
+		return Route{}, err
+	}
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	c.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return Route{}, err
+	}
+	for _, ifi := range ifaces {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(local) {
+				return Route{Dev: ifi.Name, Src: local}, nil
+			}
+		}
+	}
+	return Route{}, fmt.Errorf("no interface has %s", local)
+}
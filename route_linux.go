@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lookupRoute returns the route packets to dst with firewall mark mark, 0
+// for none, sent out of device dev, "" for any, take. It asks the kernel
+// over netlink like ip route get, falling back to dialRoute where that's
+// not allowed.
+func lookupRoute(dst *net.IPAddr, mark int, dev string) (Route, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		logger.Debug("can't query routes over netlink", "err", err)
+		var control func(network, address string, rc syscall.RawConn) error
+		if mark != 0 {
+			control = markControl(mark)
+		}
+		return dialRoute(dst, control)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return Route{}, err
+	}
+
+	family, ip := unix.AF_INET6, dst.IP.To16()
+	if ip4 := dst.IP.To4(); ip4 != nil {
+		family, ip = unix.AF_INET, ip4
+	}
+	oif := 0
+	if dst.Zone != "" {
+		dev = dst.Zone
+	}
+	if dev != "" {
+		ifi, err := net.InterfaceByName(dev)
+		if err != nil {
+			return Route{}, err
+		}
+		oif = ifi.Index
+	}
+
+	// the request is a header, an rtmsg and the attributes to route by
+	b := make([]byte, unix.SizeofNlMsghdr+unix.SizeofRtMsg)
+	b[unix.SizeofNlMsghdr] = byte(family)
+	b[unix.SizeofNlMsghdr+1] = byte(len(ip) * 8)
+	binary.NativeEndian.PutUint32(b[unix.SizeofNlMsghdr+8:], unix.RTM_F_LOOKUP_TABLE)
+	b = appendRtAttr(b, unix.RTA_DST, ip)
+	if mark != 0 {
+		b = appendRtAttr(b, unix.RTA_MARK, binary.NativeEndian.AppendUint32(nil, uint32(mark)))
+	}
+	if oif != 0 {
+		b = appendRtAttr(b, unix.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(oif)))
+	}
+	binary.NativeEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.NativeEndian.PutUint16(b[4:6], unix.RTM_GETROUTE)
+	binary.NativeEndian.PutUint16(b[6:8], unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(b[8:12], 1)
+	if err := unix.Sendto(fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return Route{}, err
+	}
+
+	buf := make([]byte, 1<<16)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return Route{}, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return Route{}, err
+	}
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(m.Data) >= 4 {
+				if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+					return Route{}, &net.OpError{Op: "route", Net: "ip", Addr: dst, Err: syscall.Errno(errno)}
+				}
+			}
+		case unix.RTM_NEWROUTE:
+			return parseRoute(&m)
+		}
+	}
+	return Route{}, syscall.ENETUNREACH
+}
+
+// append a route attribute to a netlink request, padded to 4 bytes
+func appendRtAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	b = binary.NativeEndian.AppendUint16(b, uint16(l))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for l%4 != 0 {
+		b = append(b, 0)
+		l++
+	}
+	return b
+}
+
+// parseRoute reads the route in a RTM_NEWROUTE message
+func parseRoute(m *syscall.NetlinkMessage) (Route, error) {
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return Route{}, err
+	}
+	var r Route
+	if len(m.Data) >= unix.SizeofRtMsg {
+		r.Table = int(m.Data[4])
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.RTA_OIF:
+			if ifi, err := net.InterfaceByIndex(int(binary.NativeEndian.Uint32(a.Value))); err == nil {
+				r.Dev = ifi.Name
+			}
+		case unix.RTA_PREFSRC:
+			r.Src = net.IP(a.Value)
+		case unix.RTA_GATEWAY:
+			r.Gateway = net.IP(a.Value)
+		case unix.RTA_TABLE:
+			r.Table = int(binary.NativeEndian.Uint32(a.Value))
+		}
+	}
+	return r, nil
+}
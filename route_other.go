@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// lookupRoute returns the route packets to dst take. Firewall marks and
+// VRFs are Linux only, so mark and dev are never set here.
+func lookupRoute(dst *net.IPAddr, mark int, dev string) (Route, error) {
+	return dialRoute(dst, nil)
+}
@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # build
-go build ping.go
+go build -o ping .
 
 # run
 sudo ./ping -s 40 www.google.com
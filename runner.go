@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Runner sends probes one after another, waiting Interval between them, and
+// hands every result to Handle. If Limiter is set probes are additionally
+// held back to its rate.
+//
+// With Overlap set the next probe goes out on schedule even if earlier ones
+// are still waiting for their answers, which keeps the rate steady when
+// answers are slow or lost. Prober and Handle must then be safe for
+// concurrent use. Probes that couldn't be sent are only retried without
+// Overlap, retries would upset the rate.
+type Runner struct {
+	Prober   Prober
+	Interval time.Duration
+	Jitter   float64 // move every interval randomly by up to this fraction of it either way
+	Clock    Clock
+	Limiter  RateLimiter
+	Handle   func(Result)
+	Overlap  bool
+	Count    int // stop after this many probes, 0 to go on until cancelled
+	Retry    RetryPolicy
+
+	failures int // sends failed in a row, for the backoff
+}
+
+// lateProber is implemented by probers that can hear back from a probe after
+// it returned, late or more than once
+type lateProber interface {
+	Late() []Result
+}
+
+// Run probes until ctx is cancelled or Count probes are done. It only returns an error if probing
+// can't continue at all, e.g. when raw sockets are not permitted.
+func (r *Runner) Run(ctx context.Context) error {
+	if r.Overlap {
+		return r.runOverlapped(ctx)
+	}
+
+	for sent := 0; r.Count == 0 || sent < r.Count; sent++ {
+		if sent > 0 {
+			wait := jitter(r.Interval, r.Jitter)
+			due := r.Clock.Now().Add(wait)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-r.Clock.After(wait):
+			}
+			overhead.SendDelay.add(r.Clock.Since(due))
+		}
+		if r.Limiter != nil {
+			if err := r.Limiter.Wait(ctx); err != nil {
+				return nil
+			}
+		}
+
+		res, err := r.probe(ctx)
+		if ctx.Err() != nil {
+			// interrupted mid probe, the result is meaningless
+			r.handleLate()
+			return nil
+		}
+		if errors.Is(err, ErrPermission) {
+			return err
+		}
+		logger.Debug("probe done", "target", res.Target, "seq", res.Seq,
+			"kind", res.Kind, "rtt", res.RTT, "err", err)
+		r.Handle(res)
+		r.handleLate()
+	}
+	return nil
+}
+
+// probe once, trying again on a new socket while the probe can't be sent
+// and Retry allows
+func (r *Runner) probe(ctx context.Context) (Result, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := r.Prober.Probe(ctx)
+		if !retryable(err) {
+			r.failures = 0
+			return res, err
+		}
+		r.failures++
+		if attempt >= r.Retry.Attempts {
+			return res, err
+		}
+		wait := r.Retry.wait(r.failures)
+		logger.Warn("probe not sent, retrying on a new socket", "target", res.Target,
+			"seq", res.Seq, "in", wait, "err", err)
+		reopen(r.Prober)
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-r.Clock.After(wait):
+		}
+	}
+}
+
+// send probes on schedule, each waiting for its answer in a goroutine
+func (r *Runner) runOverlapped(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for sent := 0; ctx.Err() == nil && (r.Count == 0 || sent < r.Count); sent++ {
+		if r.Limiter != nil {
+			if err := r.Limiter.Wait(ctx); err != nil {
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := r.Prober.Probe(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, ErrPermission) {
+				cancel(err)
+				return
+			}
+			logger.Debug("probe done", "target", res.Target, "seq", res.Seq,
+				"kind", res.Kind, "rtt", res.RTT, "err", err)
+			r.Handle(res)
+			r.handleLate()
+		}()
+
+		if r.Interval > 0 {
+			wait := jitter(r.Interval, r.Jitter)
+			due := r.Clock.Now().Add(wait)
+			select {
+			case <-ctx.Done():
+			case <-r.Clock.After(wait):
+				overhead.SendDelay.add(r.Clock.Since(due))
+			}
+		}
+	}
+
+	wg.Wait()
+	r.handleLate()
+	if err := context.Cause(ctx); errors.Is(err, ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// jitter returns d moved randomly by up to frac of it either way, so probes
+// of many instances started together don't keep going out at the same time
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac == 0 {
+		return d
+	}
+	return d + time.Duration(float64(d)*frac*(2*rand.Float64()-1))
+}
+
+// hand over the late and duplicate replies that came in since the last
+// probe, and those arriving meanwhile until there are none
+func (r *Runner) handleLate() {
+	lp, ok := r.Prober.(lateProber)
+	if !ok {
+		return
+	}
+	for late := lp.Late(); len(late) > 0; late = lp.Late() {
+		for _, res := range late {
+			r.Handle(res)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeProber answers every probe, noting when it was sent. Probes fail with
+// the errors in fail first, one each.
+type fakeProber struct {
+	clock Clock
+	fail  []error
+	sent  []time.Time
+}
+
+func (p *fakeProber) Probe(ctx context.Context) (Result, error) {
+	res := Result{Seq: len(p.sent), Time: p.clock.Now()}
+	p.sent = append(p.sent, res.Time)
+	if len(p.fail) > 0 {
+		err := p.fail[0]
+		p.fail = p.fail[1:]
+		return complete(res, err)
+	}
+	return complete(res, nil)
+}
+
+func TestRunnerInterval(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	p := &fakeProber{clock: clock}
+	var got []Result
+	r := &Runner{
+		Prober:   p,
+		Interval: time.Second,
+		Clock:    clock,
+		Count:    3,
+		Handle:   func(res Result) { got = append(got, res) },
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("handled %d results, want 3", len(got))
+	}
+	for i, sent := range p.sent {
+		if want := start.Add(time.Duration(i) * time.Second); !sent.Equal(want) {
+			t.Errorf("probe %d sent at %v, want %v", i, sent.Sub(start), want.Sub(start))
+		}
+		if got[i].Seq != i || got[i].Kind != KindReply {
+			t.Errorf("result %d: %+v", i, got[i])
+		}
+	}
+}
+
+func TestRunnerRetry(t *testing.T) {
+	clock := newFakeClock()
+	unsent := &SendError{errors.New("network is unreachable")}
+	p := &fakeProber{clock: clock, fail: []error{unsent, unsent}}
+	var got []Result
+	r := &Runner{
+		Prober: p,
+		Clock:  clock,
+		Count:  1,
+		Retry:  RetryPolicy{Attempts: 2, Backoff: 100 * time.Millisecond},
+		Handle: func(res Result) { got = append(got, res) },
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// two failed sends retried after a doubling backoff, the third went out
+	if len(p.sent) != 3 || len(got) != 1 || got[0].Kind != KindReply {
+		t.Fatalf("sent %d probes, handled %+v", len(p.sent), got)
+	}
+	for i, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		if waited := p.sent[i+1].Sub(p.sent[i]); waited != want {
+			t.Errorf("retry %d after %v, want %v", i+1, waited, want)
+		}
+	}
+}
+
+// lateFakeProber is a fakeProber hearing back late, count times in batches
+type lateFakeProber struct {
+	fakeProber
+	late int
+}
+
+func (p *lateFakeProber) Late() []Result {
+	if p.late == 0 {
+		return nil
+	}
+	p.late--
+	return []Result{{Kind: KindLate}, {Kind: KindDup}}
+}
+
+func TestRunnerLate(t *testing.T) {
+	clock := newFakeClock()
+	p := &lateFakeProber{fakeProber: fakeProber{clock: clock}, late: 10000}
+	late := 0
+	r := &Runner{
+		Prober: p,
+		Clock:  clock,
+		Count:  1,
+		Handle: func(res Result) {
+			if res.Kind.extra() {
+				late++
+			}
+		},
+	}
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if late != 20000 {
+		t.Errorf("handled %d late results, want 20000", late)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// counting messages dropped by a full recieve buffer is only implemented
+// on Linux
+func enableDropCount(c syscall.Conn) error {
+	return errors.New("socket drop counts are only supported on Linux")
+}
+
+func dropCount(oob []byte) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultTick = 10 * time.Millisecond // timer wheel resolution
+
+	wheelSlots     = 1024 // slots per timer wheel, about 10s at the default tick
+	schedQueueSize = 4096 // results waiting to be handled
+)
+
+// asyncProber is implemented by probers that can send a probe without
+// waiting for its answer, see PingClient.ProbeAsync
+type asyncProber interface {
+	ProbeAsync(done func(Result, error)) (expire func(), timeout time.Duration)
+}
+
+// Scheduler probes many targets, each every interval, with a fixed number
+// of goroutines however many targets there are. Targets are spread over
+// shards, each a goroutine driving a timer wheel that sends the probes that
+// are due and expires the ones that went unanswered. ICMP probes don't need
+// a goroutine while waiting for their answer, other probes get one each.
+//
+// Results are handed to Handle from a single goroutine. Targets can be added
+// and removed while running.
+type Scheduler struct {
+	Shards  int           // number of shards, GOMAXPROCS if 0
+	Tick    time.Duration // timer wheel resolution, DefaultTick if 0
+	Limiter RateLimiter   // optional limit on probes per second, over all targets
+	Jitter  float64       // move every interval randomly by up to this fraction of it either way
+	Retry   RetryPolicy   // how ICMP probes that couldn't be sent are retried
+	Clock   Clock         // SystemClock if nil
+	Handle  func(Result)
+
+	Metrics SchedulerMetrics
+
+	mu     sync.Mutex
+	tasks  map[int]*schedTask // by id
+	lastID int
+	shards []*shard // set while running
+	spread int      // shard the next added target goes to
+}
+
+// Window limits when a target is probed, e.g. to business hours
+type Window interface {
+	// Next returns t if the window is open at t, otherwise when it opens
+	Next(t time.Time) time.Time
+}
+
+// a target and when to probe it next
+type schedTask struct {
+	id       int
+	prober   Prober
+	interval time.Duration
+	window   Window // optional
+	next     time.Time
+	removed  atomic.Bool  // stop probing, and drop results still coming in
+	failures atomic.Int32 // sends failed in a row, for the retry backoff
+	retrying atomic.Bool  // a retry is waiting, which stands in for the probes due meanwhile
+}
+
+// a finished probe
+type schedResult struct {
+	task *schedTask
+	res  Result
+	err  error
+}
+
+// SchedulerMetrics count what a Scheduler does, to check it keeps up. They
+// are safe to read while it runs.
+type SchedulerMetrics struct {
+	Targets   atomic.Int64
+	Sent      atomic.Int64 // probes sent
+	Completed atomic.Int64 // probes answered or expired
+	Queued    atomic.Int64 // results waiting to be handled
+	MaxLag    atomic.Int64 // longest a tick ran late, in nanoseconds, since the last Log
+}
+
+// Add a target to probe every interval, returning the id to Remove it with.
+// Targets added while running are first probed on the next tick.
+func (s *Scheduler) Add(p Prober, interval time.Duration) int {
+	return s.AddWindowed(p, interval, nil)
+}
+
+// AddWindowed adds a target like Add, but only probes it while w is open
+func (s *Scheduler) AddWindowed(p Prober, interval time.Duration, w Window) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tasks == nil {
+		s.tasks = make(map[int]*schedTask)
+	}
+	s.lastID++
+	t := &schedTask{id: s.lastID, prober: p, interval: interval, window: w}
+	s.tasks[t.id] = t
+	s.Metrics.Targets.Add(1)
+
+	if s.shards != nil {
+		t.next = s.clock().Now()
+		sh := s.shards[s.spread%len(s.shards)]
+		s.spread++
+		sh.mu.Lock()
+		sh.pending = append(sh.pending, t)
+		sh.mu.Unlock()
+	}
+	return t.id
+}
+
+// Remove stops probing the target with id, closing its prober if it has a
+// Close method. Results of probes still in flight are dropped.
+func (s *Scheduler) Remove(id int) bool {
+	s.mu.Lock()
+	t, ok := s.tasks[id]
+	delete(s.tasks, id)
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	t.removed.Store(true)
+	s.Metrics.Targets.Add(-1)
+	if c, ok := t.prober.(io.Closer); ok {
+		c.Close()
+	}
+	return true
+}
+
+// Run probes every target until ctx is cancelled. It only returns an error
+// if probing can't continue at all, e.g. when raw sockets are not permitted.
+func (s *Scheduler) Run(ctx context.Context) error {
+	shards := s.Shards
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	tick := s.Tick
+	if tick <= 0 {
+		tick = DefaultTick
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	results := make(chan schedResult, schedQueueSize)
+
+	// spread the first probes over the interval so they don't all go out
+	// in the same tick
+	clock := s.clock()
+	start := clock.Now()
+	sh := make([]*shard, shards)
+	for i := range sh {
+		sh[i] = &shard{s: s, ctx: ctx, results: results, clock: clock, wheel: newTimerWheel(tick, wheelSlots, start)}
+	}
+	s.mu.Lock()
+	ids := slices.Sorted(maps.Keys(s.tasks))
+	for i, id := range ids {
+		t := s.tasks[id]
+		t.next = start.Add(t.interval * time.Duration(i) / time.Duration(len(ids)))
+		sh[i%shards].add(t)
+	}
+	s.shards = sh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.shards = nil
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, sh := range sh {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sh.run()
+		}()
+	}
+
+	for ctx.Err() == nil {
+		select {
+		case r := <-results:
+			s.Metrics.Completed.Add(1)
+			s.Metrics.Queued.Store(int64(len(results)))
+			if errors.Is(r.err, ErrPermission) {
+				cancel(r.err)
+				break
+			}
+			s.handle(r)
+		case <-ctx.Done():
+		}
+	}
+
+	wg.Wait()
+	if err := context.Cause(ctx); errors.Is(err, ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// the clock to schedule by
+func (s *Scheduler) clock() Clock {
+	if s.Clock == nil {
+		return SystemClock
+	}
+	return s.Clock
+}
+
+// Running reports whether Run is probing
+func (s *Scheduler) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shards != nil
+}
+
+// hand over a result, and the late and duplicate replies that came in
+// since the last one for the same target
+func (s *Scheduler) handle(r schedResult) {
+	if r.task.removed.Load() {
+		return
+	}
+	s.Handle(r.res)
+	if lp, ok := r.task.prober.(lateProber); ok {
+		for _, res := range lp.Late() {
+			s.Handle(res)
+		}
+	}
+}
+
+// Log writes the metrics, and the process' goroutine count and memory use
+func (m *SchedulerMetrics) Log() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	sent, completed := m.Sent.Load(), m.Completed.Load()
+	logger.Info("scheduler", "targets", m.Targets.Load(), "sent", sent,
+		"in_flight", sent-completed, "queued", m.Queued.Load(), "max_lag", time.Duration(m.MaxLag.Swap(0)),
+		"goroutines", runtime.NumGoroutine(), "heap_mb", mem.HeapAlloc>>20,
+		"send_delay_max", time.Duration(overhead.SendDelay.max.Load()),
+		"recv_lag_max", time.Duration(overhead.RecvLag.max.Load()), "dropped", overhead.Dropped.Load(),
+		"socket_drops", overhead.SocketDrops.Load())
+}
+
+// a goroutine probing its share of the targets
+type shard struct {
+	s       *Scheduler
+	ctx     context.Context
+	results chan<- schedResult
+	clock   Clock
+	wheel   *timerWheel
+
+	mu      sync.Mutex
+	pending []*schedTask // added while running, not on the wheel yet
+}
+
+// schedule the next probe of t
+func (sh *shard) add(t *schedTask) {
+	sh.wheel.add(t.next, func() { sh.probe(t) })
+}
+
+// advance the wheel every tick until the context is cancelled
+func (sh *shard) run() {
+	// the ticker only paces the shard, the time is the clock's
+	ticker := time.NewTicker(sh.wheel.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sh.ctx.Done():
+			return
+		case <-ticker.C:
+			now := sh.clock.Now()
+			sh.mu.Lock()
+			pending := sh.pending
+			sh.pending = nil
+			sh.mu.Unlock()
+			for _, t := range pending {
+				sh.add(t)
+			}
+
+			// how far behind the wheel is, ticks missed while busy are
+			// caught up on in one go
+			lag := int64(now.Sub(sh.wheel.now.Add(sh.wheel.tick)))
+			for {
+				prev := sh.s.Metrics.MaxLag.Load()
+				if lag <= prev || sh.s.Metrics.MaxLag.CompareAndSwap(prev, lag) {
+					break
+				}
+			}
+			sh.wheel.advance(now)
+		}
+	}
+}
+
+// probe t and schedule the one after
+func (sh *shard) probe(t *schedTask) {
+	if t.removed.Load() {
+		return
+	}
+
+	// outside its window the target is next probed when it opens
+	if t.window != nil {
+		now := sh.clock.Now()
+		if open := t.window.Next(now); open.After(now) {
+			t.next = open
+			sh.add(t)
+			return
+		}
+	}
+
+	overhead.SendDelay.add(sh.clock.Since(t.next))
+
+	// keep to the schedule, unless so far behind that probes would pile up
+	interval := jitter(t.interval, sh.s.Jitter)
+	t.next = t.next.Add(interval)
+	if now := sh.clock.Now(); t.next.Before(now) {
+		t.next = now.Add(interval)
+	}
+	sh.add(t)
+	if t.retrying.Load() {
+		return
+	}
+	sh.send(t, 0)
+}
+
+// send a probe of t, retry attempt of one that couldn't be sent
+func (sh *shard) send(t *schedTask, attempt int) {
+	if t.removed.Load() {
+		return
+	}
+	ctx := sh.ctx
+	if sh.s.Limiter != nil && sh.s.Limiter.Wait(ctx) != nil {
+		return
+	}
+	sh.s.Metrics.Sent.Add(1)
+
+	done := func(res Result, err error) {
+		select {
+		case sh.results <- schedResult{task: t, res: res, err: err}:
+		case <-ctx.Done():
+		}
+	}
+	if ap, ok := t.prober.(asyncProber); ok {
+		expire, timeout := ap.ProbeAsync(func(res Result, err error) {
+			if !retryable(err) {
+				t.failures.Store(0)
+				t.retrying.Store(false)
+				done(res, err)
+				return
+			}
+			failures := t.failures.Add(1)
+			if attempt >= sh.s.Retry.Attempts {
+				t.retrying.Store(false)
+				done(res, err)
+				return
+			}
+			t.retrying.Store(true)
+			// probes that can't be sent fail before ProbeAsync returns, on
+			// this goroutine, so the wheel can be added to
+			sh.s.Metrics.Completed.Add(1)
+			wait := sh.s.Retry.wait(int(failures))
+			logger.Warn("probe not sent, retrying on a new socket", "target", res.Target,
+				"seq", res.Seq, "in", wait, "err", err)
+			reopen(t.prober)
+			sh.wheel.add(sh.clock.Now().Add(wait), func() { sh.send(t, attempt+1) })
+		})
+		sh.wheel.add(sh.clock.Now().Add(timeout), expire)
+		return
+	}
+	go func() {
+		res, err := t.prober.Probe(ctx)
+		done(res, err)
+	}()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// a shard of s on clock, driven by advancing its wheel by hand rather than
+// by its ticker
+func newFakeShard(s *Scheduler, clock *fakeClock) (*shard, <-chan schedResult) {
+	results := make(chan schedResult, schedQueueSize)
+	return &shard{
+		s:       s,
+		ctx:     context.Background(),
+		results: results,
+		clock:   clock,
+		wheel:   newTimerWheel(DefaultTick, wheelSlots, clock.Now()),
+	}, results
+}
+
+func TestSchedulerWheel(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	p := &fakeProber{clock: clock}
+	sh, results := newFakeShard(&Scheduler{}, clock)
+	task := &schedTask{id: 1, prober: p, interval: time.Second, next: start}
+	sh.add(task)
+
+	// the first probe goes out on the next tick, the rest every interval
+	for i, due := range []time.Duration{DefaultTick, time.Second, 2 * time.Second} {
+		sh.wheel.advance(clock.Advance(start.Add(due).Sub(clock.Now())))
+		if r := <-results; r.res.Seq != i || r.res.Kind != KindReply {
+			t.Fatalf("probe %d: got %+v", i, r.res)
+		}
+		if sent := p.sent[i]; !sent.Equal(start.Add(due)) {
+			t.Errorf("probe %d sent at %v, want %v", i, sent.Sub(start), due)
+		}
+	}
+
+	// a wheel far behind sends one probe, not every one it missed
+	clock.Advance(5 * time.Second)
+	sh.wheel.advance(clock.Now())
+	<-results
+	select {
+	case r := <-results:
+		t.Errorf("caught up with an extra probe %+v", r.res)
+	default:
+	}
+	if want := clock.Now().Add(time.Second); !task.next.Equal(want) {
+		t.Errorf("next probe at %v, want %v", task.next.Sub(start), want.Sub(start))
+	}
+}
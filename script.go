@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Script is a Starlark script reacting to results, so power users can
+// restart an interface or toggle a route their own way without recompiling
+// ping. It defines on_result(r), called for every result, and on_event(event,
+// r), called for every up, down and flapping event with -events, or just
+// one of them. r has the result's fields: kind, proto, target, addr, seq,
+// size, ttl, rtt_ms, time, error and tags. Besides print, scripts can
+// run(program, args...) a program, which returns its exit status.
+//
+// The script's globals are frozen once it's loaded, calls only see what they
+// are passed. They're made one at a time by a Hook, see NewScriptHook.
+type Script struct {
+	Path string
+
+	onResult starlark.Callable // nil if the script doesn't define it
+	onEvent  starlark.Callable // nil if the script doesn't define it
+}
+
+// LoadScript runs the Starlark script at path, which defines the functions
+// to call
+func LoadScript(path string) (*Script, error) {
+	s := &Script{Path: path}
+	predeclared := starlark.StringDict{
+		"run": starlark.NewBuiltin("run", runProgram),
+	}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, s.thread(), path, nil, predeclared)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %w", path, err)
+	}
+
+	for name, fn := range map[string]*starlark.Callable{"on_result": &s.onResult, "on_event": &s.onEvent} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		if *fn, ok = v.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s: %s is a %s, not a function", path, name, v.Type())
+		}
+	}
+	if s.onResult == nil && s.onEvent == nil {
+		return nil, fmt.Errorf("%s defines neither on_result nor on_event", path)
+	}
+	return s, nil
+}
+
+// a thread to run the script on, printing to stderr
+func (s *Script) thread() *starlark.Thread {
+	return &starlark.Thread{
+		Name: s.Path,
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s.Path, msg)
+		},
+	}
+}
+
+// call the script's function for r, on_result for every result and
+// on_event for everything else
+func (s *Script) call(r Result, event string) error {
+	fn, args := s.onEvent, starlark.Tuple{starlark.String(event), resultValue(r)}
+	if event == "result" {
+		fn, args = s.onResult, starlark.Tuple{resultValue(r)}
+	}
+	if fn == nil {
+		return nil
+	}
+
+	// a script stuck in a loop is stopped like a hook running too long
+	thread := s.thread()
+	timer := time.AfterFunc(hookTimeout, func() {
+		thread.Cancel(fmt.Sprintf("took longer than %s", hookTimeout))
+	})
+	defer timer.Stop()
+
+	_, err := starlark.Call(thread, fn, args, nil)
+	return err
+}
+
+// the Starlark value scripts get for r
+func resultValue(r Result) starlark.Value {
+	var errValue starlark.Value = starlark.None
+	if r.Err != nil {
+		errValue = starlark.String(r.Err.Error())
+	}
+	tags := starlark.NewDict(len(r.Tags))
+	for k, v := range r.Tags {
+		tags.SetKey(starlark.String(k), starlark.String(v))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"kind":   starlark.String(r.Kind),
+		"proto":  starlark.String(r.Proto),
+		"target": starlark.String(r.Target),
+		"addr":   starlark.String(r.Addr),
+		"seq":    starlark.MakeInt(r.Seq),
+		"size":   starlark.MakeInt(r.Size),
+		"ttl":    starlark.MakeInt(r.TTL),
+		"rtt_ms": starlark.Float(r.RTT.Seconds() * 1e3),
+		"time":   starlark.String(r.Time.Format(time.RFC3339Nano)),
+		"error":  errValue,
+		"tags":   tags,
+	})
+}
+
+// run(program, args...) runs a program with its output on stderr and
+// returns its exit status, for scripts to react with
+func runProgram(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s: missing program to run", b.Name())
+	}
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := starlark.AsString(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s: argument %d is a %s, not a string", b.Name(), i+1, arg.Type())
+		}
+		argv[i] = s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	err := cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return starlark.MakeInt(exit.ExitCode()), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return starlark.MakeInt(0), nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write a script to a temporary file and return its path
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "react.star")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestScript(t *testing.T) {
+	s, err := LoadScript(writeScript(t, `
+def on_result(r):
+    if r.kind != "reply" or r.rtt_ms != 250.0 or r.tags["site"] != "home" or r.error != None:
+        fail("unexpected result", r)
+
+def on_event(event, r):
+    fail("%s %s %d" % (event, r.target, r.seq))
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := Result{Kind: KindReply, RTT: 250 * time.Millisecond, Tags: map[string]string{"site": "home"}}
+	if err := s.call(reply, "result"); err != nil {
+		t.Errorf("on_result: %v", err)
+	}
+	down := Result{Kind: KindDown, Target: "example.com", Seq: 3}
+	if err := s.call(down, "down"); err == nil || !strings.Contains(err.Error(), "down example.com 3") {
+		t.Errorf("on_event failed with %v, want it to see the event and result", err)
+	}
+
+	// a script has to react to something
+	if _, err := LoadScript(writeScript(t, "x = 1\n")); err == nil {
+		t.Error("loaded a script without on_result or on_event")
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// gaps between probes longer than this are taken to be the monitor not
+// running rather than the target being up or down
+const DefaultSLAGap = 5 * time.Minute
+
+// SLATracker is a Stage working out the uptime of every target over days,
+// months or all time from its results. A target is down from its first
+// failed probe until it answers again. Results are expected in the order
+// probes were sent, ones older than the target's last are only counted as
+// probes.
+type SLATracker struct {
+	period string        // day, month or all
+	gap    time.Duration // longer between probes and the monitor wasn't running
+
+	mu      sync.Mutex
+	targets map[string]*slaTarget
+	order   []string // targets in the order first seen
+}
+
+// uptime of a target
+type slaTarget struct {
+	periods []*slaPeriod // in order
+	last    time.Time    // when the latest probe was sent
+	down    bool
+
+	outage       time.Time  // when the current outage started
+	outagePeriod *slaPeriod // period the current outage started in
+}
+
+// a target's uptime over one period
+type slaPeriod struct {
+	start            time.Time
+	probes, failed   int
+	observed, down   time.Duration // time between probes, and how much was an outage
+	outages, ended   int           // outages started, and ones that ended
+	longest, repairs time.Duration // longest outage, and total time to recover
+}
+
+// Initialize and return an SLATracker summarizing every period, a day,
+// month or all
+func NewSLATracker(period string, gap time.Duration) (*SLATracker, error) {
+	switch period {
+	case "day", "month", "all":
+	default:
+		return nil, fmt.Errorf("unknown period %q, use day, month or all", period)
+	}
+	return &SLATracker{period: period, gap: gap, targets: make(map[string]*slaTarget)}, nil
+}
+
+func (st *SLATracker) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return true
+	}
+	failed := r.Kind != KindReply
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.targets[r.Target]
+	if !ok {
+		t = &slaTarget{}
+		st.targets[r.Target] = t
+		st.order = append(st.order, r.Target)
+	}
+
+	p := st.periodOf(t, r.Time)
+	p.probes++
+	if failed {
+		p.failed++
+	}
+	if r.Time.Before(t.last) {
+		return true
+	}
+
+	if !t.last.IsZero() {
+		if r.Time.Sub(t.last) <= st.gap {
+			st.accrue(t, t.last, r.Time, t.down)
+		} else if t.down {
+			// nothing is known about the gap, end the outage where it did
+			t.endOutage(t.last)
+			t.down = false
+		}
+	}
+	switch {
+	case failed && !t.down:
+		t.outage, t.outagePeriod = r.Time, p
+		p.outages++
+	case !failed && t.down:
+		t.endOutage(r.Time)
+	}
+	t.down = failed
+	t.last = r.Time
+	return true
+}
+
+// start returns the start of the period t is in
+func (st *SLATracker) start(t time.Time) time.Time {
+	t = t.Local()
+	switch st.period {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Time{}
+}
+
+// end returns the start of the period after the one starting at start
+func (st *SLATracker) end(start time.Time) time.Time {
+	switch st.period {
+	case "day":
+		return start.AddDate(0, 0, 1)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	}
+	return time.Unix(1<<62, 0)
+}
+
+// periodOf returns the period of target t at time, adding it if needed
+func (st *SLATracker) periodOf(t *slaTarget, at time.Time) *slaPeriod {
+	start := st.start(at)
+	for i := len(t.periods) - 1; i >= 0; i-- {
+		switch p := t.periods[i]; {
+		case p.start.Equal(start):
+			return p
+		case p.start.Before(start):
+			p := &slaPeriod{start: start}
+			t.periods = append(t.periods[:i+1], append([]*slaPeriod{p}, t.periods[i+1:]...)...)
+			return p
+		}
+	}
+	p := &slaPeriod{start: start}
+	t.periods = append([]*slaPeriod{p}, t.periods...)
+	return p
+}
+
+// accrue counts the time from from to to as observed, and down if it was,
+// split between the periods it spans
+func (st *SLATracker) accrue(t *slaTarget, from, to time.Time, down bool) {
+	for from.Before(to) {
+		p := st.periodOf(t, from)
+		end := st.end(p.start)
+		if end.After(to) {
+			end = to
+		}
+		p.observed += end.Sub(from)
+		if down {
+			p.down += end.Sub(from)
+		}
+		from = end
+	}
+}
+
+// endOutage records that the current outage ended at at
+func (t *slaTarget) endOutage(at time.Time) {
+	d := at.Sub(t.outage)
+	p := t.outagePeriod
+	p.longest = max(p.longest, d)
+	p.repairs += d
+	p.ended++
+}
+
+// SLA is the uptime of a target over a period
+type SLA struct {
+	Start    time.Time     // start of the period, zero for all time
+	Probes   int           // probes sent
+	Failed   int           // probes that got no reply
+	Uptime   float64       // percent of the time the target was up
+	Downtime time.Duration // time spent in outages
+	Outages  int           // outages that started in the period
+	Longest  time.Duration // longest of those, including one still going on
+	MTTR     time.Duration // mean time to recover from the ones that ended
+}
+
+// TargetSLA is the uptime of a target in every period it was probed
+type TargetSLA struct {
+	Target  string `json:"target"`
+	Periods []SLA  `json:"periods"`
+}
+
+// Snapshot returns the uptime of every target
+func (st *SLATracker) Snapshot() []TargetSLA {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list := []TargetSLA{}
+	for _, target := range st.order {
+		list = append(list, st.snapshot(target))
+	}
+	return list
+}
+
+// Get returns the uptime of target, false if it hasn't been probed
+func (st *SLATracker) Get(target string) (TargetSLA, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.targets[target]; !ok {
+		return TargetSLA{}, false
+	}
+	return st.snapshot(target), true
+}
+
+// snapshot the uptime of target, called with mu held
+func (st *SLATracker) snapshot(target string) TargetSLA {
+	t := st.targets[target]
+	ts := TargetSLA{Target: target}
+	for _, p := range t.periods {
+		s := SLA{
+			Start:    p.start,
+			Probes:   p.probes,
+			Failed:   p.failed,
+			Downtime: p.down,
+			Outages:  p.outages,
+			Longest:  p.longest,
+		}
+		if t.down && t.outagePeriod == p {
+			s.Longest = max(s.Longest, t.last.Sub(t.outage))
+		}
+		if p.ended > 0 {
+			s.MTTR = p.repairs / time.Duration(p.ended)
+		}
+		// a single probe covers no time, go by whether it failed
+		if p.observed > 0 {
+			s.Uptime = float64(p.observed-p.down) / float64(p.observed) * 100
+		} else if p.probes > 0 {
+			s.Uptime = float64(p.probes-p.failed) / float64(p.probes) * 100
+		}
+		ts.Periods = append(ts.Periods, s)
+	}
+	return ts
+}
+
+// Remove forgets the uptime of target
+func (st *SLATracker) Remove(target string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.targets, target)
+	if i := slices.Index(st.order, target); i >= 0 {
+		st.order = slices.Delete(st.order, i, i+1)
+	}
+}
+
+// Fprint writes the uptime of every target to w
+func (st *SLATracker) Fprint(w io.Writer) {
+	for _, ts := range st.Snapshot() {
+		fmt.Fprintf(w, "\n------ %s uptime ------\n", ts.Target)
+		for _, s := range ts.Periods {
+			fmt.Fprintf(w, "%s: %.3f%% up, %d probes, %d outages", st.label(s.Start), s.Uptime, s.Probes, s.Outages)
+			if s.Outages > 0 {
+				fmt.Fprintf(w, ", down %v, longest %v", s.Downtime.Round(time.Second), s.Longest.Round(time.Second))
+			}
+			if s.MTTR > 0 {
+				fmt.Fprintf(w, ", mttr %v", s.MTTR.Round(time.Second))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// label names the period starting at start
+func (st *SLATracker) label(start time.Time) string {
+	switch st.period {
+	case "day":
+		return start.Format("2006-01-02")
+	case "month":
+		return start.Format("2006-01")
+	}
+	return "all"
+}
+
+// jsonSLA is how an SLA is written as JSON
+type jsonSLA struct {
+	Start    *time.Time   `json:"start,omitempty"`
+	Probes   int          `json:"probes"`
+	Failed   int          `json:"failed"`
+	Uptime   float64      `json:"uptime_percent"`
+	Downtime jsonDuration `json:"downtime"`
+	Outages  int          `json:"outages"`
+	Longest  jsonDuration `json:"longest_outage"`
+	MTTR     jsonDuration `json:"mttr"`
+}
+
+func (s SLA) MarshalJSON() ([]byte, error) {
+	j := jsonSLA{
+		Probes:   s.Probes,
+		Failed:   s.Failed,
+		Uptime:   s.Uptime,
+		Downtime: jsonDuration(s.Downtime),
+		Outages:  s.Outages,
+		Longest:  jsonDuration(s.Longest),
+		MTTR:     jsonDuration(s.MTTR),
+	}
+	if !s.Start.IsZero() {
+		j.Start = &s.Start
+	}
+	return json.Marshal(j)
+}
+
+// a target's uptime in a serve -state file
+type savedSLA struct {
+	Target   string           `json:"target"`
+	Periods  []savedSLAPeriod `json:"periods"`
+	Last     time.Time        `json:"last"`
+	Down     bool             `json:"down,omitempty"`
+	Outage   time.Time        `json:"outage,omitempty"`
+	InOutage int              `json:"outage_period"` // index of the period the outage started in, -1 if up
+}
+
+type savedSLAPeriod struct {
+	Start    time.Time     `json:"start"`
+	Probes   int           `json:"probes"`
+	Failed   int           `json:"failed"`
+	Observed time.Duration `json:"observed"`
+	Down     time.Duration `json:"down"`
+	Outages  int           `json:"outages"`
+	Ended    int           `json:"ended"`
+	Longest  time.Duration `json:"longest"`
+	Repairs  time.Duration `json:"repairs"`
+}
+
+func (st *SLATracker) stateName() string { return "sla" }
+
+func (st *SLATracker) saveState() any {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	saved := []savedSLA{}
+	for _, target := range st.order {
+		t := st.targets[target]
+		s := savedSLA{Target: target, Last: t.last, Down: t.down, Outage: t.outage, InOutage: -1}
+		for i, p := range t.periods {
+			if p == t.outagePeriod {
+				s.InOutage = i
+			}
+			s.Periods = append(s.Periods, savedSLAPeriod{
+				Start:    p.start,
+				Probes:   p.probes,
+				Failed:   p.failed,
+				Observed: p.observed,
+				Down:     p.down,
+				Outages:  p.outages,
+				Ended:    p.ended,
+				Longest:  p.longest,
+				Repairs:  p.repairs,
+			})
+		}
+		saved = append(saved, s)
+	}
+	return saved
+}
+
+func (st *SLATracker) loadState(b json.RawMessage) error {
+	var saved []savedSLA
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, s := range saved {
+		t := &slaTarget{last: s.Last, down: s.Down, outage: s.Outage}
+		for _, p := range s.Periods {
+			t.periods = append(t.periods, &slaPeriod{
+				start:    p.Start,
+				probes:   p.Probes,
+				failed:   p.Failed,
+				observed: p.Observed,
+				down:     p.Down,
+				outages:  p.Outages,
+				ended:    p.Ended,
+				longest:  p.Longest,
+				repairs:  p.Repairs,
+			})
+		}
+		if s.InOutage >= 0 && s.InOutage < len(t.periods) {
+			t.outagePeriod = t.periods[s.InOutage]
+		} else {
+			t.down = false
+		}
+		if _, ok := st.targets[s.Target]; !ok {
+			st.order = append(st.order, s.Target)
+		}
+		st.targets[s.Target] = t
+	}
+	return nil
+}
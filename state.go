@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// kinds of the events a StateTracker turns results into
+const (
+	KindUp       Kind = "up"       // the target answered enough probes in a row
+	KindDown     Kind = "down"     // the target lost enough probes in a row
+	KindFlapping Kind = "flapping" // the target goes up and down too often to report each time
+)
+
+// how many of a target's latest probes flapping is judged over
+const flapWindow = 20
+
+// StateTracker is a Stage keeping every target up or down, replacing the
+// result that changes a target's state with an up or down event and dropping
+// the rest but latency anomalies. A target goes down after DownAfter lost probes in a row, and up
+// after UpAfter replies in a row. A target whose probes change between
+// replies and losses more than Flap times in the last flapWindow is flapping:
+// its state changes aren't reported until it settles down to half that.
+type StateTracker struct {
+	DownAfter int
+	UpAfter   int
+	Flap      int // 0 to never call a target flapping
+
+	mu      sync.Mutex
+	targets map[string]*targetState
+}
+
+// state of a target
+type targetState struct {
+	state    Kind // KindUp, KindDown or "" until known
+	failed   bool // whether the latest probe failed
+	streak   int  // probes in a row with the same outcome as the latest
+	flapping bool
+
+	changes [flapWindow]bool // whether each of the latest probes changed the outcome
+	pos     int
+	n       int // changes in the window
+}
+
+// Initialize and return a StateTracker
+func NewStateTracker(downAfter, upAfter, flap int) *StateTracker {
+	return &StateTracker{
+		DownAfter: downAfter,
+		UpAfter:   upAfter,
+		Flap:      flap,
+		targets:   make(map[string]*targetState),
+	}
+}
+
+func (st *StateTracker) Process(r *Result) bool {
+	if r.Kind.extra() {
+		return false
+	}
+	failed := r.Kind != KindReply
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	t, ok := st.targets[r.Target]
+	if !ok {
+		t = &targetState{failed: failed}
+		st.targets[r.Target] = t
+	}
+
+	changed := failed != t.failed
+	if changed {
+		t.streak = 0
+	}
+	t.failed = failed
+	t.streak++
+	if t.changes[t.pos] {
+		t.n--
+	}
+	if changed {
+		t.n++
+	}
+	t.changes[t.pos] = changed
+	t.pos = (t.pos + 1) % flapWindow
+
+	prev := t.state
+	switch {
+	case failed && t.streak >= st.DownAfter:
+		t.state = KindDown
+	case !failed && t.streak >= st.UpAfter:
+		t.state = KindUp
+	}
+
+	if st.Flap > 0 {
+		switch {
+		case !t.flapping && t.n > st.Flap:
+			t.flapping = true
+			r.Kind = KindFlapping
+			return true
+		case t.flapping && t.n <= st.Flap/2 && t.state != "":
+			// settled, say where it ended up
+			t.flapping = false
+			r.Kind = t.state
+			return true
+		}
+	}
+	if t.flapping || t.state == prev {
+		// latency anomalies are events too
+		return r.Anomaly != 0
+	}
+	r.Kind = t.state
+	return true
+}
+
+// a target's state in a serve -state file
+type savedTargetState struct {
+	State    Kind             `json:"state"`
+	Failed   bool             `json:"failed"`
+	Streak   int              `json:"streak"`
+	Flapping bool             `json:"flapping,omitempty"`
+	Changes  [flapWindow]bool `json:"changes"`
+	Pos      int              `json:"pos"`
+}
+
+func (st *StateTracker) stateName() string { return "states" }
+
+func (st *StateTracker) saveState() any {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	saved := make(map[string]savedTargetState, len(st.targets))
+	for target, t := range st.targets {
+		saved[target] = savedTargetState{t.state, t.failed, t.streak, t.flapping, t.changes, t.pos}
+	}
+	return saved
+}
+
+func (st *StateTracker) loadState(b json.RawMessage) error {
+	var saved map[string]savedTargetState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for target, s := range saved {
+		t := &targetState{
+			state:    s.State,
+			failed:   s.Failed,
+			streak:   s.Streak,
+			flapping: s.Flapping,
+			changes:  s.Changes,
+			pos:      max(s.Pos, 0) % flapWindow,
+		}
+		for _, c := range t.changes {
+			if c {
+				t.n++
+			}
+		}
+		st.targets[target] = t
+	}
+	return nil
+}
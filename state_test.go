@@ -0,0 +1,38 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStateTracker(t *testing.T) {
+	kinds := map[rune]Kind{'.': KindReply, 'x': KindTimeout, 'l': KindLate}
+	for _, tt := range []struct {
+		down, up, flap int
+		probes         string // . for a reply, x for a timeout, l for a late reply
+		want           []Kind
+	}{
+		{3, 2, 0, ".", nil},
+		{3, 2, 0, "..", []Kind{KindUp}},
+		{3, 2, 0, "..xx..", []Kind{KindUp}},
+		{3, 2, 0, "..xxx", []Kind{KindUp, KindDown}},
+		{3, 2, 0, "..xlxlx", []Kind{KindUp, KindDown}}, // late replies don't count
+		{3, 2, 0, "xxx..", []Kind{KindDown, KindUp}},
+		{1, 1, 4, ".x.x.x.x", []Kind{KindUp, KindDown, KindUp, KindDown, KindUp, KindFlapping}},
+		// settled once the changes drop out of the window
+		{1, 1, 4, ".x.x.x" + strings.Repeat(".", 20), []Kind{KindUp, KindDown, KindUp, KindDown, KindUp, KindFlapping, KindUp}},
+	} {
+		st := NewStateTracker(tt.down, tt.up, tt.flap)
+		var got []Kind
+		for i, c := range tt.probes {
+			r := Result{Target: "192.0.2.1", Seq: i, Kind: kinds[c]}
+			if st.Process(&r) {
+				got = append(got, r.Kind)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%d/%d/%d %q: got %v, want %v", tt.down, tt.up, tt.flap, tt.probes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Summary is a point in time copy of the statistics of a run
+type Summary struct {
+	PacketOut int     // number of probes sent
+	PacketIn  int     // number of replies recieved
+	TotalTime float64 // total rtt time for average
+	RTTMax    float64 // max rtt time
+	RTTMin    float64 // min rtt time
+	MsgSize   int     // message body size (bytes), 0 if probes carry no payload
+	Late      int     // replies after their probe timed out
+	Dups      int     // duplicate replies
+	Corrupted int     // replies with a bad checksum, header or payload
+	Damaged   int     // of those, replies with their payload cut short or damaged
+	Hops      int     // how far away the target is, estimated by a TTL sweep, 0 if unknown
+
+	DNSLookups int     // lookups of the target's name that were timed
+	DNSTotal   float64 // total time they took, for the average
+	DNSMin     float64 // fastest lookup
+	DNSMax     float64 // slowest lookup
+
+	Stamps map[TimestampSource]int // replies timed by each timestamp source
+	ECN    map[ECN]int             // replies by the ECN codepoint they came back with
+	RTTs   RTTHistogram            // distribution of the rtts, for percentiles
+}
+
+// Stats accumulates the results of every probe sent during a run. It is safe
+// for concurrent use and never locks: results are counted with atomics,
+// spread over shards so probes completing at the same time rarely touch the
+// same counters, and Snapshot adds the shards up.
+type Stats struct {
+	msgSize int
+	shards  []statShard
+	rtts    rttHistogram // shared, replies only contend if their rtts are alike
+
+	// name lookups, too rare to need sharding, in nanoseconds
+	dnsN, dnsTotal, dnsMin, dnsMax atomic.Int64
+}
+
+// counters for a share of the results, sized to cache lines of their own
+type statShard struct {
+	out, in    atomic.Int64
+	late, dups atomic.Int64
+	corrupted  atomic.Int64
+	damaged    atomic.Int64
+	total      atomic.Int64 // sum of rtts in nanoseconds
+	min, max   atomic.Int64 // rtt in nanoseconds, -1 before the first reply
+	stamps     [len(stampSources)]atomic.Int64
+	ecn        [len(ecnCodepoints)]atomic.Int64
+}
+
+// most shards a Stats is split into, every target of serve has its own
+const maxStatShards = 8
+
+// every timestamp source, in the order the summary lists them
+var stampSources = [...]TimestampSource{TimestampHardware, TimestampKernel, TimestampUser}
+
+// Initialize and return empty Stats for probes carrying msgSize byte payloads
+func NewStats(msgSize int) *Stats {
+	s := &Stats{msgSize: msgSize, shards: make([]statShard, min(runtime.GOMAXPROCS(0), maxStatShards))}
+	s.dnsMin.Store(-1)
+	for i := range s.shards {
+		s.shards[i].min.Store(-1)
+		s.shards[i].max.Store(-1)
+	}
+	return s
+}
+
+// Add records the outcome of a single probe
+func (s *Stats) Add(r Result) {
+	// consecutive probes complete close together, spread them by sequence
+	sh := &s.shards[uint(r.Seq)%uint(len(s.shards))]
+
+	// late, duplicate and corrupt replies answer probes already counted
+	switch r.Kind {
+	case KindLate:
+		sh.late.Add(1)
+		return
+	case KindDup:
+		sh.dups.Add(1)
+		return
+	case KindCorrupt:
+		sh.corrupted.Add(1)
+		if errors.Is(r.Err, errDamaged) {
+			sh.damaged.Add(1)
+		}
+		return
+	}
+
+	if r.DNS > 0 {
+		s.addDNS(r.DNS)
+	}
+
+	// out before in, so a snapshot never has more replies than probes
+	sh.out.Add(1)
+	if r.Kind != KindReply {
+		return
+	}
+	for i, src := range stampSources {
+		if r.Stamp == src {
+			sh.stamps[i].Add(1)
+		}
+	}
+	if r.ECN != "" {
+		sh.ecn[r.ECN.bits()].Add(1)
+	}
+
+	// keep track of max/min RTT times
+	rtt := int64(r.RTT)
+	for {
+		cur := sh.min.Load()
+		if (cur >= 0 && rtt >= cur) || sh.min.CompareAndSwap(cur, rtt) {
+			break
+		}
+	}
+	for {
+		cur := sh.max.Load()
+		if rtt <= cur || sh.max.CompareAndSwap(cur, rtt) {
+			break
+		}
+	}
+	sh.total.Add(rtt)
+	s.rtts.add(r.RTT)
+	sh.in.Add(1)
+}
+
+// record how long a lookup of the target's name took
+func (s *Stats) addDNS(took time.Duration) {
+	d := int64(took)
+	for {
+		cur := s.dnsMin.Load()
+		if (cur >= 0 && d >= cur) || s.dnsMin.CompareAndSwap(cur, d) {
+			break
+		}
+	}
+	for {
+		cur := s.dnsMax.Load()
+		if d <= cur || s.dnsMax.CompareAndSwap(cur, d) {
+			break
+		}
+	}
+	s.dnsTotal.Add(d)
+	s.dnsN.Add(1)
+}
+
+// Snapshot returns a copy of the current statistics. Results recorded while
+// it runs may be partly included.
+func (s *Stats) Snapshot() Summary {
+	sum := Summary{RTTMax: -1e5, RTTMin: 1e5, MsgSize: s.msgSize}
+	var total int64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sum.PacketIn += int(sh.in.Load())
+		total += sh.total.Load()
+		if min := sh.min.Load(); min >= 0 && float64(min)/1e6 < sum.RTTMin {
+			sum.RTTMin = float64(min) / 1e6
+		}
+		if max := sh.max.Load(); max >= 0 && float64(max)/1e6 > sum.RTTMax {
+			sum.RTTMax = float64(max) / 1e6
+		}
+		sum.Late += int(sh.late.Load())
+		sum.Dups += int(sh.dups.Load())
+		sum.Corrupted += int(sh.corrupted.Load())
+		sum.Damaged += int(sh.damaged.Load())
+		for j, src := range stampSources {
+			if n := sh.stamps[j].Load(); n > 0 {
+				if sum.Stamps == nil {
+					sum.Stamps = make(map[TimestampSource]int)
+				}
+				sum.Stamps[src] += int(n)
+			}
+		}
+		for j, cp := range ecnCodepoints {
+			if n := sh.ecn[j].Load(); n > 0 {
+				if sum.ECN == nil {
+					sum.ECN = make(map[ECN]int)
+				}
+				sum.ECN[cp] += int(n)
+			}
+		}
+	}
+	// probes are counted before their replies, so read them last
+	for i := range s.shards {
+		sum.PacketOut += int(s.shards[i].out.Load())
+	}
+	sum.TotalTime = float64(total) / 1e6
+	if n := s.dnsN.Load(); n > 0 {
+		sum.DNSLookups = int(n)
+		sum.DNSTotal = float64(s.dnsTotal.Load()) / 1e6
+		sum.DNSMin = float64(s.dnsMin.Load()) / 1e6
+		sum.DNSMax = float64(s.dnsMax.Load()) / 1e6
+	}
+	sum.RTTs = s.rtts.snapshot()
+	return sum
+}
+
+// Loss returns the percent of probes without a good reply. A reply that came
+// back damaged doesn't answer its probe, which is lost unless a good one
+// follows, so damaged replies count towards Loss as well as Damaged.
+func (s Summary) Loss() float64 {
+	if s.PacketOut == 0 {
+		return 0
+	}
+	return float64(s.PacketOut-s.PacketIn) / float64(s.PacketOut) * 100
+}
+
+// check returns an error if more than maxLoss percent of probes were lost,
+// or the average RTT was over maxRTT. Negative maxLoss and zero maxRTT aren't
+// checked.
+func (s Summary) check(maxLoss float64, maxRTT time.Duration) error {
+	lost := 100.0
+	if s.PacketOut > 0 {
+		lost = s.Loss()
+	}
+	if maxLoss >= 0 && lost > maxLoss {
+		return fmt.Errorf("FAIL: %.1f%% of probes lost, more than -max-loss %g%%", lost, maxLoss)
+	}
+	if maxRTT > 0 && s.PacketIn == 0 {
+		return fmt.Errorf("FAIL: no replies to check against -max-rtt %v", maxRTT)
+	}
+	if maxRTT > 0 {
+		avg := time.Duration(s.TotalTime / float64(s.PacketIn) * float64(time.Millisecond))
+		if avg > maxRTT {
+			return fmt.Errorf("FAIL: average rtt %v, more than -max-rtt %v", avg.Round(time.Microsecond), maxRTT)
+		}
+	}
+	return nil
+}
+
+// Print writes the ping statistics summary
+func (s Summary) Print() {
+	s.Fprint(os.Stdout, "Ping Statistics")
+}
+
+// Fprint writes the statistics summary to w under the given heading
+func (s Summary) Fprint(w io.Writer, title string) {
+	fmt.Fprintf(w, "\n------ %s ------\n", title)
+	fmt.Fprintf(w, "packets sent: %d, packets received: %d, ", s.PacketOut, s.PacketIn)
+	if s.Late > 0 {
+		fmt.Fprintf(w, "+%d late, ", s.Late)
+	}
+	if s.Dups > 0 {
+		fmt.Fprintf(w, "+%d duplicates, ", s.Dups)
+	}
+	if s.Corrupted > 0 {
+		fmt.Fprintf(w, "corrupted=%d, ", s.Corrupted)
+	}
+	fmt.Fprintf(w, "%.1f%% packet loss\n", s.Loss())
+	if s.PacketIn > 0 {
+		fmt.Fprintf(w, "rtt min/avg/max = %.1f/%.1f/%.1f ms\n",
+			s.RTTMin, s.TotalTime/float64(s.PacketIn), s.RTTMax)
+	}
+	if s.RTTs != nil {
+		fmt.Fprintf(w, "rtt p50/p90/p99 = %.1f/%.1f/%.1f ms\n",
+			s.RTTs.Percentile(0.5), s.RTTs.Percentile(0.9), s.RTTs.Percentile(0.99))
+	}
+	if s.DNSLookups > 0 {
+		fmt.Fprintf(w, "dns min/avg/max = %.1f/%.1f/%.1f ms over %d lookups\n",
+			s.DNSMin, s.DNSTotal/float64(s.DNSLookups), s.DNSMax, s.DNSLookups)
+	}
+	if s.Hops > 0 {
+		fmt.Fprintf(w, "hops≈%d\n", s.Hops)
+	}
+	if s.MsgSize > 0 {
+		fmt.Fprintf(w, "payload integrity: %d intact, %d damaged (counted as lost)\n", s.PacketIn, s.Damaged)
+	}
+	if line := s.stampLine(); line != "" {
+		fmt.Fprintln(w, line)
+	}
+	if line := s.ecnLine(); line != "" {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// describe the ECN codepoints replies came back with, nothing if requests
+// didn't set one
+func (s Summary) ecnLine() string {
+	if len(s.ECN) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, cp := range ecnCodepoints {
+		if n := s.ECN[cp]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", cp, n))
+		}
+	}
+	line := "ecn: " + strings.Join(parts, ", ")
+	switch {
+	case s.ECN[ECNCE] > 0:
+		line += " (congestion marked on the path)"
+	case s.ECN[ECNNotECT] > 0:
+		line += " (bleached on the path)"
+	}
+	return line
+}
+
+// describe the timestamp sources RTTs were measured with, nothing if they
+// were all taken in userspace
+func (s Summary) stampLine() string {
+	if len(s.Stamps) == 0 || (len(s.Stamps) == 1 && s.Stamps[TimestampUser] > 0) {
+		return ""
+	}
+	if len(s.Stamps) == 1 {
+		for src := range s.Stamps {
+			return fmt.Sprintf("timestamps: %s", src)
+		}
+	}
+
+	var parts []string
+	for _, src := range stampSources {
+		if n := s.Stamps[src]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", src, n))
+		}
+	}
+	return "timestamps: " + strings.Join(parts, ", ")
+}
+
+// TargetStats keeps separate Stats for every target of a multi-target run.
+// Looking up a target seen before doesn't lock.
+type TargetStats struct {
+	mu      sync.Mutex // held while adding a target
+	msgSize int
+	order   []string // targets in the order first seen
+	stats   sync.Map // target to *Stats
+}
+
+// Initialize and return empty TargetStats
+func NewTargetStats(msgSize int) *TargetStats {
+	return &TargetStats{msgSize: msgSize}
+}
+
+// Add records r in the stats of its target
+func (ts *TargetStats) Add(r Result) {
+	ts.Get(r.Target).Add(r)
+}
+
+// Get returns the stats of target, creating them if needed
+func (ts *TargetStats) Get(target string) *Stats {
+	if s, ok := ts.stats.Load(target); ok {
+		return s.(*Stats)
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if s, ok := ts.stats.Load(target); ok {
+		return s.(*Stats)
+	}
+	s := NewStats(ts.msgSize)
+	ts.stats.Store(target, s)
+	ts.order = append(ts.order, target)
+	return s
+}
+
+// Track starts stats for target with its own payload size, for targets
+// probed differently from the rest
+func (ts *TargetStats) Track(target string, msgSize int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.stats.Load(target); !ok {
+		ts.order = append(ts.order, target)
+	}
+	ts.stats.Store(target, NewStats(msgSize))
+}
+
+// Remove forgets the stats of target
+func (ts *TargetStats) Remove(target string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.stats.Delete(target)
+	if i := slices.Index(ts.order, target); i >= 0 {
+		ts.order = slices.Delete(ts.order, i, i+1)
+	}
+}
+
+// Targets returns every target seen so far
+func (ts *TargetStats) Targets() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.order...)
+}
+
+// savedStats are a target's Stats in a serve -state file
+type savedStats struct {
+	Target    string                  `json:"target"`
+	Out       int                     `json:"out"`
+	In        int                     `json:"in"`
+	Late      int                     `json:"late,omitempty"`
+	Dups      int                     `json:"dups,omitempty"`
+	Corrupted int                     `json:"corrupted,omitempty"`
+	Damaged   int                     `json:"damaged,omitempty"`
+	Total     float64                 `json:"total_ms"`
+	Min       float64                 `json:"min_ms"`
+	Max       float64                 `json:"max_ms"`
+	Stamps    map[TimestampSource]int `json:"timestamps,omitempty"`
+	ECN       map[ECN]int             `json:"ecn,omitempty"`
+	RTTs      map[int]int64           `json:"rtts,omitempty"` // histogram buckets that counted any
+}
+
+func (ts *TargetStats) stateName() string { return "stats" }
+
+func (ts *TargetStats) saveState() any {
+	saved := []savedStats{}
+	for _, target := range ts.Targets() {
+		sum := ts.Get(target).Snapshot()
+		ss := savedStats{
+			Target:    target,
+			Out:       sum.PacketOut,
+			In:        sum.PacketIn,
+			Late:      sum.Late,
+			Dups:      sum.Dups,
+			Corrupted: sum.Corrupted,
+			Damaged:   sum.Damaged,
+			Total:     sum.TotalTime,
+			Min:       sum.RTTMin,
+			Max:       sum.RTTMax,
+			Stamps:    sum.Stamps,
+			ECN:       sum.ECN,
+			RTTs:      make(map[int]int64),
+		}
+		for i, n := range sum.RTTs {
+			if n > 0 {
+				ss.RTTs[i] = n
+			}
+		}
+		saved = append(saved, ss)
+	}
+	return saved
+}
+
+func (ts *TargetStats) loadState(b json.RawMessage) error {
+	var saved []savedStats
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	for _, ss := range saved {
+		ts.Get(ss.Target).restore(ss)
+	}
+	return nil
+}
+
+// restore adds saved counters to s
+func (s *Stats) restore(ss savedStats) {
+	sh := &s.shards[0]
+	sh.out.Add(int64(ss.Out))
+	sh.in.Add(int64(ss.In))
+	sh.late.Add(int64(ss.Late))
+	sh.dups.Add(int64(ss.Dups))
+	sh.corrupted.Add(int64(ss.Corrupted))
+	sh.damaged.Add(int64(ss.Damaged))
+	sh.total.Add(int64(ss.Total * 1e6))
+	if ss.In > 0 {
+		if min := int64(ss.Min * 1e6); sh.min.Load() < 0 || min < sh.min.Load() {
+			sh.min.Store(min)
+		}
+		if max := int64(ss.Max * 1e6); max > sh.max.Load() {
+			sh.max.Store(max)
+		}
+	}
+	for i, src := range stampSources {
+		sh.stamps[i].Add(int64(ss.Stamps[src]))
+	}
+	for i, cp := range ecnCodepoints {
+		sh.ecn[i].Add(int64(ss.ECN[cp]))
+	}
+	for i, n := range ss.RTTs {
+		if i >= 0 && i < histBuckets {
+			s.rtts.counts[i].Add(n)
+		}
+	}
+}
+
+// Fprint writes a statistics summary for every target to w
+func (ts *TargetStats) Fprint(w io.Writer) {
+	for _, target := range ts.Targets() {
+		ts.Get(target).Snapshot().Fprint(w, target+" statistics")
+	}
+}
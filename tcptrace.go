@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// how long a connect failed by an ICMP error waits for the raw socket's
+	// copy of it
+	tcpAnswerWait = 100 * time.Millisecond
+
+	// the kernel sends the SYN again after this, and an answer to that would
+	// look like one to the first, so probes aren't waited for longer
+	tcpSYNTimeout = time.Second
+)
+
+// TCPTracer probes the hops to a host with TCP SYNs, for trace -m tcp where
+// ICMP and UDP probes are filtered but connections to a port get through.
+// Every probe is a connect from a port of its own with the TTL set, routers
+// on the way answer with ICMP time exceeded messages quoting that port,
+// which a raw ICMP socket picks up. The host answers with the handshake, or
+// a reset if the port's closed, both count as reaching it.
+type TCPTracer struct {
+	IPAddr  *net.IPAddr
+	Port    int
+	TTL     int
+	Timeout time.Duration
+	Clock   Clock
+
+	// sets socket options of connections, see net.Dialer, nil for none
+	Control func(network, address string, rc syscall.RawConn) error
+
+	ipv4 bool
+	errs *icmpErrors
+	seq  seqCounter
+}
+
+// Initialize and return a TCPTracer to port of addr, listening for ICMP
+// errors on a raw socket
+func NewTCPTracer(addr string, port int, timeout time.Duration) (*TCPTracer, error) {
+	ipaddr, err := resolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	errs, err := listenICMPErrors(ipaddr.IP, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTracer{
+		IPAddr:  ipaddr,
+		Port:    port,
+		TTL:     DefaultTTL,
+		Timeout: timeout,
+		Clock:   SystemClock,
+		ipv4:    ipaddr.IP.To4() != nil,
+		errs:    errs,
+	}, nil
+}
+
+// SetTTL sets the TTL of the probes after
+func (tt *TCPTracer) SetTTL(ttl int) error {
+	tt.TTL = ttl
+	return nil
+}
+
+// Close the raw socket
+func (tt *TCPTracer) Close() error {
+	return tt.errs.Close()
+}
+
+// Probe sends a SYN with the tracer's TTL
+func (tt *TCPTracer) Probe(ctx context.Context) (Result, error) {
+	return tt.probeTTL(ctx, tt.TTL)
+}
+
+// Round probes with each of ttls at once, plus once end to end
+func (tt *TCPTracer) Round(ctx context.Context, ttls []int) []Result {
+	return probeTTLs(ctx, ttls, tt.TTL, tt.probeTTL)
+}
+
+func (tt *TCPTracer) host() (string, int) {
+	return tt.IPAddr.String(), tt.TTL
+}
+
+// send a SYN with ttl and wait for the handshake, or an ICMP error about it
+func (tt *TCPTracer) probeTTL(ctx context.Context, ttl int) (Result, error) {
+	addr := net.JoinHostPort(tt.IPAddr.String(), strconv.Itoa(tt.Port))
+	res := Result{
+		Proto:  "tcp",
+		Target: addr,
+		Seq:    tt.seq.next(),
+		TTL:    -1,
+		Time:   tt.Clock.Now(),
+	}
+
+	answers := make(chan hopAnswer, 1)
+	port := 0
+	d := net.Dialer{Control: func(network, address string, rc syscall.RawConn) error {
+		if tt.Control != nil {
+			if err := tt.Control(network, address, rc); err != nil {
+				return err
+			}
+		}
+		var err error
+		if port, err = bindTTL(rc, tt.ipv4, ttl); err != nil {
+			return err
+		}
+		tt.errs.wait(port, answers)
+		return nil
+	}}
+	defer func() {
+		tt.errs.forget(port)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, min(tt.Timeout, tcpSYNTimeout))
+	defer cancel()
+	dialed := make(chan error, 1)
+	start := tt.Clock.Now()
+	go func() {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	select {
+	case a := <-answers:
+		cancel()
+		<-dialed
+		return a.result(res, start)
+	case err := <-dialed:
+		res.RTT = tt.Clock.Since(start)
+		// a reset is the host answering too
+		if err == nil || errors.Is(err, syscall.ECONNREFUSED) {
+			res.Addr = tt.IPAddr.String()
+			return complete(res, nil)
+		}
+		if ctx.Err() != nil {
+			return complete(res, ErrTimeout)
+		}
+		// Linux fails the connect on the ICMP error too, the raw socket's
+		// copy of it says who sent it
+		select {
+		case a := <-answers:
+			return a.result(res, start)
+		case <-tt.Clock.After(tcpAnswerWait):
+			return complete(res, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// overhead above which ping points it out without -overhead, it's then
+// enough to show up in the RTTs
+const overheadWarn = time.Millisecond
+
+// Overhead tracks what the measuring host itself adds to what's measured:
+// probes going out later than they were due, replies waiting to be handled
+// after the kernel recieved them, and ones it dropped. It is safe for
+// concurrent use.
+type Overhead struct {
+	SendDelay   lagStat      // how late probes went out, after their interval
+	RecvLag     lagStat      // how long replies waited after their kernel timestamp
+	Dropped     atomic.Int64 // late replies dropped because nothing collected them
+	SocketDrops atomic.Int64 // messages the kernel dropped because a socket's recieve buffer was full
+}
+
+// the process' overhead
+var overhead Overhead
+
+// the average and max of a delay, from many goroutines
+type lagStat struct {
+	n, total, max atomic.Int64 // max and total in nanoseconds
+}
+
+func (l *lagStat) add(d time.Duration) {
+	d = max(d, 0)
+	for {
+		cur := l.max.Load()
+		if int64(d) <= cur || l.max.CompareAndSwap(cur, int64(d)) {
+			break
+		}
+	}
+	l.total.Add(int64(d))
+	l.n.Add(1)
+}
+
+// avg and max delay in ms, 0 if there were none
+func (l *lagStat) ms() (avg, max float64) {
+	n := l.n.Load()
+	if n == 0 {
+		return 0, 0
+	}
+	return float64(l.total.Load()) / float64(n) / 1e6, float64(l.max.Load()) / 1e6
+}
+
+// worst returns the longest delay the host added to a probe
+func (o *Overhead) worst() time.Duration {
+	return time.Duration(max(o.SendDelay.max.Load(), o.RecvLag.max.Load()))
+}
+
+func (o *Overhead) String() string {
+	s := "send delay "
+	if o.SendDelay.n.Load() == 0 {
+		s += "n/a"
+	} else {
+		avg, max := o.SendDelay.ms()
+		s += fmt.Sprintf("avg/max = %.2f/%.2f ms", avg, max)
+	}
+	s += ", receive lag "
+	if o.RecvLag.n.Load() == 0 {
+		s += "n/a (no kernel timestamps)"
+	} else {
+		avg, max := o.RecvLag.ms()
+		s += fmt.Sprintf("avg/max = %.2f/%.2f ms", avg, max)
+	}
+	return s + fmt.Sprintf(", %d results dropped, %d replies dropped locally", o.Dropped.Load(), o.SocketDrops.Load())
+}
+
+// Fprint writes the overhead to w if show is set or it's big enough to
+// matter, and what that means for the RTTs
+func (o *Overhead) Fprint(w io.Writer, show bool) {
+	worst := o.worst()
+	if !show && worst < overheadWarn {
+		return
+	}
+	fmt.Fprintf(w, "measuring host: %s\n", o)
+	if worst >= overheadWarn {
+		fmt.Fprintf(w, "this host fell behind by up to %.1f ms, it's busy enough that RTT jitter of that size may be its own rather than the network's\n",
+			worst.Seconds()*1e3)
+	}
+}
+
+// FprintDrops warns on w if replies were dropped by this host's socket
+// buffers, they're counted as lost but the network delivered them
+func (o *Overhead) FprintDrops(w io.Writer) {
+	if n := o.SocketDrops.Load(); n > 0 {
+		fmt.Fprintf(w, "%d replies dropped locally by a full socket buffer, counted as lost; send at a lower rate or raise net.core.rmem_default\n", n)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// terminalWidth returns the columns of the terminal f is, going by $COLUMNS
+// here, 80 if that can't be told
+func terminalWidth(f *os.File) int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
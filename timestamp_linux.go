@@ -0,0 +1,118 @@
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// enable software timestamps of sent and recieved packets on c, and
+// hardware ones if hardware is set. Sent timestamps are queued on the
+// socket's error queue without the packet, numbered in the order packets
+// were sent so each can be matched with its request. Hardware timestamps also need to
+// be switched on for the NIC (e.g. with hwstamp_ctl), otherwise only the
+// software ones are reported.
+func enableKernelTimestamps(c syscall.Conn, hardware bool) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	flags := unix.SOF_TIMESTAMPING_SOFTWARE |
+		unix.SOF_TIMESTAMPING_RX_SOFTWARE |
+		unix.SOF_TIMESTAMPING_TX_SOFTWARE |
+		unix.SOF_TIMESTAMPING_OPT_TSONLY |
+		unix.SOF_TIMESTAMPING_OPT_ID
+	if hardware {
+		flags |= unix.SOF_TIMESTAMPING_RAW_HARDWARE |
+			unix.SOF_TIMESTAMPING_RX_HARDWARE |
+			unix.SOF_TIMESTAMPING_TX_HARDWARE
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPING, flags)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// kernelTimestamp returns the timestamp in a control message, preferring
+// the NIC's over the kernel's
+func kernelTimestamp(oob []byte) (time.Time, TimestampSource, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_SOCKET || m.Header.Type != unix.SO_TIMESTAMPING ||
+			len(m.Data) < int(unsafe.Sizeof(unix.ScmTimestamping{})) {
+			continue
+		}
+		var ts unix.ScmTimestamping
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts)), m.Data)
+		// Ts[0] is the software timestamp, Ts[2] the raw hardware one
+		if ts.Ts[2].Sec != 0 || ts.Ts[2].Nsec != 0 {
+			return time.Unix(ts.Ts[2].Unix()), TimestampHardware, true
+		}
+		if ts.Ts[0].Sec != 0 || ts.Ts[0].Nsec != 0 {
+			return time.Unix(ts.Ts[0].Unix()), TimestampKernel, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// sendTimestamps drains the socket error queue, calling fn with the
+// timestamp of every packet sent since the last call and the number of the
+// packet, counting from 0 when timestamps were enabled
+func sendTimestamps(c syscall.Conn, fn func(id uint32, ts time.Time, src TimestampSource)) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	oob := make([]byte, 512)
+	rc.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), nil, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+			if err != nil {
+				return
+			}
+			ts, src, ok := kernelTimestamp(oob[:oobn])
+			if !ok {
+				continue
+			}
+			if id, ok := timestampID(oob[:oobn]); ok {
+				fn(id, ts, src)
+			}
+		}
+	})
+}
+
+// timestampID returns the packet number of a sent timestamp, which the
+// kernel passes in the extended error next to it
+func timestampID(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range msgs {
+		isErr := (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+			(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+		if !isErr || len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+			continue
+		}
+		var ee unix.SockExtendedErr
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&ee)), unsafe.Sizeof(ee)), m.Data)
+		if ee.Origin == unix.SO_EE_ORIGIN_TIMESTAMPING {
+			return ee.Data, true
+		}
+	}
+	return 0, false
+}
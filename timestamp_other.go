@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// kernel timestamps are only implemented on Linux
+func enableKernelTimestamps(c syscall.Conn, hardware bool) error {
+	return errTimestampsUnsupported
+}
+
+func kernelTimestamp(oob []byte) (time.Time, TimestampSource, bool) {
+	return time.Time{}, "", false
+}
+
+func sendTimestamps(c syscall.Conn, fn func(id uint32, ts time.Time, src TimestampSource)) {
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setting the DSCP of connections is only implemented on Linux and macOS
+func tosControl(d DSCP) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		return errors.New("setting the DSCP of connections is only supported on Linux and macOS")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tosControl returns a net.Dialer Control function setting the DSCP of every
+// connection dialed
+func tosControl(d DSCP) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			if network[len(network)-1] == '6' {
+				serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, d.tos(""))
+				return
+			}
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, d.tos(""))
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
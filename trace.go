@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/icmp"
+)
+
+// MPLSLabel is an entry of an MPLS label stack, as routers report them in
+// time exceeded messages (RFC 4884 and 4950)
+type MPLSLabel struct {
+	Label int  `json:"label"`
+	TC    int  `json:"tc"` // traffic class, once called EXP
+	S     bool `json:"s"`  // bottom of the stack
+	TTL   int  `json:"ttl"`
+}
+
+// mplsLabels returns the label stacks in the extensions of an ICMP message
+func mplsLabels(exts []icmp.Extension) []MPLSLabel {
+	var labels []MPLSLabel
+	for _, ext := range exts {
+		if stack, ok := ext.(*icmp.MPLSLabelStack); ok {
+			for _, l := range stack.Labels {
+				labels = append(labels, MPLSLabel{l.Label, l.TC, l.S, l.TTL})
+			}
+		}
+	}
+	return labels
+}
+
+// format a label stack like traceroute -e
+func formatMPLS(labels []MPLSLabel) string {
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		s := 0
+		if l.S {
+			s = 1
+		}
+		parts[i] = fmt.Sprintf("L=%d,E=%d,S=%d,T=%d", l.Label, l.TC, s, l.TTL)
+	}
+	return "<MPLS:" + strings.Join(parts, "/") + ">"
+}
+
+// Hop is the outcome of the probes sent with one TTL during a trace
+type Hop struct {
+	TTL     int
+	Results []Result
+}
+
+// Reached reports whether the probes made it to the target, in which case
+// the trace is done
+func (h Hop) Reached() bool {
+	for _, r := range h.Results {
+		if r.Kind == KindReply || errors.Is(r.Err, ErrHostUnreachable) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the hop like traceroute does, printing the responding
+// address whenever it changes, with the MPLS labels it reported and the ECN
+// codepoint it got the probe with, followed by the probe times, * for no
+// answer
+func (h Hop) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%2d ", h.TTL)
+
+	last := ""
+	for _, r := range h.Results {
+		if r.Kind == KindTimeout || r.Addr == "" {
+			b.WriteString(" *")
+			continue
+		}
+		if r.Addr != last {
+			fmt.Fprintf(&b, " %s", r.Addr)
+			if len(r.MPLS) > 0 {
+				fmt.Fprintf(&b, " %s", formatMPLS(r.MPLS))
+			}
+			if r.ECN != "" {
+				fmt.Fprintf(&b, " ecn=%s", r.ECN)
+			}
+			last = r.Addr
+		}
+		fmt.Fprintf(&b, "  %.3f ms", r.RTT.Seconds()*1e3)
+		if errors.Is(r.Err, ErrHostUnreachable) {
+			b.WriteString(" !H")
+		}
+	}
+	return b.String()
+}
+
+// most probes trace -parallel has out at once, a trace of up to this many
+// probes takes one timeout
+const traceBatch = 128
+
+// traceParallel probes the hops from first to last queries times each, as
+// many at once as traceBatch allows, and returns the hops up to the first
+// that reached the host. Every hop is probed once before any is again, so a
+// router's answers are spread over the batch rather than asked for at once,
+// routers rate limit them.
+func traceParallel(ctx context.Context, hp hopProber, first, last, queries int) []Hop {
+	var hops []Hop
+	for lo := first; lo <= last && ctx.Err() == nil; {
+		n := min(last-lo+1, max(traceBatch/queries, 1))
+		var ttls []int
+		for range queries {
+			for ttl := lo; ttl < lo+n; ttl++ {
+				ttls = append(ttls, ttl)
+			}
+		}
+		// the round's end to end probe isn't part of the trace
+		results := hp.Round(ctx, ttls)
+		for i := range n {
+			hop := Hop{TTL: lo + i}
+			for q := range queries {
+				hop.Results = append(hop.Results, results[q*n+i])
+			}
+			hops = append(hops, hop)
+			if hop.Reached() {
+				return hops
+			}
+		}
+		lo += n
+	}
+	return hops
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	xipv4 "golang.org/x/net/ipv4"
+	xipv6 "golang.org/x/net/ipv6"
+)
+
+// Transport is the connection a PingClient sends requests and reads replies
+// on. By default this is a raw ICMP socket, tests can inject a fake one with
+// WithTransport to simulate replies, delays and errors.
+type Transport interface {
+	WriteTo(b []byte, dst net.Addr) (int, error)
+	ReadFrom(b []byte) (int, RecvInfo, error)
+	SetReadDeadline(t time.Time) error
+	SetTTL(ttl int) error
+	Close() error
+}
+
+// RecvInfo describes a message read from a Transport
+type RecvInfo struct {
+	Peer net.Addr  // sender
+	TTL  int       // ttl (IPv4) or hop limit (IPv6) on arrival, -1 if unknown
+	Time time.Time // kernel recieve timestamp, zero if unavailable
+	ECN  ECN       // ECN codepoint on arrival, "" if unknown
+
+	Source TimestampSource // where Time came from
+}
+
+// sendTimestamper is implemented by transports that know when the kernel
+// sent a message. Messages are numbered in the order they were written.
+type sendTimestamper interface {
+	NextWrite() uint32 // number the next message written gets
+	SendTime(id uint32) (time.Time, TimestampSource, bool)
+}
+
+// a kernel timestamp of a sent message
+type sendStamp struct {
+	time   time.Time
+	source TimestampSource
+}
+
+// icmpTransport is a Transport backed by a raw, or unprivileged datagram,
+// ICMP socket
+type icmpTransport struct {
+	conn     net.PacketConn
+	p4       *xipv4.PacketConn // set for IPv4 sockets
+	p6       *xipv6.PacketConn // set for IPv6 sockets
+	ipv4     bool
+	dgram    bool   // datagram socket, addressed with *net.UDPAddr
+	kernelTS bool   // kernel timestamps are enabled
+	recvECN  bool   // report the ECN codepoint of recieved messages
+	drops    bool   // the kernel reports messages dropped by a full recieve buffer
+	dropped  uint32 // how many it reported last, see readMsg
+	flow     uint32 // IPv6 flow label of sent packets, 0 for none
+	scope    int    // interface index of the flow's link-local destination
+	oob      []byte // control message buffer for ReadFrom
+
+	wmu    sync.Mutex
+	writes uint32               // messages written since timestamps were enabled
+	sent   map[uint32]sendStamp // send timestamps not asked for yet, by number
+}
+
+// open an ICMP socket for the given address family. Raw sockets need root,
+// datagram sockets are used where they aren't permitted but those are, like
+// on macOS.
+func listenICMP(ipv4 bool) (*icmpTransport, error) {
+	if access, _ := detectICMP(); access == accessDgram {
+		return listenICMPDgram(ipv4)
+	}
+	return listenRaw(ipv4)
+}
+
+// open a raw ICMP socket for the given address family
+func listenRaw(ipv4 bool) (*icmpTransport, error) {
+	network, address := "ip4:icmp", "0.0.0.0"
+	if !ipv4 {
+		network, address = "ip6:ipv6-icmp", "::"
+	}
+
+	c, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	t := &icmpTransport{conn: c, ipv4: ipv4, oob: make([]byte, 512)}
+	t.drops = enableDropCount(c.(syscall.Conn)) == nil
+
+	// ask for the ttl of recieved packets, not every platform supports this
+	// in which case replies are reported with an unknown ttl
+	if ipv4 {
+		t.p4 = xipv4.NewPacketConn(c)
+		t.p4.SetControlMessage(xipv4.FlagTTL, true)
+	} else {
+		t.p6 = xipv6.NewPacketConn(c)
+		t.p6.SetControlMessage(xipv6.FlagHopLimit, true)
+	}
+
+	return t, nil
+}
+
+// open an unprivileged datagram ICMP socket. The kernel writes the IP header,
+// and on Linux the echo identifier too, see echoID.
+func listenICMPDgram(ipv4 bool) (*icmpTransport, error) {
+	network, address := "udp4", "0.0.0.0"
+	if !ipv4 {
+		network, address = "udp6", "::"
+	}
+
+	c, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	t := &icmpTransport{conn: c, ipv4: ipv4, dgram: true, oob: make([]byte, 512)}
+
+	// these strip the IPv4 header macOS leaves on recieved messages
+	if ipv4 {
+		t.p4 = c.IPv4PacketConn()
+		t.p4.SetControlMessage(xipv4.FlagTTL, true)
+	} else {
+		t.p6 = c.IPv6PacketConn()
+		t.p6.SetControlMessage(xipv6.FlagHopLimit, true)
+	}
+
+	return t, nil
+}
+
+// echoID returns the identifier the kernel puts in every request sent on a
+// Linux datagram socket, its local port, replies only match that one
+func (t *icmpTransport) echoID() (int, bool) {
+	if !t.dgram || runtime.GOOS != "linux" {
+		return 0, false
+	}
+	addr, ok := t.conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return 0, false
+	}
+	return addr.Port, true
+}
+
+// datagram sockets take and give udp addresses, the rest of the program
+// uses ip addresses
+func (t *icmpTransport) sockAddr(addr net.Addr) net.Addr {
+	if a, ok := addr.(*net.IPAddr); ok && t.dgram {
+		return &net.UDPAddr{IP: a.IP, Zone: a.Zone}
+	}
+	return addr
+}
+
+func (t *icmpTransport) ipAddr(addr net.Addr) net.Addr {
+	if a, ok := addr.(*net.UDPAddr); ok && t.dgram {
+		return &net.IPAddr{IP: a.IP, Zone: a.Zone}
+	}
+	return addr
+}
+
+// enableTimestamps asks the kernel, and the NIC if hardware is set, to
+// timestamp sent and recieved packets which keeps scheduling delays in this
+// process out of the RTT
+func (t *icmpTransport) enableTimestamps(hardware bool) error {
+	sc, ok := t.conn.(syscall.Conn)
+	if !ok {
+		return errTimestampsUnsupported
+	}
+	if err := enableKernelTimestamps(sc, hardware); err != nil {
+		return err
+	}
+	t.kernelTS = true
+	t.sent = make(map[uint32]sendStamp)
+	return nil
+}
+
+// setFlowLabel makes every packet sent to dst carry flow label, so
+// routers hashing on it send them all down the same path
+func (t *icmpTransport) setFlowLabel(label int, dst *net.IPAddr) error {
+	sc, ok := t.conn.(syscall.Conn)
+	if t.ipv4 || !ok {
+		return errors.New("flow labels need a raw IPv6 socket")
+	}
+	if dst.Zone != "" {
+		ifi, err := net.InterfaceByName(dst.Zone)
+		if err != nil {
+			return err
+		}
+		t.scope = ifi.Index
+	}
+	if err := leaseFlowLabel(sc, uint32(label), dst.IP); err != nil {
+		return err
+	}
+	t.flow = uint32(label)
+	return nil
+}
+
+// setTOS marks every packet sent with DSCP d and ECN codepoint e. With e
+// set, it also reports the codepoint recieved messages arrive with. That's
+// read from the IP header of raw IPv4 sockets, and from a control message
+// for IPv6.
+func (t *icmpTransport) setTOS(d DSCP, e ECN) error {
+	if t.ipv4 {
+		if err := t.p4.SetTOS(d.tos(e)); err != nil {
+			return err
+		}
+		t.recvECN = e != "" && !t.dgram
+		return nil
+	}
+	if err := t.p6.SetTrafficClass(d.tos(e)); err != nil {
+		return err
+	}
+	t.recvECN = e != "" && t.p6.SetControlMessage(xipv6.FlagTrafficClass, true) == nil
+	return nil
+}
+
+// setMark sets the firewall mark of every packet sent, see setMark
+func (t *icmpTransport) setMark(mark int) error {
+	sc, ok := t.conn.(syscall.Conn)
+	if !ok {
+		return errors.New("firewall marks need a raw socket")
+	}
+	return setMark(sc, mark)
+}
+
+// setDontFragment sets or clears DF on every packet sent, see
+// setDontFragment
+func (t *icmpTransport) setDontFragment(df bool) error {
+	sc, ok := t.conn.(syscall.Conn)
+	if !ok {
+		return errors.New("setting DF needs a raw socket")
+	}
+	return setDontFragment(sc, t.ipv4, df)
+}
+
+// bindDevice binds the socket to device dev, see bindDevice
+func (t *icmpTransport) bindDevice(dev string) error {
+	sc, ok := t.conn.(syscall.Conn)
+	if !ok {
+		return errors.New("binding to a device needs a raw socket")
+	}
+	return bindDevice(sc, dev)
+}
+
+func (t *icmpTransport) WriteTo(b []byte, dst net.Addr) (int, error) {
+	dst = t.sockAddr(dst)
+	if !t.kernelTS {
+		return t.write(b, dst)
+	}
+
+	// count writes to know which timestamp belongs to which message
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	n, err := t.write(b, dst)
+	if err == nil {
+		t.writes++
+	}
+	return n, err
+}
+
+// send b to dst, with the flow label if set
+func (t *icmpTransport) write(b []byte, dst net.Addr) (int, error) {
+	if ip, ok := dst.(*net.IPAddr); ok && t.flow != 0 {
+		return writeFlow(t.conn.(syscall.Conn), b, ip, t.scope, t.flow)
+	}
+	return t.conn.WriteTo(b, dst)
+}
+
+func (t *icmpTransport) ReadFrom(b []byte) (int, RecvInfo, error) {
+	// raw IPv4 messages only carry their header this way
+	if t.kernelTS || (t.recvECN && t.ipv4) || t.drops {
+		return t.readMsg(b)
+	}
+
+	info := RecvInfo{TTL: -1}
+	if t.ipv4 {
+		n, cm, peer, err := t.p4.ReadFrom(b)
+		if cm != nil {
+			info.TTL = cm.TTL
+		}
+		info.Peer = t.ipAddr(peer)
+		return n, info, err
+	}
+
+	n, cm, peer, err := t.p6.ReadFrom(b)
+	if cm != nil {
+		info.TTL = cm.HopLimit
+		if t.recvECN {
+			info.ECN = ecnOf(cm.TrafficClass)
+		}
+	}
+	info.Peer = t.ipAddr(peer)
+	return n, info, err
+}
+
+// read a message along with its control messages, to get the kernel
+// timestamp which the ipv4/ipv6 packages don't parse
+func (t *icmpTransport) readMsg(b []byte) (int, RecvInfo, error) {
+	info := RecvInfo{TTL: -1}
+	n, oobn, _, peer, err := t.conn.(*net.IPConn).ReadMsgIP(b, t.oob)
+	if err != nil {
+		return 0, info, err
+	}
+	info.Peer = peer
+	info.TTL = t.parseTTL(t.oob[:oobn])
+	if ts, src, ok := kernelTimestamp(t.oob[:oobn]); ok {
+		info.Time, info.Source = ts, src
+	}
+	// the count is of every message dropped since the socket was opened,
+	// sent with each one read after
+	if n, ok := dropCount(t.oob[:oobn]); ok && n != t.dropped {
+		overhead.SocketDrops.Add(int64(n - t.dropped))
+		t.dropped = n
+	}
+
+	if t.recvECN && !t.ipv4 {
+		var cm xipv6.ControlMessage
+		if cm.Parse(t.oob[:oobn]) == nil {
+			info.ECN = ecnOf(cm.TrafficClass)
+		}
+	}
+
+	// unlike ReadFrom, raw IPv4 messages include the IP header
+	if t.ipv4 {
+		if t.recvECN && n > 1 && b[0]>>4 == 4 {
+			info.ECN = ecnOf(int(b[1]))
+		}
+		n = stripIPv4Header(b[:n])
+	}
+	return n, info, nil
+}
+
+// NextWrite returns the number the next message written gets
+func (t *icmpTransport) NextWrite() uint32 {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	return t.writes
+}
+
+// SendTime returns the kernel timestamp of message id
+func (t *icmpTransport) SendTime(id uint32) (time.Time, TimestampSource, bool) {
+	if !t.kernelTS {
+		return time.Time{}, "", false
+	}
+
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	sendTimestamps(t.conn.(syscall.Conn), func(id uint32, ts time.Time, src TimestampSource) {
+		t.sent[id] = sendStamp{time: ts, source: src}
+	})
+
+	// forget timestamps of messages nobody is waiting for anymore
+	if len(t.sent) > lateWindow {
+		for old := range t.sent {
+			if t.writes-old > lateWindow {
+				delete(t.sent, old)
+			}
+		}
+	}
+
+	st, ok := t.sent[id]
+	delete(t.sent, id)
+	return st.time, st.source, ok
+}
+
+func (t *icmpTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+// sets the TTL (IPv4) or hop limit (IPv6) of outgoing packets
+func (t *icmpTransport) SetTTL(ttl int) error {
+	if t.ipv4 {
+		return t.p4.SetTTL(ttl)
+	}
+	return t.p6.SetHopLimit(ttl)
+}
+
+// setFilter attaches a BPF filter to the socket so the kernel drops every
+// message that isn't an echo reply or error for identifier id (any
+// identifier if negative), or for echo replies from src if set, instead of
+// waking us up for it. Only Linux supports this, on raw sockets.
+func (t *icmpTransport) setFilter(id int, src net.IP) error {
+	if t.dgram {
+		return errors.ErrUnsupported
+	}
+	prog, err := echoFilter(t.ipv4, id, src)
+	if err != nil {
+		return err
+	}
+	if t.ipv4 {
+		return t.p4.SetBPF(prog)
+	}
+	return t.p6.SetBPF(prog)
+}
+
+// setShardFilter has the kernel only pass this socket the messages of
+// identifiers that are shard modulo shards, see shardFilter
+func (t *icmpTransport) setShardFilter(shard, shards int) error {
+	if t.dgram {
+		return errors.ErrUnsupported
+	}
+	prog, err := shardFilter(t.ipv4, shard, shards)
+	if err != nil {
+		return err
+	}
+	if t.ipv4 {
+		return t.p4.SetBPF(prog)
+	}
+	return t.p6.SetBPF(prog)
+}
+
+// SetReadBuffer sets the size of the socket's receive buffer, which the
+// kernel caps at net.core.rmem_max
+func (t *icmpTransport) SetReadBuffer(bytes int) error {
+	c, ok := t.conn.(interface{ SetReadBuffer(int) error })
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return c.SetReadBuffer(bytes)
+}
+
+func (t *icmpTransport) Close() error {
+	return t.conn.Close()
+}
+
+// ReadBatch reads up to len(ms) messages, with a single recvmmsg call on
+// Linux and one call per message elsewhere. The OOB buffer of each message
+// should be oobSize bytes for the ttl to be reported.
+func (t *icmpTransport) ReadBatch(ms []xipv4.Message) (int, error) {
+	if !t.ipv4 {
+		n, err := t.p6.ReadBatch(ms, 0)
+		if err != nil {
+			return 0, err
+		}
+		for i := range ms[:n] {
+			ms[i].Addr = t.ipAddr(ms[i].Addr)
+		}
+		return n, nil
+	}
+
+	n, err := t.p4.ReadBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// unlike ReadFrom, raw IPv4 batches include the IP header
+	for i := range ms[:n] {
+		ms[i].N = stripIPv4Header(ms[i].Buffers[0][:ms[i].N])
+		ms[i].Addr = t.ipAddr(ms[i].Addr)
+	}
+	return n, nil
+}
+
+// WriteBatch sends up to len(ms) messages, with a single sendmmsg call on
+// Linux and one call per message elsewhere
+func (t *icmpTransport) WriteBatch(ms []xipv4.Message) (int, error) {
+	for i := range ms {
+		ms[i].Addr = t.sockAddr(ms[i].Addr)
+	}
+	if t.ipv4 {
+		return t.p4.WriteBatch(ms, 0)
+	}
+	return t.p6.WriteBatch(ms, 0)
+}
+
+// size of the control message buffer needed to recieve the ttl
+func (t *icmpTransport) oobSize() int {
+	if t.ipv4 {
+		return len(xipv4.NewControlMessage(xipv4.FlagTTL))
+	}
+	return len(xipv6.NewControlMessage(xipv6.FlagHopLimit))
+}
+
+// return the ttl from a recieved control message, -1 if it has none
+func (t *icmpTransport) parseTTL(oob []byte) int {
+	if len(oob) == 0 {
+		return -1
+	}
+	if t.ipv4 {
+		var cm xipv4.ControlMessage
+		if cm.Parse(oob) != nil {
+			return -1
+		}
+		return cm.TTL
+	}
+	var cm xipv6.ControlMessage
+	if cm.Parse(oob) != nil {
+		return -1
+	}
+	return cm.HopLimit
+}
+
+// move the payload of a raw IPv4 packet in b to the start of b, returning
+// its length. b is left as is if it doesn't start with an IPv4 header.
+func stripIPv4Header(b []byte) int {
+	if len(b) < xipv4.HeaderLen || b[0]>>4 != 4 {
+		return len(b)
+	}
+	hdrLen := int(b[0]&0x0f) * 4
+	if hdrLen > len(b) {
+		return len(b)
+	}
+	return copy(b, b[hdrLen:])
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// replies a reply's RTT is compared against the average of
+	trendWindow = 10
+
+	// how far off the average a reply has to be to be trending, as a
+	// fraction of it and at least minTrend, so scheduling noise on fast
+	// targets stays steady
+	trendTolerance = 0.1
+	minTrend       = 100 * time.Microsecond
+)
+
+// Trend says how a reply's RTT compares to the target's recent ones
+type Trend string
+
+const (
+	TrendUp     Trend = "up"     // slower than usual
+	TrendDown   Trend = "down"   // faster than usual
+	TrendSteady Trend = "steady" // about the same
+)
+
+// arrow returns the marker of t in text output
+func (t Trend) arrow() string {
+	switch t {
+	case TrendUp:
+		return "▲"
+	case TrendDown:
+		return "▼"
+	case TrendSteady:
+		return "="
+	}
+	return ""
+}
+
+// TrendMarker is a Stage setting Result.Trend on replies, comparing their
+// RTT to the average of the target's last Window replies, so latency
+// slowly getting worse shows at a glance
+type TrendMarker struct {
+	Window int
+
+	mu     sync.Mutex
+	recent map[string]*rttWindow
+}
+
+// the latest RTTs of a target
+type rttWindow struct {
+	rtts  []time.Duration
+	pos   int
+	total time.Duration
+}
+
+// add rtt, dropping the oldest once the window is full
+func (w *rttWindow) add(rtt time.Duration, size int) {
+	if len(w.rtts) < size {
+		w.rtts = append(w.rtts, rtt)
+	} else {
+		w.total -= w.rtts[w.pos]
+		w.rtts[w.pos] = rtt
+		w.pos = (w.pos + 1) % size
+	}
+	w.total += rtt
+}
+
+// average RTT in the window, 0 if it's empty
+func (w *rttWindow) avg() time.Duration {
+	if len(w.rtts) == 0 {
+		return 0
+	}
+	return w.total / time.Duration(len(w.rtts))
+}
+
+// Initialize and return a TrendMarker comparing against window replies
+func NewTrendMarker(window int) *TrendMarker {
+	return &TrendMarker{Window: window, recent: make(map[string]*rttWindow)}
+}
+
+func (tm *TrendMarker) Process(r *Result) bool {
+	if r.Kind != KindReply {
+		return true
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	w, ok := tm.recent[r.Target]
+	if !ok {
+		w = &rttWindow{}
+		tm.recent[r.Target] = w
+	}
+	if len(w.rtts) > 0 {
+		avg := w.avg()
+		tolerance := max(time.Duration(float64(avg)*trendTolerance), minTrend)
+		switch {
+		case r.RTT > avg+tolerance:
+			r.Trend = TrendUp
+		case r.RTT < avg-tolerance:
+			r.Trend = TrendDown
+		default:
+			r.Trend = TrendSteady
+		}
+	}
+	w.add(r.RTT, tm.Window)
+	return true
+}
+
+// MovingAverage is a Stage setting Result.Avg on replies to the average RTT
+// of the target's last Window replies, this one included, smoothing out
+// the noise from one probe to the next
+type MovingAverage struct {
+	Window int
+
+	mu     sync.Mutex
+	recent map[string]*rttWindow
+}
+
+// Initialize and return a MovingAverage over window replies
+func NewMovingAverage(window int) *MovingAverage {
+	return &MovingAverage{Window: window, recent: make(map[string]*rttWindow)}
+}
+
+func (ma *MovingAverage) Process(r *Result) bool {
+	if r.Kind != KindReply {
+		return true
+	}
+
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	w, ok := ma.recent[r.Target]
+	if !ok {
+		w = &rttWindow{}
+		ma.recent[r.Target] = w
+	}
+	w.add(r.RTT, ma.Window)
+	r.Avg = w.avg()
+	return true
+}
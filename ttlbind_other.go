@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// TCP traces are only implemented on Linux and macOS
+func bindTTL(rc syscall.RawConn, ipv4 bool, ttl int) (int, error) {
+	return 0, errors.New("tcp traces are only supported on Linux and macOS")
+}
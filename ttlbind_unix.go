@@ -0,0 +1,46 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindTTL sets the TTL of a connection's packets and binds it to a port of
+// its own before it connects, returning the port, so ICMP errors about it
+// can be told apart by the port they quote
+func bindTTL(rc syscall.RawConn, ipv4 bool, ttl int) (int, error) {
+	port := 0
+	var serr error
+	err := rc.Control(func(fd uintptr) {
+		var sa unix.Sockaddr = &unix.SockaddrInet6{}
+		if ipv4 {
+			sa = &unix.SockaddrInet4{}
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, ttl)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, ttl)
+		}
+		if serr != nil {
+			return
+		}
+		if serr = unix.Bind(int(fd), sa); serr != nil {
+			return
+		}
+		var bound unix.Sockaddr
+		if bound, serr = unix.Getsockname(int(fd)); serr != nil {
+			return
+		}
+		switch sa := bound.(type) {
+		case *unix.SockaddrInet4:
+			port = sa.Port
+		case *unix.SockaddrInet6:
+			port = sa.Port
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return port, serr
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// the first port of classic traceroute's UDP probes, ports up from it
+	// are unlikely to have anything listening
+	udpTraceBasePort = 33434
+
+	// payload of UDP probes, as classic traceroute's 60 byte packets
+	udpTraceSize = 32
+)
+
+// UDPTracer probes the hops to a host with UDP datagrams like classic
+// traceroute, to BasePort and one port higher for every probe after, for
+// trace -m udp where routers only answer UDP. Nothing listens on those
+// ports, so the host answers with port unreachable, which counts as reaching
+// it, and routers on the way with time exceeded. Every probe is sent from a
+// port of its own, which the ICMP errors quote.
+type UDPTracer struct {
+	IPAddr   *net.IPAddr
+	BasePort int
+	TTL      int
+	Timeout  time.Duration
+	Clock    Clock
+
+	// sets socket options of the probes' sockets, see net.Dialer, nil for
+	// none
+	Control func(network, address string, rc syscall.RawConn) error
+
+	ipv4 bool
+	errs *icmpErrors
+	seq  seqCounter
+}
+
+// Initialize and return a UDPTracer to addr, probing ports up from
+// basePort and listening for ICMP errors on a raw socket
+func NewUDPTracer(addr string, basePort int, timeout time.Duration) (*UDPTracer, error) {
+	ipaddr, err := resolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	errs, err := listenICMPErrors(ipaddr.IP, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPTracer{
+		IPAddr:   ipaddr,
+		BasePort: basePort,
+		TTL:      DefaultTTL,
+		Timeout:  timeout,
+		Clock:    SystemClock,
+		ipv4:     ipaddr.IP.To4() != nil,
+		errs:     errs,
+	}, nil
+}
+
+// SetTTL sets the TTL of the probes after
+func (ut *UDPTracer) SetTTL(ttl int) error {
+	ut.TTL = ttl
+	return nil
+}
+
+// Close the raw socket
+func (ut *UDPTracer) Close() error {
+	return ut.errs.Close()
+}
+
+// Probe sends a datagram with the tracer's TTL
+func (ut *UDPTracer) Probe(ctx context.Context) (Result, error) {
+	return ut.probeTTL(ctx, ut.TTL)
+}
+
+// Round probes with each of ttls at once, plus once end to end
+func (ut *UDPTracer) Round(ctx context.Context, ttls []int) []Result {
+	return probeTTLs(ctx, ttls, ut.TTL, ut.probeTTL)
+}
+
+func (ut *UDPTracer) host() (string, int) {
+	return ut.IPAddr.String(), ut.TTL
+}
+
+// send a datagram with ttl to the next port and wait for an ICMP error
+// about it
+func (ut *UDPTracer) probeTTL(ctx context.Context, ttl int) (Result, error) {
+	seq := ut.seq.next()
+	port := ut.BasePort + seq%(0x10000-ut.BasePort)
+	addr := net.JoinHostPort(ut.IPAddr.String(), strconv.Itoa(port))
+	res := Result{
+		Proto:  "udp",
+		Target: addr,
+		Seq:    seq,
+		TTL:    -1,
+		Time:   ut.Clock.Now(),
+	}
+
+	d := net.Dialer{Control: ut.Control}
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return complete(res, err)
+	}
+	defer conn.Close()
+	if ut.ipv4 {
+		err = ipv4.NewConn(conn).SetTTL(ttl)
+	} else {
+		err = ipv6.NewConn(conn).SetHopLimit(ttl)
+	}
+	if err != nil {
+		return complete(res, err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).Port
+	answers := make(chan hopAnswer, 1)
+	ut.errs.wait(local, answers)
+	defer ut.errs.forget(local)
+
+	ctx, cancel := context.WithTimeout(ctx, ut.Timeout)
+	defer cancel()
+	start := ut.Clock.Now()
+	if _, err := conn.Write(make([]byte, udpTraceSize)); err != nil {
+		return complete(res, err)
+	}
+	select {
+	case a := <-answers:
+		return a.result(res, start)
+	case <-ctx.Done():
+		res.RTT = ut.Clock.Since(start)
+		return complete(res, ErrTimeout)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindDevice makes c send and recieve only through the network device
+// named dev. Bound to a VRF device, routes are looked up in its table.
+func bindDevice(c syscall.Conn, dev string) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return deviceControl(dev)("", "", rc)
+}
+
+// deviceControl returns a net.Dialer Control function binding every
+// connection dialed to the device named dev
+func deviceControl(dev string) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var serr error
+		err := rc.Control(func(fd uintptr) {
+			serr = unix.BindToDevice(int(fd), dev)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
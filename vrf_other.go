@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errVRFUnsupported = errors.New("binding to a VRF is only supported on Linux")
+
+// VRFs are only implemented on Linux
+func bindDevice(c syscall.Conn, dev string) error {
+	return errVRFUnsupported
+}
+
+func deviceControl(dev string) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		return errVRFUnsupported
+	}
+}
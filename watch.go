@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EventWatcher is a Stage calling On when a target goes up, down or starts
+// flapping, and when its replies go over MaxRTT ("slow") and back under
+// ("fast"), for reacting to them while every result is still printed. It
+// keeps its own StateTracker, passing results on as they came.
+type EventWatcher struct {
+	MaxRTT time.Duration // 0 to not watch latency
+	On     func(event string, r Result)
+
+	tracker *StateTracker
+	mu      sync.Mutex
+	slow    map[string]bool // targets over MaxRTT
+}
+
+// Initialize and return an EventWatcher judging states like a StateTracker
+// with the same settings
+func NewEventWatcher(downAfter, upAfter, flap int, maxRTT time.Duration, on func(event string, r Result)) *EventWatcher {
+	return &EventWatcher{
+		MaxRTT:  maxRTT,
+		On:      on,
+		tracker: NewStateTracker(downAfter, upAfter, flap),
+		slow:    make(map[string]bool),
+	}
+}
+
+func (w *EventWatcher) Process(r *Result) bool {
+	if w.MaxRTT > 0 && r.Kind == KindReply {
+		slow := r.RTT > w.MaxRTT
+		w.mu.Lock()
+		changed := slow != w.slow[r.Target]
+		w.slow[r.Target] = slow
+		w.mu.Unlock()
+		switch {
+		case changed && slow:
+			w.On("slow", *r)
+		case changed:
+			w.On("fast", *r)
+		}
+	}
+
+	ev := *r
+	if !w.tracker.Process(&ev) {
+		return true
+	}
+	switch ev.Kind {
+	case KindUp, KindDown, KindFlapping:
+		w.On(string(ev.Kind), ev)
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// timerWheel is a hashed timing wheel: a ring of slots, one per tick, each
+// holding the timers that expire during that tick. Adding a timer and
+// firing the due ones costs the same however many timers there are, unlike
+// a heap, which is what lets one goroutine drive thousands of targets.
+//
+// Timers more than a full turn away sit in their slot until the wheel comes
+// around often enough. A timerWheel is not safe for concurrent use.
+type timerWheel struct {
+	tick  time.Duration
+	slots [][]wheelTimer
+	pos   int       // slot of the current tick
+	now   time.Time // start of the current tick
+	due   []wheelTimer
+}
+
+type wheelTimer struct {
+	at time.Time
+	fn func()
+}
+
+// Initialize and return a timerWheel of n slots, starting at start
+func newTimerWheel(tick time.Duration, n int, start time.Time) *timerWheel {
+	return &timerWheel{
+		tick:  tick,
+		slots: make([][]wheelTimer, n),
+		now:   start,
+	}
+}
+
+// add a timer calling fn at, or in the next tick if at has passed
+func (w *timerWheel) add(at time.Time, fn func()) {
+	ticks := int((at.Sub(w.now) + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	slot := (w.pos + ticks) % len(w.slots)
+	w.slots[slot] = append(w.slots[slot], wheelTimer{at: at, fn: fn})
+}
+
+// advance the wheel to to, calling every timer due by then. Returns how
+// many ticks were moved.
+func (w *timerWheel) advance(to time.Time) int {
+	ticks := 0
+	for !w.now.Add(w.tick).After(to) {
+		w.now = w.now.Add(w.tick)
+		w.pos = (w.pos + 1) % len(w.slots)
+		ticks++
+
+		// timers are collected first, firing them may add to this slot
+		slot := w.slots[w.pos]
+		keep := slot[:0]
+		for _, t := range slot {
+			if t.at.After(w.now) {
+				keep = append(keep, t)
+			} else {
+				w.due = append(w.due, t)
+			}
+		}
+		clear(slot[len(keep):])
+		w.slots[w.pos] = keep
+
+		for i, t := range w.due {
+			t.fn()
+			w.due[i] = wheelTimer{}
+		}
+		w.due = w.due[:0]
+	}
+	return ticks
+}
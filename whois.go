@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// redirects RDAP queries to the registry an address is from, by IANA's
+	// bootstrap files
+	rdapURL = "https://rdap.org"
+
+	// longest the RDAP lookup may hold up the start of pinging
+	rdapTimeout = 5 * time.Second
+)
+
+// Whois is who an address is registered to, by its RDAP record
+type Whois struct {
+	Range   string // first to last address of the network
+	Name    string // the network's, e.g. APNIC-LABS
+	Country string
+	Org     string // the registrant
+	Abuse   string // where to report abuse, an email or phone number
+}
+
+func (w Whois) String() string {
+	s := w.Range
+	if w.Name != "" {
+		s += " " + w.Name
+	}
+	if w.Country != "" {
+		s += " (" + w.Country + ")"
+	}
+	if w.Org != "" {
+		s += ", org: " + w.Org
+	}
+	abuse := w.Abuse
+	if abuse == "" {
+		abuse = "none listed"
+	}
+	return s + ", abuse: " + abuse
+}
+
+// an RDAP ip network, or an entity in it
+type rdapObject struct {
+	Start    string            `json:"startAddress"`
+	End      string            `json:"endAddress"`
+	Name     string            `json:"name"`
+	Country  string            `json:"country"`
+	Roles    []string          `json:"roles"`
+	VCard    []json.RawMessage `json:"vcardArray"`
+	Entities []rdapObject      `json:"entities"`
+}
+
+// lookupWhois asks the RDAP server at base, or the registry it redirects to,
+// who ip is registered to
+func lookupWhois(ctx context.Context, client *http.Client, base string, ip net.IP) (Whois, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/ip/"+ip.String(), nil)
+	if err != nil {
+		return Whois{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Whois{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Whois{}, fmt.Errorf("%s: %s", resp.Request.URL.Host, resp.Status)
+	}
+	var network rdapObject
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&network); err != nil {
+		return Whois{}, fmt.Errorf("%s: %v", resp.Request.URL.Host, err)
+	}
+
+	w := Whois{Range: network.Start + " - " + network.End, Name: network.Name, Country: network.Country}
+	if registrant := findEntity(network.Entities, "registrant"); registrant != nil {
+		w.Org = vcardField(registrant.VCard, "fn")
+	}
+	// the abuse contact is often an entity of the registrant rather than
+	// of the network
+	if abuse := findEntity(network.Entities, "abuse"); abuse != nil {
+		w.Abuse = vcardField(abuse.VCard, "email")
+		if w.Abuse == "" {
+			w.Abuse = vcardField(abuse.VCard, "tel")
+		}
+	}
+	return w, nil
+}
+
+// findEntity returns the first of entities, or the entities they have,
+// with role
+func findEntity(entities []rdapObject, role string) *rdapObject {
+	for i := range entities {
+		if slices.Contains(entities[i].Roles, role) {
+			return &entities[i]
+		}
+	}
+	for i := range entities {
+		if e := findEntity(entities[i].Entities, role); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// vcardField returns the text of the first name field of a jCard, e.g. fn
+// for the full name, "" if it has none
+func vcardField(card []json.RawMessage, name string) string {
+	// ["vcard", [[name, params, type, value], ...]]
+	if len(card) < 2 {
+		return ""
+	}
+	var fields [][]json.RawMessage
+	if json.Unmarshal(card[1], &fields) != nil {
+		return ""
+	}
+	for _, f := range fields {
+		var fname, value string
+		if len(f) < 4 || json.Unmarshal(f[0], &fname) != nil || fname != name {
+			continue
+		}
+		if json.Unmarshal(f[3], &value) == nil {
+			return strings.TrimPrefix(value, "tel:")
+		}
+	}
+	return ""
+}
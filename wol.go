@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// where Wake-on-LAN magic packets go by default, the discard port of the
+// local network's broadcast address
+const wolAddr = "255.255.255.255:9"
+
+// parseMAC checks the MAC address of a host to wake
+func parseMAC(s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %s, Wake-on-LAN needs 6 bytes", s)
+	}
+	return mac, nil
+}
+
+// magicPacket returns the Wake-on-LAN magic packet for mac: 6 bytes of
+// 0xff and then the address 16 times
+func magicPacket(mac net.HardwareAddr) []byte {
+	return append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat(mac, 16)...)
+}
+
+// sendWakeOnLAN broadcasts the magic packet waking mac to addr, over a
+// socket set up by control if it isn't nil. Go sockets can broadcast.
+func sendWakeOnLAN(mac net.HardwareAddr, addr string, control func(network, address string, rc syscall.RawConn) error) error {
+	d := net.Dialer{Control: control}
+	conn, err := d.Dial("udp4", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(magicPacket(mac))
+	return err
+}